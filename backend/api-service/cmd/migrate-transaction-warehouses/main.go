@@ -0,0 +1,45 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command migrate-transaction-warehouses stores the warehouse of their location
+// in the Firestore inventory transaction documents of a project that were
+// created without it.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	service "github.com/GoogleCloudPlatform/cloud-run-anthos-reference-web-app/api-service/src"
+)
+
+func main() {
+	projectID := flag.String("project-id", os.Getenv("PROJECT_ID"), "Google Cloud `project` of the Firestore database (env PROJECT_ID)")
+	flag.Parse()
+
+	ctx := context.Background()
+	fb, err := service.NewFirestoreBackend(ctx, *projectID)
+	if err != nil {
+		log.Fatalf("error creating firestore backend: %v", err)
+	}
+	defer fb.Close()
+
+	migrated, err := fb.MigrateTransactionWarehouses(ctx)
+	if err != nil {
+		log.Fatalf("error migrating inventory transactions after migrating %d documents: %v", migrated, err)
+	}
+	log.Printf("Migrated %d inventory transaction documents", migrated)
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	service "github.com/GoogleCloudPlatform/cloud-run-anthos-reference-web-app/api-service/src"
+)
+
+// shutdownTimeout bounds how long the server waits for requests in flight
+// when it stops
+const shutdownTimeout = 10 * time.Second
+
+// fatalf logs the error and exits
+func fatalf(format string, args ...interface{}) {
+	service.LogErrorf(context.Background(), format, args...)
+	os.Exit(1)
+}
+
+func main() {
+	config, err := service.LoadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fatalf("error loading configuration: %v", err)
+	}
+	tp, err := config.NewTracerProvider(context.Background())
+	if err != nil {
+		fatalf("error configuring %s trace exporter: %v", config.TraceExporter, err)
+	}
+	// All services share one backend
+	db, err := config.NewBackend(service.WithTracerProvider(context.Background(), tp))
+	if err != nil {
+		fatalf("error creating %s backend: %v", config.Backend, err)
+	}
+	db = service.InstrumentBackend(db)
+
+	AlertApiService := service.NewAlertApiService(db)
+	AlertApiController := service.NewAlertApiController(AlertApiService)
+
+	InventoryApiService := service.NewInventoryApiService(db)
+	InventoryApiController := service.NewInventoryApiController(InventoryApiService)
+
+	KeyApiService := service.NewKeyApiService(db)
+	KeyApiController := service.NewKeyApiController(KeyApiService)
+
+	router := service.NewRouter(AlertApiController, InventoryApiController, KeyApiController)
+	authorize, err := config.NewAuthorizer(db)
+	if err != nil {
+		fatalf("error configuring %s auth: %v", config.Auth, err)
+	}
+	router.Use(authorize)
+	handler := service.TraceRequests(tp, service.LogRequests(service.WithRequestTimeout(router, time.Duration(config.RequestTimeout))))
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.Port), Handler: handler}
+	shutdown := make(chan struct{})
+	go func() {
+		// Finish the requests in flight when asked to stop
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			service.LogErrorf(ctx, "error shutting down server: %v", err)
+		}
+		if tp != nil {
+			if err := tp.Shutdown(ctx); err != nil {
+				service.LogErrorf(ctx, "error exporting spans: %v", err)
+			}
+		}
+		close(shutdown)
+	}()
+
+	service.LogInfof(context.Background(), "Server started on port %d with the %s backend", config.Port, config.Backend)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fatalf("%v", err)
+	}
+	<-shutdown
+	if err := db.Close(); err != nil {
+		fatalf("error closing %s backend: %v", config.Backend, err)
+	}
+	service.LogInfof(context.Background(), "Server stopped")
+}
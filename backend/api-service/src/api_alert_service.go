@@ -19,16 +19,17 @@
  * API version: 1.0.0
  * Generated by: OpenAPI Generator (https://openapi-generator.tech)
  *
- * NOTE: The AlertApiService is not yet used in the app - functionality
- * coming soon.
+ * NOTE: Alerts are raised by inventory transactions, but are not yet shown
+ * in the web UI.
  */
 
 package service
 
 import (
 	"context"
+	"fmt"
 	"net/http"
-	"os"
+	"time"
 )
 
 // AlertApiService is a service that implents the logic for the AlertApiServicer
@@ -38,16 +39,13 @@ type AlertApiService struct {
 	db DatabaseBackend
 }
 
-// NewAlertApiService creates a default api service
-func NewAlertApiService() AlertApiServicer {
-	projectID := os.Getenv("PROJECT_ID")
-	backend := NewFirestoreBackend(projectID)
-	return &AlertApiService{backend}
+// NewAlertApiService creates an api service backed by the given database
+func NewAlertApiService(db DatabaseBackend) AlertApiServicer {
+	return &AlertApiService{db}
 }
 
 // DeleteAlert - Delete Alert by ID
-func (s *AlertApiService) DeleteAlert(id string, w http.ResponseWriter) error {
-	ctx := context.Background()
+func (s *AlertApiService) DeleteAlert(ctx context.Context, id string, w http.ResponseWriter) error {
 	err := s.db.DeleteAlert(ctx, id)
 	if err != nil {
 		return err
@@ -56,21 +54,52 @@ func (s *AlertApiService) DeleteAlert(id string, w http.ResponseWriter) error {
 	return EncodeJSONStatus(http.StatusOK, "alert deleted", w)
 }
 
+// AcknowledgeAlert - Acknowledge an open Alert
+func (s *AlertApiService) AcknowledgeAlert(ctx context.Context, principal *Principal, id string, w http.ResponseWriter) error {
+	r, err := s.db.AcknowledgeAlert(ctx, id, principal.UserId)
+	if err != nil {
+		return err
+	}
+
+	return EncodeJSONResponse(r, nil, w)
+}
+
 // ListAlerts - List all Alerts
-func (s *AlertApiService) ListAlerts(w http.ResponseWriter) error {
-	ctx := context.Background()
-	l, err := s.db.ListAlerts(ctx)
+func (s *AlertApiService) ListAlerts(ctx context.Context, state string, includeSnoozed bool, pageSize int64, pageToken string, w http.ResponseWriter) error {
+	if state != "" && !isSupported(state, supportedAlertStates) {
+		return EncodeProblem(http.StatusBadRequest, fmt.Sprintf("Unknown alert state: %s ", state), w)
+	}
+	page, message := pageRequest(pageSize, pageToken)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+
+	l, next, err := s.db.ListAlerts(ctx, AlertFilter{State: state, IncludeSnoozed: includeSnoozed}, page)
 	if err != nil {
 		return err
 	}
 
-	return EncodeJSONResponse(l, nil, w)
+	return EncodeJSONResponse(newAlertPage(l, next), nil, w)
 }
 
 // NewAlert - Create a new Alert
-func (s *AlertApiService) NewAlert(alert Alert, w http.ResponseWriter) error {
-	ctx := context.Background()
-	r, err := s.db.NewAlert(ctx, &alert)
+func (s *AlertApiService) NewAlert(ctx context.Context, alert Alert, w http.ResponseWriter) error {
+	// Only the description of the alert is taken from the request; its
+	// lifecycle always starts out open
+	newAlert := &Alert{
+		ItemId:        alert.ItemId,
+		LocationId:    alert.LocationId,
+		TransactionId: alert.TransactionId,
+		Text:          alert.Text,
+		Timestamp:     alert.Timestamp,
+		State:         alertOpen,
+		Occurrences:   1,
+	}
+	if newAlert.Timestamp.IsZero() {
+		newAlert.Timestamp = time.Now()
+	}
+
+	r, err := s.db.NewAlert(ctx, newAlert)
 	if err != nil {
 		return err
 	}
@@ -78,3 +107,28 @@ func (s *AlertApiService) NewAlert(alert Alert, w http.ResponseWriter) error {
 	status := http.StatusCreated
 	return EncodeJSONResponse(r, &status, w)
 }
+
+// ResolveAlert - Resolve an open or acknowledged Alert
+func (s *AlertApiService) ResolveAlert(ctx context.Context, principal *Principal, id string, w http.ResponseWriter) error {
+	r, err := s.db.ResolveAlert(ctx, id, principal.UserId)
+	if err != nil {
+		return err
+	}
+
+	return EncodeJSONResponse(r, nil, w)
+}
+
+// SnoozeAlert - Snooze an open or acknowledged Alert until a later time
+func (s *AlertApiService) SnoozeAlert(ctx context.Context, principal *Principal, id string, alertSnooze AlertSnooze, w http.ResponseWriter) error {
+	if !alertSnooze.SnoozedUntil.After(time.Now()) {
+		reason := fmt.Sprintf("must be in the future, not %s", alertSnooze.SnoozedUntil.Format(time.RFC3339))
+		return encodeInvalidParams(invalidParams{{Name: "snoozed_until", Reason: reason}}, w)
+	}
+
+	r, err := s.db.SnoozeAlert(ctx, id, alertSnooze.SnoozedUntil, principal.UserId)
+	if err != nil {
+		return err
+	}
+
+	return EncodeJSONResponse(r, nil, w)
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestListAlertsUnknownState(t *testing.T) {
+	state := "bad-state"
+	msg := "Unknown alert state"
+
+	s := AlertApiService{}
+	r := httptest.NewRecorder()
+	err := s.ListAlerts(context.Background(), state, false, 0, "", r)
+
+	if err != nil {
+		t.Errorf("s.ListAlerts(%q) returned unexpected error: %v", state, err)
+	}
+	if r.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusBadRequest)
+	}
+	if !strings.Contains(r.Body.String(), msg) {
+		t.Errorf("response body %q does not contain %q", r.Body.String(), msg)
+	}
+}
+
+func TestSnoozeAlertBadRequests(t *testing.T) {
+	cases := []struct {
+		desc   string
+		snooze AlertSnooze
+	}{
+		{
+			desc:   "missing snoozed_until",
+			snooze: AlertSnooze{},
+		},
+		{
+			desc:   "snoozed_until in the past",
+			snooze: AlertSnooze{SnoozedUntil: time.Now().Add(-time.Minute)},
+		},
+	}
+
+	for _, tc := range cases {
+		s := AlertApiService{}
+		want := []string{"snoozed_until"}
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			err := s.SnoozeAlert(context.Background(), &testPrincipal, "alert-id", tc.snooze, r)
+
+			if err != nil {
+				t.Errorf("s.SnoozeAlert(%v) returned unexpected error: %v", tc.snooze, err)
+			}
+			if got := invalidParamNames(t, r); !cmp.Equal(got, want) {
+				t.Errorf("invalid_params = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestNewAlertStartsOpen(t *testing.T) {
+	alert := Alert{ItemId: "item-id", Text: "text", State: alertResolved, Occurrences: 5, ResolvedBy: "spoofed"}
+
+	s := AlertApiService{db: NewInMemoryBackend()}
+	r := httptest.NewRecorder()
+	if err := s.NewAlert(context.Background(), alert, r); err != nil {
+		t.Fatalf("s.NewAlert(%v) returned unexpected error: %v", alert, err)
+	}
+
+	got, _, _ := s.db.ListAlerts(context.Background(), AlertFilter{}, PageRequest{})
+	if len(got) != 1 || got[0].State != alertOpen || got[0].Occurrences != 1 || got[0].ResolvedBy != "" || got[0].Timestamp.IsZero() {
+		t.Errorf("after s.NewAlert(%v), ListAlerts() = %v want a single open alert", alert, got)
+	}
+}
+
+func TestAlertChangesByPrincipal(t *testing.T) {
+	db := NewInMemoryBackend()
+	alert, _ := db.NewAlert(context.Background(), &Alert{ItemId: "item-id", State: alertOpen, Occurrences: 1})
+	s := AlertApiService{db: db}
+	until := time.Now().Add(time.Hour)
+
+	if err := s.SnoozeAlert(context.Background(), &testPrincipal, alert.Id, AlertSnooze{SnoozedUntil: until}, httptest.NewRecorder()); err != nil {
+		t.Fatalf("s.SnoozeAlert(%q) returned unexpected error: %v", alert.Id, err)
+	}
+	if err := s.AcknowledgeAlert(context.Background(), &testPrincipal, alert.Id, httptest.NewRecorder()); err != nil {
+		t.Fatalf("s.AcknowledgeAlert(%q) returned unexpected error: %v", alert.Id, err)
+	}
+	if err := s.ResolveAlert(context.Background(), &testPrincipal, alert.Id, httptest.NewRecorder()); err != nil {
+		t.Fatalf("s.ResolveAlert(%q) returned unexpected error: %v", alert.Id, err)
+	}
+
+	got, _, _ := db.ListAlerts(context.Background(), AlertFilter{IncludeSnoozed: true}, PageRequest{})
+	want := testPrincipal.UserId
+	if len(got) != 1 || got[0].SnoozedBy != want || got[0].AcknowledgedBy != want || got[0].ResolvedBy != want {
+		t.Errorf("ListAlerts() = %v, want a single alert snoozed, acknowledged and resolved by %q", got, want)
+	}
+}
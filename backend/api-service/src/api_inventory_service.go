@@ -22,11 +22,16 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"sort"
+	"time"
 )
 
+// maxIdempotencyKeyLength is the maximum length of an Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
 // InventoryApiService is a service that implements the logic for the InventoryApiServicer
 // This service should implement the business logic for every endpoint for the InventoryApi API.
 // Include any external packages or services that will be required by this service.
@@ -34,17 +39,40 @@ type InventoryApiService struct {
 	db DatabaseBackend
 }
 
-// NewInventoryApiService creates a default api service
-func NewInventoryApiService() InventoryApiServicer {
-	projectID := os.Getenv("PROJECT_ID")
-	backend := NewFirestoreBackend(projectID)
-	return &InventoryApiService{backend}
+// NewInventoryApiService creates an api service backed by the given database
+func NewInventoryApiService(db DatabaseBackend) InventoryApiServicer {
+	return &InventoryApiService{db}
+}
+
+// ArchiveItem - Archive Item by ID, so that it no longer accepts new inventory
+func (s *InventoryApiService) ArchiveItem(ctx context.Context, id string, w http.ResponseWriter) error {
+	r, err := s.db.ArchiveItem(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	setETag(r.Version, w)
+	return EncodeJSONResponse(r, nil, w)
+}
+
+// ArchiveLocation - Archive Location by ID, so that it no longer accepts new inventory
+func (s *InventoryApiService) ArchiveLocation(ctx context.Context, id string, w http.ResponseWriter) error {
+	r, err := s.db.ArchiveLocation(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	setETag(r.Version, w)
+	return EncodeJSONResponse(r, nil, w)
 }
 
 // DeleteItem - Delete Item by ID
-func (s *InventoryApiService) DeleteItem(id string, w http.ResponseWriter) error {
-	ctx := context.Background()
-	err := s.db.DeleteItem(ctx, id)
+func (s *InventoryApiService) DeleteItem(ctx context.Context, id string, cascade string, w http.ResponseWriter) error {
+	archiveInventory, msg := archiveCascade(cascade)
+	if msg != "" {
+		return EncodeProblem(http.StatusBadRequest, msg, w)
+	}
+	err := s.db.DeleteItem(ctx, id, archiveInventory)
 	if err != nil {
 		return err
 	}
@@ -53,9 +81,12 @@ func (s *InventoryApiService) DeleteItem(id string, w http.ResponseWriter) error
 }
 
 // DeleteLocation - Delete Location by ID
-func (s *InventoryApiService) DeleteLocation(id string, w http.ResponseWriter) error {
-	ctx := context.Background()
-	err := s.db.DeleteLocation(ctx, id)
+func (s *InventoryApiService) DeleteLocation(ctx context.Context, id string, cascade string, w http.ResponseWriter) error {
+	archiveInventory, msg := archiveCascade(cascade)
+	if msg != "" {
+		return EncodeProblem(http.StatusBadRequest, msg, w)
+	}
+	err := s.db.DeleteLocation(ctx, id, archiveInventory)
 	if err != nil {
 		return err
 	}
@@ -64,8 +95,7 @@ func (s *InventoryApiService) DeleteLocation(id string, w http.ResponseWriter) e
 }
 
 // GetInventoryTransaction - Get Inventory Transaction by ID
-func (s *InventoryApiService) GetInventoryTransaction(id string, w http.ResponseWriter) error {
-	ctx := context.Background()
+func (s *InventoryApiService) GetInventoryTransaction(ctx context.Context, id string, w http.ResponseWriter) error {
 	txn, err := s.db.GetInventoryTransaction(ctx, id)
 	if err != nil {
 		return err
@@ -75,212 +105,479 @@ func (s *InventoryApiService) GetInventoryTransaction(id string, w http.Response
 }
 
 // GetItem - Get Item by ID
-func (s *InventoryApiService) GetItem(id string, w http.ResponseWriter) error {
-	ctx := context.Background()
+func (s *InventoryApiService) GetItem(ctx context.Context, id string, w http.ResponseWriter) error {
 	r, err := s.db.GetItem(ctx, id)
 	if err != nil {
 		return err
 	}
 
+	setETag(r.Version, w)
 	return EncodeJSONResponse(r, nil, w)
 }
 
 // GetLocation - Get Location by ID
-func (s *InventoryApiService) GetLocation(id string, w http.ResponseWriter) error {
-	ctx := context.Background()
+func (s *InventoryApiService) GetLocation(ctx context.Context, id string, w http.ResponseWriter) error {
 	r, err := s.db.GetLocation(ctx, id)
 	if err != nil {
 		return err
 	}
 
+	setETag(r.Version, w)
 	return EncodeJSONResponse(r, nil, w)
 }
 
 // ListInventoryTransactions - List all Inventory Transactions
-func (s *InventoryApiService) ListInventoryTransactions(w http.ResponseWriter) error {
-	ctx := context.Background()
-	l, err := s.db.ListInventoryTransactions(ctx)
+func (s *InventoryApiService) ListInventoryTransactions(ctx context.Context, principal *Principal, startTime time.Time, endTime time.Time, action string, createdBy string, warehouse string, orderBy string, pageSize int64, pageToken string, w http.ResponseWriter) error {
+	filter, message := transactionFilter(startTime, endTime, action, createdBy, warehouse, orderBy)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+	page, message := pageRequest(pageSize, pageToken)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+	scoped, err := principal.scopeTransactions(&filter)
+	if err != nil {
+		return err
+	}
+	if !scoped {
+		return EncodeJSONResponse(newInventoryTransactionPage(nil, ""), nil, w)
+	}
+
+	l, next, err := s.db.ListInventoryTransactions(ctx, filter, page)
 	if err != nil {
 		return err
 	}
 
-	return EncodeJSONResponse(l, nil, w)
+	return EncodeJSONResponse(newInventoryTransactionPage(l, next), nil, w)
 }
 
 // ListItemInventory - List all Inventory of Item
-func (s *InventoryApiService) ListItemInventory(id string, w http.ResponseWriter) error {
-	ctx := context.Background()
-	l, err := s.db.ListItemInventory(ctx, id)
+func (s *InventoryApiService) ListItemInventory(ctx context.Context, id string, pageSize int64, pageToken string, w http.ResponseWriter) error {
+	page, message := pageRequest(pageSize, pageToken)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+
+	l, next, err := s.db.ListItemInventory(ctx, id, page)
 	if err != nil {
 		return err
 	}
 
-	return EncodeJSONResponse(l, nil, w)
+	return EncodeJSONResponse(newInventoryPage(l, next), nil, w)
 }
 
 // ListItemInventoryTransactions
-func (s *InventoryApiService) ListItemInventoryTransactions(id string, w http.ResponseWriter) error {
-	ctx := context.Background()
-	l, err := s.db.ListItemInventoryTransactions(ctx, id)
+func (s *InventoryApiService) ListItemInventoryTransactions(ctx context.Context, principal *Principal, id string, startTime time.Time, endTime time.Time, action string, createdBy string, warehouse string, orderBy string, pageSize int64, pageToken string, w http.ResponseWriter) error {
+	filter, message := transactionFilter(startTime, endTime, action, createdBy, warehouse, orderBy)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+	page, message := pageRequest(pageSize, pageToken)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+	scoped, err := principal.scopeTransactions(&filter)
+	if err != nil {
+		return err
+	}
+	if !scoped {
+		return EncodeJSONResponse(newInventoryTransactionPage(nil, ""), nil, w)
+	}
+
+	l, next, err := s.db.ListItemInventoryTransactions(ctx, id, filter, page)
 	if err != nil {
 		return err
 	}
 
-	return EncodeJSONResponse(l, nil, w)
+	return EncodeJSONResponse(newInventoryTransactionPage(l, next), nil, w)
 }
 
 // ListItems - List all Items
-func (s *InventoryApiService) ListItems(w http.ResponseWriter) error {
-	ctx := context.Background()
-	l, err := s.db.ListItems(ctx)
+func (s *InventoryApiService) ListItems(ctx context.Context, pageSize int64, pageToken string, includeArchived bool, w http.ResponseWriter) error {
+	page, message := pageRequest(pageSize, pageToken)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+
+	l, next, err := s.db.ListItems(ctx, includeArchived, page)
 	if err != nil {
 		return err
 	}
 
-	return EncodeJSONResponse(l, nil, w)
+	return EncodeJSONResponse(newItemPage(l, next), nil, w)
 }
 
 // ListLocationInventory - List all Inventory at location
-func (s *InventoryApiService) ListLocationInventory(id string, w http.ResponseWriter) error {
-	ctx := context.Background()
-	l, err := s.db.ListLocationInventory(ctx, id)
+func (s *InventoryApiService) ListLocationInventory(ctx context.Context, principal *Principal, id string, pageSize int64, pageToken string, w http.ResponseWriter) error {
+	page, message := pageRequest(pageSize, pageToken)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+	if err := principal.checkLocation(ctx, s.db, id); err != nil {
+		return err
+	}
+
+	l, next, err := s.db.ListLocationInventory(ctx, id, page)
 	if err != nil {
 		return err
 	}
 
-	return EncodeJSONResponse(l, nil, w)
+	return EncodeJSONResponse(newInventoryPage(l, next), nil, w)
 }
 
-func (s *InventoryApiService) ListLocationInventoryTransactions(id string, w http.ResponseWriter) error {
-	ctx := context.Background()
-	l, err := s.db.ListLocationInventoryTransactions(ctx, id)
+func (s *InventoryApiService) ListLocationInventoryTransactions(ctx context.Context, principal *Principal, id string, startTime time.Time, endTime time.Time, action string, createdBy string, warehouse string, orderBy string, pageSize int64, pageToken string, w http.ResponseWriter) error {
+	filter, message := transactionFilter(startTime, endTime, action, createdBy, warehouse, orderBy)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+	page, message := pageRequest(pageSize, pageToken)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+	if err := principal.checkLocation(ctx, s.db, id); err != nil {
+		return err
+	}
+
+	l, next, err := s.db.ListLocationInventoryTransactions(ctx, id, filter, page)
 	if err != nil {
 		return err
 	}
 
-	return EncodeJSONResponse(l, nil, w)
+	return EncodeJSONResponse(newInventoryTransactionPage(l, next), nil, w)
 }
 
 // ListLocations - List all Locations
-func (s *InventoryApiService) ListLocations(w http.ResponseWriter) error {
-	ctx := context.Background()
-	l, err := s.db.ListLocations(ctx)
+func (s *InventoryApiService) ListLocations(ctx context.Context, pageSize int64, pageToken string, includeArchived bool, w http.ResponseWriter) error {
+	page, message := pageRequest(pageSize, pageToken)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+
+	l, next, err := s.db.ListLocations(ctx, includeArchived, page)
 	if err != nil {
 		return err
 	}
 
-	return EncodeJSONResponse(l, nil, w)
+	return EncodeJSONResponse(newLocationPage(l, next), nil, w)
 }
 
 // NewInventoryTransaction - Create a new Inventory Transaction
-func (s *InventoryApiService) NewInventoryTransaction(inventoryTransaction InventoryTransaction, w http.ResponseWriter) error {
-	if inventoryTransaction.Action == "" {
-		return requiredFieldMissing("action", w)
+func (s *InventoryApiService) NewInventoryTransaction(ctx context.Context, principal *Principal, idempotencyKey string, inventoryTransaction InventoryTransaction, w http.ResponseWriter) error {
+	params := checkInventoryTransaction(&inventoryTransaction)
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		params.add("Idempotency-Key", fmt.Sprintf("longer than %d characters", maxIdempotencyKeyLength))
 	}
-	if inventoryTransaction.ItemId == "" {
-		return requiredFieldMissing("item_id", w)
+	if len(params) > 0 {
+		return encodeInvalidParams(params, w)
 	}
-	if inventoryTransaction.LocationId == "" {
-		return requiredFieldMissing("location_id", w)
+	if err := principal.checkLocation(ctx, s.db, inventoryTransaction.LocationId); err != nil {
+		return err
 	}
-	validAction := false
-	for _, a := range supportedTransactionActions {
-		if a == inventoryTransaction.Action {
-			validAction = true
-			break
+	inventoryTransaction.CreatedBy = principal.UserId
+
+	r, err := s.db.NewInventoryTransaction(ctx, &inventoryTransaction, idempotencyKey)
+	if err != nil {
+		return err
+	}
+
+	status := http.StatusCreated
+	return EncodeJSONResponse(r, &status, w)
+}
+
+// NewInventoryTransactionBatch - Apply a batch of Inventory Transactions, all of them or none
+func (s *InventoryApiService) NewInventoryTransactionBatch(ctx context.Context, principal *Principal, inventoryTransactionBatch InventoryTransactionBatch, w http.ResponseWriter) error {
+	txns := inventoryTransactionBatch.InventoryTransactions
+	if len(txns) == 0 {
+		return encodeInvalidParams(invalidParams{{Name: "inventory_transactions", Reason: "required field is empty"}}, w)
+	}
+	if len(txns) > maxBatchSize {
+		return EncodeProblem(http.StatusBadRequest, BatchTooLarge{size: len(txns)}.Error(), w)
+	}
+	var entryErrors []EntryError
+	for i := range txns {
+		if params := checkInventoryTransaction(&txns[i]); len(params) > 0 {
+			entryErrors = append(entryErrors, EntryError{Index: int64(i), Message: params.detail(), InvalidParams: params})
+		}
+		txns[i].CreatedBy = principal.UserId
+	}
+	if len(entryErrors) > 0 {
+		return encodeEntryErrors(http.StatusBadRequest, entryErrors, w)
+	}
+	// Locations that do not exist are left for the backend to report
+	checked := make(map[string]error)
+	for i, txn := range txns {
+		err, ok := checked[txn.LocationId]
+		if !ok {
+			err = principal.checkLocation(ctx, s.db, txn.LocationId)
+			checked[txn.LocationId] = err
+		}
+		if KindOf(err) == KindForbidden {
+			entryErrors = append(entryErrors, EntryError{Index: int64(i), Message: err.Error()})
+		} else if err != nil && KindOf(err) != KindNotFound {
+			return err
 		}
 	}
-	if !validAction {
-		message := fmt.Sprintf("Unknown action: %s ", inventoryTransaction.Action)
-		return EncodeJSONStatus(http.StatusBadRequest, message, w)
+	if len(entryErrors) > 0 {
+		return encodeEntryErrors(http.StatusForbidden, entryErrors, w)
 	}
 
-	ctx := context.Background()
-	r, err := s.db.NewInventoryTransaction(ctx, &inventoryTransaction)
+	inputs := make([]*InventoryTransaction, len(txns))
+	for i := range txns {
+		inputs[i] = &txns[i]
+	}
+	created, err := s.db.NewInventoryTransactionBatch(ctx, inputs)
+	var failed *BatchEntryFailed
+	if errors.As(err, &failed) {
+		return encodeEntryErrors(errorStatus(failed.err), []EntryError{{Index: int64(failed.index), Message: failed.err.Error()}}, w)
+	}
 	if err != nil {
 		return err
 	}
 
+	r := InventoryTransactionBatch{InventoryTransactions: make([]InventoryTransaction, len(created))}
+	for i, txn := range created {
+		r.InventoryTransactions[i] = *txn
+	}
 	status := http.StatusCreated
 	return EncodeJSONResponse(r, &status, w)
 }
 
 // NewItem - Create a new Item
-func (s *InventoryApiService) NewItem(item Item, w http.ResponseWriter) error {
-	if item.Name == "" {
-		return requiredFieldMissing("name", w)
+func (s *InventoryApiService) NewItem(ctx context.Context, item Item, w http.ResponseWriter) error {
+	if params := checkItem(&item); len(params) > 0 {
+		return encodeInvalidParams(params, w)
 	}
 
-	ctx := context.Background()
 	r, err := s.db.NewItem(ctx, &item)
 	if err != nil {
 		return err
 	}
 
 	status := http.StatusCreated
+	setETag(r.Version, w)
 	return EncodeJSONResponse(r, &status, w)
 }
 
 // NewLocation - Create a new Location
-func (s *InventoryApiService) NewLocation(location Location, w http.ResponseWriter) error {
-	if location.Name == "" {
-		return requiredFieldMissing("name", w)
-	}
-	if location.Warehouse == "" {
-		return requiredFieldMissing("warehouse", w)
+func (s *InventoryApiService) NewLocation(ctx context.Context, location Location, w http.ResponseWriter) error {
+	if params := checkLocation(&location); len(params) > 0 {
+		return encodeInvalidParams(params, w)
 	}
 
-	ctx := context.Background()
 	r, err := s.db.NewLocation(ctx, &location)
 	if err != nil {
 		return err
 	}
 
+	status := http.StatusCreated
+	setETag(r.Version, w)
+	return EncodeJSONResponse(r, &status, w)
+}
+
+// NewTransfer - Move inventory between two locations
+func (s *InventoryApiService) NewTransfer(ctx context.Context, principal *Principal, transfer Transfer, w http.ResponseWriter) error {
+	if params := checkTransfer(&transfer); len(params) > 0 {
+		return encodeInvalidParams(params, w)
+	}
+	for _, locationId := range []string{transfer.SourceLocationId, transfer.DestinationLocationId} {
+		if err := principal.checkLocation(ctx, s.db, locationId); err != nil {
+			return err
+		}
+	}
+	transfer.CreatedBy = principal.UserId
+
+	r, err := s.db.NewTransfer(ctx, &transfer)
+	if err != nil {
+		return err
+	}
+
 	status := http.StatusCreated
 	return EncodeJSONResponse(r, &status, w)
 }
 
+// RestoreItem - Restore an archived Item by ID
+func (s *InventoryApiService) RestoreItem(ctx context.Context, id string, w http.ResponseWriter) error {
+	r, err := s.db.RestoreItem(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	setETag(r.Version, w)
+	return EncodeJSONResponse(r, nil, w)
+}
+
+// RestoreLocation - Restore an archived Location by ID
+func (s *InventoryApiService) RestoreLocation(ctx context.Context, id string, w http.ResponseWriter) error {
+	r, err := s.db.RestoreLocation(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	setETag(r.Version, w)
+	return EncodeJSONResponse(r, nil, w)
+}
+
 // UpdateItem - Update Item by ID
-func (s *InventoryApiService) UpdateItem(id string, item Item, w http.ResponseWriter) error {
-	if id != item.Id {
-		message := fmt.Sprintf("Mismatched path id: %s and item.Id: %s ", id, item.Id)
-		return EncodeJSONStatus(http.StatusBadRequest, message, w)
+func (s *InventoryApiService) UpdateItem(ctx context.Context, id string, ifMatch string, item Item, w http.ResponseWriter) error {
+	params := checkPathId(id, item.Id)
+	params = append(params, checkItem(&item)...)
+	if params = append(params, checkIfMatch(ifMatch)...); len(params) > 0 {
+		return encodeInvalidParams(params, w)
 	}
-	if item.Name == "" {
-		return requiredFieldMissing("name", w)
+	if ifMatchMissing(ifMatch) {
+		return EncodeProblem(http.StatusPreconditionRequired, missingIfMatch, w)
 	}
 
-	ctx := context.Background()
-	r, err := s.db.UpdateItem(ctx, &item)
+	version, message := ifMatchVersion(ifMatch)
+	if message != "" {
+		return EncodeProblem(http.StatusPreconditionFailed, message, w)
+	}
+
+	r, err := s.db.UpdateItem(ctx, &item, version)
 	if err != nil {
 		return err
 	}
 
+	setETag(r.Version, w)
 	return EncodeJSONResponse(r, nil, w)
 }
 
 // UpdateLocation - Update Location by ID
-func (s *InventoryApiService) UpdateLocation(id string, location Location, w http.ResponseWriter) error {
-	if id != location.Id {
-		message := fmt.Sprintf("Mismatched path id: %s and location.Id: %s ", id, location.Id)
-		return EncodeJSONStatus(http.StatusBadRequest, message, w)
+func (s *InventoryApiService) UpdateLocation(ctx context.Context, id string, ifMatch string, location Location, w http.ResponseWriter) error {
+	params := checkPathId(id, location.Id)
+	params = append(params, checkLocation(&location)...)
+	if params = append(params, checkIfMatch(ifMatch)...); len(params) > 0 {
+		return encodeInvalidParams(params, w)
 	}
-	if location.Name == "" {
-		return requiredFieldMissing("name", w)
+	if ifMatchMissing(ifMatch) {
+		return EncodeProblem(http.StatusPreconditionRequired, missingIfMatch, w)
 	}
-	if location.Warehouse == "" {
-		return requiredFieldMissing("warehouse", w)
+
+	version, message := ifMatchVersion(ifMatch)
+	if message != "" {
+		return EncodeProblem(http.StatusPreconditionFailed, message, w)
 	}
 
-	ctx := context.Background()
-	r, err := s.db.UpdateLocation(ctx, &location)
+	r, err := s.db.UpdateLocation(ctx, &location, version)
 	if err != nil {
 		return err
 	}
 
+	setETag(r.Version, w)
 	return EncodeJSONResponse(r, nil, w)
 }
 
-func requiredFieldMissing(name string, w http.ResponseWriter) error {
-	return EncodeJSONStatus(http.StatusBadRequest, fmt.Sprintf("Empty required field: %v", name), w)
+// checkItem returns the invalid fields of the item in a request
+func checkItem(item *Item) invalidParams {
+	var params invalidParams
+	params.required("name", item.Name)
+	params.supported("negative_stock_policy", item.NegativeStockPolicy, supportedNegativeStockPolicies)
+	if item.ReorderPoint < 0 {
+		params.add("reorder_point", "must not be negative")
+	}
+	locIds := make([]string, 0, len(item.LocationReorderPoints))
+	for locId := range item.LocationReorderPoints {
+		locIds = append(locIds, locId)
+	}
+	sort.Strings(locIds)
+	for _, locId := range locIds {
+		if item.LocationReorderPoints[locId] < 0 {
+			params.add(fmt.Sprintf("location_reorder_points[%s]", locId), "must not be negative")
+		}
+	}
+	return params
+}
+
+// checkLocation returns the invalid fields of the location in a request
+func checkLocation(location *Location) invalidParams {
+	var params invalidParams
+	params.required("name", location.Name)
+	params.required("warehouse", location.Warehouse)
+	params.supported("negative_stock_policy", location.NegativeStockPolicy, supportedNegativeStockPolicies)
+	return params
+}
+
+// checkInventoryTransaction returns the invalid fields of the inventory
+// transaction in a request
+func checkInventoryTransaction(txn *InventoryTransaction) invalidParams {
+	var params invalidParams
+	params.required("action", txn.Action)
+	params.supported("action", txn.Action, supportedTransactionActions)
+	params.required("item_id", txn.ItemId)
+	params.required("location_id", txn.LocationId)
+	switch {
+	case txn.Action == "RECOUNT" && txn.Count < 0:
+		params.add("count", "must not be negative")
+	case txn.Action != "RECOUNT" && txn.Count <= 0:
+		params.add("count", "must be positive")
+	}
+	return params
+}
+
+// checkTransfer returns the invalid fields of the transfer in a request
+func checkTransfer(transfer *Transfer) invalidParams {
+	var params invalidParams
+	params.required("item_id", transfer.ItemId)
+	params.required("source_location_id", transfer.SourceLocationId)
+	params.required("destination_location_id", transfer.DestinationLocationId)
+	if transfer.SourceLocationId != "" && transfer.SourceLocationId == transfer.DestinationLocationId {
+		params.add("destination_location_id", "must differ from source_location_id")
+	}
+	if transfer.Count <= 0 {
+		params.add("count", "must be positive")
+	}
+	return params
+}
+
+// checkPathId returns the id field as invalid if it differs from the id in
+// the path of an update
+func checkPathId(pathId, id string) invalidParams {
+	if id == pathId {
+		return nil
+	}
+	return invalidParams{{Name: "id", Reason: fmt.Sprintf("does not match the id %q in the path", pathId)}}
+}
+
+// transactionFilter returns the filter for the inventory transaction query
+// parameters, or a message explaining why they are invalid.
+func transactionFilter(startTime, endTime time.Time, action, createdBy, warehouse, orderBy string) (TransactionFilter, string) {
+	filter := TransactionFilter{Start: startTime, End: endTime, Action: action, CreatedBy: createdBy, Warehouse: warehouse}
+	if !startTime.IsZero() && !endTime.IsZero() && !startTime.Before(endTime) {
+		return filter, fmt.Sprintf("start_time must be before end_time: %s ", startTime.Format(time.RFC3339))
+	}
+	if action != "" && !isSupported(action, supportedTransactionActions) {
+		return filter, fmt.Sprintf("Unknown action: %s ", action)
+	}
+	switch orderBy {
+	case "", "timestamp":
+	case "timestamp desc":
+		filter.Descending = true
+	default:
+		return filter, fmt.Sprintf("Unknown order_by: %s ", orderBy)
+	}
+	return filter, ""
+}
+
+// archiveCascade returns whether the cascade query parameter of a delete asks
+// for the inventory to be archived, or a message explaining why it is invalid.
+func archiveCascade(cascade string) (bool, string) {
+	switch cascade {
+	case "":
+		return false, ""
+	case "archive":
+		return true, ""
+	default:
+		return false, fmt.Sprintf("Unknown cascade: %s ", cascade)
+	}
+}
+
+// isSupported returns whether value is one of the supported values
+func isSupported(value string, supported []string) bool {
+	for _, v := range supported {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
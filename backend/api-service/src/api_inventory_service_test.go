@@ -15,37 +15,92 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
+// decodeProblem returns the problem details of the response, failing the
+// test unless the response is one with the status
+func decodeProblem(t *testing.T, r *httptest.ResponseRecorder, status int) *Problem {
+	t.Helper()
+	if r.Result().StatusCode != status {
+		t.Errorf("status code: %v, want: %v", r.Result().StatusCode, status)
+	}
+	if got := r.Result().Header.Get("Content-Type"); got != problemContentType {
+		t.Errorf("Content-Type = %q, want %q", got, problemContentType)
+	}
+	problem := &Problem{}
+	if err := json.NewDecoder(r.Body).Decode(problem); err != nil {
+		t.Fatalf("response body is not a Problem: %v", err)
+	}
+	if problem.Type == "" || problem.Title == "" || problem.Status != int32(status) {
+		t.Errorf("response %v lacks a type, title or status %d", problem, status)
+	}
+	return problem
+}
+
+// invalidParamNames returns the names of the invalid_params of the problem
+// details of a bad request
+func invalidParamNames(t *testing.T, r *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var names []string
+	for _, param := range decodeProblem(t, r, http.StatusBadRequest).InvalidParams {
+		if param.Reason == "" {
+			t.Errorf("invalid param %q has no reason", param.Name)
+		}
+		names = append(names, param.Name)
+	}
+	return names
+}
+
 func TestNewInventoryTransactionBadRequests(t *testing.T) {
 	cases := []struct {
-		desc string
-		txn  InventoryTransaction
-		msg  string
+		desc    string
+		txn     InventoryTransaction
+		invalid []string
 	}{
 		{
-			desc: "missing action field",
-			txn:  InventoryTransaction{ItemId: "iid", LocationId: "lid"},
-			msg:  "required field: action",
+			desc:    "missing action field",
+			txn:     InventoryTransaction{ItemId: "iid", LocationId: "lid", Count: 1},
+			invalid: []string{"action"},
+		},
+		{
+			desc:    "missing item_id field",
+			txn:     InventoryTransaction{Action: "ADD", LocationId: "lid", Count: 1},
+			invalid: []string{"item_id"},
+		},
+		{
+			desc:    "missing location_id field",
+			txn:     InventoryTransaction{Action: "ADD", ItemId: "iid", Count: 1},
+			invalid: []string{"location_id"},
 		},
 		{
-			desc: "missing item_id field",
-			txn:  InventoryTransaction{Action: "ADD", LocationId: "lid"},
-			msg:  "required field: item_id",
+			desc:    "bad action type",
+			txn:     InventoryTransaction{Action: "bad-action", ItemId: "iid", LocationId: "lid", Count: 1},
+			invalid: []string{"action"},
 		},
 		{
-			desc: "missing location_id field",
-			txn:  InventoryTransaction{Action: "ADD", ItemId: "iid"},
-			msg:  "required field: location_id",
+			desc:    "zero count",
+			txn:     InventoryTransaction{Action: "ADD", ItemId: "iid", LocationId: "lid"},
+			invalid: []string{"count"},
 		},
 		{
-			desc: "bad action type",
-			txn:  InventoryTransaction{Action: "bad-action", ItemId: "iid", LocationId: "lid"},
-			msg:  "Unknown action",
+			desc:    "negative remove",
+			txn:     InventoryTransaction{Action: "REMOVE", ItemId: "iid", LocationId: "lid", Count: -5},
+			invalid: []string{"count"},
+		},
+		{
+			desc:    "negative recount",
+			txn:     InventoryTransaction{Action: "RECOUNT", ItemId: "iid", LocationId: "lid", Count: -1},
+			invalid: []string{"count"},
 		},
 	}
 
@@ -53,7 +108,7 @@ func TestNewInventoryTransactionBadRequests(t *testing.T) {
 		s := InventoryApiService{}
 		t.Run(tc.desc, func(t *testing.T) {
 			r := httptest.NewRecorder()
-			err := s.NewInventoryTransaction(tc.txn, r)
+			err := s.NewInventoryTransaction(context.Background(), &testPrincipal, "", tc.txn, r)
 
 			if err != nil {
 				t.Errorf("s.NewInventoryTransaction(%v) returned unexpected error: %v", tc.txn, err)
@@ -61,8 +116,8 @@ func TestNewInventoryTransactionBadRequests(t *testing.T) {
 			if r.Result().StatusCode != http.StatusBadRequest {
 				t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusBadRequest)
 			}
-			if !strings.Contains(r.Body.String(), tc.msg) {
-				t.Errorf("response body %q does not contain %q", r.Body.String(), tc.msg)
+			if got := invalidParamNames(t, r); !cmp.Equal(got, tc.invalid) {
+				t.Errorf("invalid_params = %v, want %v", got, tc.invalid)
 			}
 		})
 	}
@@ -70,38 +125,148 @@ func TestNewInventoryTransactionBadRequests(t *testing.T) {
 
 func TestNewItemMissingNameField(t *testing.T) {
 	item := Item{}
-	msg := "required field: name"
+	want := []string{"name"}
 
 	s := InventoryApiService{}
 	r := httptest.NewRecorder()
-	err := s.NewItem(item, r)
+	err := s.NewItem(context.Background(), item, r)
 
 	if err != nil {
 		t.Errorf("s.NewItem(%v) returned unexpected error: %v", item, err)
 	}
-	if r.Result().StatusCode != http.StatusBadRequest {
-		t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusBadRequest)
+	if got := invalidParamNames(t, r); !cmp.Equal(got, want) {
+		t.Errorf("invalid_params = %v, want %v", got, want)
 	}
-	if !strings.Contains(r.Body.String(), msg) {
-		t.Errorf("response body %q does not contain %q", r.Body.String(), msg)
+}
+
+func TestValidationReportsAllInvalidFields(t *testing.T) {
+	s := InventoryApiService{}
+	cases := []struct {
+		desc string
+		call func(w http.ResponseWriter) error
+		want []string
+	}{
+		{
+			desc: "new item",
+			call: func(w http.ResponseWriter) error {
+				item := Item{NegativeStockPolicy: "bad-policy", ReorderPoint: -1, LocationReorderPoints: map[string]int64{"b": -1, "a": -2, "c": 1}}
+				return s.NewItem(context.Background(), item, w)
+			},
+			want: []string{"name", "negative_stock_policy", "reorder_point", "location_reorder_points[a]", "location_reorder_points[b]"},
+		},
+		{
+			desc: "new location",
+			call: func(w http.ResponseWriter) error {
+				return s.NewLocation(context.Background(), Location{NegativeStockPolicy: "bad-policy"}, w)
+			},
+			want: []string{"name", "warehouse", "negative_stock_policy"},
+		},
+		{
+			desc: "new inventory transaction",
+			call: func(w http.ResponseWriter) error {
+				key := strings.Repeat("k", maxIdempotencyKeyLength+1)
+				return s.NewInventoryTransaction(context.Background(), &testPrincipal, key, InventoryTransaction{Action: "STEAL"}, w)
+			},
+			want: []string{"action", "item_id", "location_id", "count", "Idempotency-Key"},
+		},
+		{
+			desc: "new transfer",
+			call: func(w http.ResponseWriter) error {
+				return s.NewTransfer(context.Background(), &testPrincipal, Transfer{SourceLocationId: "src", DestinationLocationId: "src"}, w)
+			},
+			want: []string{"item_id", "destination_location_id", "count"},
+		},
+		{
+			desc: "update item",
+			call: func(w http.ResponseWriter) error {
+				return s.UpdateItem(context.Background(), "item-id", "", Item{Id: "other-id", ReorderPoint: -1}, w)
+			},
+			want: []string{"id", "name", "reorder_point"},
+		},
+		{
+			desc: "update location",
+			call: func(w http.ResponseWriter) error {
+				return s.UpdateLocation(context.Background(), "location-id", "", Location{Id: "other-id"}, w)
+			},
+			want: []string{"id", "name", "warehouse"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			if err := tc.call(r); err != nil {
+				t.Fatalf("returned unexpected error: %v", err)
+			}
+			if got := invalidParamNames(t, r); !cmp.Equal(got, tc.want) {
+				t.Errorf("invalid_params = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewItemBadRequests(t *testing.T) {
+	cases := []struct {
+		desc    string
+		item    Item
+		invalid []string
+	}{
+		{
+			desc:    "unknown negative_stock_policy",
+			item:    Item{Name: "name", NegativeStockPolicy: "bad-policy"},
+			invalid: []string{"negative_stock_policy"},
+		},
+		{
+			desc:    "negative reorder_point",
+			item:    Item{Name: "name", ReorderPoint: -1},
+			invalid: []string{"reorder_point"},
+		},
+		{
+			desc:    "negative location_reorder_points",
+			item:    Item{Name: "name", LocationReorderPoints: map[string]int64{"location-id": -1}},
+			invalid: []string{"location_reorder_points[location-id]"},
+		},
+	}
+
+	for _, tc := range cases {
+		s := InventoryApiService{}
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			err := s.NewItem(context.Background(), tc.item, r)
+
+			if err != nil {
+				t.Errorf("s.NewItem(%v) returned unexpected error: %v", tc.item, err)
+			}
+			if r.Result().StatusCode != http.StatusBadRequest {
+				t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusBadRequest)
+			}
+			if got := invalidParamNames(t, r); !cmp.Equal(got, tc.invalid) {
+				t.Errorf("invalid_params = %v, want %v", got, tc.invalid)
+			}
+		})
 	}
 }
 
 func TestNewLocationBadRequests(t *testing.T) {
 	cases := []struct {
-		desc string
-		loc  Location
-		msg  string
+		desc    string
+		loc     Location
+		invalid []string
 	}{
 		{
-			desc: "missing warehouse field",
-			loc:  Location{Name: "name"},
-			msg:  "required field: warehouse",
+			desc:    "missing warehouse field",
+			loc:     Location{Name: "name"},
+			invalid: []string{"warehouse"},
+		},
+		{
+			desc:    "missing name field",
+			loc:     Location{Warehouse: "warehouse"},
+			invalid: []string{"name"},
 		},
 		{
-			desc: "missing name field",
-			loc:  Location{Warehouse: "warehouse"},
-			msg:  "required field: name",
+			desc:    "unknown negative_stock_policy",
+			loc:     Location{Name: "name", Warehouse: "warehouse", NegativeStockPolicy: "bad-policy"},
+			invalid: []string{"negative_stock_policy"},
 		},
 	}
 
@@ -109,7 +274,7 @@ func TestNewLocationBadRequests(t *testing.T) {
 		s := InventoryApiService{}
 		t.Run(tc.desc, func(t *testing.T) {
 			r := httptest.NewRecorder()
-			err := s.NewLocation(tc.loc, r)
+			err := s.NewLocation(context.Background(), tc.loc, r)
 
 			if err != nil {
 				t.Errorf("s.NewLocation(%v) returned unexpected error: %v", tc.loc, err)
@@ -117,8 +282,60 @@ func TestNewLocationBadRequests(t *testing.T) {
 			if r.Result().StatusCode != http.StatusBadRequest {
 				t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusBadRequest)
 			}
-			if !strings.Contains(r.Body.String(), tc.msg) {
-				t.Errorf("response body %q does not contain %q", r.Body.String(), tc.msg)
+			if got := invalidParamNames(t, r); !cmp.Equal(got, tc.invalid) {
+				t.Errorf("invalid_params = %v, want %v", got, tc.invalid)
+			}
+		})
+	}
+}
+
+func TestNewTransferBadRequests(t *testing.T) {
+	cases := []struct {
+		desc     string
+		transfer Transfer
+		invalid  []string
+	}{
+		{
+			desc:     "missing item_id field",
+			transfer: Transfer{SourceLocationId: "src", DestinationLocationId: "dst", Count: 1},
+			invalid:  []string{"item_id"},
+		},
+		{
+			desc:     "missing source_location_id field",
+			transfer: Transfer{ItemId: "iid", DestinationLocationId: "dst", Count: 1},
+			invalid:  []string{"source_location_id"},
+		},
+		{
+			desc:     "missing destination_location_id field",
+			transfer: Transfer{ItemId: "iid", SourceLocationId: "src", Count: 1},
+			invalid:  []string{"destination_location_id"},
+		},
+		{
+			desc:     "same source and destination",
+			transfer: Transfer{ItemId: "iid", SourceLocationId: "src", DestinationLocationId: "src", Count: 1},
+			invalid:  []string{"destination_location_id"},
+		},
+		{
+			desc:     "non-positive count",
+			transfer: Transfer{ItemId: "iid", SourceLocationId: "src", DestinationLocationId: "dst"},
+			invalid:  []string{"count"},
+		},
+	}
+
+	for _, tc := range cases {
+		s := InventoryApiService{}
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			err := s.NewTransfer(context.Background(), &testPrincipal, tc.transfer, r)
+
+			if err != nil {
+				t.Errorf("s.NewTransfer(%v) returned unexpected error: %v", tc.transfer, err)
+			}
+			if r.Result().StatusCode != http.StatusBadRequest {
+				t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusBadRequest)
+			}
+			if got := invalidParamNames(t, r); !cmp.Equal(got, tc.invalid) {
+				t.Errorf("invalid_params = %v, want %v", got, tc.invalid)
 			}
 		})
 	}
@@ -127,19 +344,34 @@ func TestNewLocationBadRequests(t *testing.T) {
 func TestUpdateItemBadRequests(t *testing.T) {
 	id := "item-id"
 	cases := []struct {
-		desc string
-		item Item
-		msg  string
+		desc    string
+		item    Item
+		invalid []string
 	}{
 		{
-			desc: "mismatched item id",
-			item: Item{Id: "bad" + id, Name: "name"},
-			msg:  "Mismatched path id",
+			desc:    "mismatched item id",
+			item:    Item{Id: "bad" + id, Name: "name"},
+			invalid: []string{"id"},
+		},
+		{
+			desc:    "missing name field",
+			item:    Item{Id: "item-id"},
+			invalid: []string{"name"},
 		},
 		{
-			desc: "missing name field",
-			item: Item{Id: "item-id"},
-			msg:  "required field: name",
+			desc:    "unknown negative_stock_policy",
+			item:    Item{Id: id, Name: "name", NegativeStockPolicy: "bad-policy"},
+			invalid: []string{"negative_stock_policy"},
+		},
+		{
+			desc:    "negative reorder_point",
+			item:    Item{Id: id, Name: "name", ReorderPoint: -1},
+			invalid: []string{"reorder_point"},
+		},
+		{
+			desc:    "negative location_reorder_points",
+			item:    Item{Id: id, Name: "name", LocationReorderPoints: map[string]int64{"location-id": -1}},
+			invalid: []string{"location_reorder_points[location-id]"},
 		},
 	}
 
@@ -147,7 +379,7 @@ func TestUpdateItemBadRequests(t *testing.T) {
 		s := InventoryApiService{}
 		t.Run(tc.desc, func(t *testing.T) {
 			r := httptest.NewRecorder()
-			err := s.UpdateItem(id, tc.item, r)
+			err := s.UpdateItem(context.Background(), id, "", tc.item, r)
 
 			if err != nil {
 				t.Errorf("s.UpdateItem(%v, %v) returned unexpected error: %v", id, tc.item, err)
@@ -155,8 +387,8 @@ func TestUpdateItemBadRequests(t *testing.T) {
 			if r.Result().StatusCode != http.StatusBadRequest {
 				t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusBadRequest)
 			}
-			if !strings.Contains(r.Body.String(), tc.msg) {
-				t.Errorf("response body %q does not contain %q", r.Body.String(), tc.msg)
+			if got := invalidParamNames(t, r); !cmp.Equal(got, tc.invalid) {
+				t.Errorf("invalid_params = %v, want %v", got, tc.invalid)
 			}
 		})
 	}
@@ -165,24 +397,29 @@ func TestUpdateItemBadRequests(t *testing.T) {
 func TestUpdateLocationBadRequests(t *testing.T) {
 	id := "location-id"
 	cases := []struct {
-		desc string
-		loc  Location
-		msg  string
+		desc    string
+		loc     Location
+		invalid []string
 	}{
 		{
-			desc: "mismatched item id",
-			loc:  Location{Id: "bad" + id, Name: "name", Warehouse: "warehouse"},
-			msg:  "Mismatched path id",
+			desc:    "mismatched item id",
+			loc:     Location{Id: "bad" + id, Name: "name", Warehouse: "warehouse"},
+			invalid: []string{"id"},
+		},
+		{
+			desc:    "missing warehouse field",
+			loc:     Location{Id: id, Name: "name"},
+			invalid: []string{"warehouse"},
 		},
 		{
-			desc: "missing warehouse field",
-			loc:  Location{Id: id, Name: "name"},
-			msg:  "required field: warehouse",
+			desc:    "missing name field",
+			loc:     Location{Id: id, Warehouse: "warehouse"},
+			invalid: []string{"name"},
 		},
 		{
-			desc: "missing name field",
-			loc:  Location{Id: id, Warehouse: "warehouse"},
-			msg:  "required field: name",
+			desc:    "unknown negative_stock_policy",
+			loc:     Location{Id: id, Name: "name", Warehouse: "warehouse", NegativeStockPolicy: "bad-policy"},
+			invalid: []string{"negative_stock_policy"},
 		},
 	}
 
@@ -190,7 +427,7 @@ func TestUpdateLocationBadRequests(t *testing.T) {
 		s := InventoryApiService{}
 		t.Run(tc.desc, func(t *testing.T) {
 			r := httptest.NewRecorder()
-			err := s.UpdateLocation(id, tc.loc, r)
+			err := s.UpdateLocation(context.Background(), id, "", tc.loc, r)
 
 			if err != nil {
 				t.Errorf("s.UpdateLocation(%v, %v) returned unexpected error: %v", id, tc.loc, err)
@@ -198,9 +435,559 @@ func TestUpdateLocationBadRequests(t *testing.T) {
 			if r.Result().StatusCode != http.StatusBadRequest {
 				t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusBadRequest)
 			}
+			if got := invalidParamNames(t, r); !cmp.Equal(got, tc.invalid) {
+				t.Errorf("invalid_params = %v, want %v", got, tc.invalid)
+			}
+		})
+	}
+}
+
+func TestCreatedByFromPrincipal(t *testing.T) {
+	db := NewInMemoryBackend()
+	item, _ := db.NewItem(context.Background(), &Item{Name: "item"})
+	src, _ := db.NewLocation(context.Background(), &Location{Name: "src", Warehouse: "warehouse"})
+	dst, _ := db.NewLocation(context.Background(), &Location{Name: "dst", Warehouse: "warehouse"})
+	s := InventoryApiService{db: db}
+
+	txn := InventoryTransaction{ItemId: item.Id, LocationId: src.Id, Action: "ADD", Count: 2, CreatedBy: "spoofed"}
+	if err := s.NewInventoryTransaction(context.Background(), &testPrincipal, "", txn, httptest.NewRecorder()); err != nil {
+		t.Fatalf("s.NewInventoryTransaction(%v) returned unexpected error: %v", txn, err)
+	}
+	transfer := Transfer{ItemId: item.Id, SourceLocationId: src.Id, DestinationLocationId: dst.Id, Count: 1, CreatedBy: "spoofed"}
+	if err := s.NewTransfer(context.Background(), &testPrincipal, transfer, httptest.NewRecorder()); err != nil {
+		t.Fatalf("s.NewTransfer(%v) returned unexpected error: %v", transfer, err)
+	}
+
+	txns, _, _ := db.ListInventoryTransactions(context.Background(), TransactionFilter{}, PageRequest{})
+	if len(txns) != 3 {
+		t.Fatalf("ListInventoryTransactions() = %v, want 3 transactions", txns)
+	}
+	for _, got := range txns {
+		if got.CreatedBy != testPrincipal.UserId {
+			t.Errorf("transaction %v created_by = %q, want %q", got, got.CreatedBy, testPrincipal.UserId)
+		}
+	}
+}
+
+func TestListItemsNegativePageSize(t *testing.T) {
+	var pageSize int64 = -1
+	msg := "Negative page_size"
+
+	s := InventoryApiService{}
+	r := httptest.NewRecorder()
+	err := s.ListItems(context.Background(), pageSize, "", false, r)
+
+	if err != nil {
+		t.Errorf("s.ListItems(%d) returned unexpected error: %v", pageSize, err)
+	}
+	if r.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusBadRequest)
+	}
+	if !strings.Contains(r.Body.String(), msg) {
+		t.Errorf("response body %q does not contain %q", r.Body.String(), msg)
+	}
+}
+
+func TestListItemsPageSize(t *testing.T) {
+	db := NewInMemoryBackend()
+	for i := 0; i < maxPageSize+1; i++ {
+		db.NewItem(context.Background(), &Item{Name: "item"})
+	}
+	cases := []struct {
+		pageSize int64
+		want     int
+	}{
+		{pageSize: 0, want: defaultPageSize},
+		{pageSize: 10, want: 10},
+		{pageSize: maxPageSize + 1, want: maxPageSize},
+	}
+
+	for _, tc := range cases {
+		s := InventoryApiService{db: db}
+		t.Run(fmt.Sprintf("page_size %d", tc.pageSize), func(t *testing.T) {
+			r := httptest.NewRecorder()
+			if err := s.ListItems(context.Background(), tc.pageSize, "", false, r); err != nil {
+				t.Fatalf("s.ListItems(%d) returned unexpected error: %v", tc.pageSize, err)
+			}
+
+			page := &ItemPage{}
+			if err := json.NewDecoder(r.Body).Decode(page); err != nil {
+				t.Fatalf("response body is not an ItemPage: %v", err)
+			}
+			if len(page.Items) != tc.want || page.NextPageToken == "" {
+				t.Errorf("s.ListItems(%d) returned %d items and next_page_token %q, want %d items and a next page", tc.pageSize, len(page.Items), page.NextPageToken, tc.want)
+			}
+		})
+	}
+}
+
+func TestListInventoryTransactionsInvalidFilter(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		desc      string
+		startTime time.Time
+		endTime   time.Time
+		action    string
+		orderBy   string
+		msg       string
+	}{
+		{desc: "unknown action", action: "STEAL", msg: "Unknown action"},
+		{desc: "unknown order_by", orderBy: "count", msg: "Unknown order_by"},
+		{desc: "start after end", startTime: now, endTime: now.Add(-time.Hour), msg: "start_time must be before end_time"},
+		{desc: "empty range", startTime: now, endTime: now, msg: "start_time must be before end_time"},
+	}
+
+	for _, tc := range cases {
+		s := InventoryApiService{}
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			err := s.ListInventoryTransactions(context.Background(), &testPrincipal, tc.startTime, tc.endTime, tc.action, "", "", tc.orderBy, 0, "", r)
+
+			if err != nil {
+				t.Errorf("s.ListInventoryTransactions() returned unexpected error: %v", err)
+			}
+			if r.Result().StatusCode != http.StatusBadRequest {
+				t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusBadRequest)
+			}
 			if !strings.Contains(r.Body.String(), tc.msg) {
 				t.Errorf("response body %q does not contain %q", r.Body.String(), tc.msg)
 			}
 		})
 	}
 }
+
+func TestListInventoryTransactionsOrderBy(t *testing.T) {
+	db := NewInMemoryBackend()
+	item, _ := db.NewItem(context.Background(), &Item{Name: "item"})
+	location, _ := db.NewLocation(context.Background(), &Location{Name: "location", Warehouse: "warehouse"})
+	for i := 0; i < 3; i++ {
+		db.NewInventoryTransaction(context.Background(), &InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 1}, "")
+	}
+	s := InventoryApiService{db: db}
+
+	for orderBy, descending := range map[string]bool{"": false, "timestamp": false, "timestamp desc": true} {
+		t.Run(fmt.Sprintf("order_by %q", orderBy), func(t *testing.T) {
+			r := httptest.NewRecorder()
+			if err := s.ListItemInventoryTransactions(context.Background(), &testPrincipal, item.Id, time.Time{}, time.Time{}, "", "", "warehouse", orderBy, 0, "", r); err != nil {
+				t.Fatalf("s.ListItemInventoryTransactions() returned unexpected error: %v", err)
+			}
+
+			page := &InventoryTransactionPage{}
+			if err := json.NewDecoder(r.Body).Decode(page); err != nil {
+				t.Fatalf("response body is not an InventoryTransactionPage: %v", err)
+			}
+			txns := page.InventoryTransactions
+			if len(txns) != 3 {
+				t.Fatalf("s.ListItemInventoryTransactions() returned %d transactions, want 3", len(txns))
+			}
+			for i := 1; i < len(txns); i++ {
+				if txns[i].Timestamp.Before(txns[i-1].Timestamp) != descending && !txns[i].Timestamp.Equal(txns[i-1].Timestamp) {
+					t.Errorf("transactions are not in %q order: %v", orderBy, txns)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateItemIfMatch(t *testing.T) {
+	cases := []struct {
+		desc       string
+		ifMatch    string
+		wantStatus int
+		wantErr    bool
+		wantETag   string
+	}{
+		{desc: "no If-Match", ifMatch: "", wantStatus: http.StatusPreconditionRequired},
+		{desc: "blank If-Match", ifMatch: " ", wantStatus: http.StatusPreconditionRequired},
+		{desc: "any version", ifMatch: "*", wantStatus: http.StatusOK, wantETag: `"2"`},
+		{desc: "current version", ifMatch: `"1"`, wantStatus: http.StatusOK, wantETag: `"2"`},
+		{desc: "stale version", ifMatch: `"0"`, wantStatus: http.StatusPreconditionFailed},
+		{desc: "future version", ifMatch: `"2"`, wantErr: true},
+		{desc: "weak ETag", ifMatch: `W/"1"`, wantStatus: http.StatusPreconditionFailed},
+		{desc: "opaque ETag", ifMatch: `"v1"`, wantStatus: http.StatusPreconditionFailed},
+		{desc: "unquoted ETag", ifMatch: "1", wantStatus: http.StatusBadRequest},
+		{desc: "unterminated ETag", ifMatch: `"1`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			db := NewInMemoryBackend()
+			item, _ := db.NewItem(context.Background(), &Item{Name: "item"})
+			s := InventoryApiService{db: db}
+
+			r := httptest.NewRecorder()
+			if err := s.GetItem(context.Background(), item.Id, r); err != nil {
+				t.Fatalf("s.GetItem(%v) returned unexpected error: %v", item.Id, err)
+			}
+			if got := r.Result().Header.Get("ETag"); got != `"1"` {
+				t.Errorf("s.GetItem(%v) ETag = %s, want %s", item.Id, got, `"1"`)
+			}
+
+			r = httptest.NewRecorder()
+			update := Item{Id: item.Id, Name: "updated"}
+			err := s.UpdateItem(context.Background(), item.Id, tc.ifMatch, update, r)
+
+			if tc.wantErr {
+				if _, ok := err.(*PreconditionFailed); !ok {
+					t.Errorf("s.UpdateItem(%v, %s) returned %v, want *PreconditionFailed", item.Id, tc.ifMatch, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("s.UpdateItem(%v, %s) returned unexpected error: %v", item.Id, tc.ifMatch, err)
+			}
+			if r.Result().StatusCode != tc.wantStatus {
+				t.Errorf("status code: %v, want: %v", r.Result().StatusCode, tc.wantStatus)
+			}
+			if got := r.Result().Header.Get("ETag"); got != tc.wantETag {
+				t.Errorf("s.UpdateItem(%v, %s) ETag = %s, want %s", item.Id, tc.ifMatch, got, tc.wantETag)
+			}
+		})
+	}
+}
+
+func TestDeleteCascade(t *testing.T) {
+	cases := []struct {
+		desc       string
+		cascade    string
+		wantStatus int
+		wantErr    bool
+	}{
+		{desc: "no cascade", cascade: "", wantErr: true},
+		{desc: "archive", cascade: "archive", wantStatus: http.StatusOK},
+		{desc: "unknown cascade", cascade: "delete", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := context.Background()
+			db := NewInMemoryBackend()
+			item, _ := db.NewItem(ctx, &Item{Name: "item"})
+			location, _ := db.NewLocation(ctx, &Location{Name: "location", Warehouse: "warehouse"})
+			txn := &InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 1}
+			if _, err := db.NewInventoryTransaction(ctx, txn, ""); err != nil {
+				t.Fatalf("db.NewInventoryTransaction(%v) returned unexpected error: %v", txn, err)
+			}
+			s := InventoryApiService{db: db}
+
+			for _, del := range []struct {
+				name string
+				id   string
+				f    func(context.Context, string, string, http.ResponseWriter) error
+			}{
+				{"s.DeleteItem", item.Id, s.DeleteItem},
+				{"s.DeleteLocation", location.Id, s.DeleteLocation},
+			} {
+				r := httptest.NewRecorder()
+				err := del.f(ctx, del.id, tc.cascade, r)
+
+				if tc.wantErr {
+					if _, ok := err.(*ResourceInUse); !ok {
+						t.Errorf("%s(%v, %q) returned %v, want *ResourceInUse", del.name, del.id, tc.cascade, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s(%v, %q) returned unexpected error: %v", del.name, del.id, tc.cascade, err)
+				}
+				if r.Result().StatusCode != tc.wantStatus {
+					t.Errorf("%s(%v, %q) status code: %v, want: %v", del.name, del.id, tc.cascade, r.Result().StatusCode, tc.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestNewInventoryTransactionIdempotencyKey(t *testing.T) {
+	db := NewInMemoryBackend()
+	item, _ := db.NewItem(context.Background(), &Item{Name: "item"})
+	location, _ := db.NewLocation(context.Background(), &Location{Name: "location", Warehouse: "warehouse"})
+	s := InventoryApiService{db: db}
+	txn := InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 2}
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRecorder()
+		if err := s.NewInventoryTransaction(context.Background(), &testPrincipal, "retried-key", txn, r); err != nil {
+			t.Fatalf("s.NewInventoryTransaction(%v) returned unexpected error: %v", txn, err)
+		}
+		if r.Result().StatusCode != http.StatusCreated {
+			t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusCreated)
+		}
+		got := &InventoryTransaction{}
+		if err := json.NewDecoder(r.Body).Decode(got); err != nil {
+			t.Fatalf("response body is not an InventoryTransaction: %v", err)
+		}
+		ids = append(ids, got.Id)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("retried s.NewInventoryTransaction(%v) created transactions %v, want one", txn, ids)
+	}
+
+	r := httptest.NewRecorder()
+	key := strings.Repeat("k", maxIdempotencyKeyLength+1)
+	if err := s.NewInventoryTransaction(context.Background(), &testPrincipal, key, txn, r); err != nil {
+		t.Fatalf("s.NewInventoryTransaction(%v) returned unexpected error: %v", txn, err)
+	}
+	if r.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("status code for a long Idempotency-Key: %v, want: %v", r.Result().StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestNewInventoryTransactionBatchBadRequests(t *testing.T) {
+	valid := InventoryTransaction{ItemId: "item-id", LocationId: "location-id", Action: "ADD", Count: 1}
+	cases := []struct {
+		desc       string
+		txns       []InventoryTransaction
+		msg        string
+		wantErrors []EntryError
+	}{
+		{
+			desc: "empty batch",
+			txns: nil,
+			msg:  "Invalid inventory_transactions",
+		},
+		{
+			desc: "too many transactions",
+			txns: make([]InventoryTransaction, maxBatchSize+1),
+			msg:  "larger than the limit",
+		},
+		{
+			desc: "invalid entries",
+			txns: []InventoryTransaction{
+				valid,
+				{ItemId: "item-id", LocationId: "location-id", Count: 1},
+				valid,
+				{ItemId: "item-id", LocationId: "location-id", Action: "STEAL", Count: 1},
+			},
+			msg: "2 of the entries in the batch failed",
+			wantErrors: []EntryError{
+				{
+					Index:         1,
+					Message:       "Invalid action: required field is empty",
+					InvalidParams: []InvalidParam{{Name: "action", Reason: "required field is empty"}},
+				},
+				{
+					Index:         3,
+					Message:       `Invalid action: unknown value "STEAL", want one of ADD, REMOVE, RECOUNT`,
+					InvalidParams: []InvalidParam{{Name: "action", Reason: `unknown value "STEAL", want one of ADD, REMOVE, RECOUNT`}},
+				},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		s := InventoryApiService{db: NewInMemoryBackend()}
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			batch := InventoryTransactionBatch{InventoryTransactions: tc.txns}
+			if err := s.NewInventoryTransactionBatch(context.Background(), &testPrincipal, batch, r); err != nil {
+				t.Fatalf("s.NewInventoryTransactionBatch() returned unexpected error: %v", err)
+			}
+			problem := decodeProblem(t, r, http.StatusBadRequest)
+			if !strings.Contains(problem.Detail, tc.msg) {
+				t.Errorf("response detail %q does not contain %q", problem.Detail, tc.msg)
+			}
+			if !cmp.Equal(problem.Errors, tc.wantErrors) {
+				t.Errorf("response errors = %v, want %v", problem.Errors, tc.wantErrors)
+			}
+		})
+	}
+}
+
+func TestNewInventoryTransactionBatch(t *testing.T) {
+	db := NewInMemoryBackend()
+	item, _ := db.NewItem(context.Background(), &Item{Name: "item", NegativeStockPolicy: negativeStockReject})
+	location, _ := db.NewLocation(context.Background(), &Location{Name: "location", Warehouse: "warehouse"})
+	s := InventoryApiService{db: db}
+	batch := InventoryTransactionBatch{InventoryTransactions: []InventoryTransaction{
+		{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 2, CreatedBy: "spoofed"},
+		{ItemId: item.Id, LocationId: location.Id, Action: "REMOVE", Count: 1},
+	}}
+
+	r := httptest.NewRecorder()
+	if err := s.NewInventoryTransactionBatch(context.Background(), &testPrincipal, batch, r); err != nil {
+		t.Fatalf("s.NewInventoryTransactionBatch(%v) returned unexpected error: %v", batch, err)
+	}
+	if r.Result().StatusCode != http.StatusCreated {
+		t.Errorf("status code: %v, want: %v", r.Result().StatusCode, http.StatusCreated)
+	}
+	got := &InventoryTransactionBatch{}
+	if err := json.NewDecoder(r.Body).Decode(got); err != nil {
+		t.Fatalf("response body is not an InventoryTransactionBatch: %v", err)
+	}
+	if len(got.InventoryTransactions) != 2 {
+		t.Fatalf("s.NewInventoryTransactionBatch(%v) returned %v, want 2 transactions", batch, got)
+	}
+	for _, txn := range got.InventoryTransactions {
+		if txn.Id == "" || txn.CreatedBy != testPrincipal.UserId {
+			t.Errorf("s.NewInventoryTransactionBatch(%v) returned %v, want an id and created_by %q", batch, txn, testPrincipal.UserId)
+		}
+	}
+
+	// A batch that would take the inventory below zero fails at that entry
+	batch.InventoryTransactions[1].Count = 5
+	r = httptest.NewRecorder()
+	if err := s.NewInventoryTransactionBatch(context.Background(), &testPrincipal, batch, r); err != nil {
+		t.Fatalf("s.NewInventoryTransactionBatch(%v) returned unexpected error: %v", batch, err)
+	}
+	problem := decodeProblem(t, r, http.StatusConflict)
+	if len(problem.Errors) != 1 || problem.Errors[0].Index != 1 {
+		t.Errorf("response errors = %v, want an error for entry 1", problem.Errors)
+	}
+}
+
+func TestWarehouseScopes(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryBackend()
+	item, _ := db.NewItem(ctx, &Item{Name: "item"})
+	north, _ := db.NewLocation(ctx, &Location{Name: "north", Warehouse: "north"})
+	south, _ := db.NewLocation(ctx, &Location{Name: "south", Warehouse: "south"})
+	s := InventoryApiService{db: db}
+
+	txn := func(locationId string) InventoryTransaction {
+		return InventoryTransaction{ItemId: item.Id, LocationId: locationId, Action: "ADD", Count: 1}
+	}
+	calls := []struct {
+		desc      string
+		call      func(p *Principal, w http.ResponseWriter) error
+		warehouse string
+	}{
+		{
+			desc: "new inventory transaction",
+			call: func(p *Principal, w http.ResponseWriter) error {
+				return s.NewInventoryTransaction(ctx, p, "", txn(south.Id), w)
+			},
+			warehouse: "south",
+		},
+		{
+			desc: "new inventory transaction batch",
+			call: func(p *Principal, w http.ResponseWriter) error {
+				batch := InventoryTransactionBatch{InventoryTransactions: []InventoryTransaction{txn(north.Id), txn(south.Id)}}
+				return s.NewInventoryTransactionBatch(ctx, p, batch, w)
+			},
+			warehouse: "south",
+		},
+		{
+			desc: "new transfer",
+			call: func(p *Principal, w http.ResponseWriter) error {
+				transfer := Transfer{ItemId: item.Id, SourceLocationId: north.Id, DestinationLocationId: south.Id, Count: 1}
+				return s.NewTransfer(ctx, p, transfer, w)
+			},
+			warehouse: "south",
+		},
+		{
+			desc: "list location inventory",
+			call: func(p *Principal, w http.ResponseWriter) error {
+				return s.ListLocationInventory(ctx, p, south.Id, 0, "", w)
+			},
+			warehouse: "south",
+		},
+		{
+			desc: "list location inventory transactions",
+			call: func(p *Principal, w http.ResponseWriter) error {
+				return s.ListLocationInventoryTransactions(ctx, p, south.Id, time.Time{}, time.Time{}, "", "", "", "", 0, "", w)
+			},
+			warehouse: "south",
+		},
+		{
+			desc: "list inventory transactions of a warehouse",
+			call: func(p *Principal, w http.ResponseWriter) error {
+				return s.ListInventoryTransactions(ctx, p, time.Time{}, time.Time{}, "", "", "south", "", 0, "", w)
+			},
+			warehouse: "south",
+		},
+		{
+			desc: "list inventory transactions",
+			call: func(p *Principal, w http.ResponseWriter) error {
+				return s.ListInventoryTransactions(ctx, p, time.Time{}, time.Time{}, "", "", "", "", 0, "", w)
+			},
+		},
+		{
+			desc: "list item inventory transactions",
+			call: func(p *Principal, w http.ResponseWriter) error {
+				return s.ListItemInventoryTransactions(ctx, p, item.Id, time.Time{}, time.Time{}, "", "", "", "", 0, "", w)
+			},
+		},
+	}
+	callers := []struct {
+		desc      string
+		principal *Principal
+		allowed   bool
+	}{
+		{desc: "admin", principal: &Principal{UserId: "admin-id", Role: "admin"}, allowed: true},
+		{desc: "worker of both warehouses", principal: &Principal{UserId: "user-id", Role: "worker", Warehouses: []string{"north", "south"}}, allowed: true},
+		{desc: "worker of the other warehouse", principal: &Principal{UserId: "user-id", Role: "worker", Warehouses: []string{"north"}}},
+		{desc: "worker of no warehouse", principal: &Principal{UserId: "user-id", Role: "worker"}},
+	}
+
+	for _, c := range callers {
+		for _, tc := range calls {
+			t.Run(c.desc+"/"+tc.desc, func(t *testing.T) {
+				principal := *c.principal
+				r := httptest.NewRecorder()
+				err := tc.call(&principal, r)
+
+				if tc.warehouse == "" {
+					// Lists that do not name a warehouse only list the
+					// transactions of the warehouses the caller is assigned to,
+					// which the admin recorded in both
+					if err != nil || r.Result().StatusCode != http.StatusOK {
+						t.Fatalf("returned %v with status %v, want success", err, r.Result().StatusCode)
+					}
+					page := &InventoryTransactionPage{}
+					if err := json.NewDecoder(r.Body).Decode(page); err != nil {
+						t.Fatalf("error decoding response: %v", err)
+					}
+					got := map[string]bool{}
+					for _, txn := range page.InventoryTransactions {
+						got[txn.Warehouse] = true
+					}
+					want := map[string]bool{}
+					for _, warehouse := range principal.Warehouses {
+						want[warehouse] = true
+					}
+					if principal.Role == "admin" {
+						want = map[string]bool{"north": true, "south": true}
+					}
+					if !cmp.Equal(got, want) {
+						t.Errorf("listed transactions of warehouses %v, want %v", got, want)
+					}
+					return
+				}
+
+				if c.allowed {
+					if err != nil {
+						t.Fatalf("returned unexpected error: %v", err)
+					}
+					if r.Result().StatusCode >= 300 {
+						t.Errorf("status code: %v, want success", r.Result().StatusCode)
+					}
+					return
+				}
+				if r.Result().StatusCode == http.StatusForbidden {
+					// A batch reports the entries that were forbidden
+					problem := decodeProblem(t, r, http.StatusForbidden)
+					var got []int64
+					for _, entry := range problem.Errors {
+						got = append(got, entry.Index)
+					}
+					want := []int64{1}
+					if len(principal.Warehouses) == 0 {
+						want = []int64{0, 1}
+					}
+					if !cmp.Equal(got, want) {
+						t.Errorf("response errors = %v, want errors for entries %v", problem.Errors, want)
+					}
+					return
+				}
+				if KindOf(err) != KindForbidden {
+					t.Fatalf("returned err %v, want a %v error", err, KindForbidden)
+				}
+				if len(principal.Warehouses) > 0 && !strings.Contains(err.Error(), tc.warehouse) {
+					t.Errorf("error %q does not name warehouse %q", err, tc.warehouse)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+/*
+ * Inventory API
+ *
+ * Inventory API for the Cloud Run for Anthos Reference Web App
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// KeyApiService is a service that implents the logic for the KeyApiServicer
+// This service should implement the business logic for every endpoint for the KeyApi API.
+// Include any external packages or services that will be required by this service.
+type KeyApiService struct {
+	db DatabaseBackend
+}
+
+// NewKeyApiService creates an api service backed by the given database
+func NewKeyApiService(db DatabaseBackend) KeyApiServicer {
+	return &KeyApiService{db}
+}
+
+// GetApiKey - Get API key by ID
+func (s *KeyApiService) GetApiKey(ctx context.Context, id string, w http.ResponseWriter) error {
+	r, err := s.db.GetApiKey(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return EncodeJSONResponse(r, nil, w)
+}
+
+// ListApiKeys - List all API keys
+func (s *KeyApiService) ListApiKeys(ctx context.Context, pageSize int64, pageToken string, w http.ResponseWriter) error {
+	page, message := pageRequest(pageSize, pageToken)
+	if message != "" {
+		return EncodeProblem(http.StatusBadRequest, message, w)
+	}
+
+	l, next, err := s.db.ListApiKeys(ctx, page)
+	if err != nil {
+		return err
+	}
+
+	return EncodeJSONResponse(newApiKeyPage(l, next), nil, w)
+}
+
+// NewApiKey - Create a new API key. The secret key is only returned in the
+// response, as only its hash is stored.
+func (s *KeyApiService) NewApiKey(ctx context.Context, principal *Principal, apiKey ApiKey, w http.ResponseWriter) error {
+	now := time.Now()
+	if params := checkApiKey(&apiKey, now); len(params) > 0 {
+		return encodeInvalidParams(params, w)
+	}
+	record, secret, err := newApiKeyRecord(&ApiKey{
+		Name:       apiKey.Name,
+		Scope:      apiKey.Scope,
+		Warehouses: apiKey.Warehouses,
+		CreatedBy:  principal.UserId,
+		CreatedAt:  now,
+		ExpiresAt:  apiKey.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	r, err := s.db.NewApiKey(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	r.Key = formatApiKey(r.Id, secret)
+	status := http.StatusCreated
+	return EncodeJSONResponse(r, &status, w)
+}
+
+// RevokeApiKey - Revoke an API key, which stops working at once
+func (s *KeyApiService) RevokeApiKey(ctx context.Context, id string, w http.ResponseWriter) error {
+	r, err := s.db.RevokeApiKey(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return EncodeJSONResponse(r, nil, w)
+}
+
+// checkApiKey returns the invalid fields of the API key in a request
+func checkApiKey(apiKey *ApiKey, now time.Time) invalidParams {
+	var params invalidParams
+	params.required("name", apiKey.Name)
+	params.required("scope", apiKey.Scope)
+	params.supported("scope", apiKey.Scope, supportedApiKeyScopes)
+	if !apiKey.ExpiresAt.After(now) {
+		params.add("expires_at", fmt.Sprintf("must be in the future, not %s", apiKey.ExpiresAt.Format(time.RFC3339)))
+	}
+	return params
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewApiKeyBadRequests(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	cases := []struct {
+		desc   string
+		apiKey ApiKey
+		want   []string
+	}{
+		{
+			desc:   "missing fields",
+			apiKey: ApiKey{},
+			want:   []string{"name", "scope", "expires_at"},
+		},
+		{
+			desc:   "unknown scope",
+			apiKey: ApiKey{Name: "scanner", Scope: "SUPERUSER", ExpiresAt: expiry},
+			want:   []string{"scope"},
+		},
+		{
+			desc:   "expires_at in the past",
+			apiKey: ApiKey{Name: "scanner", Scope: apiKeyReadOnly, ExpiresAt: time.Now().Add(-time.Minute)},
+			want:   []string{"expires_at"},
+		},
+	}
+
+	for _, tc := range cases {
+		s := KeyApiService{}
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			err := s.NewApiKey(context.Background(), &testPrincipal, tc.apiKey, r)
+
+			if err != nil {
+				t.Errorf("s.NewApiKey(%v) returned unexpected error: %v", tc.apiKey, err)
+			}
+			if got := invalidParamNames(t, r); !cmp.Equal(got, tc.want) {
+				t.Errorf("invalid_params = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewApiKeyReturnsKeyOnce(t *testing.T) {
+	db := NewInMemoryBackend()
+	s := KeyApiService{db: db}
+	apiKey := ApiKey{
+		Name:      "scanner",
+		Scope:     apiKeyAdmin,
+		Key:       "spoofed",
+		CreatedBy: "spoofed",
+		ExpiresAt: time.Now().Add(time.Hour),
+		RevokedAt: time.Now(),
+	}
+
+	r := httptest.NewRecorder()
+	if err := s.NewApiKey(context.Background(), &testPrincipal, apiKey, r); err != nil {
+		t.Fatalf("s.NewApiKey(%v) returned unexpected error: %v", apiKey, err)
+	}
+	if r.Code != http.StatusCreated {
+		t.Fatalf("status code: %v, want: %v", r.Code, http.StatusCreated)
+	}
+	created := &ApiKey{}
+	if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if created.Key == "" || created.Key == apiKey.Key || created.CreatedBy != testPrincipal.UserId || !created.RevokedAt.IsZero() {
+		t.Errorf("s.NewApiKey(%v) = %v, want a new unrevoked key created by %q", apiKey, created, testPrincipal.UserId)
+	}
+	if _, err := verifyApiKey(context.Background(), db, created.Key, time.Now()); err != nil {
+		t.Errorf("verifyApiKey(%q) returned unexpected error: %v", created.Key, err)
+	}
+
+	responses := map[string]func(w http.ResponseWriter) error{
+		"GetApiKey": func(w http.ResponseWriter) error {
+			return s.GetApiKey(context.Background(), created.Id, w)
+		},
+		"ListApiKeys": func(w http.ResponseWriter) error {
+			return s.ListApiKeys(context.Background(), 0, "", w)
+		},
+	}
+	for name, respond := range responses {
+		r := httptest.NewRecorder()
+		if err := respond(r); err != nil {
+			t.Fatalf("s.%s() returned unexpected error: %v", name, err)
+		}
+		_, secret, _ := parseApiKey(created.Key)
+		if body := r.Body.String(); strings.Contains(body, secret) || strings.Contains(body, "secret_hash") {
+			t.Errorf("s.%s() response %s contains the secret or its hash", name, body)
+		}
+	}
+}
+
+func TestRevokedApiKeyStopsWorking(t *testing.T) {
+	db := NewInMemoryBackend()
+	key, apiKey := testApiKey(t, db, apiKeyAdmin, time.Now().Add(time.Hour))
+	s := KeyApiService{db: db}
+
+	if err := s.RevokeApiKey(context.Background(), key.Id, httptest.NewRecorder()); err != nil {
+		t.Fatalf("s.RevokeApiKey(%q) returned unexpected error: %v", key.Id, err)
+	}
+
+	_, err := verifyApiKey(context.Background(), db, apiKey, time.Now())
+	if KindOf(err) != KindUnauthenticated {
+		t.Errorf("verifyApiKey() after revoking returned err %v, want a %v error", err, KindUnauthenticated)
+	}
+}
+
+func TestTransactionsAttributedToApiKey(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryBackend()
+	item, _ := db.NewItem(ctx, &Item{Name: "item"})
+	location, _ := db.NewLocation(ctx, &Location{Name: "location", Warehouse: "warehouse"})
+	key, apiKey := testApiKey(t, db, apiKeyTransactions, time.Now().Add(time.Hour))
+	router := apiRouter(db)
+	router.Use(Authorize(nil, db))
+
+	body := strings.NewReader(`{"item_id":"` + item.Id + `","location_id":"` + location.Id + `","action":"ADD","count":3}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/inventoryTransactions", body)
+	req.Header.Set(apiKeyHeader, apiKey)
+	r := httptest.NewRecorder()
+	router.ServeHTTP(r, req)
+
+	if r.Code != http.StatusCreated {
+		t.Fatalf("status code: %v, want: %v; body: %s", r.Code, http.StatusCreated, r.Body.String())
+	}
+	txns, _, _ := db.ListInventoryTransactions(ctx, TransactionFilter{}, PageRequest{})
+	if len(txns) != 1 || txns[0].CreatedBy != key.Id {
+		t.Errorf("ListInventoryTransactions() = %v, want a single transaction created by %q", txns, key.Id)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyReadOnly     = "READ_ONLY"
+	apiKeyTransactions = "TRANSACTIONS"
+	apiKeyAdmin        = "ADMIN"
+)
+
+var supportedApiKeyScopes = []string{apiKeyReadOnly, apiKeyTransactions, apiKeyAdmin}
+
+// apiKeyHeader is the header that carries the API key of a request. Keys are
+// not sent as bearer tokens, which the Istio JWT policies would reject.
+const apiKeyHeader = "X-API-Key"
+
+// apiKeyUseResolution is how stale the last use of a key may be before it is
+// recorded again, so that busy clients do not write on every request
+const apiKeyUseResolution = time.Minute
+
+// InvalidApiKey is an API key that does not authenticate its caller
+type InvalidApiKey struct {
+	reason string
+}
+
+func (e *InvalidApiKey) Error() string {
+	return "invalid API key: " + e.reason
+}
+
+func (e *InvalidApiKey) Kind() ErrorKind {
+	return KindUnauthenticated
+}
+
+// apiKeyRecord is an API key as stored by the backends. Only the hash of the
+// secret is stored, so the secret cannot be recovered from the database.
+type apiKeyRecord struct {
+	ApiKey
+	SecretHash string `json:"secret_hash"`
+}
+
+// newApiKeyRecord returns the record of a new key, along with its secret
+func newApiKeyRecord(key *ApiKey) (*apiKeyRecord, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	record := &apiKeyRecord{ApiKey: *key, SecretHash: hashApiKeySecret(secret)}
+	record.Key = ""
+	return record, secret, nil
+}
+
+func hashApiKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// formatApiKey returns the key that clients send, which is the id of the key
+// followed by its secret
+func formatApiKey(id, secret string) string {
+	return id + "." + secret
+}
+
+// parseApiKey returns the id and secret of a key returned by formatApiKey.
+// Ids with slashes are rejected, as they are not Firestore document IDs.
+func parseApiKey(key string) (id, secret string, err error) {
+	i := strings.LastIndex(key, ".")
+	if i <= 0 || i == len(key)-1 || strings.Contains(key[:i], "/") {
+		return "", "", &InvalidApiKey{reason: "malformed"}
+	}
+	return key[:i], key[i+1:], nil
+}
+
+// verify returns an error unless the secret is the secret of the key and the
+// key may be used at time now
+func (r *apiKeyRecord) verify(secret string, now time.Time) error {
+	switch {
+	case subtle.ConstantTimeCompare([]byte(hashApiKeySecret(secret)), []byte(r.SecretHash)) != 1:
+		return &InvalidApiKey{reason: "wrong secret"}
+	case !r.RevokedAt.IsZero():
+		return &InvalidApiKey{reason: "revoked"}
+	case !now.Before(r.ExpiresAt):
+		return &InvalidApiKey{reason: "expired"}
+	}
+	return nil
+}
+
+// verifyApiKey returns the caller that uses the key at time now, and records
+// the use of the key unless it was already recorded within
+// apiKeyUseResolution
+func verifyApiKey(ctx context.Context, db DatabaseBackend, key string, now time.Time) (*Principal, error) {
+	id, secret, err := parseApiKey(key)
+	if err != nil {
+		return nil, err
+	}
+	record, err := db.lookupApiKey(ctx, id)
+	if KindOf(err) == KindNotFound {
+		return nil, &InvalidApiKey{reason: "unknown key"}
+	} else if err != nil {
+		return nil, err
+	}
+	if err := record.verify(secret, now); err != nil {
+		return nil, err
+	}
+	if now.Sub(record.LastUsedAt) >= apiKeyUseResolution {
+		// The key works whether or not its use is recorded
+		if err := db.recordApiKeyUse(ctx, id, now); err != nil {
+			LogErrorf(ctx, "error recording the use of API key %s: %v", id, err)
+		}
+	}
+	return record.principal(), nil
+}
+
+// principal returns the caller that uses the key. Its user ID is the id of the
+// key, so that what the key does is attributed to it. Keys that may only read
+// have no role.
+func (k *ApiKey) principal() *Principal {
+	principal := &Principal{UserId: k.Id, Warehouses: k.Warehouses}
+	switch k.Scope {
+	case apiKeyAdmin:
+		principal.Role = roleAdmin
+	case apiKeyTransactions:
+		principal.Role = roleWorker
+	}
+	return principal
+}
+
+// revoke stops the key from working as of the given time, unless it already
+// was revoked
+func (k *ApiKey) revoke(at time.Time) {
+	if k.RevokedAt.IsZero() {
+		k.RevokedAt = at
+	}
+}
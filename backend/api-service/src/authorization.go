@@ -0,0 +1,132 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	roleAdmin  = "admin"
+	roleWorker = "worker"
+	// roleAny stands for every caller with a valid token, whatever its role
+	roleAny = "*"
+)
+
+// routeRoles are the roles that may call each route, by route name. They
+// mirror the Istio authorization policies: anyone signed in may read, workers
+// may record inventory transactions and handle alerts, and only admins may
+// change anything else, including API keys. Routes missing from the table are denied.
+var routeRoles = map[string][]string{
+	"GetInventoryTransaction":           {roleAny},
+	"GetItem":                           {roleAny},
+	"GetLocation":                       {roleAny},
+	"ListAlerts":                        {roleAny},
+	"ListInventoryTransactions":         {roleAny},
+	"ListItemInventory":                 {roleAny},
+	"ListItemInventoryTransactions":     {roleAny},
+	"ListItems":                         {roleAny},
+	"ListLocationInventory":             {roleAny},
+	"ListLocationInventoryTransactions": {roleAny},
+	"ListLocations":                     {roleAny},
+
+	"NewInventoryTransaction":      {roleAdmin, roleWorker},
+	"NewInventoryTransactionBatch": {roleAdmin, roleWorker},
+	"NewTransfer":                  {roleAdmin, roleWorker},
+	"AcknowledgeAlert":             {roleAdmin, roleWorker},
+	"ResolveAlert":                 {roleAdmin, roleWorker},
+	"SnoozeAlert":                  {roleAdmin, roleWorker},
+
+	"NewItem":         {roleAdmin},
+	"UpdateItem":      {roleAdmin},
+	"DeleteItem":      {roleAdmin},
+	"ArchiveItem":     {roleAdmin},
+	"RestoreItem":     {roleAdmin},
+	"NewLocation":     {roleAdmin},
+	"UpdateLocation":  {roleAdmin},
+	"DeleteLocation":  {roleAdmin},
+	"ArchiveLocation": {roleAdmin},
+	"RestoreLocation": {roleAdmin},
+	"NewAlert":        {roleAdmin},
+	"DeleteAlert":     {roleAdmin},
+	"GetApiKey":       {roleAdmin},
+	"ListApiKeys":     {roleAdmin},
+	"NewApiKey":       {roleAdmin},
+	"RevokeApiKey":    {roleAdmin},
+}
+
+// Authorize returns a middleware for the router of the API that verifies the
+// API key or ID token of each request, and lets it through only if the role of
+// the caller may call the route according to routeRoles. The verified caller
+// is passed on in the context of the request.
+//
+// API keys are looked up in the database. Without a token verifier, requests
+// without an API key are let through as they are, since the Istio ingress
+// gateway verified their ID token and authorized them.
+func Authorize(verifier *TokenVerifier, db DatabaseBackend) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			noteRoute(r)
+			var principal *Principal
+			var err error
+			authorization := r.Header.Get("Authorization")
+			switch {
+			case r.Header.Get(apiKeyHeader) != "":
+				principal, err = verifyApiKey(r.Context(), db, r.Header.Get(apiKeyHeader), time.Now())
+			case verifier == nil:
+				next.ServeHTTP(w, r)
+				return
+			case !strings.HasPrefix(authorization, "Bearer "):
+				noteError(r.Context(), errMissingIdentity)
+				EncodeProblem(http.StatusUnauthorized, errMissingIdentity.Error(), w)
+				return
+			default:
+				principal, err = verifier.Verify(r.Context(), strings.TrimPrefix(authorization, "Bearer "))
+			}
+			if err != nil {
+				noteError(r.Context(), err)
+				EncodeProblem(errorStatus(err), err.Error(), w)
+				return
+			}
+			notePrincipal(r.Context(), principal)
+			route := ""
+			if current := mux.CurrentRoute(r); current != nil {
+				route = current.GetName()
+			}
+			if !mayCall(principal.Role, route) {
+				err = fmt.Errorf("role %q may not call %s", principal.Role, route)
+				noteError(r.Context(), err)
+				EncodeProblem(http.StatusForbidden, err.Error(), w)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+// mayCall reports whether a caller with the role may call the route
+func mayCall(role, route string) bool {
+	for _, allowed := range routeRoles[route] {
+		if allowed == roleAny || allowed == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/mux"
+)
+
+// apiRouter returns the router of the whole API over the backend
+func apiRouter(db DatabaseBackend) *mux.Router {
+	return NewRouter(NewAlertApiController(NewAlertApiService(db)), NewInventoryApiController(NewInventoryApiService(db)), NewKeyApiController(NewKeyApiService(db)))
+}
+
+// authorizedRouter returns the router of the API over the backend,
+// authorizing requests with tokens of the test key set or API keys of the
+// backend
+func authorizedRouter(ks *testKeySet, db DatabaseBackend) *mux.Router {
+	router := apiRouter(db)
+	router.Use(Authorize(NewTokenVerifier(ks.URL, testIssuer, testAudience), db))
+	return router
+}
+
+// testApiKey stores an API key with the scope that expires at the given time,
+// and returns the key that clients send
+func testApiKey(t *testing.T, db DatabaseBackend, scope string, expiresAt time.Time) (*ApiKey, string) {
+	t.Helper()
+	record, secret, err := newApiKeyRecord(&ApiKey{Name: "scanner", Scope: scope, Warehouses: []string{"warehouse"}, ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatalf("error generating API key: %v", err)
+	}
+	key, err := db.NewApiKey(context.Background(), record)
+	if err != nil {
+		t.Fatalf("error storing API key: %v", err)
+	}
+	return key, formatApiKey(key.Id, secret)
+}
+
+func TestRouteRolesCoverRoutes(t *testing.T) {
+	routes := make(map[string]bool)
+	err := apiRouter(NewInMemoryBackend()).Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		routes[route.GetName()] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error walking routes: %v", err)
+	}
+	for name := range routes {
+		if _, ok := routeRoles[name]; !ok {
+			t.Errorf("route %s has no roles", name)
+		}
+	}
+	for name := range routeRoles {
+		if !routes[name] {
+			t.Errorf("roles of unknown route %s", name)
+		}
+	}
+}
+
+// These cases mirror the Istio authorization policies checked by
+// istio-auth/istio_auth_test.go
+func TestAuthorize(t *testing.T) {
+	ks := newTestKeySet(t, "")
+	defer ks.Close()
+	db := NewInMemoryBackend()
+	router := authorizedRouter(ks, db)
+	expiry := time.Now().Add(time.Hour)
+	_, readOnlyKey := testApiKey(t, db, apiKeyReadOnly, expiry)
+	_, transactionsKey := testApiKey(t, db, apiKeyTransactions, expiry)
+	_, adminKey := testApiKey(t, db, apiKeyAdmin, expiry)
+	_, expiredKey := testApiKey(t, db, apiKeyAdmin, time.Now().Add(-time.Minute))
+	revoked, revokedKey := testApiKey(t, db, apiKeyAdmin, expiry)
+	if _, err := db.RevokeApiKey(context.Background(), revoked.Id); err != nil {
+		t.Fatalf("error revoking API key: %v", err)
+	}
+	id, _, _ := parseApiKey(adminKey)
+
+	paths := []string{
+		"/api/alerts",
+		"/api/alerts/id",
+		"/api/alerts/id/acknowledge",
+		"/api/alerts/id/resolve",
+		"/api/alerts/id/snooze",
+		"/api/inventoryTransactionBatches",
+		"/api/inventoryTransactions",
+		"/api/inventoryTransactions/id",
+		"/api/items",
+		"/api/items/id",
+		"/api/items/id/archive",
+		"/api/items/id/restore",
+		"/api/items/id/inventory",
+		"/api/items/id/inventoryTransactions",
+		"/api/locations",
+		"/api/locations/id",
+		"/api/locations/id/archive",
+		"/api/locations/id/restore",
+		"/api/locations/id/inventory",
+		"/api/locations/id/inventoryTransactions",
+		"/api/transfers",
+		"/api/apiKeys",
+		"/api/apiKeys/id",
+		"/api/apiKeys/id/revoke",
+	}
+	// paths that only admins may GET
+	adminPaths := map[string]bool{
+		"/api/apiKeys":    true,
+		"/api/apiKeys/id": true,
+	}
+	// paths that workers may POST to
+	workerPaths := map[string]bool{
+		"/api/inventoryTransactions":       true,
+		"/api/inventoryTransactionBatches": true,
+		"/api/transfers":                   true,
+		"/api/alerts/id/acknowledge":       true,
+		"/api/alerts/id/resolve":           true,
+		"/api/alerts/id/snooze":            true,
+	}
+	callers := []struct {
+		desc          string
+		authorization string
+		apiKey        string
+		role          string
+	}{
+		{desc: "unauthenticated"},
+		{desc: "bad token", authorization: "Bearer badToken"},
+		{desc: "unsigned token", authorization: "Bearer " + unsignedToken(`{"sub":"user-id","role":"admin"}`)},
+		{desc: "admin", authorization: "Bearer " + testToken(t, "admin"), role: "admin"},
+		{desc: "worker", authorization: "Bearer " + testToken(t, "worker"), role: "worker"},
+		{desc: "other", authorization: "Bearer " + testToken(t, "other"), role: "other"},
+		{desc: "read-only API key", apiKey: readOnlyKey, role: "reader"},
+		{desc: "transactions API key", apiKey: transactionsKey, role: "worker"},
+		{desc: "admin API key", apiKey: adminKey, role: "admin"},
+		// An API key is verified even along with a valid token
+		{desc: "expired API key", authorization: "Bearer " + testToken(t, "admin"), apiKey: expiredKey},
+		{desc: "revoked API key", apiKey: revokedKey},
+		{desc: "API key with wrong secret", apiKey: formatApiKey(id, "wrong")},
+		{desc: "unknown API key", apiKey: formatApiKey("unknown", "secret")},
+		{desc: "malformed API key", apiKey: "secret"},
+	}
+
+	for _, c := range callers {
+		t.Run(c.desc, func(t *testing.T) {
+			for _, m := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete} {
+				for _, p := range paths {
+					// Lists of transactions are filtered by the warehouse of the caller
+					req := httptest.NewRequest(m, p+"?warehouse=warehouse", nil)
+					if c.authorization != "" {
+						req.Header.Set("Authorization", c.authorization)
+					}
+					if c.apiKey != "" {
+						req.Header.Set(apiKeyHeader, c.apiKey)
+					}
+					r := httptest.NewRecorder()
+					router.ServeHTTP(r, req)
+					if r.Result().StatusCode == http.StatusMethodNotAllowed {
+						continue
+					}
+
+					got := r.Result().StatusCode
+					switch {
+					case c.role == "":
+						if got != http.StatusUnauthorized {
+							t.Errorf("%v %v: status code: %v, want: %v", m, p, got, http.StatusUnauthorized)
+						}
+					case m == http.MethodGet && !adminPaths[p] || c.role == "admin" || (c.role == "worker" && m == http.MethodPost && workerPaths[p]):
+						if got == http.StatusUnauthorized || got == http.StatusForbidden {
+							t.Errorf("%v %v: status code: %v, want the request to be allowed", m, p, got)
+						}
+					default:
+						if got != http.StatusForbidden {
+							t.Errorf("%v %v: status code: %v, want: %v", m, p, got, http.StatusForbidden)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizePassesVerifiedPrincipal(t *testing.T) {
+	ks := newTestKeySet(t, "")
+	defer ks.Close()
+	var got *Principal
+	router := mux.NewRouter()
+	router.Methods(http.MethodPost).Path("/api/inventoryTransactions").Name("NewInventoryTransaction").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = principalFromRequest(r)
+	})
+	router.Use(Authorize(NewTokenVerifier(ks.URL, testIssuer, testAudience), NewInMemoryBackend()))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/inventoryTransactions", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "worker"))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !cmp.Equal(got, &testPrincipal) {
+		t.Errorf("principalFromRequest() = %v, want %v", got, testPrincipal)
+	}
+}
+
+func TestAuthorizeApiKey(t *testing.T) {
+	db := NewInMemoryBackend()
+	key, apiKey := testApiKey(t, db, apiKeyTransactions, time.Now().Add(time.Hour))
+	var got *Principal
+	router := mux.NewRouter()
+	router.Methods(http.MethodPost).Path("/api/inventoryTransactions").Name("NewInventoryTransaction").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = principalFromRequest(r)
+	})
+	// Without a token verifier, API keys are still verified
+	router.Use(Authorize(nil, db))
+
+	send := func() {
+		t.Helper()
+		got = nil
+		req := httptest.NewRequest(http.MethodPost, "/api/inventoryTransactions", nil)
+		req.Header.Set(apiKeyHeader, apiKey)
+		r := httptest.NewRecorder()
+		router.ServeHTTP(r, req)
+		if r.Code != http.StatusOK {
+			t.Fatalf("status code: %v, want: %v", r.Code, http.StatusOK)
+		}
+	}
+	send()
+	want := &Principal{UserId: key.Id, Role: roleWorker, Warehouses: []string{"warehouse"}}
+	if !cmp.Equal(got, want) {
+		t.Errorf("principalFromRequest() = %v, want %v", got, want)
+	}
+	used, err := db.GetApiKey(context.Background(), key.Id)
+	if err != nil || used.LastUsedAt.IsZero() {
+		t.Fatalf("GetApiKey() = %v, %v, want the key last used now", used, err)
+	}
+
+	// The use is recorded again only once it is older than the resolution
+	send()
+	if again, err := db.GetApiKey(context.Background(), key.Id); err != nil || !again.LastUsedAt.Equal(used.LastUsedAt) {
+		t.Errorf("GetApiKey() = %v, %v, want the key last used at %v", again, err, used.LastUsedAt)
+	}
+}
+
+func TestAuthorizeWithoutVerifier(t *testing.T) {
+	var got *Principal
+	router := mux.NewRouter()
+	router.Methods(http.MethodPost).Path("/api/items").Name("NewItem").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = principalFromRequest(r)
+	})
+	router.Use(Authorize(nil, NewInMemoryBackend()))
+
+	// The Istio ingress gateway authorized the token
+	req := httptest.NewRequest(http.MethodPost, "/api/items", nil)
+	req.Header.Set("Authorization", "Bearer "+unsignedToken(`{"sub":"user-id","role":"admin"}`))
+	r := httptest.NewRecorder()
+	router.ServeHTTP(r, req)
+
+	if want := (&Principal{UserId: "user-id", Role: roleAdmin}); r.Code != http.StatusOK || !cmp.Equal(got, want) {
+		t.Errorf("status code: %v, principalFromRequest() = %v, want: %v, %v", r.Code, got, http.StatusOK, want)
+	}
+}
+
+func TestAuthorizeKeySetUnavailable(t *testing.T) {
+	ks := newTestKeySet(t, "")
+	router := authorizedRouter(ks, NewInMemoryBackend())
+	ks.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "admin"))
+	r := httptest.NewRecorder()
+	router.ServeHTTP(r, req)
+
+	decodeProblem(t, r, http.StatusServiceUnavailable)
+}
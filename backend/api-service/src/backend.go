@@ -16,12 +16,51 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
 var supportedTransactionActions = []string{"ADD", "REMOVE", "RECOUNT"}
 
+const (
+	negativeStockAllow  = "ALLOW"
+	negativeStockReject = "REJECT"
+	negativeStockAlert  = "ALERT"
+)
+
+// supportedNegativeStockPolicies is ordered from least to most strict
+var supportedNegativeStockPolicies = []string{negativeStockAllow, negativeStockAlert, negativeStockReject}
+
+const (
+	alertOpen         = "OPEN"
+	alertAcknowledged = "ACKNOWLEDGED"
+	alertResolved     = "RESOLVED"
+)
+
+var supportedAlertStates = []string{alertOpen, alertAcknowledged, alertResolved}
+
+const (
+	alertKindNegativeStock = "NEGATIVE_STOCK"
+	alertKindReorder       = "REORDER"
+)
+
+// negativeStockPolicy returns the policy for inventory of the item at the
+// location, which is the strictest of the item and location policies.
+func negativeStockPolicy(item *Item, location *Location) string {
+	policy := negativeStockAllow
+	for _, p := range supportedNegativeStockPolicies {
+		if p == item.NegativeStockPolicy || p == location.NegativeStockPolicy {
+			policy = p
+		}
+	}
+	return policy
+}
+
 // applyTransaction applies the transaction to the inventory
 func (i *Inventory) applyTransaction(txn *InventoryTransaction) error {
 	switch txn.Action {
@@ -32,38 +71,495 @@ func (i *Inventory) applyTransaction(txn *InventoryTransaction) error {
 	case "RECOUNT":
 		i.Count = txn.Count
 	default:
-		return fmt.Errorf("unknown action: %s", txn.Action)
+		return &InvalidInventoryTransaction{field: "action", reason: fmt.Sprintf("unknown action %q", txn.Action)}
 	}
 	txn.Timestamp = time.Now()
 	i.LastUpdated = txn.Timestamp
 	return nil
 }
 
+// applyTransactionWithPolicy applies the transaction to the inventory unless
+// doing so takes the count below zero and the negative stock policy rejects
+// it, in which case the inventory is left unchanged. If the policy asks for
+// an alert, the alert is returned for the caller to store along with the
+// inventory.
+func (i *Inventory) applyTransactionWithPolicy(txn *InventoryTransaction, policy string) ([]*Alert, error) {
+	updated := *i
+	if err := updated.applyTransaction(txn); err != nil {
+		return nil, err
+	}
+	// Only transactions that lower the count can violate the policy
+	if updated.Count >= 0 || updated.Count >= i.Count {
+		*i = updated
+		return nil, nil
+	}
+
+	switch policy {
+	case negativeStockReject:
+		return nil, &InsufficientInventory{itemId: i.ItemId, locationId: i.LocationId, count: updated.Count}
+	case negativeStockAlert:
+		*i = updated
+		text := fmt.Sprintf("Inventory of item %q at location %q is negative: %d", i.ItemId, i.LocationId, i.Count)
+		return []*Alert{raisedAlert(alertKindNegativeStock, txn, txn.LocationId, text)}, nil
+	default:
+		*i = updated
+		return nil, nil
+	}
+}
+
+// maxBatchSize is the most inventory transactions that may be applied in one
+// batch. Each transaction writes its inventory, itself and up to three alerts:
+// negative stock, and reorder at its location and across all locations. At
+// five writes each, a batch stays well within the limit of 500 writes per
+// Firestore transaction.
+const maxBatchSize = 80
+
+type inventoryKey struct {
+	itemId     string
+	locationId string
+}
+
+// transactionBatch applies a batch of inventory transactions in order to
+// copies of the inventories they affect, so that the caller can store all of
+// the results, or none of them if any transaction fails. The caller loads the
+// items, locations and inventories of the batch, and the total inventory of
+// every item with a reorder point.
+type transactionBatch struct {
+	items       map[string]*Item
+	locations   map[string]*Location
+	inventories map[inventoryKey]*Inventory
+	totals      map[string]int64
+	alerts      []*Alert
+}
+
+func newTransactionBatch() *transactionBatch {
+	return &transactionBatch{
+		items:       make(map[string]*Item),
+		locations:   make(map[string]*Location),
+		inventories: make(map[inventoryKey]*Inventory),
+		totals:      make(map[string]int64),
+	}
+}
+
+// apply applies the transaction at the given index of the batch
+func (b *transactionBatch) apply(index int, txn *InventoryTransaction) error {
+	item, ok := b.items[txn.ItemId]
+	if !ok {
+		return &BatchEntryFailed{index: index, err: ItemNotFound(txn.ItemId)}
+	}
+	location, ok := b.locations[txn.LocationId]
+	if !ok {
+		return &BatchEntryFailed{index: index, err: LocationNotFound(txn.LocationId)}
+	}
+	key := inventoryKey{txn.ItemId, txn.LocationId}
+	inv, ok := b.inventories[key]
+	if !ok {
+		inv = &Inventory{ItemId: txn.ItemId, LocationId: txn.LocationId}
+		b.inventories[key] = inv
+	}
+
+	if err := checkNotArchived(txn, item, location, inv); err != nil {
+		return &BatchEntryFailed{index: index, err: err}
+	}
+	txn.Warehouse = location.Warehouse
+	before, total := inv.Count, b.totals[txn.ItemId]
+	alerts, err := inv.applyTransactionWithPolicy(txn, negativeStockPolicy(item, location))
+	if err != nil {
+		return &BatchEntryFailed{index: index, err: err}
+	}
+	b.totals[txn.ItemId] = total - before + inv.Count
+	alerts = append(alerts, item.reorderAlerts(txn, before, inv.Count, total, b.totals[txn.ItemId])...)
+
+	// Merge alerts raised more than once within the batch
+	for _, alert := range alerts {
+		duplicate := false
+		for _, existing := range b.alerts {
+			if alert.duplicates(existing) {
+				existing.merge(alert)
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			b.alerts = append(b.alerts, alert)
+		}
+	}
+	return nil
+}
+
+// idempotencyRecord remembers the inventory transaction created by a request
+// with an idempotency key, so that retries of the request return it again
+type idempotencyRecord struct {
+	Key           string
+	CreatedBy     string
+	TransactionId string
+	Timestamp     time.Time
+}
+
+// idempotencyId returns the id of the record of an idempotency key. Keys are
+// chosen by clients, so they are scoped to the user that created them.
+func idempotencyId(createdBy, key string) string {
+	sum := sha256.Sum256([]byte(createdBy + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// archivedInventory is the last state of an inventory that was removed along
+// with its item or location, kept as a record of the stock that was written off
+type archivedInventory struct {
+	Inventory
+	ArchivedAt time.Time
+}
+
+// versionMatches returns whether an update that expects the given version of
+// a resource may replace the stored version. Expecting version 0 matches any
+// version.
+func versionMatches(stored, expected int64) bool {
+	return expected == 0 || stored == expected
+}
+
+// versioned is a resource whose version is incremented on every update
+type versioned interface {
+	setVersion(version int64)
+}
+
+func (item *Item) setVersion(version int64) {
+	item.Version = version
+}
+
+func (location *Location) setVersion(version int64) {
+	location.Version = version
+}
+
+// archivable is a versioned resource that is archived instead of deleted, so
+// that the inventory transactions referring to it stay resolvable
+type archivable interface {
+	versioned
+	isArchived() bool
+	setArchived(archived bool, at time.Time)
+}
+
+func (item *Item) isArchived() bool {
+	return item.Archived
+}
+
+// setArchived archives the item as of the given time, or restores it
+func (item *Item) setArchived(archived bool, at time.Time) {
+	item.Archived = archived
+	item.ArchivedAt = time.Time{}
+	if archived {
+		item.ArchivedAt = at
+	}
+}
+
+func (location *Location) isArchived() bool {
+	return location.Archived
+}
+
+// setArchived archives the location as of the given time, or restores it
+func (location *Location) setArchived(archived bool, at time.Time) {
+	location.Archived = archived
+	location.ArchivedAt = time.Time{}
+	if archived {
+		location.ArchivedAt = at
+	}
+}
+
+// checkNotArchived rejects transactions that would increase the inventory of
+// an archived item or at an archived location, whatever their action. Other
+// transactions may still clear out the inventory left behind.
+func checkNotArchived(txn *InventoryTransaction, item *Item, location *Location, inv *Inventory) error {
+	updated := *inv
+	if err := updated.applyTransaction(txn); err != nil || updated.Count <= inv.Count {
+		return nil
+	}
+	if item.Archived {
+		return ItemArchived(txn.ItemId)
+	}
+	if location.Archived {
+		return LocationArchived(txn.LocationId)
+	}
+	return nil
+}
+
+// reorderAlerts returns an alert for every reorder point of the item that the
+// transaction took the inventory below, either at the location of the
+// transaction or in total across all locations.
+func (item *Item) reorderAlerts(txn *InventoryTransaction, locationBefore, locationAfter, totalBefore, totalAfter int64) []*Alert {
+	var alerts []*Alert
+	if point := item.LocationReorderPoints[txn.LocationId]; crossedBelow(locationBefore, locationAfter, point) {
+		text := fmt.Sprintf("Inventory of item %q at location %q is below its reorder point of %d: %d", txn.ItemId, txn.LocationId, point, locationAfter)
+		alerts = append(alerts, raisedAlert(alertKindReorder, txn, txn.LocationId, text))
+	}
+	if crossedBelow(totalBefore, totalAfter, item.ReorderPoint) {
+		text := fmt.Sprintf("Total inventory of item %q is below its reorder point of %d: %d", txn.ItemId, item.ReorderPoint, totalAfter)
+		alerts = append(alerts, raisedAlert(alertKindReorder, txn, "", text))
+	}
+	return alerts
+}
+
+// raisedAlert returns a new open alert raised by the inventory transaction
+func raisedAlert(kind string, txn *InventoryTransaction, locationId, text string) *Alert {
+	return &Alert{
+		ItemId:        txn.ItemId,
+		LocationId:    locationId,
+		TransactionId: txn.Id,
+		Kind:          kind,
+		Text:          text,
+		Timestamp:     txn.Timestamp,
+		State:         alertOpen,
+		Occurrences:   1,
+	}
+}
+
+// duplicates returns whether the raised alert is another occurrence of the
+// existing alert, which is the case while the existing alert is unresolved.
+func (a *Alert) duplicates(existing *Alert) bool {
+	return a.Kind != "" && a.Kind == existing.Kind && a.ItemId == existing.ItemId &&
+		a.LocationId == existing.LocationId && existing.State != alertResolved
+}
+
+// merge records other occurrences of the alert
+func (a *Alert) merge(occurrence *Alert) {
+	a.Occurrences += occurrence.Occurrences
+	a.TransactionId = occurrence.TransactionId
+	a.Text = occurrence.Text
+	a.Timestamp = occurrence.Timestamp
+}
+
+func (a *Alert) acknowledge(actor string) error {
+	if a.State != alertOpen {
+		return &AlertStateConflict{id: a.Id, state: a.State, action: "acknowledge"}
+	}
+	a.State = alertAcknowledged
+	a.AcknowledgedBy = actor
+	a.AcknowledgedAt = time.Now()
+	return nil
+}
+
+func (a *Alert) resolve(actor string) error {
+	if a.State == alertResolved {
+		return &AlertStateConflict{id: a.Id, state: a.State, action: "resolve"}
+	}
+	a.State = alertResolved
+	a.ResolvedBy = actor
+	a.ResolvedAt = time.Now()
+	return nil
+}
+
+func (a *Alert) snooze(until time.Time, actor string) error {
+	if a.State == alertResolved {
+		return &AlertStateConflict{id: a.Id, state: a.State, action: "snooze"}
+	}
+	a.SnoozedBy = actor
+	a.SnoozedUntil = until
+	return nil
+}
+
+// AlertFilter selects the alerts listed by ListAlerts
+type AlertFilter struct {
+	// State selects only alerts in this state, if set
+	State string
+	// IncludeSnoozed also selects alerts that are snoozed until a later time
+	IncludeSnoozed bool
+}
+
+// matches returns whether the filter selects the alert at time now
+func (f AlertFilter) matches(a *Alert, now time.Time) bool {
+	if f.State != "" && a.State != f.State {
+		return false
+	}
+	return f.IncludeSnoozed || !a.SnoozedUntil.After(now)
+}
+
+// crossedBelow returns whether a count went from at or above the reorder
+// point to below it. A reorder point of 0 or less is disabled.
+func crossedBelow(before, after, point int64) bool {
+	return point > 0 && before >= point && after < point
+}
+
+// legs returns the REMOVE and ADD inventory transactions that make up the
+// transfer, linked together by the transfer id.
+func (t *Transfer) legs(source, destination *Location) (*InventoryTransaction, *InventoryTransaction) {
+	out := &InventoryTransaction{
+		ItemId:     t.ItemId,
+		LocationId: t.SourceLocationId,
+		Action:     "REMOVE",
+		Count:      t.Count,
+		Note:       t.Note,
+		CreatedBy:  t.CreatedBy,
+		TransferId: t.Id,
+		Warehouse:  source.Warehouse,
+	}
+	in := &InventoryTransaction{
+		ItemId:     t.ItemId,
+		LocationId: t.DestinationLocationId,
+		Action:     "ADD",
+		Count:      t.Count,
+		Note:       t.Note,
+		CreatedBy:  t.CreatedBy,
+		TransferId: t.Id,
+		Warehouse:  destination.Warehouse,
+	}
+	return out, in
+}
+
+// PageRequest selects a page of a list. Lists are ordered by a key that is
+// unique within the list, and the page token encodes the last key of the
+// previous page.
+type PageRequest struct {
+	// Size is the maximum number of results, or 0 for all remaining results
+	Size int
+	// Token is the next page token returned with the previous page, if any
+	Token string
+}
+
+// pageToken returns the token of the page that starts after key
+func pageToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// after returns the key that the requested page starts after
+func (p PageRequest) after() (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(p.Token)
+	if err != nil || p.Token != "" && len(key) == 0 {
+		return "", &InvalidPageToken{token: p.Token}
+	}
+	return string(key), nil
+}
+
+// bounds returns the start and end of the requested page of n results sorted
+// by key, along with the token of the next page if there are more results.
+func (p PageRequest) bounds(n int, descending bool, key func(i int) string) (start, end int, next string, err error) {
+	after, err := p.after()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if descending && after != "" {
+		start = sort.Search(n, func(i int) bool { return key(i) < after })
+	} else {
+		start = sort.Search(n, func(i int) bool { return key(i) > after })
+	}
+	if p.Size > 0 && start+p.Size < n {
+		end = start + p.Size
+		return start, end, pageToken(key(end - 1)), nil
+	}
+	return start, n, "", nil
+}
+
+// timeKeyLayout formats times in UTC with a fixed width, so that time keys
+// sort in the same order as the times and ids they are made of
+const timeKeyLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// timeKey returns the page key of a result ordered by time, then by id
+func timeKey(t time.Time, id string) string {
+	return t.UTC().Format(timeKeyLayout) + " " + id
+}
+
+// parseTimeKey returns the time and id of a page key returned by timeKey
+func parseTimeKey(key string) (time.Time, string, error) {
+	i := strings.Index(key, " ")
+	if i < 0 {
+		return time.Time{}, "", fmt.Errorf("missing id in time key %q", key)
+	}
+	t, err := time.Parse(timeKeyLayout, key[:i])
+	return t, key[i+1:], err
+}
+
+// TransactionFilter selects the inventory transactions listed by the
+// List*InventoryTransactions methods, which order them by timestamp
+type TransactionFilter struct {
+	// Start selects transactions at or after this time, if set
+	Start time.Time
+	// End selects transactions before this time, if set
+	End time.Time
+	// Action, CreatedBy and Warehouse select transactions with these values, if set
+	Action    string
+	CreatedBy string
+	Warehouse string
+	// Warehouses selects transactions at any of these warehouses, if set
+	Warehouses []string
+	// Descending lists the newest transactions first
+	Descending bool
+}
+
+// matches returns whether the filter selects the transaction
+func (f TransactionFilter) matches(txn *InventoryTransaction) bool {
+	return (f.Start.IsZero() || !txn.Timestamp.Before(f.Start)) &&
+		(f.End.IsZero() || txn.Timestamp.Before(f.End)) &&
+		(f.Action == "" || txn.Action == f.Action) &&
+		(f.CreatedBy == "" || txn.CreatedBy == f.CreatedBy) &&
+		(f.Warehouse == "" || txn.Warehouse == f.Warehouse) &&
+		(len(f.Warehouses) == 0 || isSupported(txn.Warehouse, f.Warehouses))
+}
+
 type DatabaseBackend interface {
+	AcknowledgeAlert(ctx context.Context, id, actor string) (*Alert, error)
+	ResolveAlert(ctx context.Context, id, actor string) (*Alert, error)
+	SnoozeAlert(ctx context.Context, id string, until time.Time, actor string) (*Alert, error)
+
 	DeleteAlert(ctx context.Context, id string) error
-	DeleteItem(ctx context.Context, id string) error
-	DeleteLocation(ctx context.Context, id string) error
+	// DeleteItem and DeleteLocation fail with *ResourceInUse while the item or
+	// location has nonzero inventory, unless archiveInventory is set, in which
+	// case its inventory is zeroed and archived in the same transaction
+	DeleteItem(ctx context.Context, id string, archiveInventory bool) error
+	DeleteLocation(ctx context.Context, id string, archiveInventory bool) error
 
+	// API keys are returned without the hash of their secret
+	GetApiKey(ctx context.Context, id string) (*ApiKey, error)
 	GetInventoryTransaction(ctx context.Context, id string) (*InventoryTransaction, error)
 	GetItem(ctx context.Context, id string) (*Item, error)
 	GetLocation(ctx context.Context, id string) (*Location, error)
 
-	ListAlerts(ctx context.Context) ([]*Alert, error)
-	ListItems(ctx context.Context) ([]*Item, error)
-	ListItemInventory(ctx context.Context, itemId string) ([]*Inventory, error)
-	ListItemInventoryTransactions(ctx context.Context, itemId string) ([]*InventoryTransaction, error)
-	ListInventoryTransactions(ctx context.Context) ([]*InventoryTransaction, error)
-	ListLocations(ctx context.Context) ([]*Location, error)
-	ListLocationInventory(ctx context.Context, locationId string) ([]*Inventory, error)
-	ListLocationInventoryTransactions(ctx context.Context, locationId string) ([]*InventoryTransaction, error)
+	// List methods return a page of results, along with the token of the
+	// next page if there are more results. Archived items and locations are
+	// only listed if includeArchived is set.
+	ListAlerts(ctx context.Context, filter AlertFilter, page PageRequest) ([]*Alert, string, error)
+	ListApiKeys(ctx context.Context, page PageRequest) ([]*ApiKey, string, error)
+	ListItems(ctx context.Context, includeArchived bool, page PageRequest) ([]*Item, string, error)
+	ListItemInventory(ctx context.Context, itemId string, page PageRequest) ([]*Inventory, string, error)
+	ListItemInventoryTransactions(ctx context.Context, itemId string, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error)
+	ListInventoryTransactions(ctx context.Context, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error)
+	ListLocations(ctx context.Context, includeArchived bool, page PageRequest) ([]*Location, string, error)
+	ListLocationInventory(ctx context.Context, locationId string, page PageRequest) ([]*Inventory, string, error)
+	ListLocationInventoryTransactions(ctx context.Context, locationId string, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error)
 
 	NewAlert(ctx context.Context, alert *Alert) (*Alert, error)
+	NewApiKey(ctx context.Context, key *apiKeyRecord) (*ApiKey, error)
 	NewItem(ctx context.Context, item *Item) (*Item, error)
-	NewInventoryTransaction(ctx context.Context, transaction *InventoryTransaction) (*InventoryTransaction, error)
+	// NewInventoryTransaction returns the transaction previously created with
+	// the same non-empty idempotency key by the same user, if any, instead of
+	// applying the transaction again. Transactions that add inventory of an
+	// archived item or at an archived location fail with *ResourceArchived, as
+	// do transfers of an archived item or to an archived location.
+	NewInventoryTransaction(ctx context.Context, transaction *InventoryTransaction, idempotencyKey string) (*InventoryTransaction, error)
+	// NewInventoryTransactionBatch applies the transactions in order, all of
+	// them or none, failing with *BatchEntryFailed if any of them fails
+	NewInventoryTransactionBatch(ctx context.Context, transactions []*InventoryTransaction) ([]*InventoryTransaction, error)
 	NewLocation(ctx context.Context, location *Location) (*Location, error)
+	NewTransfer(ctx context.Context, transfer *Transfer) (*Transfer, error)
+
+	// Update methods fail with *PreconditionFailed unless the stored version
+	// matches the given version, and increment the version on success
+	UpdateItem(ctx context.Context, item *Item, version int64) (*Item, error)
+	UpdateLocation(ctx context.Context, location *Location, version int64) (*Location, error)
+
+	// Archive and Restore methods increment the version of the item or
+	// location unless it already is in the requested state
+	ArchiveItem(ctx context.Context, id string) (*Item, error)
+	ArchiveLocation(ctx context.Context, id string) (*Location, error)
+	RestoreItem(ctx context.Context, id string) (*Item, error)
+	RestoreLocation(ctx context.Context, id string) (*Location, error)
+
+	// RevokeApiKey stops the key from working, and keeps the time it was
+	// first revoked if it already was
+	RevokeApiKey(ctx context.Context, id string) (*ApiKey, error)
 
-	UpdateItem(ctx context.Context, item *Item) (*Item, error)
-	UpdateLocation(ctx context.Context, location *Location) (*Location, error)
+	// Close releases the connections of the backend, which is unusable after
+	Close() error
 
 	lookupInventory(ctx context.Context, itemID, locationID string) (*Inventory, error)
+	// lookupApiKey returns the key along with the hash of its secret
+	lookupApiKey(ctx context.Context, id string) (*apiKeyRecord, error)
+	// recordApiKeyUse sets the time the key was last used
+	recordApiKeyUse(ctx context.Context, id string, at time.Time) error
 }
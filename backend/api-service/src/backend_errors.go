@@ -13,7 +13,58 @@
 // limitations under the License.
 package service
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrorKind classifies errors by what went wrong, which decides how they are
+// reported to API clients
+type ErrorKind int
+
+const (
+	// KindInternal errors are failures of the API service itself
+	KindInternal ErrorKind = iota
+	// KindNotFound errors name a resource that does not exist
+	KindNotFound
+	// KindConflict errors request a change the current state of a resource
+	// does not allow, or that a concurrent change got in the way of
+	KindConflict
+	// KindInvalid errors are requests that can never succeed as they are
+	KindInvalid
+	// KindPreconditionFailed errors expect a version of a resource that has
+	// since changed
+	KindPreconditionFailed
+	// KindUnavailable errors are failures of the database that may go away
+	// if the request is retried later
+	KindUnavailable
+	// KindForbidden errors are requests the caller may not make
+	KindForbidden
+	// KindUnauthenticated errors are requests whose credentials do not
+	// identify a caller
+	KindUnauthenticated
+)
+
+// KindOf returns the kind of the error or of the first error it wraps that has
+// one. Errors of the database are classified by the backend that returned
+// them, and other errors are internal.
+func KindOf(err error) ErrorKind {
+	var kinded interface{ Kind() ErrorKind }
+	if errors.As(err, &kinded) {
+		return kinded.Kind()
+	}
+	if kind, ok := firestoreErrorKind(err); ok {
+		return kind
+	}
+	if kind, ok := sqlErrorKind(err); ok {
+		return kind
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return KindUnavailable
+	}
+	return KindInternal
+}
 
 type ResourceNotFound struct {
 	collection string
@@ -24,6 +75,10 @@ func (e ResourceNotFound) Error() string {
 	return fmt.Sprintf("resource %q not found in collection %q", e.id, e.collection)
 }
 
+func (e ResourceNotFound) Kind() ErrorKind {
+	return KindNotFound
+}
+
 func ItemNotFound(id string) *ResourceNotFound {
 	return &ResourceNotFound{collection: "items", id: id}
 }
@@ -40,6 +95,10 @@ func AlertNotFound(id string) *ResourceNotFound {
 	return &ResourceNotFound{collection: "alerts", id: id}
 }
 
+func ApiKeyNotFound(id string) *ResourceNotFound {
+	return &ResourceNotFound{collection: "apiKeys", id: id}
+}
+
 type ResourceConflict struct {
 	collection string
 	id         string
@@ -48,3 +107,166 @@ type ResourceConflict struct {
 func (e ResourceConflict) Error() string {
 	return fmt.Sprintf("concurrent transaction ongoing conflicting with resource %q in collection %q", e.id, e.collection)
 }
+
+func (e ResourceConflict) Kind() ErrorKind {
+	return KindConflict
+}
+
+type ResourceInUse struct {
+	collection  string
+	id          string
+	inventories int
+}
+
+func (e ResourceInUse) Error() string {
+	return fmt.Sprintf("resource %q in collection %q still has nonzero inventory in %d inventories, move it first or delete with cascade=archive", e.id, e.collection, e.inventories)
+}
+
+func (e ResourceInUse) Kind() ErrorKind {
+	return KindConflict
+}
+
+func ItemInUse(id string, inventories int) *ResourceInUse {
+	return &ResourceInUse{collection: "items", id: id, inventories: inventories}
+}
+
+func LocationInUse(id string, inventories int) *ResourceInUse {
+	return &ResourceInUse{collection: "locations", id: id, inventories: inventories}
+}
+
+type TooManyInventories struct {
+	collection  string
+	id          string
+	inventories int
+	max         int
+}
+
+func (e TooManyInventories) Error() string {
+	return fmt.Sprintf("resource %q in collection %q has %d inventories, more than the %d that can be deleted along with it, archive it instead", e.id, e.collection, e.inventories, e.max)
+}
+
+func (e TooManyInventories) Kind() ErrorKind {
+	return KindConflict
+}
+
+type ResourceArchived struct {
+	collection string
+	id         string
+}
+
+func (e ResourceArchived) Error() string {
+	return fmt.Sprintf("resource %q in collection %q is archived and does not accept new inventory, restore it first", e.id, e.collection)
+}
+
+func (e ResourceArchived) Kind() ErrorKind {
+	return KindConflict
+}
+
+func ItemArchived(id string) *ResourceArchived {
+	return &ResourceArchived{collection: "items", id: id}
+}
+
+func LocationArchived(id string) *ResourceArchived {
+	return &ResourceArchived{collection: "locations", id: id}
+}
+
+type InsufficientInventory struct {
+	itemId     string
+	locationId string
+	count      int64
+}
+
+func (e InsufficientInventory) Error() string {
+	return fmt.Sprintf("insufficient inventory of item %q at location %q: transaction would leave a count of %d", e.itemId, e.locationId, e.count)
+}
+
+func (e InsufficientInventory) Kind() ErrorKind {
+	return KindConflict
+}
+
+type AlertStateConflict struct {
+	id     string
+	state  string
+	action string
+}
+
+func (e AlertStateConflict) Error() string {
+	return fmt.Sprintf("cannot %s alert %q in state %s", e.action, e.id, e.state)
+}
+
+func (e AlertStateConflict) Kind() ErrorKind {
+	return KindConflict
+}
+
+type InvalidPageToken struct {
+	token string
+}
+
+func (e InvalidPageToken) Error() string {
+	return fmt.Sprintf("invalid page token %q", e.token)
+}
+
+func (e InvalidPageToken) Kind() ErrorKind {
+	return KindInvalid
+}
+
+type PreconditionFailed struct {
+	collection string
+	id         string
+	version    int64
+}
+
+func (e PreconditionFailed) Error() string {
+	return fmt.Sprintf("resource %q in collection %q has changed since version %d", e.id, e.collection, e.version)
+}
+
+func (e PreconditionFailed) Kind() ErrorKind {
+	return KindPreconditionFailed
+}
+
+func ItemPreconditionFailed(id string, version int64) *PreconditionFailed {
+	return &PreconditionFailed{collection: "items", id: id, version: version}
+}
+
+func LocationPreconditionFailed(id string, version int64) *PreconditionFailed {
+	return &PreconditionFailed{collection: "locations", id: id, version: version}
+}
+
+type InvalidInventoryTransaction struct {
+	field  string
+	reason string
+}
+
+func (e InvalidInventoryTransaction) Error() string {
+	return fmt.Sprintf("invalid inventory transaction %s: %s", e.field, e.reason)
+}
+
+func (e InvalidInventoryTransaction) Kind() ErrorKind {
+	return KindInvalid
+}
+
+// BatchEntryFailed is of the kind of the error of the entry
+type BatchEntryFailed struct {
+	index int
+	err   error
+}
+
+func (e BatchEntryFailed) Error() string {
+	return fmt.Sprintf("inventory transaction %d of the batch: %v", e.index, e.err)
+}
+
+func (e BatchEntryFailed) Unwrap() error {
+	return e.err
+}
+
+type BatchTooLarge struct {
+	size int
+}
+
+func (e BatchTooLarge) Error() string {
+	return fmt.Sprintf("batch of %d inventory transactions is larger than the limit of %d, split it into smaller batches", e.size, maxBatchSize)
+}
+
+func (e BatchTooLarge) Kind() ErrorKind {
+	return KindInvalid
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sqliteError has the result code of an error of the SQLite driver
+type sqliteError int
+
+func (e sqliteError) Error() string { return fmt.Sprintf("sqlite error %d", int(e)) }
+func (e sqliteError) Code() int     { return int(e) }
+
+var errorKindCases = []struct {
+	desc string
+	err  error
+	want ErrorKind
+}{
+	{desc: "item not found", err: ItemNotFound("item-id"), want: KindNotFound},
+	{desc: "location not found", err: LocationNotFound("location-id"), want: KindNotFound},
+	{desc: "transaction not found", err: InventoryTransactionNotFound("txn-id"), want: KindNotFound},
+	{desc: "alert not found", err: AlertNotFound("alert-id"), want: KindNotFound},
+	{desc: "resource conflict", err: &ResourceConflict{collection: "idempotencyRecords", id: "id"}, want: KindConflict},
+	{desc: "item in use", err: ItemInUse("item-id", 1), want: KindConflict},
+	{desc: "location archived", err: LocationArchived("location-id"), want: KindConflict},
+	{desc: "insufficient inventory", err: &InsufficientInventory{itemId: "item-id", locationId: "location-id", count: -1}, want: KindConflict},
+	{desc: "alert state conflict", err: &AlertStateConflict{id: "alert-id", state: alertResolved, action: "snooze"}, want: KindConflict},
+	{desc: "invalid page token", err: &InvalidPageToken{token: "token"}, want: KindInvalid},
+	{desc: "batch too large", err: &BatchTooLarge{size: maxBatchSize + 1}, want: KindInvalid},
+	{desc: "invalid inventory transaction", err: (&Inventory{}).applyTransaction(&InventoryTransaction{Action: "STEAL"}), want: KindInvalid},
+	{desc: "precondition failed", err: ItemPreconditionFailed("item-id", 1), want: KindPreconditionFailed},
+	{desc: "warehouse forbidden", err: &WarehouseForbidden{userId: "user-id", warehouse: "north"}, want: KindForbidden},
+	{desc: "invalid token", err: &InvalidToken{reason: "expired"}, want: KindUnauthenticated},
+	{desc: "invalid API key", err: &InvalidApiKey{reason: "revoked"}, want: KindUnauthenticated},
+	{desc: "batch entry failed", err: &BatchEntryFailed{index: 1, err: ItemArchived("item-id")}, want: KindConflict},
+	{desc: "wrapped", err: fmt.Errorf("transaction failed: %w", LocationNotFound("location-id")), want: KindNotFound},
+	{desc: "firestore not found", err: status.Error(codes.NotFound, "missing"), want: KindNotFound},
+	{desc: "firestore aborted", err: status.Error(codes.Aborted, "contention"), want: KindConflict},
+	{desc: "firestore invalid argument", err: status.Error(codes.InvalidArgument, "too large"), want: KindInvalid},
+	{desc: "firestore unavailable", err: status.Error(codes.Unavailable, "unavailable"), want: KindUnavailable},
+	{desc: "firestore deadline exceeded", err: status.Error(codes.DeadlineExceeded, "deadline"), want: KindUnavailable},
+	{desc: "firestore failed precondition", err: status.Error(codes.FailedPrecondition, "missing index"), want: KindInternal},
+	{desc: "postgres serialization failure", err: &pq.Error{Code: "40001"}, want: KindConflict},
+	{desc: "postgres unique violation", err: &pq.Error{Code: "23505"}, want: KindConflict},
+	{desc: "postgres connection failure", err: &pq.Error{Code: "08006"}, want: KindUnavailable},
+	{desc: "postgres syntax error", err: &pq.Error{Code: "42601"}, want: KindInternal},
+	{desc: "sqlite busy", err: sqliteError(5), want: KindUnavailable},
+	{desc: "sqlite busy snapshot", err: sqliteError(5 | 2<<8), want: KindUnavailable},
+	{desc: "sqlite constraint", err: sqliteError(19), want: KindInternal},
+	{desc: "bad connection", err: driver.ErrBadConn, want: KindUnavailable},
+	{desc: "connection done", err: sql.ErrConnDone, want: KindUnavailable},
+	{desc: "deadline exceeded", err: context.DeadlineExceeded, want: KindUnavailable},
+	{desc: "other", err: errors.New("boom"), want: KindInternal},
+}
+
+func TestKindOf(t *testing.T) {
+	for _, tc := range errorKindCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := KindOf(tc.err); got != tc.want {
+				t.Errorf("KindOf(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+// failingBackend is a backend whose GetItem returns err
+type failingBackend struct {
+	*InMemoryBackend
+	err error
+}
+
+func (fb failingBackend) GetItem(ctx context.Context, id string) (*Item, error) {
+	return nil, fb.err
+}
+
+func TestControllerErrorStatus(t *testing.T) {
+	statuses := map[ErrorKind]int{
+		KindInternal:           http.StatusInternalServerError,
+		KindNotFound:           http.StatusNotFound,
+		KindConflict:           http.StatusConflict,
+		KindInvalid:            http.StatusBadRequest,
+		KindPreconditionFailed: http.StatusPreconditionFailed,
+		KindUnavailable:        http.StatusServiceUnavailable,
+		KindForbidden:          http.StatusForbidden,
+		KindUnauthenticated:    http.StatusUnauthorized,
+	}
+	for _, tc := range errorKindCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			db := failingBackend{NewInMemoryBackend(), tc.err}
+			router := NewRouter(NewInventoryApiController(NewInventoryApiService(db)))
+
+			r := httptest.NewRecorder()
+			router.ServeHTTP(r, httptest.NewRequest(http.MethodGet, "/api/items/item-id", nil))
+
+			want := statuses[tc.want]
+			problem := decodeProblem(t, r, want)
+			if wantType := problemTypeBase + problemTypes[want].name; problem.Type != wantType {
+				t.Errorf("GET /api/items/item-id failing with %v: problem type = %q, want %q", tc.err, problem.Type, wantType)
+			}
+		})
+	}
+}
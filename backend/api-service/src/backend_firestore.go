@@ -15,17 +15,25 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 const (
 	alertsCollection                = "alerts"
+	apiKeysCollection               = "apiKeys"
+	archivedInventoriesCollection   = "archivedInventories"
+	idempotencyRecordsCollection    = "idempotencyRecords"
 	inventoriesCollection           = "inventories"
 	inventoryTransactionsCollection = "inventoryTransactions"
 	itemsCollection                 = "items"
@@ -35,40 +43,144 @@ const (
 // FirestoreBackend is a backend that talks to Firestore and implements the
 // Backend interface
 type FirestoreBackend struct {
-	projectID string
+	// client is shared by all operations, and safe for concurrent use
+	client *firestore.Client
 }
 
-func NewFirestoreBackend(projectID string) *FirestoreBackend {
-	return &FirestoreBackend{projectID}
+// NewFirestoreBackend connects to Firestore in the given project. Close the
+// backend to release its connections.
+func NewFirestoreBackend(ctx context.Context, projectID string) (*FirestoreBackend, error) {
+	ctx, s := startSpan(ctx, "firestore.NewClient", trace.SpanKindClient)
+	client, err := firestore.NewClient(ctx, projectID)
+	endSpan(s, err)
+	if err != nil {
+		return nil, fmt.Errorf("error creating firestore client: %v", err)
+	}
+	return &FirestoreBackend{client: client}, nil
 }
 
-func (fb *FirestoreBackend) NewClient(ctx context.Context) (*firestore.Client, error) {
-	// Return a new client
-	client, err := firestore.NewClient(ctx, fb.projectID)
-	if err != nil {
-		log.Printf("error creating firestore client: %v", err)
+// Close closes the connections to Firestore
+func (fb *FirestoreBackend) Close() error {
+	return fb.client.Close()
+}
+
+// errTransactionRetried ends the span of a transaction attempt that failed to
+// commit and was retried
+var errTransactionRetried = errors.New("transaction aborted, retrying")
+
+// runTransaction runs f in a transaction, and records each attempt at it in a
+// span that lasts until the attempt commits or is retried
+func (fb *FirestoreBackend) runTransaction(ctx context.Context, f func(context.Context, *firestore.Transaction) error) error {
+	var attempt trace.Span
+	attempts := 0
+	err := fb.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if attempt != nil {
+			endSpan(attempt, errTransactionRetried)
+		}
+		attempts++
+		ctx, attempt = startSpan(ctx, "firestore.transaction", trace.SpanKindClient)
+		attempt.SetAttributes(attribute.Int("firestore.transaction.attempt", attempts))
+		return f(ctx, tx)
+	})
+	if attempt != nil {
+		endSpan(attempt, err)
 	}
-	return client, err
+	return err
 }
 
-func (fb *FirestoreBackend) deleteDoc(ctx context.Context, path, id string) error {
-	client, err := fb.NewClient(ctx)
-	if err != nil {
-		return err
+// firestoreErrorKind classifies the errors Firestore returns, which carry a
+// gRPC status code
+func firestoreErrorKind(err error) (ErrorKind, bool) {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &grpcErr) {
+		return KindInternal, false
+	}
+	switch grpcErr.GRPCStatus().Code() {
+	case codes.NotFound:
+		return KindNotFound, true
+	case codes.AlreadyExists, codes.Aborted:
+		return KindConflict, true
+	case codes.InvalidArgument, codes.OutOfRange:
+		return KindInvalid, true
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return KindUnavailable, true
+	default:
+		return KindInternal, true
 	}
-	_, err = client.Collection(path).Doc(id).Delete(ctx, firestore.Exists)
+}
+
+func (fb *FirestoreBackend) deleteDoc(ctx context.Context, path, id string) error {
+	client := fb.client
+	_, err := client.Collection(path).Doc(id).Delete(ctx, firestore.Exists)
 	if err != nil && status.Code(err) == codes.NotFound {
 		return &ResourceNotFound{collection: path, id: id}
 	}
 	return err
 }
 
-func (fb *FirestoreBackend) DeleteItem(ctx context.Context, id string) error {
-	return fb.deleteDoc(ctx, itemsCollection, id)
+// maxDeletedInventories is the most inventories an item or location may have
+// to be deleted. Each inventory is archived and deleted, and the item or
+// location deleted, within the limit of 500 writes per Firestore transaction.
+const maxDeletedInventories = (500 - 1) / 2
+
+// deleteWithInventory deletes the item or location document with the given id
+// along with its inventories, the ones whose field matches the id, in one
+// transaction. Nonzero inventories are archived if archiveInventory is set,
+// and block the delete otherwise. Items and locations with more than
+// maxDeletedInventories inventories cannot be deleted.
+func (fb *FirestoreBackend) deleteWithInventory(ctx context.Context, path, field, id string, archiveInventory bool) error {
+	client := fb.client
+	dref := client.Collection(path).Doc(id)
+	q := client.Collection(inventoriesCollection).Where(field, "==", id)
+	return fb.runTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if _, err := tx.Get(dref); err != nil {
+			if status.Code(err) == codes.NotFound {
+				return &ResourceNotFound{collection: path, id: id}
+			}
+			return err
+		}
+		docs, err := tx.Documents(q).GetAll()
+		if err != nil {
+			return err
+		}
+		invs := make([]*Inventory, len(docs))
+		nonzero := 0
+		for i, doc := range docs {
+			invs[i] = &Inventory{}
+			if err := doc.DataTo(invs[i]); err != nil {
+				return err
+			}
+			if invs[i].Count != 0 {
+				nonzero++
+			}
+		}
+		if nonzero > 0 && !archiveInventory {
+			return &ResourceInUse{collection: path, id: id, inventories: nonzero}
+		}
+		if len(docs) > maxDeletedInventories {
+			return &TooManyInventories{collection: path, id: id, inventories: len(docs), max: maxDeletedInventories}
+		}
+
+		now := time.Now()
+		for i, doc := range docs {
+			archived := &archivedInventory{Inventory: *invs[i], ArchivedAt: now}
+			if err := tx.Create(client.Collection(archivedInventoriesCollection).NewDoc(), archived); err != nil {
+				return err
+			}
+			if err := tx.Delete(doc.Ref); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(dref)
+	})
 }
 
-func (fb *FirestoreBackend) DeleteLocation(ctx context.Context, id string) error {
-	return fb.deleteDoc(ctx, locationsCollection, id)
+func (fb *FirestoreBackend) DeleteItem(ctx context.Context, id string, archiveInventory bool) error {
+	return fb.deleteWithInventory(ctx, itemsCollection, "ItemId", id, archiveInventory)
+}
+
+func (fb *FirestoreBackend) DeleteLocation(ctx context.Context, id string, archiveInventory bool) error {
+	return fb.deleteWithInventory(ctx, locationsCollection, "LocationId", id, archiveInventory)
 }
 
 func (fb *FirestoreBackend) DeleteAlert(ctx context.Context, id string) error {
@@ -76,18 +188,25 @@ func (fb *FirestoreBackend) DeleteAlert(ctx context.Context, id string) error {
 }
 
 func (fb *FirestoreBackend) getDoc(ctx context.Context, path, id string) (*firestore.DocumentSnapshot, error) {
-	client, err := fb.NewClient(ctx)
-	if err != nil {
-		return nil, err
-	}
-
+	client := fb.client
+	ctx, s := startSpan(ctx, "firestore.get", trace.SpanKindClient)
+	s.SetAttributes(attribute.String("firestore.collection", path))
 	doc, err := client.Collection(path).Doc(id).Get(ctx)
+	endSpan(s, err)
 	if err != nil && status.Code(err) == codes.NotFound {
 		return nil, &ResourceNotFound{collection: path, id: id}
 	}
 	return doc, err
 }
 
+func (fb *FirestoreBackend) GetApiKey(ctx context.Context, id string) (*ApiKey, error) {
+	record, err := fb.lookupApiKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &record.ApiKey, nil
+}
+
 func (fb *FirestoreBackend) GetInventoryTransaction(ctx context.Context, id string) (*InventoryTransaction, error) {
 	doc, err := fb.getDoc(ctx, inventoryTransactionsCollection, id)
 	if err != nil {
@@ -104,7 +223,7 @@ func (fb *FirestoreBackend) GetItem(ctx context.Context, id string) (*Item, erro
 		return nil, err
 	}
 	item := &Item{}
-	err = doc.DataTo(item)
+	err = dataToVersioned(doc, item)
 	return item, err
 }
 
@@ -114,293 +233,915 @@ func (fb *FirestoreBackend) GetLocation(ctx context.Context, id string) (*Locati
 		return nil, err
 	}
 	location := &Location{}
-	err = doc.DataTo(location)
+	err = dataToVersioned(doc, location)
 	return location, err
 }
 
+// maxInValues is the most values an "in" query filter may compare a field to
+const maxInValues = 10
+
 type queryFilter struct {
 	path  string
 	op    string
 	value interface{}
 }
 
-func (fb *FirestoreBackend) listDocs(ctx context.Context, path string, filters ...queryFilter) ([]*firestore.DocumentSnapshot, error) {
-	client, err := fb.NewClient(ctx)
+// docOrder orders listed documents by a time field, if set, then by document ID
+type docOrder struct {
+	timePath   string
+	descending bool
+}
+
+// listDocs returns the requested page of documents that match the filters,
+// in the given order, along with the token of the next page if there are more
+// documents
+func (fb *FirestoreBackend) listDocs(ctx context.Context, path string, order docOrder, page PageRequest, filters ...queryFilter) ([]*firestore.DocumentSnapshot, string, error) {
+	return fb.listMatchingDocs(ctx, path, order, page, nil, filters...)
+}
+
+// listMatchingDocs is like listDocs, but only lists the documents that keep,
+// if set, returns true for, which tests what the query cannot. It fetches
+// documents until it has a full page of the ones kept, so that pages are only
+// shorter than requested when there are no more documents.
+func (fb *FirestoreBackend) listMatchingDocs(ctx context.Context, path string, order docOrder, page PageRequest, keep func(*firestore.DocumentSnapshot) (bool, error), filters ...queryFilter) ([]*firestore.DocumentSnapshot, string, error) {
+	after, err := page.after()
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	client := fb.client
+	dir := firestore.Asc
+	if order.descending {
+		dir = firestore.Desc
 	}
-
 	q := client.Collection(path).Query
 	for _, f := range filters {
 		q = q.Where(f.path, f.op, f.value)
 	}
+	if order.timePath != "" {
+		q = q.OrderBy(order.timePath, dir)
+	}
+	q = q.OrderBy(firestore.DocumentID, dir)
+	if after != "" {
+		if order.timePath == "" {
+			q = q.StartAfter(after)
+		} else {
+			t, id, err := parseTimeKey(after)
+			if err != nil {
+				return nil, "", &InvalidPageToken{token: page.Token}
+			}
+			q = q.StartAfter(t, id)
+		}
+	}
+	if page.Size > 0 {
+		// Fetch one more document to tell whether there is a next page
+		q = q.Limit(page.Size + 1)
+	}
+
+	var docs []*firestore.DocumentSnapshot
+	for {
+		fetched, err := q.Documents(ctx).GetAll()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, doc := range fetched {
+			if keep != nil {
+				if ok, err := keep(doc); err != nil {
+					return nil, "", err
+				} else if !ok {
+					continue
+				}
+			}
+			docs = append(docs, doc)
+		}
+		if page.Size == 0 || len(docs) > page.Size || len(fetched) <= page.Size {
+			break
+		}
+		q = q.StartAfter(fetched[len(fetched)-1])
+	}
+	if page.Size == 0 || len(docs) <= page.Size {
+		return docs, "", nil
+	}
+	docs = docs[:page.Size]
+	last := docs[len(docs)-1]
+	if order.timePath == "" {
+		return docs, pageToken(last.Ref.ID), nil
+	}
+	t, err := last.DataAt(order.timePath)
+	if err != nil {
+		return nil, "", err
+	}
+	return docs, pageToken(timeKey(t.(time.Time), last.Ref.ID)), nil
+}
 
-	return q.Documents(ctx).GetAll()
+func (fb *FirestoreBackend) ListApiKeys(ctx context.Context, page PageRequest) ([]*ApiKey, string, error) {
+	docs, next, err := fb.listDocs(ctx, apiKeysCollection, docOrder{}, page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys := make([]*ApiKey, 0, len(docs))
+	for _, doc := range docs {
+		record := &apiKeyRecord{}
+		if err = doc.DataTo(record); err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, &record.ApiKey)
+	}
+	return keys, next, nil
 }
 
-func (fb *FirestoreBackend) ListItems(ctx context.Context) ([]*Item, error) {
-	docs, err := fb.listDocs(ctx, itemsCollection)
+// ListItems queries the Archived field, which items stored before they could be
+// archived lack until MigrateArchivedFields stores it.
+func (fb *FirestoreBackend) ListItems(ctx context.Context, includeArchived bool, page PageRequest) ([]*Item, string, error) {
+	docs, next, err := fb.listDocs(ctx, itemsCollection, docOrder{}, page, unarchivedFilters(includeArchived)...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	items := make([]*Item, 0, len(docs))
 	for _, doc := range docs {
 		item := &Item{}
-		if err = doc.DataTo(item); err != nil {
-			return nil, err
+		if err = dataToVersioned(doc, item); err != nil {
+			return nil, "", err
 		}
 		items = append(items, item)
 	}
-	return items, nil
+	return items, next, nil
 }
 
-func (fb *FirestoreBackend) ListLocations(ctx context.Context) ([]*Location, error) {
-	docs, err := fb.listDocs(ctx, locationsCollection)
+// ListLocations queries the Archived field, like ListItems.
+func (fb *FirestoreBackend) ListLocations(ctx context.Context, includeArchived bool, page PageRequest) ([]*Location, string, error) {
+	docs, next, err := fb.listDocs(ctx, locationsCollection, docOrder{}, page, unarchivedFilters(includeArchived)...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	locations := make([]*Location, 0, len(docs))
 	for _, doc := range docs {
 		location := &Location{}
-		if err = doc.DataTo(location); err != nil {
-			return nil, err
+		if err = dataToVersioned(doc, location); err != nil {
+			return nil, "", err
 		}
 		locations = append(locations, location)
 	}
-	return locations, nil
+	return locations, next, nil
 }
 
-func (fb *FirestoreBackend) ListAlerts(ctx context.Context) ([]*Alert, error) {
-	docs, err := fb.listDocs(ctx, alertsCollection)
+// ListAlerts filters out snoozed alerts as it fetches them, since the query
+// cannot compare their snooze time to now without ordering alerts by it.
+func (fb *FirestoreBackend) ListAlerts(ctx context.Context, filter AlertFilter, page PageRequest) ([]*Alert, string, error) {
+	var filters []queryFilter
+	if filter.State != "" {
+		filters = append(filters, queryFilter{"State", "==", filter.State})
+	}
+	now := time.Now()
+	keep := func(doc *firestore.DocumentSnapshot) (bool, error) {
+		alert := &Alert{}
+		if err := doc.DataTo(alert); err != nil {
+			return false, err
+		}
+		return filter.matches(alert, now), nil
+	}
+	docs, next, err := fb.listMatchingDocs(ctx, alertsCollection, docOrder{}, page, keep, filters...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	alerts := make([]*Alert, 0, len(docs))
 	for _, doc := range docs {
 		alert := &Alert{}
 		if err = doc.DataTo(alert); err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		alerts = append(alerts, alert)
 	}
-	return alerts, nil
+	return alerts, next, nil
+}
+
+// unarchivedFilters returns the filters that leave out archived items or
+// locations, unless they are included
+func unarchivedFilters(includeArchived bool) []queryFilter {
+	if includeArchived {
+		return nil
+	}
+	return []queryFilter{{"Archived", "==", false}}
 }
 
-func (fb *FirestoreBackend) listInventories(ctx context.Context, filters ...queryFilter) ([]*Inventory, error) {
-	docs, err := fb.listDocs(ctx, inventoriesCollection, filters...)
+func (fb *FirestoreBackend) listInventories(ctx context.Context, page PageRequest, filters ...queryFilter) ([]*Inventory, string, error) {
+	docs, next, err := fb.listDocs(ctx, inventoriesCollection, docOrder{}, page, filters...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	invs := make([]*Inventory, 0, len(docs))
 	for _, doc := range docs {
 		inv := &Inventory{}
 		if err = doc.DataTo(inv); err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		invs = append(invs, inv)
 	}
-	return invs, nil
+	return invs, next, nil
 }
 
-func (fb *FirestoreBackend) listInventoryTransactions(ctx context.Context, filters ...queryFilter) ([]*InventoryTransaction, error) {
-	docs, err := fb.listDocs(ctx, inventoryTransactionsCollection, filters...)
+func (fb *FirestoreBackend) listInventoryTransactions(ctx context.Context, filter TransactionFilter, page PageRequest, filters ...queryFilter) ([]*InventoryTransaction, string, error) {
+	if !filter.Start.IsZero() {
+		filters = append(filters, queryFilter{"Timestamp", ">=", filter.Start})
+	}
+	if !filter.End.IsZero() {
+		filters = append(filters, queryFilter{"Timestamp", "<", filter.End})
+	}
+	if filter.Action != "" {
+		filters = append(filters, queryFilter{"Action", "==", filter.Action})
+	}
+	if filter.CreatedBy != "" {
+		filters = append(filters, queryFilter{"CreatedBy", "==", filter.CreatedBy})
+	}
+	if filter.Warehouse != "" {
+		filters = append(filters, queryFilter{"Warehouse", "==", filter.Warehouse})
+	}
+	// Queries can only select up to maxInValues warehouses, so transactions
+	// at more are selected as they are listed
+	var keep func(*firestore.DocumentSnapshot) (bool, error)
+	switch {
+	case len(filter.Warehouses) > maxInValues:
+		keep = func(doc *firestore.DocumentSnapshot) (bool, error) {
+			warehouse, err := doc.DataAt("Warehouse")
+			if err != nil {
+				return false, nil
+			}
+			w, _ := warehouse.(string)
+			return isSupported(w, filter.Warehouses), nil
+		}
+	case len(filter.Warehouses) > 0:
+		filters = append(filters, queryFilter{"Warehouse", "in", filter.Warehouses})
+	}
+	order := docOrder{timePath: "Timestamp", descending: filter.Descending}
+	docs, next, err := fb.listMatchingDocs(ctx, inventoryTransactionsCollection, order, page, keep, filters...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	txns := make([]*InventoryTransaction, 0, len(docs))
 	for _, doc := range docs {
 		txn := &InventoryTransaction{}
 		if err = doc.DataTo(txn); err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		txns = append(txns, txn)
 	}
-	return txns, nil
+	return txns, next, nil
 }
 
-func (fb *FirestoreBackend) ListItemInventory(ctx context.Context, itemId string) ([]*Inventory, error) {
-	return fb.listInventories(ctx, queryFilter{"ItemId", "==", itemId})
+func (fb *FirestoreBackend) ListItemInventory(ctx context.Context, itemId string, page PageRequest) ([]*Inventory, string, error) {
+	return fb.listInventories(ctx, page, queryFilter{"ItemId", "==", itemId})
 }
 
-func (fb *FirestoreBackend) ListLocationInventory(ctx context.Context, locationId string) ([]*Inventory, error) {
-	return fb.listInventories(ctx, queryFilter{"LocationId", "==", locationId})
+func (fb *FirestoreBackend) ListLocationInventory(ctx context.Context, locationId string, page PageRequest) ([]*Inventory, string, error) {
+	return fb.listInventories(ctx, page, queryFilter{"LocationId", "==", locationId})
 }
 
-func (fb *FirestoreBackend) ListInventoryTransactions(ctx context.Context) ([]*InventoryTransaction, error) {
-	return fb.listInventoryTransactions(ctx)
+func (fb *FirestoreBackend) ListInventoryTransactions(ctx context.Context, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error) {
+	return fb.listInventoryTransactions(ctx, filter, page)
 }
 
-func (fb *FirestoreBackend) ListItemInventoryTransactions(ctx context.Context, itemId string) ([]*InventoryTransaction, error) {
-	return fb.listInventoryTransactions(ctx, queryFilter{"ItemId", "==", itemId})
+func (fb *FirestoreBackend) ListItemInventoryTransactions(ctx context.Context, itemId string, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error) {
+	return fb.listInventoryTransactions(ctx, filter, page, queryFilter{"ItemId", "==", itemId})
 }
 
-func (fb *FirestoreBackend) ListLocationInventoryTransactions(ctx context.Context, locationId string) ([]*InventoryTransaction, error) {
-	return fb.listInventoryTransactions(ctx, queryFilter{"LocationId", "==", locationId})
+func (fb *FirestoreBackend) ListLocationInventoryTransactions(ctx context.Context, locationId string, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error) {
+	return fb.listInventoryTransactions(ctx, filter, page, queryFilter{"LocationId", "==", locationId})
 }
 
-func (fb *FirestoreBackend) NewInventoryTransaction(ctx context.Context, invTxn *InventoryTransaction) (*InventoryTransaction, error) {
-	itemId, locId := invTxn.ItemId, invTxn.LocationId
-	if _, err := fb.getDoc(ctx, itemsCollection, itemId); err != nil {
+// inventoryId returns the document ID of the inventory of the item at the
+// location, so that transactions find or create it without querying
+func inventoryId(itemId, locId string) string {
+	sum := sha256.Sum256([]byte(itemId + "\x00" + locId))
+	return hex.EncodeToString(sum[:])
+}
+
+// inventoryRef returns a reference to the inventory document of the item at
+// the location, which may not exist yet
+func inventoryRef(client *firestore.Client, itemId, locId string) *firestore.DocumentRef {
+	return client.Collection(inventoriesCollection).Doc(inventoryId(itemId, locId))
+}
+
+// getInventory reads the inventory document of the item at the location
+// within the transaction, or returns an empty inventory if it does not exist
+// yet, which the transaction creates when it stores the inventory
+func getInventory(tx *firestore.Transaction, client *firestore.Client, itemId, locId string) (*Inventory, error) {
+	doc, err := tx.Get(inventoryRef(client, itemId, locId))
+	if status.Code(err) == codes.NotFound {
+		return &Inventory{ItemId: itemId, LocationId: locId, LastUpdated: time.Now()}, nil
+	}
+	if err != nil {
 		return nil, err
 	}
-	if _, err := fb.getDoc(ctx, locationsCollection, locId); err != nil {
+	inv := &Inventory{}
+	if err = doc.DataTo(inv); err != nil {
 		return nil, err
 	}
-	client, err := fb.NewClient(ctx)
+	return inv, nil
+}
+
+// getItemAndLocation reads the item and location within the transaction
+func getItemAndLocation(tx *firestore.Transaction, client *firestore.Client, itemId, locId string) (*Item, *Location, error) {
+	item, err := getItem(tx, client, itemId)
+	if err != nil {
+		return nil, nil, err
+	}
+	location, err := getLocation(tx, client, locId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return item, location, nil
+}
+
+// getItem reads the item within the transaction
+func getItem(tx *firestore.Transaction, client *firestore.Client, itemId string) (*Item, error) {
+	item := &Item{}
+	doc, err := tx.Get(client.Collection(itemsCollection).Doc(itemId))
+	if status.Code(err) == codes.NotFound {
+		return nil, ItemNotFound(itemId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = dataToVersioned(doc, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// getLocation reads the location within the transaction
+func getLocation(tx *firestore.Transaction, client *firestore.Client, locId string) (*Location, error) {
+	location := &Location{}
+	doc, err := tx.Get(client.Collection(locationsCollection).Doc(locId))
+	if status.Code(err) == codes.NotFound {
+		return nil, LocationNotFound(locId)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if err = dataToVersioned(doc, location); err != nil {
+		return nil, err
+	}
+	return location, nil
+}
 
-	// Lookup the inventory id
-	invs := client.Collection(inventoriesCollection)
-	var invRef *firestore.DocumentRef
+// getItemCount returns the total inventory of the item across all locations
+func getItemCount(tx *firestore.Transaction, client *firestore.Client, itemId string) (int64, error) {
+	q := client.Collection(inventoriesCollection).Where("ItemId", "==", itemId)
+	docs, err := tx.Documents(q).GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("error querying inventories collection: %v", err)
+	}
+	var count int64
+	for _, doc := range docs {
+		inv := &Inventory{}
+		if err = doc.DataTo(inv); err != nil {
+			return 0, err
+		}
+		count += inv.Count
+	}
+	return count, nil
+}
 
-	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		// Find the inventory
-		q := invs.Where("ItemId", "==", itemId).Where("LocationId", "==", locId)
+// raiseAlerts stores the alerts within the transaction, merging each one into
+// an unresolved alert it duplicates. As it reads before writing, it must be
+// called before any other writes in the transaction.
+func raiseAlerts(tx *firestore.Transaction, client *firestore.Client, alerts []*Alert) error {
+	refs := make([]*firestore.DocumentRef, len(alerts))
+	stored := make([]*Alert, len(alerts))
+	for i, alert := range alerts {
+		q := client.Collection(alertsCollection).
+			Where("ItemId", "==", alert.ItemId).
+			Where("LocationId", "==", alert.LocationId).
+			Where("Kind", "==", alert.Kind)
 		docs, err := tx.Documents(q).GetAll()
 		if err != nil {
-			return fmt.Errorf("error querying inventories collection: %v", err)
+			return err
 		}
-
-		if len(docs) > 2 {
-			log.Panicf("Found multiple inventories for item %q and location %q", invTxn.ItemId, invTxn.LocationId)
+		for _, doc := range docs {
+			existing := &Alert{}
+			if err := doc.DataTo(existing); err != nil {
+				return err
+			}
+			if alert.duplicates(existing) {
+				existing.merge(alert)
+				refs[i], stored[i] = doc.Ref, existing
+				break
+			}
+		}
+		if refs[i] == nil {
+			refs[i] = client.Collection(alertsCollection).NewDoc()
+			alert.Id = refs[i].ID
+			stored[i] = alert
 		}
+	}
 
-		if len(docs) == 0 {
-			inv := &Inventory{ItemId: itemId, LocationId: locId, LastUpdated: time.Now()}
-			invRef = invs.NewDoc()
-			return tx.Create(invRef, inv)
+	for i, ref := range refs {
+		if err := tx.Set(ref, stored[i]); err != nil {
+			return err
 		}
-		invRef = docs[0].Ref
-		return nil
-	})
-	if err != nil {
-		return nil, err
 	}
+	return nil
+}
+
+func (fb *FirestoreBackend) NewInventoryTransaction(ctx context.Context, invTxn *InventoryTransaction, idempotencyKey string) (*InventoryTransaction, error) {
+	itemId, locId := invTxn.ItemId, invTxn.LocationId
+	client := fb.client
+	invRef := inventoryRef(client, itemId, locId)
+	recordRef := client.Collection(idempotencyRecordsCollection).Doc(idempotencyId(invTxn.CreatedBy, idempotencyKey))
+	var replayed *InventoryTransaction
+	err := fb.runTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Return the transaction created by an earlier request with the same key
+		replayed = nil
+		if idempotencyKey != "" {
+			txn, err := getReplayedTransaction(tx, client, recordRef)
+			if err != nil || txn != nil {
+				replayed = txn
+				return err
+			}
+		}
 
-	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		// Fetch the inventory
-		inv := Inventory{}
-		doc, err := tx.Get(invRef)
+		// Fetch the inventory along with the item and location settings that apply to it
+		item, location, err := getItemAndLocation(tx, client, itemId, locId)
 		if err != nil {
 			return err
 		}
-		if err = doc.DataTo(&inv); err != nil {
+		inv, err := getInventory(tx, client, itemId, locId)
+		if err != nil {
+			return err
+		}
+		if err := checkNotArchived(invTxn, item, location, inv); err != nil {
 			return err
 		}
+		var total int64
+		if item.ReorderPoint > 0 {
+			if total, err = getItemCount(tx, client, itemId); err != nil {
+				return err
+			}
+		}
 
 		// Update the inventory
-		if err := inv.applyTransaction(invTxn); err != nil {
+		dref := client.Collection(inventoryTransactionsCollection).NewDoc()
+		invTxn.Id = dref.ID
+		invTxn.Warehouse = location.Warehouse
+		before := inv.Count
+		alerts, err := inv.applyTransactionWithPolicy(invTxn, negativeStockPolicy(item, location))
+		if err != nil {
+			return err
+		}
+		alerts = append(alerts, item.reorderAlerts(invTxn, before, inv.Count, total, total-before+inv.Count)...)
+		if err := raiseAlerts(tx, client, alerts); err != nil {
 			return err
 		}
 		if err := tx.Set(invRef, inv); err != nil {
 			return err
 		}
+		if idempotencyKey != "" {
+			record := &idempotencyRecord{
+				Key:           idempotencyKey,
+				CreatedBy:     invTxn.CreatedBy,
+				TransactionId: invTxn.Id,
+				Timestamp:     invTxn.Timestamp,
+			}
+			if err := tx.Create(recordRef, record); err != nil {
+				return err
+			}
+		}
 
 		// Create the inventory transaction itself
-		dref := client.Collection(inventoryTransactionsCollection).NewDoc()
-		invTxn.Id = dref.ID
 		return tx.Create(dref, invTxn)
 	})
 
+	if replayed != nil {
+		return replayed, err
+	}
 	return invTxn, err
 }
 
-func (fb *FirestoreBackend) NewItem(ctx context.Context, item *Item) (*Item, error) {
-	client, err := fb.NewClient(ctx)
+// getReplayedTransaction returns the inventory transaction recorded with an
+// idempotency key, or nil if the key has not been used yet
+func getReplayedTransaction(tx *firestore.Transaction, client *firestore.Client, recordRef *firestore.DocumentRef) (*InventoryTransaction, error) {
+	doc, err := tx.Get(recordRef)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &idempotencyRecord{}
+	if err := doc.DataTo(record); err != nil {
+		return nil, err
+	}
+	doc, err = tx.Get(client.Collection(inventoryTransactionsCollection).Doc(record.TransactionId))
+	if err != nil {
+		return nil, err
+	}
+	txn := &InventoryTransaction{}
+	if err := doc.DataTo(txn); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+func (fb *FirestoreBackend) NewInventoryTransactionBatch(ctx context.Context, inputTxns []*InventoryTransaction) ([]*InventoryTransaction, error) {
+	if len(inputTxns) > maxBatchSize {
+		return nil, &BatchTooLarge{size: len(inputTxns)}
+	}
+	client := fb.client
+	var transactions []*InventoryTransaction
+	err := fb.runTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Fetch everything the batch needs; Firestore requires all reads before any writes
+		batch := newTransactionBatch()
+		for _, txn := range inputTxns {
+			// Missing items and locations fail the transactions that refer
+			// to them when the batch applies
+			if _, ok := batch.items[txn.ItemId]; !ok {
+				item, err := getItem(tx, client, txn.ItemId)
+				if err == nil {
+					batch.items[txn.ItemId] = item
+					if item.ReorderPoint > 0 {
+						if batch.totals[txn.ItemId], err = getItemCount(tx, client, txn.ItemId); err != nil {
+							return err
+						}
+					}
+				} else if KindOf(err) != KindNotFound {
+					return err
+				}
+			}
+			if _, ok := batch.locations[txn.LocationId]; !ok {
+				location, err := getLocation(tx, client, txn.LocationId)
+				if err == nil {
+					batch.locations[txn.LocationId] = location
+				} else if KindOf(err) != KindNotFound {
+					return err
+				}
+			}
+			key := inventoryKey{txn.ItemId, txn.LocationId}
+			if _, ok := batch.inventories[key]; !ok {
+				inv, err := getInventory(tx, client, txn.ItemId, txn.LocationId)
+				if err != nil {
+					return err
+				}
+				batch.inventories[key] = inv
+			}
+		}
+
+		// Apply the transactions in order
+		refs := make([]*firestore.DocumentRef, len(inputTxns))
+		transactions = make([]*InventoryTransaction, len(inputTxns))
+		for i, inputTxn := range inputTxns {
+			refs[i] = client.Collection(inventoryTransactionsCollection).NewDoc()
+			transactions[i] = &InventoryTransaction{}
+			*transactions[i] = *inputTxn
+			transactions[i].Id = refs[i].ID
+			if err := batch.apply(i, transactions[i]); err != nil {
+				return err
+			}
+		}
+
+		// Store the results
+		if err := raiseAlerts(tx, client, batch.alerts); err != nil {
+			return err
+		}
+		for key, inv := range batch.inventories {
+			if err := tx.Set(inventoryRef(client, key.itemId, key.locationId), inv); err != nil {
+				return err
+			}
+		}
+		for i, ref := range refs {
+			if err := tx.Create(ref, transactions[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return transactions, nil
+}
+
+func (fb *FirestoreBackend) NewTransfer(ctx context.Context, transfer *Transfer) (*Transfer, error) {
+	itemId, srcId, dstId := transfer.ItemId, transfer.SourceLocationId, transfer.DestinationLocationId
+	client := fb.client
+	srcRef, dstRef := inventoryRef(client, itemId, srcId), inventoryRef(client, itemId, dstId)
+	transfer.Id = uuid.New().String()
+	err := fb.runTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Fetch both inventories, the item and source location settings that
+		// apply, and both warehouses; Firestore requires all reads before any writes
+		item, source, err := getItemAndLocation(tx, client, itemId, srcId)
+		if err != nil {
+			return err
+		}
+		destination, err := getLocation(tx, client, dstId)
+		if err != nil {
+			return err
+		}
+		srcInv, err := getInventory(tx, client, itemId, srcId)
+		if err != nil {
+			return err
+		}
+		dstInv, err := getInventory(tx, client, itemId, dstId)
+		if err != nil {
+			return err
+		}
+
+		// Update the inventories
+		out, in := transfer.legs(source, destination)
+		if err := checkNotArchived(in, item, destination, dstInv); err != nil {
+			return err
+		}
+		outRef := client.Collection(inventoryTransactionsCollection).NewDoc()
+		inRef := client.Collection(inventoryTransactionsCollection).NewDoc()
+		out.Id, in.Id = outRef.ID, inRef.ID
+		before := srcInv.Count
+		alerts, err := srcInv.applyTransactionWithPolicy(out, negativeStockPolicy(item, source))
+		if err != nil {
+			return err
+		}
+		// The total inventory of the item is unchanged by a transfer
+		alerts = append(alerts, item.reorderAlerts(out, before, srcInv.Count, 0, 0)...)
+		if err := dstInv.applyTransaction(in); err != nil {
+			return err
+		}
+		if err := raiseAlerts(tx, client, alerts); err != nil {
+			return err
+		}
+		if err := tx.Set(srcRef, srcInv); err != nil {
+			return err
+		}
+		if err := tx.Set(dstRef, dstInv); err != nil {
+			return err
+		}
+
+		// Create both legs of the transfer
+		if err := tx.Create(outRef, out); err != nil {
+			return err
+		}
+		if err := tx.Create(inRef, in); err != nil {
+			return err
+		}
+		transfer.Timestamp = out.Timestamp
+		transfer.Transactions = []InventoryTransaction{*out, *in}
+		return nil
+	})
+
+	return transfer, err
+}
+
+func (fb *FirestoreBackend) NewItem(ctx context.Context, item *Item) (*Item, error) {
+	client := fb.client
 	dref := client.Collection(itemsCollection).NewDoc()
 	item.Id = dref.ID
-	_, err = dref.Create(ctx, item)
+	item.Version = 1
+	item.setArchived(false, time.Time{})
+	_, err := dref.Create(ctx, item)
 	return item, err
 }
 
 func (fb *FirestoreBackend) NewLocation(ctx context.Context, location *Location) (*Location, error) {
-	client, err := fb.NewClient(ctx)
-	if err != nil {
-		return nil, err
-	}
+	client := fb.client
 	dref := client.Collection(locationsCollection).NewDoc()
 	location.Id = dref.ID
-	_, err = dref.Create(ctx, location)
+	location.Version = 1
+	location.setArchived(false, time.Time{})
+	_, err := dref.Create(ctx, location)
 	return location, err
 }
 
 func (fb *FirestoreBackend) NewAlert(ctx context.Context, alert *Alert) (*Alert, error) {
-	client, err := fb.NewClient(ctx)
-	if err != nil {
-		return nil, err
-	}
+	client := fb.client
 	dref := client.Collection(alertsCollection).NewDoc()
 	alert.Id = dref.ID
-	_, err = dref.Create(ctx, alert)
+	_, err := dref.Create(ctx, alert)
 	return alert, err
 }
 
-func (fb *FirestoreBackend) update(ctx context.Context, path, id string, value interface{}) error {
-	client, err := fb.NewClient(ctx)
+func (fb *FirestoreBackend) NewApiKey(ctx context.Context, key *apiKeyRecord) (*ApiKey, error) {
+	client := fb.client
+	dref := client.Collection(apiKeysCollection).NewDoc()
+	record := *key
+	record.Id = dref.ID
+	if _, err := dref.Create(ctx, &record); err != nil {
+		return nil, err
+	}
+	return &record.ApiKey, nil
+}
+
+// storedVersion returns the version of the document. Documents stored before
+// they were versioned have no Version field, and are at their first version.
+func storedVersion(doc *firestore.DocumentSnapshot) int64 {
+	v, err := doc.DataAt("Version")
 	if err != nil {
+		return 1
+	}
+	version, _ := v.(int64)
+	return version
+}
+
+// dataToVersioned reads the item or location document into value, at its
+// stored version
+func dataToVersioned(doc *firestore.DocumentSnapshot, value versioned) error {
+	if err := doc.DataTo(value); err != nil {
 		return err
 	}
+	value.setVersion(storedVersion(doc))
+	return nil
+}
+
+// update replaces the document with the given id by value, unless the stored
+// version does not match the given version, and increments the version. The
+// archived state of the document is kept as stored.
+func (fb *FirestoreBackend) update(ctx context.Context, path, id string, version int64, value archivable) error {
+	client := fb.client
 	dref := client.Collection(path).Doc(id)
-	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		if _, err := tx.Get(dref); err != nil {
+	err := fb.runTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(dref)
+		if err != nil {
 			if status.Code(err) == codes.NotFound {
 				return &ResourceNotFound{collection: path, id: id}
 			}
 			return err
 		}
+		stored := storedVersion(doc)
+		if !versionMatches(stored, version) {
+			return &PreconditionFailed{collection: path, id: id, version: version}
+		}
+		var archived bool
+		var archivedAt time.Time
+		if v, err := doc.DataAt("Archived"); err == nil {
+			archived, _ = v.(bool)
+		}
+		if v, err := doc.DataAt("ArchivedAt"); err == nil {
+			archivedAt, _ = v.(time.Time)
+		}
+		value.setArchived(archived, archivedAt)
+		value.setVersion(stored + 1)
 		return tx.Set(dref, value)
 	})
 
 	return err
 }
 
-func (fb *FirestoreBackend) UpdateItem(ctx context.Context, item *Item) (*Item, error) {
-	err := fb.update(ctx, itemsCollection, item.Id, item)
+// setArchived reads the document with the given id into value, then archives
+// or restores it and increments its version unless it already is in the
+// requested state
+func (fb *FirestoreBackend) setArchived(ctx context.Context, path, id string, archived bool, value archivable) error {
+	client := fb.client
+	dref := client.Collection(path).Doc(id)
+	return fb.runTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(dref)
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				return &ResourceNotFound{collection: path, id: id}
+			}
+			return err
+		}
+		if err := dataToVersioned(doc, value); err != nil {
+			return err
+		}
+		if value.isArchived() == archived {
+			return nil
+		}
+		value.setArchived(archived, time.Now())
+		value.setVersion(storedVersion(doc) + 1)
+		return tx.Set(dref, value)
+	})
+}
+
+// updateAlert changes the alert with the given id in a transaction
+func (fb *FirestoreBackend) updateAlert(ctx context.Context, id string, change func(*Alert) error) (*Alert, error) {
+	client := fb.client
+	dref := client.Collection(alertsCollection).Doc(id)
+	alert := &Alert{}
+	err := fb.runTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(dref)
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				return AlertNotFound(id)
+			}
+			return err
+		}
+		if err := doc.DataTo(alert); err != nil {
+			return err
+		}
+		if err := change(alert); err != nil {
+			return err
+		}
+		return tx.Set(dref, alert)
+	})
+	return alert, err
+}
+
+func (fb *FirestoreBackend) AcknowledgeAlert(ctx context.Context, id, actor string) (*Alert, error) {
+	return fb.updateAlert(ctx, id, func(alert *Alert) error {
+		return alert.acknowledge(actor)
+	})
+}
+
+func (fb *FirestoreBackend) ResolveAlert(ctx context.Context, id, actor string) (*Alert, error) {
+	return fb.updateAlert(ctx, id, func(alert *Alert) error {
+		return alert.resolve(actor)
+	})
+}
+
+func (fb *FirestoreBackend) SnoozeAlert(ctx context.Context, id string, until time.Time, actor string) (*Alert, error) {
+	return fb.updateAlert(ctx, id, func(alert *Alert) error {
+		return alert.snooze(until, actor)
+	})
+}
+
+func (fb *FirestoreBackend) UpdateItem(ctx context.Context, item *Item, version int64) (*Item, error) {
+	err := fb.update(ctx, itemsCollection, item.Id, version, item)
 	return item, err
 }
 
-func (fb *FirestoreBackend) UpdateLocation(ctx context.Context, location *Location) (*Location, error) {
-	err := fb.update(ctx, locationsCollection, location.Id, location)
+func (fb *FirestoreBackend) UpdateLocation(ctx context.Context, location *Location, version int64) (*Location, error) {
+	err := fb.update(ctx, locationsCollection, location.Id, version, location)
 	return location, err
 }
 
-func (fb *FirestoreBackend) lookupInventory(ctx context.Context, itemID, locationID string) (*Inventory, error) {
-	client, err := fb.NewClient(ctx)
-	if err != nil {
-		return nil, err
-	}
+func (fb *FirestoreBackend) ArchiveItem(ctx context.Context, id string) (*Item, error) {
+	item := &Item{}
+	err := fb.setArchived(ctx, itemsCollection, id, true, item)
+	return item, err
+}
 
-	// Lookup the inventory id
-	invs := client.Collection(inventoriesCollection)
-	inv := &Inventory{ItemId: itemID, LocationId: locationID}
-	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		// Find the inventory
-		q := invs.Where("ItemId", "==", itemID).Where("LocationId", "==", locationID)
-		docs, err := tx.Documents(q).GetAll()
+func (fb *FirestoreBackend) ArchiveLocation(ctx context.Context, id string) (*Location, error) {
+	location := &Location{}
+	err := fb.setArchived(ctx, locationsCollection, id, true, location)
+	return location, err
+}
+
+func (fb *FirestoreBackend) RestoreItem(ctx context.Context, id string) (*Item, error) {
+	item := &Item{}
+	err := fb.setArchived(ctx, itemsCollection, id, false, item)
+	return item, err
+}
+
+func (fb *FirestoreBackend) RestoreLocation(ctx context.Context, id string) (*Location, error) {
+	location := &Location{}
+	err := fb.setArchived(ctx, locationsCollection, id, false, location)
+	return location, err
+}
+
+func (fb *FirestoreBackend) RevokeApiKey(ctx context.Context, id string) (*ApiKey, error) {
+	client := fb.client
+	dref := client.Collection(apiKeysCollection).Doc(id)
+	record := &apiKeyRecord{}
+	err := fb.runTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(dref)
 		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				return ApiKeyNotFound(id)
+			}
 			return err
 		}
-
-		if len(docs) > 2 {
-			log.Panicf("Found multiple inventories for item %q and location %q", itemID, locationID)
+		if err := doc.DataTo(record); err != nil {
+			return err
 		}
+		record.revoke(time.Now())
+		return tx.Set(dref, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record.ApiKey, nil
+}
 
-		if len(docs) == 0 {
-			inv.LastUpdated = time.Now()
-			return tx.Create(invs.NewDoc(), inv)
-		}
+func (fb *FirestoreBackend) lookupApiKey(ctx context.Context, id string) (*apiKeyRecord, error) {
+	doc, err := fb.getDoc(ctx, apiKeysCollection, id)
+	if err != nil {
+		return nil, err
+	}
+	record := &apiKeyRecord{}
+	err = doc.DataTo(record)
+	return record, err
+}
+
+// recordApiKeyUse only updates the time of last use, so that it does not
+// overwrite a concurrent revocation
+func (fb *FirestoreBackend) recordApiKeyUse(ctx context.Context, id string, at time.Time) error {
+	_, err := fb.client.Collection(apiKeysCollection).Doc(id).Update(ctx, []firestore.Update{{Path: "LastUsedAt", Value: at}})
+	if status.Code(err) == codes.NotFound {
+		return ApiKeyNotFound(id)
+	}
+	return err
+}
 
-		return docs[0].DataTo(inv)
+func (fb *FirestoreBackend) lookupInventory(ctx context.Context, itemID, locationID string) (*Inventory, error) {
+	client := fb.client
+	var inv *Inventory
+	err := fb.runTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var err error
+		if inv, err = getInventory(tx, client, itemID, locationID); err != nil {
+			return err
+		}
+		return tx.Set(inventoryRef(client, itemID, locationID), inv)
 	})
 	return inv, err
 }
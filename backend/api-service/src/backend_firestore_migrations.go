@@ -0,0 +1,173 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"context"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MigrateInventoryIds moves the inventory documents created under random IDs,
+// before inventories were keyed by item and location, to the ID of their item
+// and location. Duplicate documents of the same item and location, which
+// concurrent transactions could create under random IDs, are merged into one
+// by adding up their counts, since each of them received a share of the
+// transactions. It returns the number of documents moved or merged.
+//
+// The migration is safe to run again, and while the API serves requests: each
+// item and location is migrated in its own transaction.
+func (fb *FirestoreBackend) MigrateInventoryIds(ctx context.Context) (int, error) {
+	client := fb.client
+	docs, err := client.Collection(inventoriesCollection).Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+	unmigrated := make(map[inventoryKey][]*firestore.DocumentRef)
+	for _, doc := range docs {
+		inv := &Inventory{}
+		if err := doc.DataTo(inv); err != nil {
+			return 0, err
+		}
+		if doc.Ref.ID != inventoryId(inv.ItemId, inv.LocationId) {
+			key := inventoryKey{inv.ItemId, inv.LocationId}
+			unmigrated[key] = append(unmigrated[key], doc.Ref)
+		}
+	}
+
+	migrated := 0
+	for key, refs := range unmigrated {
+		var n int
+		err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			n = 0
+			target := inventoryRef(client, key.itemId, key.locationId)
+			docs, err := tx.GetAll(append([]*firestore.DocumentRef{target}, refs...))
+			if err != nil {
+				return err
+			}
+			merged := &Inventory{ItemId: key.itemId, LocationId: key.locationId}
+			for _, doc := range docs {
+				// Another run of the migration may have moved it already
+				if !doc.Exists() {
+					continue
+				}
+				inv := &Inventory{}
+				if err := doc.DataTo(inv); err != nil {
+					return err
+				}
+				merged.Count += inv.Count
+				if inv.LastUpdated.After(merged.LastUpdated) {
+					merged.LastUpdated = inv.LastUpdated
+				}
+				if doc.Ref.ID != target.ID {
+					if err := tx.Delete(doc.Ref); err != nil {
+						return err
+					}
+					n++
+				}
+			}
+			if n == 0 {
+				return nil
+			}
+			return tx.Set(target, merged)
+		})
+		if err != nil {
+			return migrated, err
+		}
+		migrated += n
+	}
+	return migrated, nil
+}
+
+// MigrateArchivedFields stores an Archived field of false in the item and
+// location documents created before items and locations could be archived, so
+// that the queries for unarchived items and locations find them. It returns
+// the number of documents updated.
+//
+// The migration is safe to run again, and while the API serves requests: a
+// document that changes after it is read is left alone, since every change
+// stores the field.
+func (fb *FirestoreBackend) MigrateArchivedFields(ctx context.Context) (int, error) {
+	migrated := 0
+	for _, path := range []string{itemsCollection, locationsCollection} {
+		docs, err := fb.client.Collection(path).Documents(ctx).GetAll()
+		if err != nil {
+			return migrated, err
+		}
+		for _, doc := range docs {
+			if _, err := doc.DataAt("Archived"); err == nil {
+				continue
+			}
+			_, err := doc.Ref.Update(ctx, []firestore.Update{{Path: "Archived", Value: false}}, firestore.LastUpdateTime(doc.UpdateTime))
+			switch status.Code(err) {
+			case codes.OK:
+				migrated++
+			case codes.FailedPrecondition, codes.NotFound:
+			default:
+				return migrated, err
+			}
+		}
+	}
+	return migrated, nil
+}
+
+// MigrateTransactionWarehouses stores the warehouse of their location in the
+// inventory transaction documents created before transactions recorded it, so
+// that the lists limited to a caller's warehouses find them. Transactions of
+// locations that no longer exist are left alone. It returns the number of
+// documents updated.
+//
+// The migration is safe to run again, and while the API serves requests:
+// transactions are never changed once created, and new ones store the field.
+func (fb *FirestoreBackend) MigrateTransactionWarehouses(ctx context.Context) (int, error) {
+	locations, err := fb.client.Collection(locationsCollection).Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+	warehouses := make(map[string]string, len(locations))
+	for _, doc := range locations {
+		location := &Location{}
+		if err := doc.DataTo(location); err != nil {
+			return 0, err
+		}
+		warehouses[doc.Ref.ID] = location.Warehouse
+	}
+
+	docs, err := fb.client.Collection(inventoryTransactionsCollection).Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, doc := range docs {
+		txn := &InventoryTransaction{}
+		if err := doc.DataTo(txn); err != nil {
+			return migrated, err
+		}
+		warehouse, ok := warehouses[txn.LocationId]
+		if txn.Warehouse != "" || !ok || warehouse == "" {
+			continue
+		}
+		_, err := doc.Ref.Update(ctx, []firestore.Update{{Path: "Warehouse", Value: warehouse}}, firestore.LastUpdateTime(doc.UpdateTime))
+		switch status.Code(err) {
+		case codes.OK:
+			migrated++
+		case codes.FailedPrecondition, codes.NotFound:
+		default:
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
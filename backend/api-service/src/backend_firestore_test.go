@@ -18,22 +18,26 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
-	"cloud.google.com/go/firestore"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 const testProjectId = "foo"
 
-func clearFirestoreBackend(t *testing.T) DatabaseBackend {
+func clearFirestoreBackend(t *testing.T) *FirestoreBackend {
 	t.Helper()
 	ctx := context.Background()
-	client, err := firestore.NewClient(ctx, testProjectId)
+	backend, err := NewFirestoreBackend(ctx, testProjectId)
 	if err != nil {
-		t.Fatalf("error creating firestore client: %v", err)
+		t.Fatalf("error creating firestore backend: %v", err)
 	}
+	t.Cleanup(func() { backend.Close() })
 
-	crefs, err := client.Collections(ctx).GetAll()
+	crefs, err := backend.client.Collections(ctx).GetAll()
 	if err != nil {
 		t.Fatalf("error getting all collections: %v", err)
 	}
@@ -49,7 +53,7 @@ func clearFirestoreBackend(t *testing.T) DatabaseBackend {
 			}
 		}
 	}
-	return NewFirestoreBackend(testProjectId)
+	return backend
 }
 
 var firestoreBackendTester = backendTester{
@@ -60,12 +64,9 @@ var firestoreBackendTester = backendTester{
 		t.Helper()
 		backend := clearFirestoreBackend(t)
 		ctx := context.Background()
-		client, err := firestore.NewClient(ctx, testProjectId)
-		if err != nil {
-			t.Fatalf("error creating firestore client: %v", err)
-		}
-		for id, data := range state.inventories {
-			dref := client.Collection("inventories").Doc(id)
+		client := backend.client
+		for _, data := range state.inventories {
+			dref := inventoryRef(client, data.ItemId, data.LocationId)
 			_, err := dref.Create(ctx, data)
 			if err != nil {
 				t.Fatalf("error creating doc: %v", err)
@@ -104,6 +105,184 @@ var firestoreBackendTester = backendTester{
 	},
 }
 
+func TestFSMigrateInventoryIds(t *testing.T) {
+	ctx := context.Background()
+	backend := clearFirestoreBackend(t)
+	invs := backend.client.Collection(inventoriesCollection)
+	now := time.Now()
+	stored := []*Inventory{
+		{ItemId: "item-id", LocationId: "loc1-id", Count: 3, LastUpdated: now.Add(-time.Hour)},
+		{ItemId: "item-id", LocationId: "loc1-id", Count: 4, LastUpdated: now},
+		{ItemId: "item-id", LocationId: "loc2-id", Count: 5, LastUpdated: now},
+	}
+	for _, inv := range stored {
+		if _, err := invs.NewDoc().Create(ctx, inv); err != nil {
+			t.Fatalf("error creating doc: %v", err)
+		}
+	}
+
+	migrated, err := backend.MigrateInventoryIds(ctx)
+	if err != nil {
+		t.Fatalf("MigrateInventoryIds() returned unexpected err: %v", err)
+	}
+	if migrated != len(stored) {
+		t.Errorf("MigrateInventoryIds() = %d, want %d", migrated, len(stored))
+	}
+	got, _, err := backend.ListItemInventory(ctx, "item-id", PageRequest{})
+	if err != nil {
+		t.Fatalf("ListItemInventory() returned unexpected err: %v", err)
+	}
+	want := []*Inventory{
+		{ItemId: "item-id", LocationId: "loc1-id", Count: 7, LastUpdated: now},
+		{ItemId: "item-id", LocationId: "loc2-id", Count: 5, LastUpdated: now},
+	}
+	if !cmp.Equal(got, want, cmpopts.SortSlices(modelLess), cmpopts.EquateApproxTime(time.Millisecond)) {
+		t.Errorf("ListItemInventory() = %v, want %v", got, want)
+	}
+
+	if migrated, err := backend.MigrateInventoryIds(ctx); err != nil || migrated != 0 {
+		t.Errorf("MigrateInventoryIds() again = %d, %v, want 0, nil", migrated, err)
+	}
+}
+
+func TestFSMigrateArchivedFields(t *testing.T) {
+	ctx := context.Background()
+	backend := clearFirestoreBackend(t)
+	// Documents stored before items and locations could be archived
+	for _, path := range []string{itemsCollection, locationsCollection} {
+		if _, err := backend.client.Collection(path).Doc("legacy-id").Create(ctx, map[string]interface{}{"Id": "legacy-id", "Name": "legacy"}); err != nil {
+			t.Fatalf("error creating doc: %v", err)
+		}
+	}
+	backend.NewItem(ctx, &Item{Name: "item"})
+
+	migrated, err := backend.MigrateArchivedFields(ctx)
+	if err != nil || migrated != 2 {
+		t.Errorf("MigrateArchivedFields() = %d, %v, want 2, nil", migrated, err)
+	}
+	items, _, err := backend.ListItems(ctx, false, PageRequest{})
+	if err != nil || len(items) != 2 {
+		t.Errorf("ListItems() = %v, %v, want the legacy item and the new one", items, err)
+	}
+	locations, _, err := backend.ListLocations(ctx, false, PageRequest{})
+	if err != nil || len(locations) != 1 || locations[0].Id != "legacy-id" {
+		t.Errorf("ListLocations() = %v, %v, want the legacy location", locations, err)
+	}
+
+	if migrated, err := backend.MigrateArchivedFields(ctx); err != nil || migrated != 0 {
+		t.Errorf("MigrateArchivedFields() again = %d, %v, want 0, nil", migrated, err)
+	}
+}
+
+func TestFSMigrateTransactionWarehouses(t *testing.T) {
+	ctx := context.Background()
+	backend := clearFirestoreBackend(t)
+	location, err := backend.NewLocation(ctx, &Location{Name: "location", Warehouse: "warehouse"})
+	if err != nil {
+		t.Fatalf("error creating location: %v", err)
+	}
+	// Documents stored before transactions recorded their warehouse
+	txns := backend.client.Collection(inventoryTransactionsCollection)
+	for id, locationId := range map[string]string{"legacy-id": location.Id, "deleted-id": "deleted-loc-id"} {
+		if _, err := txns.Doc(id).Create(ctx, map[string]interface{}{"Id": id, "ItemId": "item-id", "LocationId": locationId, "Action": "ADD", "Count": 1, "Timestamp": time.Now()}); err != nil {
+			t.Fatalf("error creating doc: %v", err)
+		}
+	}
+
+	migrated, err := backend.MigrateTransactionWarehouses(ctx)
+	if err != nil || migrated != 1 {
+		t.Errorf("MigrateTransactionWarehouses() = %d, %v, want 1, nil", migrated, err)
+	}
+	got, _, err := backend.ListInventoryTransactions(ctx, TransactionFilter{Warehouses: []string{"warehouse"}}, PageRequest{})
+	if err != nil || len(got) != 1 || got[0].Id != "legacy-id" {
+		t.Errorf("ListInventoryTransactions() = %v, %v, want the legacy transaction", got, err)
+	}
+
+	if migrated, err := backend.MigrateTransactionWarehouses(ctx); err != nil || migrated != 0 {
+		t.Errorf("MigrateTransactionWarehouses() again = %d, %v, want 0, nil", migrated, err)
+	}
+}
+
+func TestFSUnversionedItem(t *testing.T) {
+	ctx := context.Background()
+	backend := clearFirestoreBackend(t)
+	// A document stored before items were versioned
+	if _, err := backend.client.Collection(itemsCollection).Doc("legacy-id").Create(ctx, map[string]interface{}{"Id": "legacy-id", "Name": "legacy"}); err != nil {
+		t.Fatalf("error creating doc: %v", err)
+	}
+
+	if got, err := backend.GetItem(ctx, "legacy-id"); err != nil || got.Version != 1 {
+		t.Errorf("GetItem() = %v, %v, want version 1", got, err)
+	}
+	item := &Item{Id: "legacy-id", Name: "updated"}
+	if _, err := backend.UpdateItem(ctx, item, 2); KindOf(err) != KindPreconditionFailed {
+		t.Errorf("UpdateItem(%v, 2) returned %v, want a %v error", item, err, KindPreconditionFailed)
+	}
+	if got, err := backend.UpdateItem(ctx, item, 1); err != nil || got.Version != 2 {
+		t.Errorf("UpdateItem(%v, 1) = %v, %v, want version 2", item, got, err)
+	}
+}
+
+func TestFSTransactionSpans(t *testing.T) {
+	backend := clearFirestoreBackend(t)
+	item, _ := backend.NewItem(context.Background(), &Item{Name: "item"})
+	location, _ := backend.NewLocation(context.Background(), &Location{Name: "location"})
+	tp, recorder := recordingTracerProvider()
+	ctx := WithTracerProvider(context.Background(), tp)
+
+	invTxn := &InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 1}
+	if _, err := InstrumentBackend(backend).NewInventoryTransaction(ctx, invTxn, ""); err != nil {
+		t.Fatalf("NewInventoryTransaction() returned unexpected err: %v", err)
+	}
+
+	spans := endedSpans(recorder)
+	call, attempt := spans["DatabaseBackend.NewInventoryTransaction"], spans["firestore.transaction"]
+	if call == nil || attempt == nil || attempt.Parent().SpanID() != call.SpanContext().SpanID() || spanAttribute(attempt, "firestore.transaction.attempt") != "1" {
+		t.Errorf("recorded spans %v, want the first transaction attempt within the backend call", spans)
+	}
+}
+
+func TestFSDeleteItemWithManyInventories(t *testing.T) {
+	cases := []struct {
+		desc        string
+		inventories int
+		wantErr     bool
+	}{
+		{desc: "at the limit", inventories: maxDeletedInventories},
+		{desc: "over the limit", inventories: maxDeletedInventories + 1, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := context.Background()
+			backend := clearFirestoreBackend(t)
+			item, err := backend.NewItem(ctx, &Item{Name: "item"})
+			if err != nil {
+				t.Fatalf("error creating item: %v", err)
+			}
+			batch := backend.client.Batch()
+			for i := 0; i < tc.inventories; i++ {
+				locationId := fmt.Sprintf("location-%d", i)
+				batch.Set(inventoryRef(backend.client, item.Id, locationId), &Inventory{ItemId: item.Id, LocationId: locationId, Count: 1})
+			}
+			if _, err := batch.Commit(ctx); err != nil {
+				t.Fatalf("error creating inventories: %v", err)
+			}
+
+			err = backend.DeleteItem(ctx, item.Id, true)
+			if tc.wantErr {
+				if _, ok := err.(*TooManyInventories); !ok {
+					t.Errorf("DeleteItem() of an item with %d inventories returned %v, want *TooManyInventories", tc.inventories, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("DeleteItem() of an item with %d inventories returned unexpected err: %v", tc.inventories, err)
+			}
+		})
+	}
+}
+
 func TestFSDeleteItem(t *testing.T) {
 	firestoreBackendTester.testDeleteItem(t)
 }
@@ -120,6 +299,14 @@ func TestFSDeleteLocationNotFound(t *testing.T) {
 	firestoreBackendTester.testDeleteLocationNotFound(t)
 }
 
+func TestFSDeleteItemInventory(t *testing.T) {
+	firestoreBackendTester.testDeleteItemInventory(t)
+}
+
+func TestFSDeleteLocationInventory(t *testing.T) {
+	firestoreBackendTester.testDeleteLocationInventory(t)
+}
+
 func TestFSDeleteAlert(t *testing.T) {
 	firestoreBackendTester.testDeleteAlert(t)
 }
@@ -161,7 +348,7 @@ func TestFSListItemInventory(t *testing.T) {
 }
 
 func TestFSListItemInventoryTransactions(t *testing.T) {
-	firestoreBackendTester.testListInventoryTransactions(t)
+	firestoreBackendTester.testListItemInventoryTransactions(t)
 }
 
 func TestFSListInventoryTransactions(t *testing.T) {
@@ -173,7 +360,7 @@ func TestFSListLocations(t *testing.T) {
 }
 
 func TestFSListLocationInventory(t *testing.T) {
-	firestoreBackendTester.testListLocations(t)
+	firestoreBackendTester.testListLocationInventory(t)
 }
 
 func TestFSListLocationInventoryTransactions(t *testing.T) {
@@ -196,6 +383,74 @@ func TestFSNewInventoryTransactionNotFoundErrors(t *testing.T) {
 	firestoreBackendTester.testNewInventoryTransactionNotFoundErrors(t)
 }
 
+func TestFSNewInventoryTransactionIdempotent(t *testing.T) {
+	firestoreBackendTester.testNewInventoryTransactionIdempotent(t)
+}
+
+func TestFSConcurrentIdempotentTransactions(t *testing.T) {
+	firestoreBackendTester.testConcurrentIdempotentTransactions(t)
+}
+
+func TestFSConcurrentInventoryTransactions(t *testing.T) {
+	firestoreBackendTester.testConcurrentInventoryTransactions(t)
+}
+
+func TestFSNewInventoryTransactionBatch(t *testing.T) {
+	firestoreBackendTester.testNewInventoryTransactionBatch(t)
+}
+
+func TestFSNewInventoryTransactionBatchAllOrNone(t *testing.T) {
+	firestoreBackendTester.testNewInventoryTransactionBatchAllOrNone(t)
+}
+
+func TestFSNewInventoryTransactionBatchTooLarge(t *testing.T) {
+	firestoreBackendTester.testNewInventoryTransactionBatchTooLarge(t)
+}
+
+func TestFSNewInventoryTransactionBatchAlerts(t *testing.T) {
+	firestoreBackendTester.testNewInventoryTransactionBatchAlerts(t)
+}
+
+func TestFSNewInventoryTransactionNegativeStockPolicy(t *testing.T) {
+	firestoreBackendTester.testNewInventoryTransactionNegativeStockPolicy(t)
+}
+
+func TestFSReorderAlerts(t *testing.T) {
+	firestoreBackendTester.testReorderAlerts(t)
+}
+
+func TestFSListAlertsFilter(t *testing.T) {
+	firestoreBackendTester.testListAlertsFilter(t)
+}
+
+func TestFSListPagination(t *testing.T) {
+	firestoreBackendTester.testListPagination(t)
+}
+
+func TestFSListInvalidPageToken(t *testing.T) {
+	firestoreBackendTester.testListInvalidPageToken(t)
+}
+
+func TestFSListInventoryTransactionsFilter(t *testing.T) {
+	firestoreBackendTester.testListInventoryTransactionsFilter(t)
+}
+
+func TestFSTransactionWarehouse(t *testing.T) {
+	firestoreBackendTester.testTransactionWarehouse(t)
+}
+
+func TestFSAlertLifecycle(t *testing.T) {
+	firestoreBackendTester.testAlertLifecycle(t)
+}
+
+func TestFSAlertLifecycleNotFound(t *testing.T) {
+	firestoreBackendTester.testAlertLifecycleNotFound(t)
+}
+
+func TestFSRaisedAlertsDeduplicated(t *testing.T) {
+	firestoreBackendTester.testRaisedAlertsDeduplicated(t)
+}
+
 func TestFSNewLocation(t *testing.T) {
 	firestoreBackendTester.testNewLocation(t)
 }
@@ -204,6 +459,26 @@ func TestFSNewAlert(t *testing.T) {
 	firestoreBackendTester.testNewAlert(t)
 }
 
+func TestFSNewTransfer(t *testing.T) {
+	firestoreBackendTester.testNewTransfer(t)
+}
+
+func TestFSNewTransferNotFoundErrors(t *testing.T) {
+	firestoreBackendTester.testNewTransferNotFoundErrors(t)
+}
+
+func TestFSNewTransferNegativeStockPolicy(t *testing.T) {
+	firestoreBackendTester.testNewTransferNegativeStockPolicy(t)
+}
+
+func TestFSApiKeyLifecycle(t *testing.T) {
+	firestoreBackendTester.testApiKeyLifecycle(t)
+}
+
+func TestFSApiKeyNotFound(t *testing.T) {
+	firestoreBackendTester.testApiKeyNotFound(t)
+}
+
 func TestFSUpdateItem(t *testing.T) {
 	firestoreBackendTester.testUpdateItem(t)
 }
@@ -212,6 +487,10 @@ func TestFSUpdateItemNotFound(t *testing.T) {
 	firestoreBackendTester.testUpdateItemNotFound(t)
 }
 
+func TestFSUpdateItemVersion(t *testing.T) {
+	firestoreBackendTester.testUpdateItemVersion(t)
+}
+
 func TestFSUpdateLocation(t *testing.T) {
 	firestoreBackendTester.testUpdateLocation(t)
 }
@@ -219,3 +498,31 @@ func TestFSUpdateLocation(t *testing.T) {
 func TestFSUpdateLocationNotFound(t *testing.T) {
 	firestoreBackendTester.testUpdateLocationNotFound(t)
 }
+
+func TestFSUpdateLocationVersion(t *testing.T) {
+	firestoreBackendTester.testUpdateLocationVersion(t)
+}
+
+func TestFSArchiveItem(t *testing.T) {
+	firestoreBackendTester.testArchiveItem(t)
+}
+
+func TestFSArchiveItemNotFound(t *testing.T) {
+	firestoreBackendTester.testArchiveItemNotFound(t)
+}
+
+func TestFSArchiveLocation(t *testing.T) {
+	firestoreBackendTester.testArchiveLocation(t)
+}
+
+func TestFSArchiveLocationNotFound(t *testing.T) {
+	firestoreBackendTester.testArchiveLocationNotFound(t)
+}
+
+func TestFSListIncludeArchived(t *testing.T) {
+	firestoreBackendTester.testListIncludeArchived(t)
+}
+
+func TestFSNewInventoryTransactionArchived(t *testing.T) {
+	firestoreBackendTester.testNewInventoryTransactionArchived(t)
+}
@@ -0,0 +1,270 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentedBackend records each call to the backend in a span, and its
+// time in the access log entry of the request it is made for
+type instrumentedBackend struct {
+	DatabaseBackend
+}
+
+// InstrumentBackend returns the backend, recording its calls in spans and
+// the time they take in the access log entries of LogRequests
+func InstrumentBackend(db DatabaseBackend) DatabaseBackend {
+	return &instrumentedBackend{db}
+}
+
+// backendCall is a call to the backend
+type backendCall struct {
+	ctx   context.Context
+	span  trace.Span
+	start time.Time
+}
+
+// startBackendCall starts a call to the backend method, and returns the
+// context to make it with
+func startBackendCall(ctx context.Context, method string) (context.Context, *backendCall) {
+	ctx, s := startSpan(ctx, "DatabaseBackend."+method, trace.SpanKindInternal)
+	return ctx, &backendCall{ctx: ctx, span: s, start: time.Now()}
+}
+
+// end ends the call, which returned *err
+func (c *backendCall) end(err *error) {
+	noteBackendCall(c.ctx, c.start)
+	endSpan(c.span, *err)
+}
+
+func (ib *instrumentedBackend) AcknowledgeAlert(ctx context.Context, id, actor string) (_ *Alert, err error) {
+	ctx, call := startBackendCall(ctx, "AcknowledgeAlert")
+	defer call.end(&err)
+	return ib.DatabaseBackend.AcknowledgeAlert(ctx, id, actor)
+}
+
+func (ib *instrumentedBackend) ResolveAlert(ctx context.Context, id, actor string) (_ *Alert, err error) {
+	ctx, call := startBackendCall(ctx, "ResolveAlert")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ResolveAlert(ctx, id, actor)
+}
+
+func (ib *instrumentedBackend) SnoozeAlert(ctx context.Context, id string, until time.Time, actor string) (_ *Alert, err error) {
+	ctx, call := startBackendCall(ctx, "SnoozeAlert")
+	defer call.end(&err)
+	return ib.DatabaseBackend.SnoozeAlert(ctx, id, until, actor)
+}
+
+func (ib *instrumentedBackend) DeleteAlert(ctx context.Context, id string) (err error) {
+	ctx, call := startBackendCall(ctx, "DeleteAlert")
+	defer call.end(&err)
+	return ib.DatabaseBackend.DeleteAlert(ctx, id)
+}
+
+func (ib *instrumentedBackend) DeleteItem(ctx context.Context, id string, archiveInventory bool) (err error) {
+	ctx, call := startBackendCall(ctx, "DeleteItem")
+	defer call.end(&err)
+	return ib.DatabaseBackend.DeleteItem(ctx, id, archiveInventory)
+}
+
+func (ib *instrumentedBackend) DeleteLocation(ctx context.Context, id string, archiveInventory bool) (err error) {
+	ctx, call := startBackendCall(ctx, "DeleteLocation")
+	defer call.end(&err)
+	return ib.DatabaseBackend.DeleteLocation(ctx, id, archiveInventory)
+}
+
+func (ib *instrumentedBackend) GetApiKey(ctx context.Context, id string) (_ *ApiKey, err error) {
+	ctx, call := startBackendCall(ctx, "GetApiKey")
+	defer call.end(&err)
+	return ib.DatabaseBackend.GetApiKey(ctx, id)
+}
+
+func (ib *instrumentedBackend) GetInventoryTransaction(ctx context.Context, id string) (_ *InventoryTransaction, err error) {
+	ctx, call := startBackendCall(ctx, "GetInventoryTransaction")
+	defer call.end(&err)
+	return ib.DatabaseBackend.GetInventoryTransaction(ctx, id)
+}
+
+func (ib *instrumentedBackend) GetItem(ctx context.Context, id string) (_ *Item, err error) {
+	ctx, call := startBackendCall(ctx, "GetItem")
+	defer call.end(&err)
+	return ib.DatabaseBackend.GetItem(ctx, id)
+}
+
+func (ib *instrumentedBackend) GetLocation(ctx context.Context, id string) (_ *Location, err error) {
+	ctx, call := startBackendCall(ctx, "GetLocation")
+	defer call.end(&err)
+	return ib.DatabaseBackend.GetLocation(ctx, id)
+}
+
+func (ib *instrumentedBackend) ListAlerts(ctx context.Context, filter AlertFilter, page PageRequest) (_ []*Alert, _ string, err error) {
+	ctx, call := startBackendCall(ctx, "ListAlerts")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ListAlerts(ctx, filter, page)
+}
+
+func (ib *instrumentedBackend) ListApiKeys(ctx context.Context, page PageRequest) (_ []*ApiKey, _ string, err error) {
+	ctx, call := startBackendCall(ctx, "ListApiKeys")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ListApiKeys(ctx, page)
+}
+
+func (ib *instrumentedBackend) ListItems(ctx context.Context, includeArchived bool, page PageRequest) (_ []*Item, _ string, err error) {
+	ctx, call := startBackendCall(ctx, "ListItems")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ListItems(ctx, includeArchived, page)
+}
+
+func (ib *instrumentedBackend) ListItemInventory(ctx context.Context, itemId string, page PageRequest) (_ []*Inventory, _ string, err error) {
+	ctx, call := startBackendCall(ctx, "ListItemInventory")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ListItemInventory(ctx, itemId, page)
+}
+
+func (ib *instrumentedBackend) ListItemInventoryTransactions(ctx context.Context, itemId string, filter TransactionFilter, page PageRequest) (_ []*InventoryTransaction, _ string, err error) {
+	ctx, call := startBackendCall(ctx, "ListItemInventoryTransactions")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ListItemInventoryTransactions(ctx, itemId, filter, page)
+}
+
+func (ib *instrumentedBackend) ListInventoryTransactions(ctx context.Context, filter TransactionFilter, page PageRequest) (_ []*InventoryTransaction, _ string, err error) {
+	ctx, call := startBackendCall(ctx, "ListInventoryTransactions")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ListInventoryTransactions(ctx, filter, page)
+}
+
+func (ib *instrumentedBackend) ListLocations(ctx context.Context, includeArchived bool, page PageRequest) (_ []*Location, _ string, err error) {
+	ctx, call := startBackendCall(ctx, "ListLocations")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ListLocations(ctx, includeArchived, page)
+}
+
+func (ib *instrumentedBackend) ListLocationInventory(ctx context.Context, locationId string, page PageRequest) (_ []*Inventory, _ string, err error) {
+	ctx, call := startBackendCall(ctx, "ListLocationInventory")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ListLocationInventory(ctx, locationId, page)
+}
+
+func (ib *instrumentedBackend) ListLocationInventoryTransactions(ctx context.Context, locationId string, filter TransactionFilter, page PageRequest) (_ []*InventoryTransaction, _ string, err error) {
+	ctx, call := startBackendCall(ctx, "ListLocationInventoryTransactions")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ListLocationInventoryTransactions(ctx, locationId, filter, page)
+}
+
+func (ib *instrumentedBackend) NewAlert(ctx context.Context, alert *Alert) (_ *Alert, err error) {
+	ctx, call := startBackendCall(ctx, "NewAlert")
+	defer call.end(&err)
+	return ib.DatabaseBackend.NewAlert(ctx, alert)
+}
+
+func (ib *instrumentedBackend) NewApiKey(ctx context.Context, key *apiKeyRecord) (_ *ApiKey, err error) {
+	ctx, call := startBackendCall(ctx, "NewApiKey")
+	defer call.end(&err)
+	return ib.DatabaseBackend.NewApiKey(ctx, key)
+}
+
+func (ib *instrumentedBackend) NewItem(ctx context.Context, item *Item) (_ *Item, err error) {
+	ctx, call := startBackendCall(ctx, "NewItem")
+	defer call.end(&err)
+	return ib.DatabaseBackend.NewItem(ctx, item)
+}
+
+func (ib *instrumentedBackend) NewInventoryTransaction(ctx context.Context, transaction *InventoryTransaction, idempotencyKey string) (_ *InventoryTransaction, err error) {
+	ctx, call := startBackendCall(ctx, "NewInventoryTransaction")
+	defer call.end(&err)
+	return ib.DatabaseBackend.NewInventoryTransaction(ctx, transaction, idempotencyKey)
+}
+
+func (ib *instrumentedBackend) NewInventoryTransactionBatch(ctx context.Context, transactions []*InventoryTransaction) (_ []*InventoryTransaction, err error) {
+	ctx, call := startBackendCall(ctx, "NewInventoryTransactionBatch")
+	defer call.end(&err)
+	return ib.DatabaseBackend.NewInventoryTransactionBatch(ctx, transactions)
+}
+
+func (ib *instrumentedBackend) NewLocation(ctx context.Context, location *Location) (_ *Location, err error) {
+	ctx, call := startBackendCall(ctx, "NewLocation")
+	defer call.end(&err)
+	return ib.DatabaseBackend.NewLocation(ctx, location)
+}
+
+func (ib *instrumentedBackend) NewTransfer(ctx context.Context, transfer *Transfer) (_ *Transfer, err error) {
+	ctx, call := startBackendCall(ctx, "NewTransfer")
+	defer call.end(&err)
+	return ib.DatabaseBackend.NewTransfer(ctx, transfer)
+}
+
+func (ib *instrumentedBackend) UpdateItem(ctx context.Context, item *Item, version int64) (_ *Item, err error) {
+	ctx, call := startBackendCall(ctx, "UpdateItem")
+	defer call.end(&err)
+	return ib.DatabaseBackend.UpdateItem(ctx, item, version)
+}
+
+func (ib *instrumentedBackend) UpdateLocation(ctx context.Context, location *Location, version int64) (_ *Location, err error) {
+	ctx, call := startBackendCall(ctx, "UpdateLocation")
+	defer call.end(&err)
+	return ib.DatabaseBackend.UpdateLocation(ctx, location, version)
+}
+
+func (ib *instrumentedBackend) ArchiveItem(ctx context.Context, id string) (_ *Item, err error) {
+	ctx, call := startBackendCall(ctx, "ArchiveItem")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ArchiveItem(ctx, id)
+}
+
+func (ib *instrumentedBackend) ArchiveLocation(ctx context.Context, id string) (_ *Location, err error) {
+	ctx, call := startBackendCall(ctx, "ArchiveLocation")
+	defer call.end(&err)
+	return ib.DatabaseBackend.ArchiveLocation(ctx, id)
+}
+
+func (ib *instrumentedBackend) RestoreItem(ctx context.Context, id string) (_ *Item, err error) {
+	ctx, call := startBackendCall(ctx, "RestoreItem")
+	defer call.end(&err)
+	return ib.DatabaseBackend.RestoreItem(ctx, id)
+}
+
+func (ib *instrumentedBackend) RestoreLocation(ctx context.Context, id string) (_ *Location, err error) {
+	ctx, call := startBackendCall(ctx, "RestoreLocation")
+	defer call.end(&err)
+	return ib.DatabaseBackend.RestoreLocation(ctx, id)
+}
+
+func (ib *instrumentedBackend) RevokeApiKey(ctx context.Context, id string) (_ *ApiKey, err error) {
+	ctx, call := startBackendCall(ctx, "RevokeApiKey")
+	defer call.end(&err)
+	return ib.DatabaseBackend.RevokeApiKey(ctx, id)
+}
+
+func (ib *instrumentedBackend) lookupInventory(ctx context.Context, itemID, locationID string) (_ *Inventory, err error) {
+	ctx, call := startBackendCall(ctx, "lookupInventory")
+	defer call.end(&err)
+	return ib.DatabaseBackend.lookupInventory(ctx, itemID, locationID)
+}
+
+func (ib *instrumentedBackend) lookupApiKey(ctx context.Context, id string) (_ *apiKeyRecord, err error) {
+	ctx, call := startBackendCall(ctx, "lookupApiKey")
+	defer call.end(&err)
+	return ib.DatabaseBackend.lookupApiKey(ctx, id)
+}
+
+func (ib *instrumentedBackend) recordApiKeyUse(ctx context.Context, id string, at time.Time) (err error) {
+	ctx, call := startBackendCall(ctx, "recordApiKeyUse")
+	defer call.end(&err)
+	return ib.DatabaseBackend.recordApiKeyUse(ctx, id, at)
+}
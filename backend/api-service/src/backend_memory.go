@@ -15,20 +15,42 @@ package service
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-// InMemoryBackend is an in memory backend that implements the Backend interface
+// InMemoryBackend is an in memory backend that implements the Backend interface.
+// It is safe for concurrent use: every method runs with exclusive access to
+// the data it changes, so each one applies entirely or not at all, like a
+// Firestore transaction.
 type InMemoryBackend struct {
+	// mu guards the data below. Stored values are never handed out, only
+	// copies of them, so that methods may change them in place.
+	mu                             sync.RWMutex
 	items                          map[string]*Item
 	locations                      map[string]*Location
 	inventoryByItemByLocationIndex map[string]map[string]*Inventory
 	inventoryByLocationByItemIndex map[string]map[string]*Inventory
 	inventoryTransactions          map[string]*InventoryTransaction
 	alerts                         map[string]*Alert
+	apiKeys                        map[string]*apiKeyRecord
+	idempotencyRecords             map[string]*idempotencyRecord
+	archivedInventories            []*archivedInventory
+
+	// changes counts the changes made to the data
+	changes uint64
+
+	// snapshotPath is the file the data is saved to after every change, if set
+	snapshotPath string
+	// saveMu serializes the writes of snapshots, which happen outside mu so
+	// that readers do not wait for the disk. savedChanges is the number of
+	// changes in the last snapshot written, so that an older snapshot never
+	// replaces a newer one.
+	saveMu       sync.Mutex
+	savedChanges uint64
 }
 
 func NewInMemoryBackend() *InMemoryBackend {
@@ -39,208 +61,826 @@ func NewInMemoryBackend() *InMemoryBackend {
 		inventoryByLocationByItemIndex: make(map[string]map[string]*Inventory),
 		inventoryTransactions:          make(map[string]*InventoryTransaction),
 		alerts:                         make(map[string]*Alert),
+		apiKeys:                        make(map[string]*apiKeyRecord),
+		idempotencyRecords:             make(map[string]*idempotencyRecord),
+	}
+}
+
+// update runs the change with exclusive access to the data, and saves a
+// snapshot of the data if the change succeeds. A change must leave the data
+// as it was when it fails. The snapshot is written after the data is
+// unlocked, so that other methods need not wait for the disk. The change has
+// been made in memory by the time the snapshot is saved, so an error saving
+// it is logged rather than returned, and the next snapshot saved includes
+// the change.
+func (mb *InMemoryBackend) update(ctx context.Context, change func() error) error {
+	mb.mu.Lock()
+	if err := change(); err != nil {
+		mb.mu.Unlock()
+		return err
+	}
+	mb.changes++
+	changes := mb.changes
+	// The snapshot is encoded under the lock, and written to disk after it
+	// is released
+	snapshot, err := mb.encodeSnapshot()
+	mb.mu.Unlock()
+
+	if err == nil {
+		err = mb.writeSnapshot(snapshot, changes)
+	}
+	if err != nil {
+		LogErrorf(ctx, "error saving snapshot %s: %v", mb.snapshotPath, err)
+	}
+	return nil
+}
+
+func copyItem(item *Item) *Item {
+	copied := *item
+	if item.LocationReorderPoints != nil {
+		copied.LocationReorderPoints = make(map[string]int64, len(item.LocationReorderPoints))
+		for id, point := range item.LocationReorderPoints {
+			copied.LocationReorderPoints[id] = point
+		}
 	}
+	return &copied
+}
+
+func copyLocation(location *Location) *Location {
+	copied := *location
+	return &copied
+}
+
+func copyInventory(inv *Inventory) *Inventory {
+	copied := *inv
+	return &copied
+}
+
+func copyInventoryTransaction(txn *InventoryTransaction) *InventoryTransaction {
+	copied := *txn
+	return &copied
+}
+
+func copyAlert(alert *Alert) *Alert {
+	copied := *alert
+	return &copied
+}
+
+func copyApiKey(key *ApiKey) *ApiKey {
+	copied := *key
+	copied.Warehouses = append([]string(nil), key.Warehouses...)
+	return &copied
+}
+
+// Close does nothing, since the backend has no connections to release. The
+// snapshot, if any, is already saved after every change.
+func (mb *InMemoryBackend) Close() error {
+	return nil
 }
 
-func (mb *InMemoryBackend) DeleteItem(ctx context.Context, id string) error {
-	if _, ok := mb.items[id]; ok {
+func (mb *InMemoryBackend) DeleteItem(ctx context.Context, id string, archiveInventory bool) error {
+	return mb.update(ctx, func() error {
+		if _, ok := mb.items[id]; !ok {
+			return ItemNotFound(id)
+		}
+		invs := mb.inventoryByItemByLocationIndex[id]
+		if n := nonzeroInventories(invs); n > 0 && !archiveInventory {
+			return ItemInUse(id, n)
+		}
+		mb.archiveInventories(invs)
 		delete(mb.items, id)
 		return nil
-	}
-	return ItemNotFound(id)
+	})
 }
 
-func (mb *InMemoryBackend) DeleteLocation(ctx context.Context, id string) error {
-	if _, ok := mb.locations[id]; ok {
+func (mb *InMemoryBackend) DeleteLocation(ctx context.Context, id string, archiveInventory bool) error {
+	return mb.update(ctx, func() error {
+		if _, ok := mb.locations[id]; !ok {
+			return LocationNotFound(id)
+		}
+		invs := mb.inventoryByLocationByItemIndex[id]
+		if n := nonzeroInventories(invs); n > 0 && !archiveInventory {
+			return LocationInUse(id, n)
+		}
+		mb.archiveInventories(invs)
 		delete(mb.locations, id)
 		return nil
+	})
+}
+
+// nonzeroInventories returns the number of inventories with a nonzero count
+func nonzeroInventories(invs map[string]*Inventory) int {
+	n := 0
+	for _, inv := range invs {
+		if inv.Count != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// archiveInventories removes the inventories from both indexes and archives
+// their last state
+func (mb *InMemoryBackend) archiveInventories(invs map[string]*Inventory) {
+	now := time.Now()
+	for _, inv := range invs {
+		mb.archivedInventories = append(mb.archivedInventories, &archivedInventory{Inventory: *inv, ArchivedAt: now})
+		delete(mb.inventoryByItemByLocationIndex[inv.ItemId], inv.LocationId)
+		delete(mb.inventoryByLocationByItemIndex[inv.LocationId], inv.ItemId)
 	}
-	return LocationNotFound(id)
 }
 
 func (mb *InMemoryBackend) DeleteAlert(ctx context.Context, id string) error {
-	if _, ok := mb.alerts[id]; ok {
+	return mb.update(ctx, func() error {
+		if _, ok := mb.alerts[id]; !ok {
+			return AlertNotFound(id)
+		}
 		delete(mb.alerts, id)
 		return nil
-	}
-	return AlertNotFound(id)
+	})
 }
 
 func (mb *InMemoryBackend) GetInventoryTransaction(ctx context.Context, id string) (*InventoryTransaction, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
 	if transaction, ok := mb.inventoryTransactions[id]; ok {
-		return transaction, nil
+		return copyInventoryTransaction(transaction), nil
 	}
 	return nil, InventoryTransactionNotFound(id)
 }
 
 func (mb *InMemoryBackend) GetItem(ctx context.Context, id string) (*Item, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
 	if item, ok := mb.items[id]; ok {
-		return item, nil
+		return copyItem(item), nil
 	}
 	return nil, ItemNotFound(id)
 }
 
 func (mb *InMemoryBackend) GetLocation(ctx context.Context, id string) (*Location, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
 	if loc, ok := mb.locations[id]; ok {
-		return loc, nil
+		return copyLocation(loc), nil
 	}
 	return nil, LocationNotFound(id)
 }
 
-func (mb *InMemoryBackend) ListItems(ctx context.Context) ([]*Item, error) {
+func (mb *InMemoryBackend) ListItems(ctx context.Context, includeArchived bool, page PageRequest) ([]*Item, string, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
 	items := make([]*Item, 0, len(mb.items))
 	for _, item := range mb.items {
-		items = append(items, item)
+		if includeArchived || !item.Archived {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Id < items[j].Id })
+	start, end, next, err := page.bounds(len(items), false, func(i int) string { return items[i].Id })
+	if err != nil {
+		return nil, "", err
 	}
-	return items, nil
+	items = items[start:end]
+	for i, item := range items {
+		items[i] = copyItem(item)
+	}
+	return items, next, nil
 }
 
-func (mb *InMemoryBackend) ListItemInventory(ctx context.Context, id string) ([]*Inventory, error) {
+func (mb *InMemoryBackend) ListItemInventory(ctx context.Context, id string, page PageRequest) ([]*Inventory, string, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
 	inventories := make([]*Inventory, 0)
 	if itemInvs, ok := mb.inventoryByItemByLocationIndex[id]; ok {
 		for _, inventory := range itemInvs {
 			inventories = append(inventories, inventory)
 		}
 	}
-	return inventories, nil
+	// The inventory of an item is keyed by location
+	return pageOfInventory(inventories, page, func(inv *Inventory) string { return inv.LocationId })
 }
 
-func (mb *InMemoryBackend) ListItemInventoryTransactions(ctx context.Context, id string) ([]*InventoryTransaction, error) {
+func (mb *InMemoryBackend) ListItemInventoryTransactions(ctx context.Context, id string, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
 	txns := make([]*InventoryTransaction, 0)
 	for _, txn := range mb.inventoryTransactions {
-		if txn.ItemId == id {
+		if txn.ItemId == id && filter.matches(txn) {
 			txns = append(txns, txn)
 		}
 	}
-	return txns, nil
+	return pageOfTransactions(txns, filter, page)
 }
 
-func (mb *InMemoryBackend) ListInventoryTransactions(ctx context.Context) ([]*InventoryTransaction, error) {
+func (mb *InMemoryBackend) ListInventoryTransactions(ctx context.Context, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
 	transactions := make([]*InventoryTransaction, 0, len(mb.inventoryTransactions))
 	for _, transaction := range mb.inventoryTransactions {
-		transactions = append(transactions, transaction)
+		if filter.matches(transaction) {
+			transactions = append(transactions, transaction)
+		}
 	}
-	return transactions, nil
+	return pageOfTransactions(transactions, filter, page)
 }
 
-func (mb *InMemoryBackend) ListLocations(ctx context.Context) ([]*Location, error) {
+func (mb *InMemoryBackend) ListLocations(ctx context.Context, includeArchived bool, page PageRequest) ([]*Location, string, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
 	locations := make([]*Location, 0, len(mb.locations))
 	for _, location := range mb.locations {
-		locations = append(locations, location)
+		if includeArchived || !location.Archived {
+			locations = append(locations, location)
+		}
+	}
+	sort.Slice(locations, func(i, j int) bool { return locations[i].Id < locations[j].Id })
+	start, end, next, err := page.bounds(len(locations), false, func(i int) string { return locations[i].Id })
+	if err != nil {
+		return nil, "", err
+	}
+	locations = locations[start:end]
+	for i, location := range locations {
+		locations[i] = copyLocation(location)
 	}
-	return locations, nil
+	return locations, next, nil
 }
 
-func (mb *InMemoryBackend) ListLocationInventory(ctx context.Context, id string) ([]*Inventory, error) {
+func (mb *InMemoryBackend) ListLocationInventory(ctx context.Context, id string, page PageRequest) ([]*Inventory, string, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
 	inventories := make([]*Inventory, 0)
 	if locInvs, ok := mb.inventoryByLocationByItemIndex[id]; ok {
 		for _, inventory := range locInvs {
 			inventories = append(inventories, inventory)
 		}
 	}
-	return inventories, nil
+	// The inventory at a location is keyed by item
+	return pageOfInventory(inventories, page, func(inv *Inventory) string { return inv.ItemId })
 }
 
-func (mb *InMemoryBackend) ListLocationInventoryTransactions(ctx context.Context, id string) ([]*InventoryTransaction, error) {
+func (mb *InMemoryBackend) ListLocationInventoryTransactions(ctx context.Context, id string, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
 	txns := make([]*InventoryTransaction, 0, len(mb.inventoryTransactions))
 	for _, txn := range mb.inventoryTransactions {
-		if txn.LocationId == id {
+		if txn.LocationId == id && filter.matches(txn) {
 			txns = append(txns, txn)
 		}
 	}
-	return txns, nil
+	return pageOfTransactions(txns, filter, page)
 }
 
-func (mb *InMemoryBackend) ListAlerts(ctx context.Context) ([]*Alert, error) {
+func (mb *InMemoryBackend) ListAlerts(ctx context.Context, filter AlertFilter, page PageRequest) ([]*Alert, string, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	now := time.Now()
 	alerts := make([]*Alert, 0, len(mb.alerts))
 	for _, alert := range mb.alerts {
-		alerts = append(alerts, alert)
+		if filter.matches(alert, now) {
+			alerts = append(alerts, alert)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Id < alerts[j].Id })
+	start, end, next, err := page.bounds(len(alerts), false, func(i int) string { return alerts[i].Id })
+	if err != nil {
+		return nil, "", err
+	}
+	alerts = alerts[start:end]
+	for i, alert := range alerts {
+		alerts[i] = copyAlert(alert)
 	}
-	return alerts, nil
+	return alerts, next, nil
+}
+
+func (mb *InMemoryBackend) GetApiKey(ctx context.Context, id string) (*ApiKey, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	record, ok := mb.apiKeys[id]
+	if !ok {
+		return nil, ApiKeyNotFound(id)
+	}
+	return copyApiKey(&record.ApiKey), nil
+}
+
+func (mb *InMemoryBackend) ListApiKeys(ctx context.Context, page PageRequest) ([]*ApiKey, string, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	keys := make([]*ApiKey, 0, len(mb.apiKeys))
+	for _, record := range mb.apiKeys {
+		keys = append(keys, &record.ApiKey)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Id < keys[j].Id })
+	start, end, next, err := page.bounds(len(keys), false, func(i int) string { return keys[i].Id })
+	if err != nil {
+		return nil, "", err
+	}
+	keys = keys[start:end]
+	for i, key := range keys {
+		keys[i] = copyApiKey(key)
+	}
+	return keys, next, nil
+}
+
+// pageOfInventory returns copies of the requested page of the inventories
+// ordered by key
+func pageOfInventory(invs []*Inventory, page PageRequest, key func(*Inventory) string) ([]*Inventory, string, error) {
+	sort.Slice(invs, func(i, j int) bool { return key(invs[i]) < key(invs[j]) })
+	start, end, next, err := page.bounds(len(invs), false, func(i int) string { return key(invs[i]) })
+	if err != nil {
+		return nil, "", err
+	}
+	invs = invs[start:end]
+	for i, inv := range invs {
+		invs[i] = copyInventory(inv)
+	}
+	return invs, next, nil
+}
+
+// pageOfTransactions returns copies of the requested page of the transactions
+// ordered by timestamp, then by id, in the direction of the filter
+func pageOfTransactions(txns []*InventoryTransaction, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error) {
+	key := func(i int) string { return timeKey(txns[i].Timestamp, txns[i].Id) }
+	sort.Slice(txns, func(i, j int) bool {
+		if filter.Descending {
+			return key(i) > key(j)
+		}
+		return key(i) < key(j)
+	})
+	start, end, next, err := page.bounds(len(txns), filter.Descending, key)
+	if err != nil {
+		return nil, "", err
+	}
+	txns = txns[start:end]
+	for i, txn := range txns {
+		txns[i] = copyInventoryTransaction(txn)
+	}
+	return txns, next, nil
 }
 
 func (mb *InMemoryBackend) NewItem(ctx context.Context, inputItem *Item) (*Item, error) {
-	item := &Item{}
-	*item = *inputItem
+	item := copyItem(inputItem)
 	item.Id = uuid.New().String()
-	mb.items[item.Id] = item
-	return item, nil
+	item.Version = 1
+	item.setArchived(false, time.Time{})
+	err := mb.update(ctx, func() error {
+		mb.items[item.Id] = item
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyItem(item), nil
 }
 
 func (mb *InMemoryBackend) NewAlert(ctx context.Context, inputAlert *Alert) (*Alert, error) {
-	alert := &Alert{}
-	*alert = *inputAlert
+	alert := copyAlert(inputAlert)
 	alert.Id = uuid.New().String()
-	mb.alerts[alert.Id] = alert
-	return alert, nil
+	err := mb.update(ctx, func() error {
+		mb.alerts[alert.Id] = alert
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyAlert(alert), nil
+}
+
+func (mb *InMemoryBackend) NewApiKey(ctx context.Context, inputKey *apiKeyRecord) (*ApiKey, error) {
+	record := &apiKeyRecord{ApiKey: *copyApiKey(&inputKey.ApiKey), SecretHash: inputKey.SecretHash}
+	record.Id = uuid.New().String()
+	err := mb.update(ctx, func() error {
+		mb.apiKeys[record.Id] = record
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyApiKey(&record.ApiKey), nil
+}
+
+// inventory returns a copy of the inventory of the item at the location, or
+// an empty inventory if there is none yet, for the caller to store once it
+// has changed
+func (mb *InMemoryBackend) inventory(itemID, locID string) *Inventory {
+	if inv, ok := mb.inventoryByItemByLocationIndex[itemID][locID]; ok {
+		return copyInventory(inv)
+	}
+	return &Inventory{ItemId: itemID, LocationId: locID}
+}
+
+// storeInventory stores the inventory in both indexes, creating index
+// entries for the item and location as needed
+func (mb *InMemoryBackend) storeInventory(inv *Inventory) {
+	if _, found := mb.inventoryByItemByLocationIndex[inv.ItemId]; !found {
+		mb.inventoryByItemByLocationIndex[inv.ItemId] = make(map[string]*Inventory)
+	}
+	if _, found := mb.inventoryByLocationByItemIndex[inv.LocationId]; !found {
+		mb.inventoryByLocationByItemIndex[inv.LocationId] = make(map[string]*Inventory)
+	}
+	mb.inventoryByItemByLocationIndex[inv.ItemId][inv.LocationId] = inv
+	mb.inventoryByLocationByItemIndex[inv.LocationId][inv.ItemId] = inv
 }
 
 // lookupInventory returns the inventory associated with the item and location
 func (mb *InMemoryBackend) lookupInventory(ctx context.Context, itemID, locID string) (*Inventory, error) {
-	// item and/or location may not have any inventory yet. Create index entries as needed.
-	if _, found := mb.inventoryByItemByLocationIndex[itemID]; !found {
-		mb.inventoryByItemByLocationIndex[itemID] = make(map[string]*Inventory)
+	var inv *Inventory
+	err := mb.update(ctx, func() error {
+		// item and/or location may not have any inventory yet
+		inv = mb.inventory(itemID, locID)
+		mb.storeInventory(inv)
+		inv = copyInventory(inv)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if _, found := mb.inventoryByLocationByItemIndex[locID]; !found {
-		mb.inventoryByLocationByItemIndex[locID] = make(map[string]*Inventory)
+	return inv, nil
+}
+
+func (mb *InMemoryBackend) NewInventoryTransaction(ctx context.Context, inputTxn *InventoryTransaction, idempotencyKey string) (*InventoryTransaction, error) {
+	recordId := idempotencyId(inputTxn.CreatedBy, idempotencyKey)
+	var transaction *InventoryTransaction
+	err := mb.update(ctx, func() error {
+		if record, ok := mb.idempotencyRecords[recordId]; ok && idempotencyKey != "" {
+			replayed, ok := mb.inventoryTransactions[record.TransactionId]
+			if !ok {
+				return InventoryTransactionNotFound(record.TransactionId)
+			}
+			transaction = copyInventoryTransaction(replayed)
+			return nil
+		}
+		item, ok := mb.items[inputTxn.ItemId]
+		if !ok {
+			return ItemNotFound(inputTxn.ItemId)
+		}
+		location, ok := mb.locations[inputTxn.LocationId]
+		if !ok {
+			return LocationNotFound(inputTxn.LocationId)
+		}
+		txn := copyInventoryTransaction(inputTxn)
+		txn.Id = uuid.New().String()
+		txn.Warehouse = location.Warehouse
+		inv := mb.inventory(txn.ItemId, txn.LocationId)
+		if err := checkNotArchived(txn, item, location, inv); err != nil {
+			return err
+		}
+		before, total := inv.Count, mb.itemCount(txn.ItemId)
+		alerts, err := inv.applyTransactionWithPolicy(txn, negativeStockPolicy(item, location))
+		if err != nil {
+			return err
+		}
+		alerts = append(alerts, item.reorderAlerts(txn, before, inv.Count, total, total-before+inv.Count)...)
+		mb.storeInventory(inv)
+		mb.inventoryTransactions[txn.Id] = txn
+		mb.storeAlerts(alerts)
+		if idempotencyKey != "" {
+			mb.idempotencyRecords[recordId] = &idempotencyRecord{
+				Key:           idempotencyKey,
+				CreatedBy:     txn.CreatedBy,
+				TransactionId: txn.Id,
+				Timestamp:     txn.Timestamp,
+			}
+		}
+		transaction = copyInventoryTransaction(txn)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return transaction, nil
+}
 
-	// Make sure the two indices return the same inventory (which could be nil)
-	inv, exists := mb.inventoryByItemByLocationIndex[itemID][locID]
-	locItemInv, _ := mb.inventoryByLocationByItemIndex[locID][itemID]
-	if locItemInv != inv {
-		msg := fmt.Sprintf("[item][location] index returned %p and [location][item] index returned %p", inv, locItemInv)
-		log.Panicf("inventory data inconsistent for item %q and location %q: %s", itemID, locID, msg)
+func (mb *InMemoryBackend) NewInventoryTransactionBatch(ctx context.Context, inputTxns []*InventoryTransaction) ([]*InventoryTransaction, error) {
+	if len(inputTxns) > maxBatchSize {
+		return nil, &BatchTooLarge{size: len(inputTxns)}
 	}
 
-	// Create an inventory entry if needed
-	if !exists {
-		inv = &Inventory{ItemId: itemID, LocationId: locID}
-		mb.inventoryByItemByLocationIndex[itemID][locID] = inv
-		mb.inventoryByLocationByItemIndex[locID][itemID] = inv
+	transactions := make([]*InventoryTransaction, len(inputTxns))
+	err := mb.update(ctx, func() error {
+		// Apply the transactions to copies of the inventories they affect
+		batch := newTransactionBatch()
+		for i, inputTxn := range inputTxns {
+			if _, loaded := batch.items[inputTxn.ItemId]; !loaded {
+				if item, ok := mb.items[inputTxn.ItemId]; ok {
+					batch.items[item.Id] = item
+					batch.totals[item.Id] = mb.itemCount(item.Id)
+				}
+			}
+			if location, ok := mb.locations[inputTxn.LocationId]; ok {
+				batch.locations[location.Id] = location
+			}
+			key := inventoryKey{inputTxn.ItemId, inputTxn.LocationId}
+			if inv, ok := mb.inventoryByItemByLocationIndex[key.itemId][key.locationId]; ok {
+				if _, loaded := batch.inventories[key]; !loaded {
+					batch.inventories[key] = copyInventory(inv)
+				}
+			}
+
+			transaction := copyInventoryTransaction(inputTxn)
+			transaction.Id = uuid.New().String()
+			if err := batch.apply(i, transaction); err != nil {
+				return err
+			}
+			transactions[i] = transaction
+		}
+
+		// Store the results, now that every transaction has applied
+		for _, inv := range batch.inventories {
+			mb.storeInventory(inv)
+		}
+		for i, transaction := range transactions {
+			mb.inventoryTransactions[transaction.Id] = transaction
+			transactions[i] = copyInventoryTransaction(transaction)
+		}
+		mb.storeAlerts(batch.alerts)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// itemCount returns the total inventory of the item across all locations
+func (mb *InMemoryBackend) itemCount(itemID string) int64 {
+	var count int64
+	for _, inv := range mb.inventoryByItemByLocationIndex[itemID] {
+		count += inv.Count
+	}
+	return count
+}
+
+// storeAlerts stores the alerts raised by an inventory transaction, merging
+// each one into an unresolved alert it duplicates
+func (mb *InMemoryBackend) storeAlerts(alerts []*Alert) {
+	for _, alert := range alerts {
+		if existing := mb.duplicatedAlert(alert); existing != nil {
+			existing.merge(alert)
+			continue
+		}
+		alert.Id = uuid.New().String()
+		mb.alerts[alert.Id] = alert
 	}
-	return inv, nil
 }
 
-func (mb *InMemoryBackend) NewInventoryTransaction(ctx context.Context, inputTxn *InventoryTransaction) (*InventoryTransaction, error) {
-	if _, ok := mb.items[inputTxn.ItemId]; !ok {
-		return nil, ItemNotFound(inputTxn.ItemId)
+func (mb *InMemoryBackend) duplicatedAlert(alert *Alert) *Alert {
+	for _, existing := range mb.alerts {
+		if alert.duplicates(existing) {
+			return existing
+		}
 	}
-	if _, ok := mb.locations[inputTxn.LocationId]; !ok {
-		return nil, LocationNotFound(inputTxn.LocationId)
+	return nil
+}
+
+// updateAlert changes a copy of the alert with the given id, and stores it
+// if the change succeeds
+func (mb *InMemoryBackend) updateAlert(ctx context.Context, id string, change func(*Alert) error) (*Alert, error) {
+	var alert *Alert
+	err := mb.update(ctx, func() error {
+		stored, ok := mb.alerts[id]
+		if !ok {
+			return AlertNotFound(id)
+		}
+		changed := copyAlert(stored)
+		if err := change(changed); err != nil {
+			return err
+		}
+		mb.alerts[id] = changed
+		alert = copyAlert(changed)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return alert, nil
+}
 
-	transaction := &InventoryTransaction{}
-	*transaction = *inputTxn
-	transaction.Id = uuid.New().String()
-	inv, _ := mb.lookupInventory(ctx, transaction.ItemId, transaction.LocationId)
-	if err := inv.applyTransaction(transaction); err != nil {
+// updateApiKey changes a copy of the key with the given id, and stores it
+func (mb *InMemoryBackend) updateApiKey(ctx context.Context, id string, change func(*ApiKey)) (*ApiKey, error) {
+	var key *ApiKey
+	err := mb.update(ctx, func() error {
+		stored, ok := mb.apiKeys[id]
+		if !ok {
+			return ApiKeyNotFound(id)
+		}
+		changed := &apiKeyRecord{ApiKey: *copyApiKey(&stored.ApiKey), SecretHash: stored.SecretHash}
+		change(&changed.ApiKey)
+		mb.apiKeys[id] = changed
+		key = copyApiKey(&changed.ApiKey)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	mb.inventoryTransactions[transaction.Id] = transaction
-	return transaction, nil
+	return key, nil
+}
+
+func (mb *InMemoryBackend) RevokeApiKey(ctx context.Context, id string) (*ApiKey, error) {
+	return mb.updateApiKey(ctx, id, func(key *ApiKey) {
+		key.revoke(time.Now())
+	})
+}
+
+func (mb *InMemoryBackend) lookupApiKey(ctx context.Context, id string) (*apiKeyRecord, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	record, ok := mb.apiKeys[id]
+	if !ok {
+		return nil, ApiKeyNotFound(id)
+	}
+	return &apiKeyRecord{ApiKey: *copyApiKey(&record.ApiKey), SecretHash: record.SecretHash}, nil
+}
+
+func (mb *InMemoryBackend) recordApiKeyUse(ctx context.Context, id string, at time.Time) error {
+	_, err := mb.updateApiKey(ctx, id, func(key *ApiKey) {
+		key.LastUsedAt = at
+	})
+	return err
+}
+
+func (mb *InMemoryBackend) AcknowledgeAlert(ctx context.Context, id, actor string) (*Alert, error) {
+	return mb.updateAlert(ctx, id, func(alert *Alert) error {
+		return alert.acknowledge(actor)
+	})
+}
+
+func (mb *InMemoryBackend) ResolveAlert(ctx context.Context, id, actor string) (*Alert, error) {
+	return mb.updateAlert(ctx, id, func(alert *Alert) error {
+		return alert.resolve(actor)
+	})
+}
+
+func (mb *InMemoryBackend) SnoozeAlert(ctx context.Context, id string, until time.Time, actor string) (*Alert, error) {
+	return mb.updateAlert(ctx, id, func(alert *Alert) error {
+		return alert.snooze(until, actor)
+	})
+}
+
+func (mb *InMemoryBackend) NewTransfer(ctx context.Context, inputTransfer *Transfer) (*Transfer, error) {
+	transfer := &Transfer{}
+	*transfer = *inputTransfer
+	transfer.Id = uuid.New().String()
+	err := mb.update(ctx, func() error {
+		item, ok := mb.items[transfer.ItemId]
+		if !ok {
+			return ItemNotFound(transfer.ItemId)
+		}
+		source, ok := mb.locations[transfer.SourceLocationId]
+		if !ok {
+			return LocationNotFound(transfer.SourceLocationId)
+		}
+		destination, ok := mb.locations[transfer.DestinationLocationId]
+		if !ok {
+			return LocationNotFound(transfer.DestinationLocationId)
+		}
+
+		out, in := transfer.legs(source, destination)
+		out.Id, in.Id = uuid.New().String(), uuid.New().String()
+
+		// Apply both legs to copies so that neither inventory changes unless both succeed
+		src := mb.inventory(transfer.ItemId, transfer.SourceLocationId)
+		dst := mb.inventory(transfer.ItemId, transfer.DestinationLocationId)
+		if err := checkNotArchived(in, item, destination, dst); err != nil {
+			return err
+		}
+		before := src.Count
+		alerts, err := src.applyTransactionWithPolicy(out, negativeStockPolicy(item, source))
+		if err != nil {
+			return err
+		}
+		// The total inventory of the item is unchanged by a transfer
+		alerts = append(alerts, item.reorderAlerts(out, before, src.Count, 0, 0)...)
+		if err := dst.applyTransaction(in); err != nil {
+			return err
+		}
+		mb.storeInventory(src)
+		mb.storeInventory(dst)
+
+		mb.inventoryTransactions[out.Id] = out
+		mb.inventoryTransactions[in.Id] = in
+		mb.storeAlerts(alerts)
+		transfer.Timestamp = out.Timestamp
+		transfer.Transactions = []InventoryTransaction{*out, *in}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transfer, nil
 }
 
 func (mb *InMemoryBackend) NewLocation(ctx context.Context, inputLocation *Location) (*Location, error) {
-	location := &Location{}
-	*location = *inputLocation
+	location := copyLocation(inputLocation)
 	location.Id = uuid.New().String()
-	mb.locations[location.Id] = location
-	return location, nil
+	location.Version = 1
+	location.setArchived(false, time.Time{})
+	err := mb.update(ctx, func() error {
+		mb.locations[location.Id] = location
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyLocation(location), nil
 }
 
-func (mb *InMemoryBackend) UpdateItem(ctx context.Context, item *Item) (*Item, error) {
-	if _, ok := mb.items[item.Id]; ok {
-		*mb.items[item.Id] = *item
-		return mb.items[item.Id], nil
+func (mb *InMemoryBackend) UpdateItem(ctx context.Context, item *Item, version int64) (*Item, error) {
+	updated := copyItem(item)
+	err := mb.update(ctx, func() error {
+		stored, ok := mb.items[item.Id]
+		if !ok {
+			return ItemNotFound(item.Id)
+		}
+		if !versionMatches(stored.Version, version) {
+			return ItemPreconditionFailed(item.Id, version)
+		}
+		updated.Version = stored.Version + 1
+		updated.setArchived(stored.Archived, stored.ArchivedAt)
+		mb.items[item.Id] = updated
+		updated = copyItem(updated)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, ItemNotFound(item.Id)
+	return updated, nil
 }
 
-func (mb *InMemoryBackend) UpdateLocation(ctx context.Context, location *Location) (*Location, error) {
-	if _, ok := mb.locations[location.Id]; ok {
-		*mb.locations[location.Id] = *location
-		return mb.locations[location.Id], nil
+func (mb *InMemoryBackend) UpdateLocation(ctx context.Context, location *Location, version int64) (*Location, error) {
+	updated := copyLocation(location)
+	err := mb.update(ctx, func() error {
+		stored, ok := mb.locations[location.Id]
+		if !ok {
+			return LocationNotFound(location.Id)
+		}
+		if !versionMatches(stored.Version, version) {
+			return LocationPreconditionFailed(location.Id, version)
+		}
+		updated.Version = stored.Version + 1
+		updated.setArchived(stored.Archived, stored.ArchivedAt)
+		mb.locations[location.Id] = updated
+		updated = copyLocation(updated)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, LocationNotFound(location.Id)
+	return updated, nil
+}
+
+func (mb *InMemoryBackend) ArchiveItem(ctx context.Context, id string) (*Item, error) {
+	return mb.setItemArchived(ctx, id, true)
+}
+
+func (mb *InMemoryBackend) RestoreItem(ctx context.Context, id string) (*Item, error) {
+	return mb.setItemArchived(ctx, id, false)
+}
+
+func (mb *InMemoryBackend) setItemArchived(ctx context.Context, id string, archived bool) (*Item, error) {
+	var item *Item
+	err := mb.update(ctx, func() error {
+		stored, ok := mb.items[id]
+		if !ok {
+			return ItemNotFound(id)
+		}
+		if stored.Archived != archived {
+			stored.setArchived(archived, time.Now())
+			stored.Version++
+		}
+		item = copyItem(stored)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (mb *InMemoryBackend) ArchiveLocation(ctx context.Context, id string) (*Location, error) {
+	return mb.setLocationArchived(ctx, id, true)
+}
+
+func (mb *InMemoryBackend) RestoreLocation(ctx context.Context, id string) (*Location, error) {
+	return mb.setLocationArchived(ctx, id, false)
+}
+
+func (mb *InMemoryBackend) setLocationArchived(ctx context.Context, id string, archived bool) (*Location, error) {
+	var location *Location
+	err := mb.update(ctx, func() error {
+		stored, ok := mb.locations[id]
+		if !ok {
+			return LocationNotFound(id)
+		}
+		if stored.Archived != archived {
+			stored.setArchived(archived, time.Now())
+			stored.Version++
+		}
+		location = copyLocation(stored)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return location, nil
 }
@@ -0,0 +1,140 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// memorySnapshot is the data of an InMemoryBackend as saved to its snapshot
+// file. Inventories are keyed by item, then by location.
+type memorySnapshot struct {
+	Items                 map[string]*Item                 `json:"items"`
+	Locations             map[string]*Location             `json:"locations"`
+	Inventories           map[string]map[string]*Inventory `json:"inventories"`
+	InventoryTransactions map[string]*InventoryTransaction `json:"inventory_transactions"`
+	Alerts                map[string]*Alert                `json:"alerts"`
+	ApiKeys               map[string]*apiKeyRecord         `json:"api_keys"`
+	IdempotencyRecords    map[string]*idempotencyRecord    `json:"idempotency_records"`
+	ArchivedInventories   []*archivedInventory             `json:"archived_inventories"`
+}
+
+// NewInMemoryBackendWithSnapshot returns an in memory backend that saves its
+// data to the snapshot file at path after every change, so that the data
+// survives restarts. The data is loaded from the file if it exists.
+func NewInMemoryBackendWithSnapshot(path string) (*InMemoryBackend, error) {
+	mb := NewInMemoryBackend()
+	mb.snapshotPath = path
+	if err := mb.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	return mb, nil
+}
+
+// loadSnapshot replaces the data with the data in the snapshot file, unless
+// there is no file yet
+func (mb *InMemoryBackend) loadSnapshot() error {
+	data, err := ioutil.ReadFile(mb.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	snapshot := &memorySnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return fmt.Errorf("error reading snapshot %s: %v", mb.snapshotPath, err)
+	}
+
+	if snapshot.Items != nil {
+		mb.items = snapshot.Items
+	}
+	if snapshot.Locations != nil {
+		mb.locations = snapshot.Locations
+	}
+	if snapshot.InventoryTransactions != nil {
+		mb.inventoryTransactions = snapshot.InventoryTransactions
+	}
+	if snapshot.Alerts != nil {
+		mb.alerts = snapshot.Alerts
+	}
+	if snapshot.ApiKeys != nil {
+		mb.apiKeys = snapshot.ApiKeys
+	}
+	if snapshot.IdempotencyRecords != nil {
+		mb.idempotencyRecords = snapshot.IdempotencyRecords
+	}
+	mb.archivedInventories = snapshot.ArchivedInventories
+	for _, invs := range snapshot.Inventories {
+		for _, inv := range invs {
+			mb.storeInventory(inv)
+		}
+	}
+	return nil
+}
+
+// encodeSnapshot returns the data as saved to the snapshot file, or nil if
+// there is no file. It must be called with mu held.
+func (mb *InMemoryBackend) encodeSnapshot() ([]byte, error) {
+	if mb.snapshotPath == "" {
+		return nil, nil
+	}
+	return json.MarshalIndent(&memorySnapshot{
+		Items:                 mb.items,
+		Locations:             mb.locations,
+		Inventories:           mb.inventoryByItemByLocationIndex,
+		InventoryTransactions: mb.inventoryTransactions,
+		Alerts:                mb.alerts,
+		ApiKeys:               mb.apiKeys,
+		IdempotencyRecords:    mb.idempotencyRecords,
+		ArchivedInventories:   mb.archivedInventories,
+	}, "", "  ")
+}
+
+// writeSnapshot writes the snapshot of the data after the given number of
+// changes to the snapshot file, unless a snapshot of later changes has been
+// written already. The file is replaced by renaming a complete copy over it,
+// so that it is never left partly written.
+func (mb *InMemoryBackend) writeSnapshot(data []byte, changes uint64) error {
+	if data == nil {
+		return nil
+	}
+	mb.saveMu.Lock()
+	defer mb.saveMu.Unlock()
+	if changes <= mb.savedChanges {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(mb.snapshotPath), filepath.Base(mb.snapshotPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), mb.snapshotPath); err != nil {
+		return err
+	}
+	mb.savedChanges = changes
+	return nil
+}
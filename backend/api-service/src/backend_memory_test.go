@@ -14,7 +14,15 @@
 package service
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 var inMemoryBackendTester = backendTester{
@@ -51,6 +59,163 @@ var inMemoryBackendTester = backendTester{
 	},
 }
 
+func TestIMBSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	mb, err := NewInMemoryBackendWithSnapshot(path)
+	if err != nil {
+		t.Fatalf("NewInMemoryBackendWithSnapshot(%q) returned unexpected err: %v", path, err)
+	}
+	item, err := mb.NewItem(ctx, &Item{Name: "item", LocationReorderPoints: map[string]int64{"loc": 5}})
+	if err != nil {
+		t.Fatalf("error creating item: %v", err)
+	}
+	location, err := mb.NewLocation(ctx, &Location{Name: "location", Warehouse: "warehouse"})
+	if err != nil {
+		t.Fatalf("error creating location: %v", err)
+	}
+	txn, err := mb.NewInventoryTransaction(ctx, &InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 3, CreatedBy: "alice"}, "key")
+	if err != nil {
+		t.Fatalf("error creating inventory transaction: %v", err)
+	}
+	key, err := mb.NewApiKey(ctx, &apiKeyRecord{ApiKey: ApiKey{Name: "scanner", Scope: apiKeyReadOnly}, SecretHash: "hash"})
+	if err != nil {
+		t.Fatalf("error creating API key: %v", err)
+	}
+
+	reloaded, err := NewInMemoryBackendWithSnapshot(path)
+	if err != nil {
+		t.Fatalf("NewInMemoryBackendWithSnapshot(%q) returned unexpected err: %v", path, err)
+	}
+	if got, err := reloaded.GetItem(ctx, item.Id); err != nil || !cmp.Equal(got, item) {
+		t.Errorf("reloaded GetItem() = %v, %v, want %v", got, err, item)
+	}
+	if got, err := reloaded.GetLocation(ctx, location.Id); err != nil || !cmp.Equal(got, location) {
+		t.Errorf("reloaded GetLocation() = %v, %v, want %v", got, err, location)
+	}
+	if got, err := reloaded.GetInventoryTransaction(ctx, txn.Id); err != nil || !cmp.Equal(got, txn) {
+		t.Errorf("reloaded GetInventoryTransaction() = %v, %v, want %v", got, err, txn)
+	}
+	if got, err := reloaded.lookupApiKey(ctx, key.Id); err != nil || !cmp.Equal(&got.ApiKey, key) || got.SecretHash != "hash" {
+		t.Errorf("reloaded lookupApiKey() = %v, %v, want %v with its hash", got, err, key)
+	}
+	invs, _, err := reloaded.ListLocationInventory(ctx, location.Id, PageRequest{})
+	if err != nil || len(invs) != 1 || invs[0].Count != 3 {
+		t.Errorf("reloaded ListLocationInventory() = %v, %v, want one inventory of 3", invs, err)
+	}
+
+	// The idempotency record survives the restart, so a retry is not applied twice
+	retry, err := reloaded.NewInventoryTransaction(ctx, &InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 3, CreatedBy: "alice"}, "key")
+	if err != nil || retry.Id != txn.Id {
+		t.Errorf("retried NewInventoryTransaction() = %v, %v, want %v", retry, err, txn)
+	}
+	inv, err := reloaded.lookupInventory(ctx, item.Id, location.Id)
+	if err != nil || inv.Count != 3 {
+		t.Errorf("lookupInventory() after retry = %v, %v, want count 3", inv, err)
+	}
+}
+
+func TestIMBSnapshotSaveFailure(t *testing.T) {
+	ctx := context.Background()
+	logs := captureLogs(t)
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// The snapshot cannot be saved until its directory is created
+	path := filepath.Join(dir, "missing", "snapshot.json")
+	mb, err := NewInMemoryBackendWithSnapshot(path)
+	if err != nil {
+		t.Fatalf("NewInMemoryBackendWithSnapshot(%q) returned unexpected err: %v", path, err)
+	}
+
+	item, err := mb.NewItem(ctx, &Item{Name: "item"})
+	if err != nil {
+		t.Fatalf("NewItem() with an unsaved snapshot returned unexpected err: %v", err)
+	}
+	if entries := logs(); len(entries) != 1 || entries[0]["severity"] != severityError {
+		t.Errorf("logged %v, want an error saving the snapshot", entries)
+	}
+
+	// The next snapshot saved includes the earlier change
+	if err := os.Mkdir(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("error creating snapshot dir: %v", err)
+	}
+	if _, err := mb.NewLocation(ctx, &Location{Name: "location", Warehouse: "warehouse"}); err != nil {
+		t.Fatalf("error creating location: %v", err)
+	}
+	reloaded, err := NewInMemoryBackendWithSnapshot(path)
+	if err != nil {
+		t.Fatalf("NewInMemoryBackendWithSnapshot(%q) returned unexpected err: %v", path, err)
+	}
+	if got, err := reloaded.GetItem(ctx, item.Id); err != nil || !cmp.Equal(got, item) {
+		t.Errorf("reloaded GetItem() = %v, %v, want %v", got, err, item)
+	}
+}
+
+func TestIMBSnapshotConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+	mb, err := NewInMemoryBackendWithSnapshot(path)
+	if err != nil {
+		t.Fatalf("NewInMemoryBackendWithSnapshot(%q) returned unexpected err: %v", path, err)
+	}
+
+	// Snapshots may be written in any order, but the last one left on disk
+	// has every change
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := mb.NewItem(ctx, &Item{Name: fmt.Sprintf("item%d", i)}); err != nil {
+				t.Errorf("error creating item: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	reloaded, err := NewInMemoryBackendWithSnapshot(path)
+	if err != nil {
+		t.Fatalf("NewInMemoryBackendWithSnapshot(%q) returned unexpected err: %v", path, err)
+	}
+	items, _, err := reloaded.ListItems(ctx, false, PageRequest{})
+	if err != nil {
+		t.Fatalf("reloaded ListItems() returned unexpected err: %v", err)
+	}
+	if len(items) != n {
+		t.Errorf("reloaded ListItems() returned %d items, want %d", len(items), n)
+	}
+}
+
+func TestIMBSnapshotInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatalf("error writing snapshot: %v", err)
+	}
+	if _, err := NewInMemoryBackendWithSnapshot(path); err == nil {
+		t.Errorf("NewInMemoryBackendWithSnapshot(%q) with an invalid snapshot returned nil err", path)
+	}
+}
+
 func TestIMBDeleteItem(t *testing.T) {
 	inMemoryBackendTester.testDeleteItem(t)
 }
@@ -67,6 +232,14 @@ func TestIMBDeleteLocationNotFound(t *testing.T) {
 	inMemoryBackendTester.testDeleteLocationNotFound(t)
 }
 
+func TestIMBDeleteItemInventory(t *testing.T) {
+	inMemoryBackendTester.testDeleteItemInventory(t)
+}
+
+func TestIMBDeleteLocationInventory(t *testing.T) {
+	inMemoryBackendTester.testDeleteLocationInventory(t)
+}
+
 func TestIMBDeleteAlert(t *testing.T) {
 	inMemoryBackendTester.testDeleteAlert(t)
 }
@@ -108,7 +281,7 @@ func TestIMBListItemInventory(t *testing.T) {
 }
 
 func TestIMBListItemInventoryTransactions(t *testing.T) {
-	inMemoryBackendTester.testListInventoryTransactions(t)
+	inMemoryBackendTester.testListItemInventoryTransactions(t)
 }
 
 func TestIMBListInventoryTransactions(t *testing.T) {
@@ -120,7 +293,7 @@ func TestIMBListLocations(t *testing.T) {
 }
 
 func TestIMBListLocationInventory(t *testing.T) {
-	inMemoryBackendTester.testListLocations(t)
+	inMemoryBackendTester.testListLocationInventory(t)
 }
 
 func TestIMBListLocationInventoryTransactions(t *testing.T) {
@@ -143,6 +316,74 @@ func TestIMBNewInventoryTransactionNotFoundErrors(t *testing.T) {
 	inMemoryBackendTester.testNewInventoryTransactionNotFoundErrors(t)
 }
 
+func TestIMBNewInventoryTransactionIdempotent(t *testing.T) {
+	inMemoryBackendTester.testNewInventoryTransactionIdempotent(t)
+}
+
+func TestIMBConcurrentIdempotentTransactions(t *testing.T) {
+	inMemoryBackendTester.testConcurrentIdempotentTransactions(t)
+}
+
+func TestIMBConcurrentInventoryTransactions(t *testing.T) {
+	inMemoryBackendTester.testConcurrentInventoryTransactions(t)
+}
+
+func TestIMBNewInventoryTransactionBatch(t *testing.T) {
+	inMemoryBackendTester.testNewInventoryTransactionBatch(t)
+}
+
+func TestIMBNewInventoryTransactionBatchAllOrNone(t *testing.T) {
+	inMemoryBackendTester.testNewInventoryTransactionBatchAllOrNone(t)
+}
+
+func TestIMBNewInventoryTransactionBatchTooLarge(t *testing.T) {
+	inMemoryBackendTester.testNewInventoryTransactionBatchTooLarge(t)
+}
+
+func TestIMBNewInventoryTransactionBatchAlerts(t *testing.T) {
+	inMemoryBackendTester.testNewInventoryTransactionBatchAlerts(t)
+}
+
+func TestIMBNewInventoryTransactionNegativeStockPolicy(t *testing.T) {
+	inMemoryBackendTester.testNewInventoryTransactionNegativeStockPolicy(t)
+}
+
+func TestIMBReorderAlerts(t *testing.T) {
+	inMemoryBackendTester.testReorderAlerts(t)
+}
+
+func TestIMBListAlertsFilter(t *testing.T) {
+	inMemoryBackendTester.testListAlertsFilter(t)
+}
+
+func TestIMBListPagination(t *testing.T) {
+	inMemoryBackendTester.testListPagination(t)
+}
+
+func TestIMBListInvalidPageToken(t *testing.T) {
+	inMemoryBackendTester.testListInvalidPageToken(t)
+}
+
+func TestIMBListInventoryTransactionsFilter(t *testing.T) {
+	inMemoryBackendTester.testListInventoryTransactionsFilter(t)
+}
+
+func TestIMBTransactionWarehouse(t *testing.T) {
+	inMemoryBackendTester.testTransactionWarehouse(t)
+}
+
+func TestIMBAlertLifecycle(t *testing.T) {
+	inMemoryBackendTester.testAlertLifecycle(t)
+}
+
+func TestIMBAlertLifecycleNotFound(t *testing.T) {
+	inMemoryBackendTester.testAlertLifecycleNotFound(t)
+}
+
+func TestIMBRaisedAlertsDeduplicated(t *testing.T) {
+	inMemoryBackendTester.testRaisedAlertsDeduplicated(t)
+}
+
 func TestIMBNewLocation(t *testing.T) {
 	inMemoryBackendTester.testNewLocation(t)
 }
@@ -151,6 +392,26 @@ func TestIMBNewAlert(t *testing.T) {
 	inMemoryBackendTester.testNewAlert(t)
 }
 
+func TestIMBNewTransfer(t *testing.T) {
+	inMemoryBackendTester.testNewTransfer(t)
+}
+
+func TestIMBNewTransferNotFoundErrors(t *testing.T) {
+	inMemoryBackendTester.testNewTransferNotFoundErrors(t)
+}
+
+func TestIMBNewTransferNegativeStockPolicy(t *testing.T) {
+	inMemoryBackendTester.testNewTransferNegativeStockPolicy(t)
+}
+
+func TestIMBApiKeyLifecycle(t *testing.T) {
+	inMemoryBackendTester.testApiKeyLifecycle(t)
+}
+
+func TestIMBApiKeyNotFound(t *testing.T) {
+	inMemoryBackendTester.testApiKeyNotFound(t)
+}
+
 func TestIMBUpdateItem(t *testing.T) {
 	inMemoryBackendTester.testUpdateItem(t)
 }
@@ -159,6 +420,10 @@ func TestIMBUpdateItemNotFound(t *testing.T) {
 	inMemoryBackendTester.testUpdateItemNotFound(t)
 }
 
+func TestIMBUpdateItemVersion(t *testing.T) {
+	inMemoryBackendTester.testUpdateItemVersion(t)
+}
+
 func TestIMBUpdateLocation(t *testing.T) {
 	inMemoryBackendTester.testUpdateLocation(t)
 }
@@ -166,3 +431,31 @@ func TestIMBUpdateLocation(t *testing.T) {
 func TestIMBUpdateLocationNotFound(t *testing.T) {
 	inMemoryBackendTester.testUpdateLocationNotFound(t)
 }
+
+func TestIMBUpdateLocationVersion(t *testing.T) {
+	inMemoryBackendTester.testUpdateLocationVersion(t)
+}
+
+func TestIMBArchiveItem(t *testing.T) {
+	inMemoryBackendTester.testArchiveItem(t)
+}
+
+func TestIMBArchiveItemNotFound(t *testing.T) {
+	inMemoryBackendTester.testArchiveItemNotFound(t)
+}
+
+func TestIMBArchiveLocation(t *testing.T) {
+	inMemoryBackendTester.testArchiveLocation(t)
+}
+
+func TestIMBArchiveLocationNotFound(t *testing.T) {
+	inMemoryBackendTester.testArchiveLocationNotFound(t)
+}
+
+func TestIMBListIncludeArchived(t *testing.T) {
+	inMemoryBackendTester.testListIncludeArchived(t)
+}
+
+func TestIMBNewInventoryTransactionArchived(t *testing.T) {
+	inMemoryBackendTester.testNewInventoryTransactionArchived(t)
+}
@@ -0,0 +1,1441 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	alertColumns                = "id, item_id, location_id, transaction_id, kind, text, timestamp, state, occurrences, acknowledged_by, acknowledged_at, resolved_by, resolved_at, snoozed_by, snoozed_until"
+	apiKeyColumns               = "id, name, scope, warehouses, created_by, created_at, expires_at, last_used_at, revoked_at, secret_hash"
+	archivedInventoryColumns    = "id, item_id, location_id, count, last_updated, archived_at"
+	idempotencyRecordColumns    = "id, key, created_by, transaction_id, timestamp"
+	inventoryColumns            = "item_id, location_id, count, last_updated"
+	inventoryTransactionColumns = "id, item_id, location_id, action, count, note, timestamp, created_by, transfer_id, warehouse"
+	itemColumns                 = "id, name, description, negative_stock_policy, reorder_point, location_reorder_points, version, archived, archived_at"
+	locationColumns             = "id, name, warehouse, negative_stock_policy, version, archived, archived_at"
+)
+
+// The primary result codes of SQLite that a later retry may not run into
+const (
+	sqliteBusy   = 5
+	sqliteLocked = 6
+)
+
+// sqlDialect describes how the SQL databases supported by SQLBackend differ
+type sqlDialect struct {
+	// timestamp is the column type of times
+	timestamp string
+	// forUpdate is appended to queries that lock the rows they select until
+	// the end of the transaction
+	forUpdate string
+	// lockMigrations keeps concurrent migrations of the database apart
+	lockMigrations string
+	// maxOpenConns limits the connections to the database, if positive
+	maxOpenConns int
+}
+
+// sqlDialects are the supported dialects by driver name
+var sqlDialects = map[string]sqlDialect{
+	"postgres": {
+		timestamp:      "TIMESTAMPTZ",
+		forUpdate:      " FOR UPDATE",
+		lockMigrations: "LOCK TABLE schema_migrations IN EXCLUSIVE MODE",
+	},
+	// SQLite has no row locks, but it allows a single writer at a time, and
+	// an in-memory database only exists for the connection that opened it.
+	// A single connection serializes transactions instead.
+	"sqlite": {
+		timestamp:    "TIMESTAMP",
+		maxOpenConns: 1,
+	},
+}
+
+// SQLBackend is a backend that talks to PostgreSQL or SQLite and implements
+// the Backend interface
+type SQLBackend struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// NewSQLBackend opens the database with the given driver, either "postgres" or
+// "sqlite", and migrates its schema to the latest version
+func NewSQLBackend(ctx context.Context, driver, dataSourceName string) (*SQLBackend, error) {
+	dialect, ok := sqlDialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported SQL driver %q, want postgres or sqlite", driver)
+	}
+	db, err := sql.Open(driver, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if dialect.maxOpenConns > 0 {
+		db.SetMaxOpenConns(dialect.maxOpenConns)
+	}
+	sb := &SQLBackend{db: db, dialect: dialect}
+	if err := sb.migrate(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating the %s database: %v", driver, err)
+	}
+	return sb, nil
+}
+
+// Close closes the database
+func (sb *SQLBackend) Close() error {
+	return sb.db.Close()
+}
+
+// sqlErrorKind classifies the errors of the database drivers. PostgreSQL
+// reports the SQLSTATE of an error, and SQLite its result code.
+func sqlErrorKind(err error) (ErrorKind, bool) {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return KindUnavailable, true
+	}
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		state := pgErr.SQLState()
+		switch {
+		case strings.HasPrefix(state, "08"), strings.HasPrefix(state, "53"), strings.HasPrefix(state, "57P"):
+			// Connection exceptions, insufficient resources and shutdowns
+			return KindUnavailable, true
+		case strings.HasPrefix(state, "40"), state == "23505":
+			// Serialization failures, deadlocks and unique violations
+			return KindConflict, true
+		default:
+			return KindInternal, true
+		}
+	}
+	var sqliteErr interface{ Code() int }
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() & 0xff {
+		case sqliteBusy, sqliteLocked:
+			return KindUnavailable, true
+		default:
+			return KindInternal, true
+		}
+	}
+	return KindInternal, false
+}
+
+// migrate applies the migrations that the database is missing
+func (sb *SQLBackend) migrate(ctx context.Context) error {
+	create := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at %s NOT NULL
+	)`, sb.dialect.timestamp)
+	if _, err := sb.db.ExecContext(ctx, create); err != nil {
+		return err
+	}
+
+	return sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		if sb.dialect.lockMigrations != "" {
+			if _, err := tx.ExecContext(ctx, sb.dialect.lockMigrations); err != nil {
+				return err
+			}
+		}
+		var applied int
+		if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&applied); err != nil {
+			return err
+		}
+		for version := applied + 1; version <= len(sqlMigrations); version++ {
+			migration := sqlMigrations[version-1]
+			for _, statement := range migration.statements {
+				statement = strings.ReplaceAll(statement, "{{timestamp}}", sb.dialect.timestamp)
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return fmt.Errorf("migration %d (%s): %v", version, migration.description, err)
+				}
+			}
+			err := insertRow(ctx, tx, "schema_migrations", "version, description, applied_at", version, migration.description, time.Now().UTC())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// maxTransactionAttempts bounds the attempts at a transaction that conflicts
+// with concurrent ones, as the Firestore client does
+const maxTransactionAttempts = 5
+
+// runTransaction runs f in a database transaction, which is committed if f
+// succeeds and rolled back otherwise. Like Firestore transactions, it is run
+// again if it conflicts with a concurrent transaction, so f must not have
+// effects outside of tx.
+func (sb *SQLBackend) runTransaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	var err error
+	for attempt := 0; attempt < maxTransactionAttempts; attempt++ {
+		if err = sb.attemptTransaction(ctx, f); !retryableSQLError(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// attemptTransaction runs f in a database transaction once
+func (sb *SQLBackend) attemptTransaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := sb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// concurrentTransaction fails an attempt at a transaction that found the
+// changes of a concurrent one, so that runTransaction runs it again
+type concurrentTransaction struct {
+	err error
+}
+
+func (e *concurrentTransaction) Error() string {
+	return e.err.Error()
+}
+
+func (e *concurrentTransaction) Unwrap() error {
+	return e.err
+}
+
+// retryableSQLError reports whether the transaction failed because of a
+// concurrent one, and may succeed if it is run again: PostgreSQL
+// serialization failures, deadlocks and unique violations, and the
+// concurrentTransaction errors of the backend
+func retryableSQLError(err error) bool {
+	var concurrent *concurrentTransaction
+	if errors.As(err, &concurrent) {
+		return true
+	}
+	var pgErr interface{ SQLState() string }
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	switch pgErr.SQLState() {
+	case "40001", "40P01", "23505":
+		return true
+	default:
+		return false
+	}
+}
+
+// queryer runs queries either directly on the database or in a transaction
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// rowScanner is either *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// placeholders returns the numbered placeholders of n query arguments
+func placeholders(n int) string {
+	p := make([]string, n)
+	for i := range p {
+		p[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return strings.Join(p, ", ")
+}
+
+// insertRow inserts the values of the columns as a row of the table
+func insertRow(ctx context.Context, q queryer, table, columns string, values ...interface{}) error {
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, columns, placeholders(len(values)))
+	_, err := q.ExecContext(ctx, query, values...)
+	return err
+}
+
+// updateRow replaces the columns of the row of the table whose id is the
+// first of the values
+func updateRow(ctx context.Context, q queryer, table, columns string, values ...interface{}) error {
+	names := strings.Split(columns, ", ")
+	sets := make([]string, 0, len(names)-1)
+	for i, name := range names[1:] {
+		sets = append(sets, fmt.Sprintf("%s = $%d", name, i+2))
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s = $1", table, strings.Join(sets, ", "), names[0])
+	_, err := q.ExecContext(ctx, query, values...)
+	return err
+}
+
+// deleteRow deletes the row of the table with the given id, and returns
+// whether it existed
+func deleteRow(ctx context.Context, q queryer, table, id string) (bool, error) {
+	result, err := q.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = $1", table), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// sqlTime returns the time to store, in UTC so that stored times compare in
+// the same order as the times they are
+func sqlTime(t time.Time) time.Time {
+	return t.UTC()
+}
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: sqlTime(t), Valid: !t.IsZero()}
+}
+
+func itemValues(item *Item) ([]interface{}, error) {
+	var points string
+	if len(item.LocationReorderPoints) > 0 {
+		b, err := json.Marshal(item.LocationReorderPoints)
+		if err != nil {
+			return nil, err
+		}
+		points = string(b)
+	}
+	return []interface{}{item.Id, item.Name, item.Description, item.NegativeStockPolicy, item.ReorderPoint, points, item.Version, item.Archived, nullTime(item.ArchivedAt)}, nil
+}
+
+func scanItem(row rowScanner) (*Item, error) {
+	item := &Item{}
+	var points string
+	var archivedAt sql.NullTime
+	err := row.Scan(&item.Id, &item.Name, &item.Description, &item.NegativeStockPolicy, &item.ReorderPoint, &points, &item.Version, &item.Archived, &archivedAt)
+	if err != nil {
+		return nil, err
+	}
+	item.ArchivedAt = archivedAt.Time
+	if points != "" {
+		if err := json.Unmarshal([]byte(points), &item.LocationReorderPoints); err != nil {
+			return nil, err
+		}
+	}
+	return item, nil
+}
+
+func locationValues(location *Location) []interface{} {
+	return []interface{}{location.Id, location.Name, location.Warehouse, location.NegativeStockPolicy, location.Version, location.Archived, nullTime(location.ArchivedAt)}
+}
+
+func scanLocation(row rowScanner) (*Location, error) {
+	location := &Location{}
+	var archivedAt sql.NullTime
+	err := row.Scan(&location.Id, &location.Name, &location.Warehouse, &location.NegativeStockPolicy, &location.Version, &location.Archived, &archivedAt)
+	if err != nil {
+		return nil, err
+	}
+	location.ArchivedAt = archivedAt.Time
+	return location, nil
+}
+
+func inventoryValues(inv *Inventory) []interface{} {
+	return []interface{}{inv.ItemId, inv.LocationId, inv.Count, sqlTime(inv.LastUpdated)}
+}
+
+func scanInventory(row rowScanner) (*Inventory, error) {
+	inv := &Inventory{}
+	if err := row.Scan(&inv.ItemId, &inv.LocationId, &inv.Count, &inv.LastUpdated); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+func inventoryTransactionValues(txn *InventoryTransaction) []interface{} {
+	return []interface{}{txn.Id, txn.ItemId, txn.LocationId, txn.Action, txn.Count, txn.Note, sqlTime(txn.Timestamp), txn.CreatedBy, txn.TransferId, txn.Warehouse}
+}
+
+func scanInventoryTransaction(row rowScanner) (*InventoryTransaction, error) {
+	txn := &InventoryTransaction{}
+	err := row.Scan(&txn.Id, &txn.ItemId, &txn.LocationId, &txn.Action, &txn.Count, &txn.Note, &txn.Timestamp, &txn.CreatedBy, &txn.TransferId, &txn.Warehouse)
+	if err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+func alertValues(alert *Alert) []interface{} {
+	return []interface{}{
+		alert.Id, alert.ItemId, alert.LocationId, alert.TransactionId, alert.Kind, alert.Text, sqlTime(alert.Timestamp), alert.State, alert.Occurrences,
+		alert.AcknowledgedBy, nullTime(alert.AcknowledgedAt), alert.ResolvedBy, nullTime(alert.ResolvedAt), alert.SnoozedBy, nullTime(alert.SnoozedUntil),
+	}
+}
+
+func scanAlert(row rowScanner) (*Alert, error) {
+	alert := &Alert{}
+	var acknowledgedAt, resolvedAt, snoozedUntil sql.NullTime
+	err := row.Scan(
+		&alert.Id, &alert.ItemId, &alert.LocationId, &alert.TransactionId, &alert.Kind, &alert.Text, &alert.Timestamp, &alert.State, &alert.Occurrences,
+		&alert.AcknowledgedBy, &acknowledgedAt, &alert.ResolvedBy, &resolvedAt, &alert.SnoozedBy, &snoozedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	alert.AcknowledgedAt, alert.ResolvedAt, alert.SnoozedUntil = acknowledgedAt.Time, resolvedAt.Time, snoozedUntil.Time
+	return alert, nil
+}
+
+// getItem reads the item, locking it if forUpdate is set
+func (sb *SQLBackend) getItem(ctx context.Context, q queryer, id string, forUpdate bool) (*Item, error) {
+	query := "SELECT " + itemColumns + " FROM items WHERE id = $1"
+	if forUpdate {
+		query += sb.dialect.forUpdate
+	}
+	item, err := scanItem(q.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, ItemNotFound(id)
+	}
+	return item, err
+}
+
+// getLocation reads the location, locking it if forUpdate is set
+func (sb *SQLBackend) getLocation(ctx context.Context, q queryer, id string, forUpdate bool) (*Location, error) {
+	query := "SELECT " + locationColumns + " FROM locations WHERE id = $1"
+	if forUpdate {
+		query += sb.dialect.forUpdate
+	}
+	location, err := scanLocation(q.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, LocationNotFound(id)
+	}
+	return location, err
+}
+
+// getItemAndLocation reads the item and location of an inventory transaction
+func (sb *SQLBackend) getItemAndLocation(ctx context.Context, q queryer, itemId, locationId string) (*Item, *Location, error) {
+	item, err := sb.getItem(ctx, q, itemId, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	location, err := sb.getLocation(ctx, q, locationId, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return item, location, nil
+}
+
+// lockInventory creates the inventory of the item at the location if it does
+// not exist yet, then reads and locks it within the transaction
+func (sb *SQLBackend) lockInventory(ctx context.Context, tx *sql.Tx, itemId, locationId string) (*Inventory, error) {
+	if err := createInventory(ctx, tx, itemId, locationId); err != nil {
+		return nil, err
+	}
+	query := "SELECT " + inventoryColumns + " FROM inventories WHERE item_id = $1 AND location_id = $2" + sb.dialect.forUpdate
+	return scanInventory(tx.QueryRowContext(ctx, query, itemId, locationId))
+}
+
+// createInventory creates an empty inventory of the item at the location,
+// unless it exists already
+func createInventory(ctx context.Context, q queryer, itemId, locationId string) error {
+	query := "INSERT INTO inventories (" + inventoryColumns + ") VALUES ($1, $2, 0, $3) ON CONFLICT (item_id, location_id) DO NOTHING"
+	_, err := q.ExecContext(ctx, query, itemId, locationId, sqlTime(time.Now()))
+	return err
+}
+
+// storeInventory stores the inventory, replacing the stored count
+func storeInventory(ctx context.Context, q queryer, inv *Inventory) error {
+	query := "INSERT INTO inventories (" + inventoryColumns + ") VALUES ($1, $2, $3, $4) " +
+		"ON CONFLICT (item_id, location_id) DO UPDATE SET count = excluded.count, last_updated = excluded.last_updated"
+	_, err := q.ExecContext(ctx, query, inventoryValues(inv)...)
+	return err
+}
+
+// lockItemCount returns the total inventory of the item across all locations,
+// and locks its inventories within the transaction in the order of their
+// locations, so that concurrent transactions do not deadlock
+func (sb *SQLBackend) lockItemCount(ctx context.Context, tx *sql.Tx, itemId string) (int64, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT count FROM inventories WHERE item_id = $1 ORDER BY location_id"+sb.dialect.forUpdate, itemId)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var total int64
+	for rows.Next() {
+		var count int64
+		if err := rows.Scan(&count); err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, rows.Err()
+}
+
+func apiKeyValues(record *apiKeyRecord) ([]interface{}, error) {
+	var warehouses string
+	if len(record.Warehouses) > 0 {
+		b, err := json.Marshal(record.Warehouses)
+		if err != nil {
+			return nil, err
+		}
+		warehouses = string(b)
+	}
+	return []interface{}{
+		record.Id, record.Name, record.Scope, warehouses, record.CreatedBy, sqlTime(record.CreatedAt), sqlTime(record.ExpiresAt),
+		nullTime(record.LastUsedAt), nullTime(record.RevokedAt), record.SecretHash,
+	}, nil
+}
+
+func scanApiKey(row rowScanner) (*apiKeyRecord, error) {
+	record := &apiKeyRecord{}
+	var warehouses string
+	var lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(
+		&record.Id, &record.Name, &record.Scope, &warehouses, &record.CreatedBy, &record.CreatedAt, &record.ExpiresAt,
+		&lastUsedAt, &revokedAt, &record.SecretHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	record.LastUsedAt, record.RevokedAt = lastUsedAt.Time, revokedAt.Time
+	if warehouses != "" {
+		if err := json.Unmarshal([]byte(warehouses), &record.Warehouses); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// raiseAlerts stores the alerts within the transaction, merging each one into
+// an unresolved alert it duplicates
+func (sb *SQLBackend) raiseAlerts(ctx context.Context, tx *sql.Tx, alerts []*Alert) error {
+	for _, alert := range alerts {
+		query := "SELECT " + alertColumns + " FROM alerts WHERE item_id = $1 AND location_id = $2 AND kind = $3 ORDER BY id" + sb.dialect.forUpdate
+		existing, err := queryAlerts(ctx, tx, query, alert.ItemId, alert.LocationId, alert.Kind)
+		if err != nil {
+			return err
+		}
+		var duplicated *Alert
+		for _, e := range existing {
+			if alert.duplicates(e) {
+				duplicated = e
+				break
+			}
+		}
+		if duplicated != nil {
+			duplicated.merge(alert)
+			err = updateRow(ctx, tx, "alerts", alertColumns, alertValues(duplicated)...)
+		} else {
+			alert.Id = uuid.New().String()
+			err = insertRow(ctx, tx, "alerts", alertColumns, alertValues(alert)...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryAlerts(ctx context.Context, q queryer, query string, args ...interface{}) ([]*Alert, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var alerts []*Alert
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, rows.Err()
+}
+
+// sqlQuery builds a query with numbered arguments
+type sqlQuery struct {
+	selectFrom string
+	conditions []string
+	args       []interface{}
+}
+
+// arg adds an argument to the query and returns its placeholder
+func (q *sqlQuery) arg(value interface{}) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+// where adds a condition that the selected rows must all meet
+func (q *sqlQuery) where(condition string) {
+	q.conditions = append(q.conditions, condition)
+}
+
+func (q *sqlQuery) String() string {
+	if len(q.conditions) == 0 {
+		return q.selectFrom
+	}
+	return q.selectFrom + " WHERE " + strings.Join(q.conditions, " AND ")
+}
+
+// rowOrder orders listed rows by a time column, if set, then by a key column
+// that is unique within the list
+type rowOrder struct {
+	timeColumn string
+	keyColumn  string
+	descending bool
+}
+
+// listPage runs the query for the requested page of rows in the given order,
+// scanning each row of the page, and returns the token of the next page if
+// there are more rows. scan returns the key of the row, and its time if the
+// order has a time column.
+func (sb *SQLBackend) listPage(ctx context.Context, q *sqlQuery, order rowOrder, page PageRequest, scan func(*sql.Rows) (string, time.Time, error)) (string, error) {
+	after, err := page.after()
+	if err != nil {
+		return "", err
+	}
+	dir, cmp := "ASC", ">"
+	if order.descending {
+		dir, cmp = "DESC", "<"
+	}
+	if after != "" {
+		if order.timeColumn == "" {
+			q.where(fmt.Sprintf("%s %s %s", order.keyColumn, cmp, q.arg(after)))
+		} else {
+			t, key, err := parseTimeKey(after)
+			if err != nil {
+				return "", &InvalidPageToken{token: page.Token}
+			}
+			at, k := q.arg(sqlTime(t)), q.arg(key)
+			q.where(fmt.Sprintf("(%[1]s %[3]s %[4]s OR %[1]s = %[4]s AND %[2]s %[3]s %[5]s)", order.timeColumn, order.keyColumn, cmp, at, k))
+		}
+	}
+	query := q.String() + " ORDER BY "
+	if order.timeColumn != "" {
+		query += order.timeColumn + " " + dir + ", "
+	}
+	query += order.keyColumn + " " + dir
+	if page.Size > 0 {
+		// Fetch one more row to tell whether there is a next page
+		query += fmt.Sprintf(" LIMIT %d", page.Size+1)
+	}
+
+	rows, err := sb.db.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var n int
+	var key string
+	var t time.Time
+	for rows.Next() {
+		if page.Size > 0 && n == page.Size {
+			if order.timeColumn == "" {
+				return pageToken(key), nil
+			}
+			return pageToken(timeKey(t, key)), nil
+		}
+		if key, t, err = scan(rows); err != nil {
+			return "", err
+		}
+		n++
+	}
+	return "", rows.Err()
+}
+
+func (sb *SQLBackend) DeleteAlert(ctx context.Context, id string) error {
+	ok, err := deleteRow(ctx, sb.db, "alerts", id)
+	if err == nil && !ok {
+		return AlertNotFound(id)
+	}
+	return err
+}
+
+// deleteWithInventory deletes the item or location along with its
+// inventories, the ones whose column matches the id, in one transaction.
+// Nonzero inventories are archived if archiveInventory is set, and block the
+// delete otherwise.
+func (sb *SQLBackend) deleteWithInventory(ctx context.Context, table, column, id string, archiveInventory bool) error {
+	return sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRowContext(ctx, "SELECT 1 FROM "+table+" WHERE id = $1"+sb.dialect.forUpdate, id).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return &ResourceNotFound{collection: table, id: id}
+		}
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, "SELECT "+inventoryColumns+" FROM inventories WHERE "+column+" = $1 ORDER BY item_id, location_id"+sb.dialect.forUpdate, id)
+		if err != nil {
+			return err
+		}
+		var invs []*Inventory
+		nonzero := 0
+		for rows.Next() {
+			inv, err := scanInventory(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if inv.Count != 0 {
+				nonzero++
+			}
+			invs = append(invs, inv)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if nonzero > 0 && !archiveInventory {
+			return &ResourceInUse{collection: table, id: id, inventories: nonzero}
+		}
+
+		now := sqlTime(time.Now())
+		for _, inv := range invs {
+			err := insertRow(ctx, tx, "archived_inventories", archivedInventoryColumns, uuid.New().String(), inv.ItemId, inv.LocationId, inv.Count, sqlTime(inv.LastUpdated), now)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM inventories WHERE "+column+" = $1", id); err != nil {
+			return err
+		}
+		_, err = deleteRow(ctx, tx, table, id)
+		return err
+	})
+}
+
+func (sb *SQLBackend) DeleteItem(ctx context.Context, id string, archiveInventory bool) error {
+	return sb.deleteWithInventory(ctx, "items", "item_id", id, archiveInventory)
+}
+
+func (sb *SQLBackend) DeleteLocation(ctx context.Context, id string, archiveInventory bool) error {
+	return sb.deleteWithInventory(ctx, "locations", "location_id", id, archiveInventory)
+}
+
+func (sb *SQLBackend) GetApiKey(ctx context.Context, id string) (*ApiKey, error) {
+	record, err := sb.lookupApiKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &record.ApiKey, nil
+}
+
+func (sb *SQLBackend) GetInventoryTransaction(ctx context.Context, id string) (*InventoryTransaction, error) {
+	row := sb.db.QueryRowContext(ctx, "SELECT "+inventoryTransactionColumns+" FROM inventory_transactions WHERE id = $1", id)
+	txn, err := scanInventoryTransaction(row)
+	if err == sql.ErrNoRows {
+		return nil, InventoryTransactionNotFound(id)
+	}
+	return txn, err
+}
+
+func (sb *SQLBackend) GetItem(ctx context.Context, id string) (*Item, error) {
+	return sb.getItem(ctx, sb.db, id, false)
+}
+
+func (sb *SQLBackend) GetLocation(ctx context.Context, id string) (*Location, error) {
+	return sb.getLocation(ctx, sb.db, id, false)
+}
+
+func (sb *SQLBackend) ListAlerts(ctx context.Context, filter AlertFilter, page PageRequest) ([]*Alert, string, error) {
+	q := &sqlQuery{selectFrom: "SELECT " + alertColumns + " FROM alerts"}
+	if filter.State != "" {
+		q.where("state = " + q.arg(filter.State))
+	}
+	if !filter.IncludeSnoozed {
+		q.where("(snoozed_until IS NULL OR snoozed_until <= " + q.arg(sqlTime(time.Now())) + ")")
+	}
+	alerts := make([]*Alert, 0)
+	next, err := sb.listPage(ctx, q, rowOrder{keyColumn: "id"}, page, func(rows *sql.Rows) (string, time.Time, error) {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		alerts = append(alerts, alert)
+		return alert.Id, time.Time{}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return alerts, next, nil
+}
+
+func (sb *SQLBackend) ListItems(ctx context.Context, includeArchived bool, page PageRequest) ([]*Item, string, error) {
+	q := &sqlQuery{selectFrom: "SELECT " + itemColumns + " FROM items"}
+	if !includeArchived {
+		q.where("NOT archived")
+	}
+	items := make([]*Item, 0)
+	next, err := sb.listPage(ctx, q, rowOrder{keyColumn: "id"}, page, func(rows *sql.Rows) (string, time.Time, error) {
+		item, err := scanItem(rows)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		items = append(items, item)
+		return item.Id, time.Time{}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return items, next, nil
+}
+
+func (sb *SQLBackend) ListLocations(ctx context.Context, includeArchived bool, page PageRequest) ([]*Location, string, error) {
+	q := &sqlQuery{selectFrom: "SELECT " + locationColumns + " FROM locations"}
+	if !includeArchived {
+		q.where("NOT archived")
+	}
+	locations := make([]*Location, 0)
+	next, err := sb.listPage(ctx, q, rowOrder{keyColumn: "id"}, page, func(rows *sql.Rows) (string, time.Time, error) {
+		location, err := scanLocation(rows)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		locations = append(locations, location)
+		return location.Id, time.Time{}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return locations, next, nil
+}
+
+// listInventories lists the inventories whose column matches the id, keyed by
+// the key column
+func (sb *SQLBackend) listInventories(ctx context.Context, column, id, keyColumn string, page PageRequest) ([]*Inventory, string, error) {
+	q := &sqlQuery{selectFrom: "SELECT " + inventoryColumns + " FROM inventories"}
+	q.where(column + " = " + q.arg(id))
+	invs := make([]*Inventory, 0)
+	next, err := sb.listPage(ctx, q, rowOrder{keyColumn: keyColumn}, page, func(rows *sql.Rows) (string, time.Time, error) {
+		inv, err := scanInventory(rows)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		invs = append(invs, inv)
+		if keyColumn == "item_id" {
+			return inv.ItemId, time.Time{}, nil
+		}
+		return inv.LocationId, time.Time{}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return invs, next, nil
+}
+
+func (sb *SQLBackend) ListItemInventory(ctx context.Context, itemId string, page PageRequest) ([]*Inventory, string, error) {
+	// The inventory of an item is keyed by location
+	return sb.listInventories(ctx, "item_id", itemId, "location_id", page)
+}
+
+func (sb *SQLBackend) ListLocationInventory(ctx context.Context, locationId string, page PageRequest) ([]*Inventory, string, error) {
+	// The inventory at a location is keyed by item
+	return sb.listInventories(ctx, "location_id", locationId, "item_id", page)
+}
+
+// listInventoryTransactions lists the inventory transactions selected by the
+// filter whose column matches the id, if a column is given
+func (sb *SQLBackend) listInventoryTransactions(ctx context.Context, column, id string, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error) {
+	q := &sqlQuery{selectFrom: "SELECT " + inventoryTransactionColumns + " FROM inventory_transactions"}
+	if column != "" {
+		q.where(column + " = " + q.arg(id))
+	}
+	if !filter.Start.IsZero() {
+		q.where("timestamp >= " + q.arg(sqlTime(filter.Start)))
+	}
+	if !filter.End.IsZero() {
+		q.where("timestamp < " + q.arg(sqlTime(filter.End)))
+	}
+	if filter.Action != "" {
+		q.where("action = " + q.arg(filter.Action))
+	}
+	if filter.CreatedBy != "" {
+		q.where("created_by = " + q.arg(filter.CreatedBy))
+	}
+	if filter.Warehouse != "" {
+		q.where("warehouse = " + q.arg(filter.Warehouse))
+	}
+	if len(filter.Warehouses) > 0 {
+		placeholders := make([]string, len(filter.Warehouses))
+		for i, warehouse := range filter.Warehouses {
+			placeholders[i] = q.arg(warehouse)
+		}
+		q.where("warehouse IN (" + strings.Join(placeholders, ", ") + ")")
+	}
+	order := rowOrder{timeColumn: "timestamp", keyColumn: "id", descending: filter.Descending}
+	txns := make([]*InventoryTransaction, 0)
+	next, err := sb.listPage(ctx, q, order, page, func(rows *sql.Rows) (string, time.Time, error) {
+		txn, err := scanInventoryTransaction(rows)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		txns = append(txns, txn)
+		return txn.Id, txn.Timestamp, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return txns, next, nil
+}
+
+func (sb *SQLBackend) ListInventoryTransactions(ctx context.Context, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error) {
+	return sb.listInventoryTransactions(ctx, "", "", filter, page)
+}
+
+func (sb *SQLBackend) ListItemInventoryTransactions(ctx context.Context, itemId string, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error) {
+	return sb.listInventoryTransactions(ctx, "item_id", itemId, filter, page)
+}
+
+func (sb *SQLBackend) ListLocationInventoryTransactions(ctx context.Context, locationId string, filter TransactionFilter, page PageRequest) ([]*InventoryTransaction, string, error) {
+	return sb.listInventoryTransactions(ctx, "location_id", locationId, filter, page)
+}
+
+func (sb *SQLBackend) ListApiKeys(ctx context.Context, page PageRequest) ([]*ApiKey, string, error) {
+	q := &sqlQuery{selectFrom: "SELECT " + apiKeyColumns + " FROM api_keys"}
+	keys := make([]*ApiKey, 0)
+	next, err := sb.listPage(ctx, q, rowOrder{keyColumn: "id"}, page, func(rows *sql.Rows) (string, time.Time, error) {
+		record, err := scanApiKey(rows)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		keys = append(keys, &record.ApiKey)
+		return record.Id, time.Time{}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, next, nil
+}
+
+func (sb *SQLBackend) NewApiKey(ctx context.Context, key *apiKeyRecord) (*ApiKey, error) {
+	record := *key
+	record.Id = uuid.New().String()
+	values, err := apiKeyValues(&record)
+	if err != nil {
+		return nil, err
+	}
+	if err := insertRow(ctx, sb.db, "api_keys", apiKeyColumns, values...); err != nil {
+		return nil, err
+	}
+	return &record.ApiKey, nil
+}
+
+func (sb *SQLBackend) NewAlert(ctx context.Context, inputAlert *Alert) (*Alert, error) {
+	alert := &Alert{}
+	*alert = *inputAlert
+	alert.Id = uuid.New().String()
+	if err := insertRow(ctx, sb.db, "alerts", alertColumns, alertValues(alert)...); err != nil {
+		return nil, err
+	}
+	return alert, nil
+}
+
+func (sb *SQLBackend) NewItem(ctx context.Context, inputItem *Item) (*Item, error) {
+	item := &Item{}
+	*item = *inputItem
+	item.Id = uuid.New().String()
+	item.Version = 1
+	item.setArchived(false, time.Time{})
+	values, err := itemValues(item)
+	if err != nil {
+		return nil, err
+	}
+	if err := insertRow(ctx, sb.db, "items", itemColumns, values...); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (sb *SQLBackend) NewLocation(ctx context.Context, inputLocation *Location) (*Location, error) {
+	location := &Location{}
+	*location = *inputLocation
+	location.Id = uuid.New().String()
+	location.Version = 1
+	location.setArchived(false, time.Time{})
+	if err := insertRow(ctx, sb.db, "locations", locationColumns, locationValues(location)...); err != nil {
+		return nil, err
+	}
+	return location, nil
+}
+
+// getReplayedTransaction returns the inventory transaction recorded with an
+// idempotency key, or nil if the key has not been used yet
+func (sb *SQLBackend) getReplayedTransaction(ctx context.Context, q queryer, recordId string) (*InventoryTransaction, error) {
+	var txnId string
+	err := q.QueryRowContext(ctx, "SELECT transaction_id FROM idempotency_records WHERE id = $1", recordId).Scan(&txnId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	row := q.QueryRowContext(ctx, "SELECT "+inventoryTransactionColumns+" FROM inventory_transactions WHERE id = $1", txnId)
+	return scanInventoryTransaction(row)
+}
+
+func (sb *SQLBackend) NewInventoryTransaction(ctx context.Context, inputTxn *InventoryTransaction, idempotencyKey string) (*InventoryTransaction, error) {
+	recordId := idempotencyId(inputTxn.CreatedBy, idempotencyKey)
+	var transaction, replayed *InventoryTransaction
+	err := sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		// Return the transaction created by an earlier request with the same key
+		if idempotencyKey != "" {
+			txn, err := sb.getReplayedTransaction(ctx, tx, recordId)
+			if err != nil || txn != nil {
+				replayed = txn
+				return err
+			}
+		}
+
+		// Lock the inventory, along with the whole inventory of the item if
+		// it has a total reorder point, before reading it
+		item, location, err := sb.getItemAndLocation(ctx, tx, inputTxn.ItemId, inputTxn.LocationId)
+		if err != nil {
+			return err
+		}
+		var total int64
+		if item.ReorderPoint > 0 {
+			if total, err = sb.lockItemCount(ctx, tx, item.Id); err != nil {
+				return err
+			}
+		}
+		inv, err := sb.lockInventory(ctx, tx, item.Id, location.Id)
+		if err != nil {
+			return err
+		}
+		if err := checkNotArchived(inputTxn, item, location, inv); err != nil {
+			return err
+		}
+
+		transaction = &InventoryTransaction{}
+		*transaction = *inputTxn
+		transaction.Id = uuid.New().String()
+		transaction.Warehouse = location.Warehouse
+		before := inv.Count
+		alerts, err := inv.applyTransactionWithPolicy(transaction, negativeStockPolicy(item, location))
+		if err != nil {
+			return err
+		}
+		alerts = append(alerts, item.reorderAlerts(transaction, before, inv.Count, total, total-before+inv.Count)...)
+		if err := sb.raiseAlerts(ctx, tx, alerts); err != nil {
+			return err
+		}
+		if err := storeInventory(ctx, tx, inv); err != nil {
+			return err
+		}
+		if err := insertRow(ctx, tx, "inventory_transactions", inventoryTransactionColumns, inventoryTransactionValues(transaction)...); err != nil {
+			return err
+		}
+		if idempotencyKey != "" {
+			return storeIdempotencyRecord(ctx, tx, recordId, &idempotencyRecord{
+				Key:           idempotencyKey,
+				CreatedBy:     transaction.CreatedBy,
+				TransactionId: transaction.Id,
+				Timestamp:     transaction.Timestamp,
+			})
+		}
+		return nil
+	})
+
+	if replayed != nil {
+		return replayed, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// storeIdempotencyRecord stores the record unless a concurrent request with
+// the same key stored one first, in which case the transaction is run again
+// to replay the transaction of that request
+func storeIdempotencyRecord(ctx context.Context, tx *sql.Tx, id string, record *idempotencyRecord) error {
+	query := "INSERT INTO idempotency_records (" + idempotencyRecordColumns + ") VALUES ($1, $2, $3, $4, $5) ON CONFLICT (id) DO NOTHING"
+	result, err := tx.ExecContext(ctx, query, id, record.Key, record.CreatedBy, record.TransactionId, sqlTime(record.Timestamp))
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &concurrentTransaction{&ResourceConflict{collection: "idempotencyRecords", id: id}}
+	}
+	return nil
+}
+
+func (sb *SQLBackend) NewInventoryTransactionBatch(ctx context.Context, inputTxns []*InventoryTransaction) ([]*InventoryTransaction, error) {
+	if len(inputTxns) > maxBatchSize {
+		return nil, &BatchTooLarge{size: len(inputTxns)}
+	}
+
+	transactions := make([]*InventoryTransaction, len(inputTxns))
+	err := sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		batch := newTransactionBatch()
+		for _, inputTxn := range inputTxns {
+			if _, loaded := batch.items[inputTxn.ItemId]; !loaded {
+				item, err := sb.getItem(ctx, tx, inputTxn.ItemId, false)
+				if err == nil {
+					batch.items[item.Id] = item
+				} else if KindOf(err) != KindNotFound {
+					return err
+				}
+			}
+			if _, loaded := batch.locations[inputTxn.LocationId]; !loaded {
+				location, err := sb.getLocation(ctx, tx, inputTxn.LocationId, false)
+				if err == nil {
+					batch.locations[location.Id] = location
+				} else if KindOf(err) != KindNotFound {
+					return err
+				}
+			}
+		}
+
+		// Lock the inventories of the items with a reorder point, then the
+		// inventories the batch affects, each in a stable order like single
+		// transactions do, so that concurrent batches do not deadlock
+		itemIds := make([]string, 0, len(batch.items))
+		for id := range batch.items {
+			itemIds = append(itemIds, id)
+		}
+		sort.Strings(itemIds)
+		for _, id := range itemIds {
+			if batch.items[id].ReorderPoint > 0 {
+				total, err := sb.lockItemCount(ctx, tx, id)
+				if err != nil {
+					return err
+				}
+				batch.totals[id] = total
+			}
+		}
+		// Entries of missing items or locations fail, so their inventories
+		// are not locked
+		var keys []inventoryKey
+		locked := make(map[inventoryKey]bool)
+		for _, inputTxn := range inputTxns {
+			key := inventoryKey{inputTxn.ItemId, inputTxn.LocationId}
+			_, itemFound := batch.items[key.itemId]
+			_, locationFound := batch.locations[key.locationId]
+			if itemFound && locationFound && !locked[key] {
+				locked[key] = true
+				keys = append(keys, key)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].itemId < keys[j].itemId || keys[i].itemId == keys[j].itemId && keys[i].locationId < keys[j].locationId
+		})
+		for _, key := range keys {
+			inv, err := sb.lockInventory(ctx, tx, key.itemId, key.locationId)
+			if err != nil {
+				return err
+			}
+			batch.inventories[key] = inv
+		}
+
+		// Apply the transactions to copies of the locked inventories
+		for i, inputTxn := range inputTxns {
+			transaction := &InventoryTransaction{}
+			*transaction = *inputTxn
+			transaction.Id = uuid.New().String()
+			if err := batch.apply(i, transaction); err != nil {
+				return err
+			}
+			transactions[i] = transaction
+		}
+
+		// Store the results, now that every transaction has applied, in a
+		// stable order
+		for _, key := range keys {
+			if err := storeInventory(ctx, tx, batch.inventories[key]); err != nil {
+				return err
+			}
+		}
+		for _, transaction := range transactions {
+			if err := insertRow(ctx, tx, "inventory_transactions", inventoryTransactionColumns, inventoryTransactionValues(transaction)...); err != nil {
+				return err
+			}
+		}
+		return sb.raiseAlerts(ctx, tx, batch.alerts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+func (sb *SQLBackend) NewTransfer(ctx context.Context, inputTransfer *Transfer) (*Transfer, error) {
+	transfer := &Transfer{}
+	*transfer = *inputTransfer
+	transfer.Id = uuid.New().String()
+	err := sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		item, source, err := sb.getItemAndLocation(ctx, tx, transfer.ItemId, transfer.SourceLocationId)
+		if err != nil {
+			return err
+		}
+		destination, err := sb.getLocation(ctx, tx, transfer.DestinationLocationId, false)
+		if err != nil {
+			return err
+		}
+		out, in := transfer.legs(source, destination)
+		out.Id, in.Id = uuid.New().String(), uuid.New().String()
+
+		// Lock both inventories in a stable order, so that opposite transfers
+		// do not deadlock
+		locationIds := []string{source.Id, destination.Id}
+		sort.Strings(locationIds)
+		invs := make(map[string]*Inventory)
+		for _, locationId := range locationIds {
+			inv, err := sb.lockInventory(ctx, tx, item.Id, locationId)
+			if err != nil {
+				return err
+			}
+			invs[locationId] = inv
+		}
+		srcInv, dstInv := invs[source.Id], invs[destination.Id]
+		if err := checkNotArchived(in, item, destination, dstInv); err != nil {
+			return err
+		}
+
+		before := srcInv.Count
+		alerts, err := srcInv.applyTransactionWithPolicy(out, negativeStockPolicy(item, source))
+		if err != nil {
+			return err
+		}
+		// The total inventory of the item is unchanged by a transfer
+		alerts = append(alerts, item.reorderAlerts(out, before, srcInv.Count, 0, 0)...)
+		if err := dstInv.applyTransaction(in); err != nil {
+			return err
+		}
+		if err := sb.raiseAlerts(ctx, tx, alerts); err != nil {
+			return err
+		}
+		for _, inv := range []*Inventory{srcInv, dstInv} {
+			if err := storeInventory(ctx, tx, inv); err != nil {
+				return err
+			}
+		}
+		for _, txn := range []*InventoryTransaction{out, in} {
+			if err := insertRow(ctx, tx, "inventory_transactions", inventoryTransactionColumns, inventoryTransactionValues(txn)...); err != nil {
+				return err
+			}
+		}
+		transfer.Timestamp = out.Timestamp
+		transfer.Transactions = []InventoryTransaction{*out, *in}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transfer, nil
+}
+
+func (sb *SQLBackend) UpdateItem(ctx context.Context, item *Item, version int64) (*Item, error) {
+	updated := &Item{}
+	*updated = *item
+	err := sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		stored, err := sb.getItem(ctx, tx, item.Id, true)
+		if err != nil {
+			return err
+		}
+		if !versionMatches(stored.Version, version) {
+			return ItemPreconditionFailed(item.Id, version)
+		}
+		updated.Version = stored.Version + 1
+		updated.setArchived(stored.Archived, stored.ArchivedAt)
+		values, err := itemValues(updated)
+		if err != nil {
+			return err
+		}
+		return updateRow(ctx, tx, "items", itemColumns, values...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (sb *SQLBackend) UpdateLocation(ctx context.Context, location *Location, version int64) (*Location, error) {
+	updated := &Location{}
+	*updated = *location
+	err := sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		stored, err := sb.getLocation(ctx, tx, location.Id, true)
+		if err != nil {
+			return err
+		}
+		if !versionMatches(stored.Version, version) {
+			return LocationPreconditionFailed(location.Id, version)
+		}
+		updated.Version = stored.Version + 1
+		updated.setArchived(stored.Archived, stored.ArchivedAt)
+		return updateRow(ctx, tx, "locations", locationColumns, locationValues(updated)...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (sb *SQLBackend) ArchiveItem(ctx context.Context, id string) (*Item, error) {
+	return sb.setItemArchived(ctx, id, true)
+}
+
+func (sb *SQLBackend) RestoreItem(ctx context.Context, id string) (*Item, error) {
+	return sb.setItemArchived(ctx, id, false)
+}
+
+func (sb *SQLBackend) setItemArchived(ctx context.Context, id string, archived bool) (*Item, error) {
+	var item *Item
+	err := sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		if item, err = sb.getItem(ctx, tx, id, true); err != nil || item.Archived == archived {
+			return err
+		}
+		item.setArchived(archived, time.Now())
+		item.Version++
+		values, err := itemValues(item)
+		if err != nil {
+			return err
+		}
+		return updateRow(ctx, tx, "items", itemColumns, values...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (sb *SQLBackend) ArchiveLocation(ctx context.Context, id string) (*Location, error) {
+	return sb.setLocationArchived(ctx, id, true)
+}
+
+func (sb *SQLBackend) RestoreLocation(ctx context.Context, id string) (*Location, error) {
+	return sb.setLocationArchived(ctx, id, false)
+}
+
+func (sb *SQLBackend) setLocationArchived(ctx context.Context, id string, archived bool) (*Location, error) {
+	var location *Location
+	err := sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		if location, err = sb.getLocation(ctx, tx, id, true); err != nil || location.Archived == archived {
+			return err
+		}
+		location.setArchived(archived, time.Now())
+		location.Version++
+		return updateRow(ctx, tx, "locations", locationColumns, locationValues(location)...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return location, nil
+}
+
+// updateAlert changes the alert with the given id in a transaction
+func (sb *SQLBackend) updateAlert(ctx context.Context, id string, change func(*Alert) error) (*Alert, error) {
+	var alert *Alert
+	err := sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, "SELECT "+alertColumns+" FROM alerts WHERE id = $1"+sb.dialect.forUpdate, id)
+		var err error
+		if alert, err = scanAlert(row); err == sql.ErrNoRows {
+			return AlertNotFound(id)
+		} else if err != nil {
+			return err
+		}
+		if err := change(alert); err != nil {
+			return err
+		}
+		return updateRow(ctx, tx, "alerts", alertColumns, alertValues(alert)...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return alert, nil
+}
+
+func (sb *SQLBackend) AcknowledgeAlert(ctx context.Context, id, actor string) (*Alert, error) {
+	return sb.updateAlert(ctx, id, func(alert *Alert) error {
+		return alert.acknowledge(actor)
+	})
+}
+
+func (sb *SQLBackend) ResolveAlert(ctx context.Context, id, actor string) (*Alert, error) {
+	return sb.updateAlert(ctx, id, func(alert *Alert) error {
+		return alert.resolve(actor)
+	})
+}
+
+func (sb *SQLBackend) SnoozeAlert(ctx context.Context, id string, until time.Time, actor string) (*Alert, error) {
+	return sb.updateAlert(ctx, id, func(alert *Alert) error {
+		return alert.snooze(until, actor)
+	})
+}
+
+func (sb *SQLBackend) RevokeApiKey(ctx context.Context, id string) (*ApiKey, error) {
+	var record *apiKeyRecord
+	err := sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = $1"+sb.dialect.forUpdate, id)
+		var err error
+		if record, err = scanApiKey(row); err == sql.ErrNoRows {
+			return ApiKeyNotFound(id)
+		} else if err != nil {
+			return err
+		}
+		record.revoke(time.Now())
+		values, err := apiKeyValues(record)
+		if err != nil {
+			return err
+		}
+		return updateRow(ctx, tx, "api_keys", apiKeyColumns, values...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record.ApiKey, nil
+}
+
+func (sb *SQLBackend) lookupApiKey(ctx context.Context, id string) (*apiKeyRecord, error) {
+	row := sb.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = $1", id)
+	record, err := scanApiKey(row)
+	if err == sql.ErrNoRows {
+		return nil, ApiKeyNotFound(id)
+	}
+	return record, err
+}
+
+// recordApiKeyUse only updates the time of last use, so that it does not
+// overwrite a concurrent revocation
+func (sb *SQLBackend) recordApiKeyUse(ctx context.Context, id string, at time.Time) error {
+	result, err := sb.db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = $1 WHERE id = $2", sqlTime(at), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ApiKeyNotFound(id)
+	}
+	return nil
+}
+
+// lookupInventory returns the inventory associated with the item and location
+func (sb *SQLBackend) lookupInventory(ctx context.Context, itemID, locationID string) (*Inventory, error) {
+	if err := createInventory(ctx, sb.db, itemID, locationID); err != nil {
+		return nil, err
+	}
+	row := sb.db.QueryRowContext(ctx, "SELECT "+inventoryColumns+" FROM inventories WHERE item_id = $1 AND location_id = $2", itemID, locationID)
+	return scanInventory(row)
+}
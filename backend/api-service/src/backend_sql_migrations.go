@@ -0,0 +1,137 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+// sqlMigration is a change to the schema of the SQL backend
+type sqlMigration struct {
+	description string
+	// statements are run in order, in the same transaction. {{timestamp}} is
+	// replaced by the column type of times in the dialect of the database.
+	statements []string
+}
+
+// sqlMigrations bring the schema of a SQL database up to date. A database
+// records the number of migrations applied to it in schema_migrations, so
+// migrations must never change or be reordered once released; add new ones
+// at the end instead.
+var sqlMigrations = []sqlMigration{
+	{
+		description: "create tables",
+		statements: []string{
+			`CREATE TABLE items (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				description TEXT NOT NULL,
+				negative_stock_policy TEXT NOT NULL,
+				reorder_point BIGINT NOT NULL,
+				location_reorder_points TEXT NOT NULL,
+				version BIGINT NOT NULL,
+				archived BOOLEAN NOT NULL,
+				archived_at {{timestamp}}
+			)`,
+			`CREATE TABLE locations (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				warehouse TEXT NOT NULL,
+				negative_stock_policy TEXT NOT NULL,
+				version BIGINT NOT NULL,
+				archived BOOLEAN NOT NULL,
+				archived_at {{timestamp}}
+			)`,
+			// The primary key is the unique constraint on (item_id, location_id)
+			// that keeps a single inventory per item and location
+			`CREATE TABLE inventories (
+				item_id TEXT NOT NULL,
+				location_id TEXT NOT NULL,
+				count BIGINT NOT NULL,
+				last_updated {{timestamp}} NOT NULL,
+				PRIMARY KEY (item_id, location_id)
+			)`,
+			`CREATE INDEX inventories_location_id ON inventories (location_id, item_id)`,
+			`CREATE TABLE inventory_transactions (
+				id TEXT PRIMARY KEY,
+				item_id TEXT NOT NULL,
+				location_id TEXT NOT NULL,
+				action TEXT NOT NULL,
+				count BIGINT NOT NULL,
+				note TEXT NOT NULL,
+				timestamp {{timestamp}} NOT NULL,
+				created_by TEXT NOT NULL,
+				transfer_id TEXT NOT NULL,
+				warehouse TEXT NOT NULL
+			)`,
+			`CREATE INDEX inventory_transactions_timestamp ON inventory_transactions (timestamp, id)`,
+			`CREATE INDEX inventory_transactions_item_id ON inventory_transactions (item_id, timestamp, id)`,
+			`CREATE INDEX inventory_transactions_location_id ON inventory_transactions (location_id, timestamp, id)`,
+			`CREATE TABLE alerts (
+				id TEXT PRIMARY KEY,
+				item_id TEXT NOT NULL,
+				location_id TEXT NOT NULL,
+				transaction_id TEXT NOT NULL,
+				kind TEXT NOT NULL,
+				text TEXT NOT NULL,
+				timestamp {{timestamp}} NOT NULL,
+				state TEXT NOT NULL,
+				occurrences BIGINT NOT NULL,
+				acknowledged_by TEXT NOT NULL,
+				acknowledged_at {{timestamp}},
+				resolved_by TEXT NOT NULL,
+				resolved_at {{timestamp}},
+				snoozed_by TEXT NOT NULL,
+				snoozed_until {{timestamp}}
+			)`,
+			`CREATE INDEX alerts_item_id ON alerts (item_id, location_id, kind)`,
+			`CREATE TABLE idempotency_records (
+				id TEXT PRIMARY KEY,
+				key TEXT NOT NULL,
+				created_by TEXT NOT NULL,
+				transaction_id TEXT NOT NULL,
+				timestamp {{timestamp}} NOT NULL
+			)`,
+			`CREATE TABLE archived_inventories (
+				id TEXT PRIMARY KEY,
+				item_id TEXT NOT NULL,
+				location_id TEXT NOT NULL,
+				count BIGINT NOT NULL,
+				last_updated {{timestamp}} NOT NULL,
+				archived_at {{timestamp}} NOT NULL
+			)`,
+		},
+	},
+	{
+		description: "create api_keys table",
+		statements: []string{
+			`CREATE TABLE api_keys (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				scope TEXT NOT NULL,
+				warehouses TEXT NOT NULL,
+				created_by TEXT NOT NULL,
+				created_at {{timestamp}} NOT NULL,
+				expires_at {{timestamp}} NOT NULL,
+				last_used_at {{timestamp}},
+				revoked_at {{timestamp}},
+				secret_hash TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		description: "store the warehouse of inventory transactions without one",
+		statements: []string{
+			`UPDATE inventory_transactions
+			SET warehouse = (SELECT warehouse FROM locations WHERE locations.id = inventory_transactions.location_id)
+			WHERE warehouse = '' AND EXISTS (SELECT 1 FROM locations WHERE locations.id = inventory_transactions.location_id)`,
+		},
+	},
+}
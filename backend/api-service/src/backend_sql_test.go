@@ -0,0 +1,453 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package service
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// sqlTestTables are cleared between tests run against a shared database
+var sqlTestTables = []string{"items", "locations", "inventories", "inventory_transactions", "alerts", "idempotency_records", "archived_inventories", "api_keys"}
+
+// clearSQLBackend returns a SQL backend without any data. Tests run against a
+// fresh in-memory SQLite database, unless POSTGRES_TEST_DATA_SOURCE names a
+// PostgreSQL database to clear and run them against instead.
+func clearSQLBackend(t *testing.T) *SQLBackend {
+	t.Helper()
+	ctx := context.Background()
+	driver, dataSource := "sqlite", ":memory:"
+	if postgres := os.Getenv("POSTGRES_TEST_DATA_SOURCE"); postgres != "" {
+		driver, dataSource = "postgres", postgres
+	}
+	sb, err := NewSQLBackend(ctx, driver, dataSource)
+	if err != nil {
+		t.Fatalf("error creating SQL backend: %v", err)
+	}
+	t.Cleanup(func() { sb.Close() })
+	for _, table := range sqlTestTables {
+		if _, err := sb.db.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+			t.Fatalf("error clearing table %s: %v", table, err)
+		}
+	}
+	return sb
+}
+
+var sqlBackendTester = backendTester{
+	resetBackend: func(t *testing.T) DatabaseBackend {
+		return clearSQLBackend(t)
+	},
+	initBackend: func(t *testing.T, state initialBackendState) DatabaseBackend {
+		t.Helper()
+		sb := clearSQLBackend(t)
+		ctx := context.Background()
+		for _, item := range state.items {
+			values, err := itemValues(item)
+			if err != nil {
+				t.Fatalf("error encoding item: %v", err)
+			}
+			if err := insertRow(ctx, sb.db, "items", itemColumns, values...); err != nil {
+				t.Fatalf("error inserting item: %v", err)
+			}
+		}
+		for _, location := range state.locations {
+			if err := insertRow(ctx, sb.db, "locations", locationColumns, locationValues(location)...); err != nil {
+				t.Fatalf("error inserting location: %v", err)
+			}
+		}
+		for _, inv := range state.inventories {
+			if err := insertRow(ctx, sb.db, "inventories", inventoryColumns, inventoryValues(inv)...); err != nil {
+				t.Fatalf("error inserting inventory: %v", err)
+			}
+		}
+		for _, txn := range state.inventoryTransactions {
+			if err := insertRow(ctx, sb.db, "inventory_transactions", inventoryTransactionColumns, inventoryTransactionValues(txn)...); err != nil {
+				t.Fatalf("error inserting inventory transaction: %v", err)
+			}
+		}
+		for _, alert := range state.alerts {
+			if err := insertRow(ctx, sb.db, "alerts", alertColumns, alertValues(alert)...); err != nil {
+				t.Fatalf("error inserting alert: %v", err)
+			}
+		}
+		return sb
+	},
+}
+
+func TestSQLMigrateTwice(t *testing.T) {
+	sb := clearSQLBackend(t)
+	if err := sb.migrate(context.Background()); err != nil {
+		t.Fatalf("migrating a migrated database: %v", err)
+	}
+	var applied int
+	if err := sb.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+		t.Fatalf("error counting migrations: %v", err)
+	}
+	if applied != len(sqlMigrations) {
+		t.Errorf("applied %d migrations, want %d", applied, len(sqlMigrations))
+	}
+}
+
+func TestSQLMigrateTransactionWarehouses(t *testing.T) {
+	sb := clearSQLBackend(t)
+	ctx := context.Background()
+	location := &Location{Id: "loc-id", Name: "location", Warehouse: "warehouse"}
+	if err := insertRow(ctx, sb.db, "locations", locationColumns, locationValues(location)...); err != nil {
+		t.Fatalf("error inserting location: %v", err)
+	}
+	// Transactions stored before they recorded their warehouse
+	txns := []*InventoryTransaction{
+		{Id: "txn-id", ItemId: "item-id", LocationId: location.Id, Action: "ADD", Count: 1},
+		{Id: "deleted-id", ItemId: "item-id", LocationId: "deleted-loc-id", Action: "ADD", Count: 1},
+	}
+	for _, txn := range txns {
+		if err := insertRow(ctx, sb.db, "inventory_transactions", inventoryTransactionColumns, inventoryTransactionValues(txn)...); err != nil {
+			t.Fatalf("error inserting inventory transaction: %v", err)
+		}
+	}
+
+	// Apply the last migration again, as if the database predated it
+	if _, err := sb.db.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = "+strconv.Itoa(len(sqlMigrations))); err != nil {
+		t.Fatalf("error unapplying migration: %v", err)
+	}
+	if err := sb.migrate(ctx); err != nil {
+		t.Fatalf("error migrating: %v", err)
+	}
+	for id, want := range map[string]string{"txn-id": "warehouse", "deleted-id": ""} {
+		got, err := sb.GetInventoryTransaction(ctx, id)
+		if err != nil || got.Warehouse != want {
+			t.Errorf("GetInventoryTransaction(%q) = %v, %v, want warehouse %q", id, got, err, want)
+		}
+	}
+}
+
+func TestSQLUniqueInventory(t *testing.T) {
+	sb := clearSQLBackend(t)
+	ctx := context.Background()
+	inv := &Inventory{ItemId: "item", LocationId: "location", Count: 1}
+	if err := insertRow(ctx, sb.db, "inventories", inventoryColumns, inventoryValues(inv)...); err != nil {
+		t.Fatalf("error inserting inventory: %v", err)
+	}
+	if err := insertRow(ctx, sb.db, "inventories", inventoryColumns, inventoryValues(inv)...); err == nil {
+		t.Errorf("inserted a second inventory of the item at the location")
+	}
+}
+
+func TestSQLRetryConflictingTransactions(t *testing.T) {
+	sb := clearSQLBackend(t)
+	cases := []struct {
+		desc     string
+		err      error
+		failures int
+		attempts int
+		wantErr  bool
+	}{
+		{desc: "serialization failure", err: &pq.Error{Code: "40001"}, failures: 1, attempts: 2},
+		{desc: "deadlock", err: &pq.Error{Code: "40P01"}, failures: 1, attempts: 2},
+		{desc: "unique violation", err: &pq.Error{Code: "23505"}, failures: 1, attempts: 2},
+		{desc: "persistent conflict", err: &pq.Error{Code: "40001"}, failures: maxTransactionAttempts, attempts: maxTransactionAttempts, wantErr: true},
+		{desc: "foreign key violation", err: &pq.Error{Code: "23503"}, failures: 1, attempts: 1, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			attempts := 0
+			err := sb.runTransaction(context.Background(), func(tx *sql.Tx) error {
+				attempts++
+				if attempts <= tc.failures {
+					return tc.err
+				}
+				return nil
+			})
+			if attempts != tc.attempts || (err != nil) != tc.wantErr {
+				t.Errorf("runTransaction() made %d attempts and returned %v, want %d attempts and an error %v", attempts, err, tc.attempts, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSQLDeleteItem(t *testing.T) {
+	sqlBackendTester.testDeleteItem(t)
+}
+
+func TestSQLDeleteItemNotFound(t *testing.T) {
+	sqlBackendTester.testDeleteItemNotFound(t)
+}
+
+func TestSQLDeleteLocation(t *testing.T) {
+	sqlBackendTester.testDeleteLocation(t)
+}
+
+func TestSQLDeleteLocationNotFound(t *testing.T) {
+	sqlBackendTester.testDeleteLocationNotFound(t)
+}
+
+func TestSQLDeleteItemInventory(t *testing.T) {
+	sqlBackendTester.testDeleteItemInventory(t)
+}
+
+func TestSQLDeleteLocationInventory(t *testing.T) {
+	sqlBackendTester.testDeleteLocationInventory(t)
+}
+
+func TestSQLDeleteAlert(t *testing.T) {
+	sqlBackendTester.testDeleteAlert(t)
+}
+
+func TestSQLDeleteAlertNotFound(t *testing.T) {
+	sqlBackendTester.testDeleteAlertNotFound(t)
+}
+
+func TestSQLGetInventoryTransaction(t *testing.T) {
+	sqlBackendTester.testGetInventoryTransaction(t)
+}
+
+func TestSQLGetInventoryTransactionNotFound(t *testing.T) {
+	sqlBackendTester.testGetInventoryTransactionNotFound(t)
+}
+
+func TestSQLGetItem(t *testing.T) {
+	sqlBackendTester.testGetItem(t)
+}
+
+func TestSQLGetItemNotFound(t *testing.T) {
+	sqlBackendTester.testGetItemNotFound(t)
+}
+
+func TestSQLGetLocation(t *testing.T) {
+	sqlBackendTester.testGetLocation(t)
+}
+
+func TestSQLGetLocationNotFound(t *testing.T) {
+	sqlBackendTester.testGetLocationNotFound(t)
+}
+
+func TestSQLListItems(t *testing.T) {
+	sqlBackendTester.testListItems(t)
+}
+
+func TestSQLListItemInventory(t *testing.T) {
+	sqlBackendTester.testListItemInventory(t)
+}
+
+func TestSQLListItemInventoryTransactions(t *testing.T) {
+	sqlBackendTester.testListItemInventoryTransactions(t)
+}
+
+func TestSQLListInventoryTransactions(t *testing.T) {
+	sqlBackendTester.testListInventoryTransactions(t)
+}
+
+func TestSQLListLocations(t *testing.T) {
+	sqlBackendTester.testListLocations(t)
+}
+
+func TestSQLListLocationInventory(t *testing.T) {
+	sqlBackendTester.testListLocationInventory(t)
+}
+
+func TestSQLListLocationInventoryTransactions(t *testing.T) {
+	sqlBackendTester.testListLocationInventoryTransactions(t)
+}
+
+func TestSQLListAlerts(t *testing.T) {
+	sqlBackendTester.testListAlerts(t)
+}
+
+func TestSQLNewItem(t *testing.T) {
+	sqlBackendTester.testNewItem(t)
+}
+
+func TestSQLNewInventoryTransaction(t *testing.T) {
+	sqlBackendTester.testNewInventoryTransaction(t)
+}
+
+func TestSQLNewInventoryTransactionNotFoundErrors(t *testing.T) {
+	sqlBackendTester.testNewInventoryTransactionNotFoundErrors(t)
+}
+
+func TestSQLNewInventoryTransactionIdempotent(t *testing.T) {
+	sqlBackendTester.testNewInventoryTransactionIdempotent(t)
+}
+
+func TestSQLStoreIdempotencyRecordRetried(t *testing.T) {
+	sb := clearSQLBackend(t)
+	ctx := context.Background()
+	record := &idempotencyRecord{Key: "key", CreatedBy: "alice", TransactionId: "txn-id", Timestamp: time.Now()}
+	id := idempotencyId(record.CreatedBy, record.Key)
+	attempts := 0
+	err := sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		attempts++
+		return storeIdempotencyRecord(ctx, tx, id, record)
+	})
+	if err != nil || attempts != 1 {
+		t.Fatalf("storing an idempotency record made %d attempts and returned %v, want one attempt", attempts, err)
+	}
+	// A record stored by a concurrent request makes the transaction run
+	// again, until it finds the record and replays its transaction
+	attempts = 0
+	err = sb.runTransaction(ctx, func(tx *sql.Tx) error {
+		attempts++
+		return storeIdempotencyRecord(ctx, tx, id, record)
+	})
+	if KindOf(err) != KindConflict || attempts != maxTransactionAttempts {
+		t.Errorf("storing the idempotency record again made %d attempts and returned %v, want %d attempts and a %v error", attempts, err, maxTransactionAttempts, KindConflict)
+	}
+}
+
+func TestSQLConcurrentIdempotentTransactions(t *testing.T) {
+	sqlBackendTester.testConcurrentIdempotentTransactions(t)
+}
+
+func TestSQLConcurrentInventoryTransactions(t *testing.T) {
+	sqlBackendTester.testConcurrentInventoryTransactions(t)
+}
+
+func TestSQLNewInventoryTransactionBatch(t *testing.T) {
+	sqlBackendTester.testNewInventoryTransactionBatch(t)
+}
+
+func TestSQLNewInventoryTransactionBatchAllOrNone(t *testing.T) {
+	sqlBackendTester.testNewInventoryTransactionBatchAllOrNone(t)
+}
+
+func TestSQLNewInventoryTransactionBatchTooLarge(t *testing.T) {
+	sqlBackendTester.testNewInventoryTransactionBatchTooLarge(t)
+}
+
+func TestSQLNewInventoryTransactionBatchAlerts(t *testing.T) {
+	sqlBackendTester.testNewInventoryTransactionBatchAlerts(t)
+}
+
+func TestSQLNewInventoryTransactionNegativeStockPolicy(t *testing.T) {
+	sqlBackendTester.testNewInventoryTransactionNegativeStockPolicy(t)
+}
+
+func TestSQLReorderAlerts(t *testing.T) {
+	sqlBackendTester.testReorderAlerts(t)
+}
+
+func TestSQLListAlertsFilter(t *testing.T) {
+	sqlBackendTester.testListAlertsFilter(t)
+}
+
+func TestSQLListPagination(t *testing.T) {
+	sqlBackendTester.testListPagination(t)
+}
+
+func TestSQLListInvalidPageToken(t *testing.T) {
+	sqlBackendTester.testListInvalidPageToken(t)
+}
+
+func TestSQLListInventoryTransactionsFilter(t *testing.T) {
+	sqlBackendTester.testListInventoryTransactionsFilter(t)
+}
+
+func TestSQLTransactionWarehouse(t *testing.T) {
+	sqlBackendTester.testTransactionWarehouse(t)
+}
+
+func TestSQLAlertLifecycle(t *testing.T) {
+	sqlBackendTester.testAlertLifecycle(t)
+}
+
+func TestSQLAlertLifecycleNotFound(t *testing.T) {
+	sqlBackendTester.testAlertLifecycleNotFound(t)
+}
+
+func TestSQLRaisedAlertsDeduplicated(t *testing.T) {
+	sqlBackendTester.testRaisedAlertsDeduplicated(t)
+}
+
+func TestSQLNewLocation(t *testing.T) {
+	sqlBackendTester.testNewLocation(t)
+}
+
+func TestSQLNewAlert(t *testing.T) {
+	sqlBackendTester.testNewAlert(t)
+}
+
+func TestSQLNewTransfer(t *testing.T) {
+	sqlBackendTester.testNewTransfer(t)
+}
+
+func TestSQLNewTransferNotFoundErrors(t *testing.T) {
+	sqlBackendTester.testNewTransferNotFoundErrors(t)
+}
+
+func TestSQLNewTransferNegativeStockPolicy(t *testing.T) {
+	sqlBackendTester.testNewTransferNegativeStockPolicy(t)
+}
+
+func TestSQLApiKeyLifecycle(t *testing.T) {
+	sqlBackendTester.testApiKeyLifecycle(t)
+}
+
+func TestSQLApiKeyNotFound(t *testing.T) {
+	sqlBackendTester.testApiKeyNotFound(t)
+}
+
+func TestSQLUpdateItem(t *testing.T) {
+	sqlBackendTester.testUpdateItem(t)
+}
+
+func TestSQLUpdateItemNotFound(t *testing.T) {
+	sqlBackendTester.testUpdateItemNotFound(t)
+}
+
+func TestSQLUpdateItemVersion(t *testing.T) {
+	sqlBackendTester.testUpdateItemVersion(t)
+}
+
+func TestSQLUpdateLocation(t *testing.T) {
+	sqlBackendTester.testUpdateLocation(t)
+}
+
+func TestSQLUpdateLocationNotFound(t *testing.T) {
+	sqlBackendTester.testUpdateLocationNotFound(t)
+}
+
+func TestSQLUpdateLocationVersion(t *testing.T) {
+	sqlBackendTester.testUpdateLocationVersion(t)
+}
+
+func TestSQLArchiveItem(t *testing.T) {
+	sqlBackendTester.testArchiveItem(t)
+}
+
+func TestSQLArchiveItemNotFound(t *testing.T) {
+	sqlBackendTester.testArchiveItemNotFound(t)
+}
+
+func TestSQLArchiveLocation(t *testing.T) {
+	sqlBackendTester.testArchiveLocation(t)
+}
+
+func TestSQLArchiveLocationNotFound(t *testing.T) {
+	sqlBackendTester.testArchiveLocationNotFound(t)
+}
+
+func TestSQLListIncludeArchived(t *testing.T) {
+	sqlBackendTester.testListIncludeArchived(t)
+}
+
+func TestSQLNewInventoryTransactionArchived(t *testing.T) {
+	sqlBackendTester.testNewInventoryTransactionArchived(t)
+}
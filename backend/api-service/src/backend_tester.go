@@ -17,6 +17,8 @@ package service
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -65,7 +67,7 @@ func (bt *backendTester) testDeleteItem(t *testing.T) {
 	}
 	backend := bt.initBackend(t, initialBackendState{items: map[string]*Item{id: &item}})
 
-	err := backend.DeleteItem(ctx, id)
+	err := backend.DeleteItem(ctx, id, false)
 
 	if err != nil {
 		t.Fatalf("DeleteItem(%q) = %v, want nil", id, err)
@@ -81,7 +83,7 @@ func (bt *backendTester) testDeleteItemNotFound(t *testing.T) {
 	backend := bt.resetBackend(t)
 	want := ItemNotFound(id)
 
-	err := backend.DeleteItem(ctx, id)
+	err := backend.DeleteItem(ctx, id, false)
 
 	if err == nil {
 		t.Fatalf("DeleteItem(%q) succeeded, want error", id)
@@ -101,7 +103,7 @@ func (bt *backendTester) testDeleteLocation(t *testing.T) {
 	}
 	backend := bt.initBackend(t, initialBackendState{locations: map[string]*Location{id: &location}})
 
-	err := backend.DeleteLocation(ctx, id)
+	err := backend.DeleteLocation(ctx, id, false)
 
 	if err != nil {
 		t.Fatalf("DeleteLocation(%v) = %v, want nil", id, err)
@@ -117,7 +119,7 @@ func (bt *backendTester) testDeleteLocationNotFound(t *testing.T) {
 	backend := bt.resetBackend(t)
 	want := LocationNotFound(id)
 
-	err := backend.DeleteLocation(ctx, id)
+	err := backend.DeleteLocation(ctx, id, false)
 
 	if err == nil {
 		t.Fatalf("DeleteLocation(%q) succeeded, want error", id)
@@ -127,11 +129,153 @@ func (bt *backendTester) testDeleteLocationNotFound(t *testing.T) {
 	}
 }
 
+func (bt *backendTester) testDeleteItemInventory(t *testing.T) {
+	item := Item{Id: "item-id"}
+	location1, location2 := Location{Id: "loc-id-1"}, Location{Id: "loc-id-2"}
+	empty := Inventory{ItemId: item.Id, LocationId: location1.Id, Count: 0, LastUpdated: time.Now()}
+	stocked := Inventory{ItemId: item.Id, LocationId: location2.Id, Count: 5, LastUpdated: time.Now()}
+	cases := []struct {
+		desc             string
+		inventories      map[string]*Inventory
+		archiveInventory bool
+		wantErr          *ResourceInUse
+	}{
+		{
+			desc:        "only zero inventory",
+			inventories: map[string]*Inventory{"empty": &empty},
+		},
+		{
+			desc:        "nonzero inventory",
+			inventories: map[string]*Inventory{"empty": &empty, "stocked": &stocked},
+			wantErr:     ItemInUse(item.Id, 1),
+		},
+		{
+			desc:             "nonzero inventory archived",
+			inventories:      map[string]*Inventory{"empty": &empty, "stocked": &stocked},
+			archiveInventory: true,
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := context.Background()
+		t.Run(tc.desc, func(t *testing.T) {
+			backend := bt.initBackend(t, initialBackendState{
+				items:       map[string]*Item{item.Id: &item},
+				locations:   map[string]*Location{location1.Id: &location1, location2.Id: &location2},
+				inventories: tc.inventories,
+			})
+
+			err := backend.DeleteItem(ctx, item.Id, tc.archiveInventory)
+
+			if tc.wantErr != nil {
+				if iu, ok := err.(*ResourceInUse); !ok || *iu != *tc.wantErr {
+					t.Fatalf("DeleteItem(%q, %v) = %v, want %v", item.Id, tc.archiveInventory, err, tc.wantErr)
+				}
+				if _, err := backend.GetItem(ctx, item.Id); err != nil {
+					t.Errorf("after failed DeleteItem(%q), GetItem(%q) = %v, want nil", item.Id, item.Id, err)
+				}
+				want := make([]*Inventory, 0, len(tc.inventories))
+				for _, inv := range tc.inventories {
+					want = append(want, inv)
+				}
+				got, _, err := backend.ListItemInventory(ctx, item.Id, PageRequest{})
+				if err != nil || !cmp.Equal(got, want, cmpopts.SortSlices(modelLess), cmpopts.EquateApproxTime(time.Millisecond)) {
+					t.Errorf("after failed DeleteItem(%q), ListItemInventory(%q) = %v, %v, want %v", item.Id, item.Id, got, err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DeleteItem(%q, %v) = %v, want nil", item.Id, tc.archiveInventory, err)
+			}
+			if _, err := backend.GetItem(ctx, item.Id); err == nil {
+				t.Errorf("after DeleteItem(%q), GetItem(%q) succeeded, want error", item.Id, item.Id)
+			}
+			for _, loc := range []Location{location1, location2} {
+				got, _, err := backend.ListLocationInventory(ctx, loc.Id, PageRequest{})
+				if err != nil || len(got) != 0 {
+					t.Errorf("after DeleteItem(%q), ListLocationInventory(%q) = %v, %v, want no inventory", item.Id, loc.Id, got, err)
+				}
+			}
+		})
+	}
+}
+
+func (bt *backendTester) testDeleteLocationInventory(t *testing.T) {
+	location := Location{Id: "loc-id"}
+	item1, item2 := Item{Id: "item-id-1"}, Item{Id: "item-id-2"}
+	empty := Inventory{ItemId: item1.Id, LocationId: location.Id, Count: 0, LastUpdated: time.Now()}
+	stocked := Inventory{ItemId: item2.Id, LocationId: location.Id, Count: -3, LastUpdated: time.Now()}
+	cases := []struct {
+		desc             string
+		inventories      map[string]*Inventory
+		archiveInventory bool
+		wantErr          *ResourceInUse
+	}{
+		{
+			desc:        "only zero inventory",
+			inventories: map[string]*Inventory{"empty": &empty},
+		},
+		{
+			desc:        "nonzero inventory",
+			inventories: map[string]*Inventory{"empty": &empty, "stocked": &stocked},
+			wantErr:     LocationInUse(location.Id, 1),
+		},
+		{
+			desc:             "nonzero inventory archived",
+			inventories:      map[string]*Inventory{"empty": &empty, "stocked": &stocked},
+			archiveInventory: true,
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := context.Background()
+		t.Run(tc.desc, func(t *testing.T) {
+			backend := bt.initBackend(t, initialBackendState{
+				items:       map[string]*Item{item1.Id: &item1, item2.Id: &item2},
+				locations:   map[string]*Location{location.Id: &location},
+				inventories: tc.inventories,
+			})
+
+			err := backend.DeleteLocation(ctx, location.Id, tc.archiveInventory)
+
+			if tc.wantErr != nil {
+				if iu, ok := err.(*ResourceInUse); !ok || *iu != *tc.wantErr {
+					t.Fatalf("DeleteLocation(%q, %v) = %v, want %v", location.Id, tc.archiveInventory, err, tc.wantErr)
+				}
+				if _, err := backend.GetLocation(ctx, location.Id); err != nil {
+					t.Errorf("after failed DeleteLocation(%q), GetLocation(%q) = %v, want nil", location.Id, location.Id, err)
+				}
+				want := make([]*Inventory, 0, len(tc.inventories))
+				for _, inv := range tc.inventories {
+					want = append(want, inv)
+				}
+				got, _, err := backend.ListLocationInventory(ctx, location.Id, PageRequest{})
+				if err != nil || !cmp.Equal(got, want, cmpopts.SortSlices(modelLess), cmpopts.EquateApproxTime(time.Millisecond)) {
+					t.Errorf("after failed DeleteLocation(%q), ListLocationInventory(%q) = %v, %v, want %v", location.Id, location.Id, got, err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DeleteLocation(%q, %v) = %v, want nil", location.Id, tc.archiveInventory, err)
+			}
+			if _, err := backend.GetLocation(ctx, location.Id); err == nil {
+				t.Errorf("after DeleteLocation(%q), GetLocation(%q) succeeded, want error", location.Id, location.Id)
+			}
+			for _, item := range []Item{item1, item2} {
+				got, _, err := backend.ListItemInventory(ctx, item.Id, PageRequest{})
+				if err != nil || len(got) != 0 {
+					t.Errorf("after DeleteLocation(%q), ListItemInventory(%q) = %v, %v, want no inventory", location.Id, item.Id, got, err)
+				}
+			}
+		})
+	}
+}
+
 func (bt *backendTester) testDeleteAlert(t *testing.T) {
 	ctx := context.Background()
 	id := "alert-id"
 	alert := Alert{
-		Id:            "id",
+		Id:            id,
 		ItemId:        "item_id",
 		TransactionId: "transaction_id",
 		Text:          "text",
@@ -144,7 +288,7 @@ func (bt *backendTester) testDeleteAlert(t *testing.T) {
 	if err != nil {
 		t.Fatalf("DeleteAlert(%q) = %v, want nil", id, err)
 	}
-	got, err := backend.ListAlerts(ctx)
+	got, _, err := backend.ListAlerts(ctx, AlertFilter{}, PageRequest{})
 	if err != nil {
 		t.Fatalf("ListAlerts() returned unexpected err: %v", err)
 	}
@@ -218,7 +362,7 @@ func (bt *backendTester) testGetItem(t *testing.T) {
 	backend := bt.initBackend(t, initialBackendState{items: map[string]*Item{item.Id: &item}})
 	got, err := backend.GetItem(ctx, id)
 
-	if err != nil || *got != item {
+	if err != nil || !cmp.Equal(got, &item) {
 		t.Errorf("GetItem(%v) = %v, %v want %v, nil", id, got, err, &item)
 	}
 }
@@ -300,7 +444,7 @@ func (bt *backendTester) testListInventoryTransactions(t *testing.T) {
 		t.Run(tc.desc, func(t *testing.T) {
 			backend := bt.initBackend(t, tc.init)
 
-			got, err := backend.ListInventoryTransactions(ctx)
+			got, _, err := backend.ListInventoryTransactions(ctx, TransactionFilter{}, PageRequest{})
 
 			if err != nil {
 				t.Fatalf("ListInventoryTransactions() returned unexpected err: %v", err)
@@ -367,7 +511,7 @@ func (bt *backendTester) testListItemInventory(t *testing.T) {
 		t.Run(tc.desc, func(t *testing.T) {
 			backend := bt.initBackend(t, tc.init)
 
-			got, err := backend.ListItemInventory(ctx, tc.id)
+			got, _, err := backend.ListItemInventory(ctx, tc.id, PageRequest{})
 
 			if err != nil {
 				t.Fatalf("ListItemInventory(%v) returned unexpected err: %v", tc.id, err)
@@ -434,7 +578,7 @@ func (bt *backendTester) testListItemInventoryTransactions(t *testing.T) {
 	for _, tc := range cases {
 		ctx := context.Background()
 		t.Run(tc.desc, func(t *testing.T) {
-			got, err := backend.ListItemInventoryTransactions(ctx, tc.id)
+			got, _, err := backend.ListItemInventoryTransactions(ctx, tc.id, TransactionFilter{}, PageRequest{})
 
 			if err != nil {
 				t.Fatalf("ListItemInventoryTransactions() returned unexpected err: %v", err)
@@ -475,7 +619,7 @@ func (bt *backendTester) testListItems(t *testing.T) {
 		t.Run(tc.desc, func(t *testing.T) {
 			backend := bt.initBackend(t, tc.init)
 
-			got, err := backend.ListItems(ctx)
+			got, _, err := backend.ListItems(ctx, false, PageRequest{})
 
 			if err != nil {
 				t.Fatalf("ListItems() returned unexpected err: %v", err)
@@ -539,7 +683,7 @@ func (bt *backendTester) testListLocationInventory(t *testing.T) {
 	for _, tc := range cases {
 		ctx := context.Background()
 		t.Run(tc.desc, func(t *testing.T) {
-			got, err := backend.ListLocationInventory(ctx, tc.id)
+			got, _, err := backend.ListLocationInventory(ctx, tc.id, PageRequest{})
 
 			if err != nil {
 				t.Fatalf("ListLocationInventory(%v) returned unexpected err: %v", tc.id, err)
@@ -606,7 +750,7 @@ func (bt *backendTester) testListLocationInventoryTransactions(t *testing.T) {
 	for _, tc := range cases {
 		ctx := context.Background()
 		t.Run(tc.desc, func(t *testing.T) {
-			got, err := backend.ListLocationInventoryTransactions(ctx, tc.id)
+			got, _, err := backend.ListLocationInventoryTransactions(ctx, tc.id, TransactionFilter{}, PageRequest{})
 
 			if err != nil {
 				t.Fatalf("ListLocationInventoryTransactions() returned unexpected err: %v", err)
@@ -647,7 +791,7 @@ func (bt *backendTester) testListLocations(t *testing.T) {
 		t.Run(tc.desc, func(t *testing.T) {
 			backend := bt.initBackend(t, tc.init)
 
-			got, err := backend.ListLocations(ctx)
+			got, _, err := backend.ListLocations(ctx, false, PageRequest{})
 
 			if err != nil {
 				t.Fatalf("ListLocations() returned unexpected err: %v", err)
@@ -688,7 +832,7 @@ func (bt *backendTester) testListAlerts(t *testing.T) {
 		t.Run(tc.desc, func(t *testing.T) {
 			backend := bt.initBackend(t, tc.init)
 
-			got, err := backend.ListAlerts(ctx)
+			got, _, err := backend.ListAlerts(ctx, AlertFilter{}, PageRequest{})
 
 			if err != nil {
 				t.Fatalf("ListAlerts() returned unexpected err: %v", err)
@@ -700,200 +844,1569 @@ func (bt *backendTester) testListAlerts(t *testing.T) {
 	}
 }
 
-func (bt *backendTester) testNewInventoryTransaction(t *testing.T) {
-	// properties of a
-	stockedItem := Item{Id: "stocked-item"}
-	stockedLoc := Location{Id: "stocked-location"}
-	const stockedInitCount = 100
+func (bt *backendTester) testListAlertsFilter(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	open := Alert{Id: "open-id", State: alertOpen}
+	acked := Alert{Id: "acked-id", State: alertAcknowledged}
+	resolved := Alert{Id: "resolved-id", State: alertResolved}
+	snoozed := Alert{Id: "snoozed-id", State: alertOpen, SnoozedUntil: later}
+	woken := Alert{Id: "woken-id", State: alertAcknowledged, SnoozedUntil: time.Now().Add(-time.Hour)}
+	state := initialBackendState{alerts: map[string]*Alert{
+		open.Id: &open, acked.Id: &acked, resolved.Id: &resolved, snoozed.Id: &snoozed, woken.Id: &woken,
+	}}
+	cases := []struct {
+		desc   string
+		filter AlertFilter
+		want   []*Alert
+	}{
+		{
+			desc:   "no filter excludes snoozed alerts",
+			filter: AlertFilter{},
+			want:   []*Alert{&open, &acked, &resolved, &woken},
+		},
+		{
+			desc:   "include snoozed alerts",
+			filter: AlertFilter{IncludeSnoozed: true},
+			want:   []*Alert{&open, &acked, &resolved, &snoozed, &woken},
+		},
+		{
+			desc:   "open alerts",
+			filter: AlertFilter{State: alertOpen},
+			want:   []*Alert{&open},
+		},
+		{
+			desc:   "open alerts including snoozed alerts",
+			filter: AlertFilter{State: alertOpen, IncludeSnoozed: true},
+			want:   []*Alert{&open, &snoozed},
+		},
+		{
+			desc:   "acknowledged alerts",
+			filter: AlertFilter{State: alertAcknowledged},
+			want:   []*Alert{&acked, &woken},
+		},
+		{
+			desc:   "resolved alerts",
+			filter: AlertFilter{State: alertResolved},
+			want:   []*Alert{&resolved},
+		},
+	}
 
-	newItem := Item{Id: "new-item"}
-	newLoc := Location{Id: "new-location"}
+	for _, tc := range cases {
+		ctx := context.Background()
+		t.Run(tc.desc, func(t *testing.T) {
+			backend := bt.initBackend(t, state)
+
+			got, _, err := backend.ListAlerts(ctx, tc.filter, PageRequest{})
+
+			if err != nil {
+				t.Fatalf("ListAlerts(%+v) returned unexpected err: %v", tc.filter, err)
+			}
+			if !cmp.Equal(got, tc.want, cmpopts.SortSlices(modelLess), cmpopts.EquateApproxTime(time.Millisecond)) {
+				t.Errorf("ListAlerts(%+v) = %v want %v", tc.filter, got, tc.want)
+			}
+		})
+	}
+}
+
+func (bt *backendTester) testAlertLifecycle(t *testing.T) {
+	until := time.Now().Add(time.Hour)
 	cases := []struct {
 		desc      string
-		txn       *InventoryTransaction
-		wantCount int64
+		state     string
+		change    func(DatabaseBackend, string) (*Alert, error)
+		wantState string
+		wantErr   bool
 	}{
 		{
-			desc: "add to existing inventory",
-			txn: &InventoryTransaction{
-				ItemId:     stockedItem.Id,
-				LocationId: stockedLoc.Id,
-				Action:     "ADD",
-				Count:      20,
+			desc:  "acknowledge open alert",
+			state: alertOpen,
+			change: func(b DatabaseBackend, id string) (*Alert, error) {
+				return b.AcknowledgeAlert(context.Background(), id, "worker")
 			},
-			wantCount: stockedInitCount + 20,
+			wantState: alertAcknowledged,
 		},
 		{
-			desc: "add new inventory",
-			txn: &InventoryTransaction{
-				ItemId:     newItem.Id,
-				LocationId: newLoc.Id,
-				Action:     "ADD",
-				Count:      20,
+			desc:  "acknowledge acknowledged alert",
+			state: alertAcknowledged,
+			change: func(b DatabaseBackend, id string) (*Alert, error) {
+				return b.AcknowledgeAlert(context.Background(), id, "worker")
 			},
-			wantCount: 20,
+			wantErr: true,
 		},
 		{
-			desc: "recount existing inventory",
-			txn: &InventoryTransaction{
-				ItemId:     stockedItem.Id,
-				LocationId: stockedLoc.Id,
-				Action:     "RECOUNT",
-				Count:      20,
+			desc:  "acknowledge resolved alert",
+			state: alertResolved,
+			change: func(b DatabaseBackend, id string) (*Alert, error) {
+				return b.AcknowledgeAlert(context.Background(), id, "worker")
 			},
-			wantCount: 20,
+			wantErr: true,
 		},
 		{
-			desc: "recount existing inventory to 0",
-			txn: &InventoryTransaction{
-				ItemId:     stockedItem.Id,
-				LocationId: stockedLoc.Id,
-				Action:     "RECOUNT",
-				Count:      0,
+			desc:  "resolve open alert",
+			state: alertOpen,
+			change: func(b DatabaseBackend, id string) (*Alert, error) {
+				return b.ResolveAlert(context.Background(), id, "worker")
 			},
-			wantCount: 0,
+			wantState: alertResolved,
 		},
 		{
-			desc: "recount new inventory",
-			txn: &InventoryTransaction{
-				ItemId:     newItem.Id,
-				LocationId: newLoc.Id,
-				Action:     "RECOUNT",
-				Count:      20,
+			desc:  "resolve acknowledged alert",
+			state: alertAcknowledged,
+			change: func(b DatabaseBackend, id string) (*Alert, error) {
+				return b.ResolveAlert(context.Background(), id, "worker")
 			},
-			wantCount: 20,
+			wantState: alertResolved,
 		},
 		{
-			desc: "remove from existing inventory",
-			txn: &InventoryTransaction{
-				ItemId:     stockedItem.Id,
-				LocationId: stockedLoc.Id,
-				Action:     "REMOVE",
-				Count:      20,
+			desc:  "resolve resolved alert",
+			state: alertResolved,
+			change: func(b DatabaseBackend, id string) (*Alert, error) {
+				return b.ResolveAlert(context.Background(), id, "worker")
 			},
-			wantCount: stockedInitCount - 20,
+			wantErr: true,
 		},
 		{
-			desc: "remove from new inventory",
-			txn: &InventoryTransaction{
-				ItemId:     newItem.Id,
-				LocationId: newLoc.Id,
-				Action:     "REMOVE",
-				Count:      20,
+			desc:  "snooze open alert",
+			state: alertOpen,
+			change: func(b DatabaseBackend, id string) (*Alert, error) {
+				return b.SnoozeAlert(context.Background(), id, until, "worker")
 			},
-			wantCount: -20,
+			wantState: alertOpen,
+		},
+		{
+			desc:  "snooze acknowledged alert",
+			state: alertAcknowledged,
+			change: func(b DatabaseBackend, id string) (*Alert, error) {
+				return b.SnoozeAlert(context.Background(), id, until, "worker")
+			},
+			wantState: alertAcknowledged,
+		},
+		{
+			desc:  "snooze resolved alert",
+			state: alertResolved,
+			change: func(b DatabaseBackend, id string) (*Alert, error) {
+				return b.SnoozeAlert(context.Background(), id, until, "worker")
+			},
+			wantErr: true,
 		},
 	}
 
 	for _, tc := range cases {
 		ctx := context.Background()
-		stockedInv := Inventory{
-			LocationId:  stockedLoc.Id,
-			ItemId:      stockedItem.Id,
-			Count:       stockedInitCount,
-			LastUpdated: time.Now(),
-		}
-		backend := bt.initBackend(t, initialBackendState{
-			inventories: map[string]*Inventory{"stockedInv-id": &stockedInv},
-			items:       map[string]*Item{newItem.Id: &newItem, stockedItem.Id: &stockedItem},
-			locations:   map[string]*Location{newLoc.Id: &newLoc, stockedLoc.Id: &stockedLoc},
-		})
+		alert := Alert{Id: "alert-id", ItemId: "item-id", Text: "text", State: tc.state, Occurrences: 1}
+		backend := bt.initBackend(t, initialBackendState{alerts: map[string]*Alert{alert.Id: &alert}})
 		t.Run(tc.desc, func(t *testing.T) {
-
-			got, err := backend.NewInventoryTransaction(ctx, tc.txn)
-			if err != nil {
-				t.Fatalf("NewInventoryTransaction(%v) returned unexpected err: %v", tc.txn, err)
+			got, err := tc.change(backend, alert.Id)
+
+			if tc.wantErr {
+				if _, ok := err.(*AlertStateConflict); !ok {
+					t.Errorf("changing %s alert returned %v, want *AlertStateConflict", tc.state, err)
+				}
+				if alerts, _, _ := backend.ListAlerts(ctx, AlertFilter{IncludeSnoozed: true}, PageRequest{}); len(alerts) != 1 || alerts[0].State != tc.state {
+					t.Errorf("after failed change, ListAlerts() = %v want a single %s alert", alerts, tc.state)
+				}
+				return
 			}
-			if got.Id == "" {
-				t.Errorf("NewInventoryTransaction(%v) did not generate InventoryTransaction.Id", tc.txn)
+			if err != nil {
+				t.Fatalf("changing %s alert returned unexpected err: %v", tc.state, err)
 			}
-			if !cmp.Equal(got, tc.txn, cmpopts.IgnoreFields(InventoryTransaction{}, "Id", "Timestamp")) {
-				t.Errorf("NewInventoryTransaction(%v) = %v want %v (ignoring Id field)", tc.txn, got, tc.txn)
+			if got.State != tc.wantState {
+				t.Errorf("alert state = %s want %s", got.State, tc.wantState)
 			}
-			if v, _ := backend.GetInventoryTransaction(ctx, got.Id); !cmp.Equal(got, v, cmpopts.EquateApproxTime(time.Microsecond)) {
-				t.Errorf("after backend.NewInventoryTransaction(%v), backend.GetInventoryTransaction(%v) = %v want %v", tc.txn, got.Id, v, got)
+			switch {
+			case got.State == alertAcknowledged && tc.state == alertOpen:
+				if got.AcknowledgedBy != "worker" || got.AcknowledgedAt.IsZero() {
+					t.Errorf("acknowledged alert = %+v want AcknowledgedBy and AcknowledgedAt set", got)
+				}
+			case got.State == alertResolved:
+				if got.ResolvedBy != "worker" || got.ResolvedAt.IsZero() {
+					t.Errorf("resolved alert = %+v want ResolvedBy and ResolvedAt set", got)
+				}
+			default:
+				if got.SnoozedBy != "worker" || !got.SnoozedUntil.Equal(until) {
+					t.Errorf("snoozed alert = %+v want SnoozedBy and SnoozedUntil set", got)
+				}
 			}
-
-			wantInv := &Inventory{ItemId: tc.txn.ItemId, LocationId: tc.txn.LocationId, Count: tc.wantCount}
-
-			inv, err := backend.lookupInventory(ctx, tc.txn.ItemId, tc.txn.LocationId)
+			alerts, _, err := backend.ListAlerts(ctx, AlertFilter{State: tc.wantState, IncludeSnoozed: true}, PageRequest{})
 			if err != nil {
-				t.Errorf("getting inventory for item: %v, location: %v, produced error: %v", tc.txn.ItemId, tc.txn.LocationId, err)
+				t.Fatalf("ListAlerts() returned unexpected err: %v", err)
 			}
-			if !cmp.Equal(inv, wantInv, cmpopts.IgnoreFields(Inventory{}, "LastUpdated")) {
-				t.Errorf("NewInventoryTransaction(%v) produced unexpected inventory state", tc.txn)
-				t.Errorf("[item %q, location %q] inventory = %v want %v", tc.txn.ItemId, tc.txn.LocationId, inv, wantInv)
+			if len(alerts) != 1 || !cmp.Equal(alerts[0], got, cmpopts.EquateApproxTime(time.Millisecond)) {
+				t.Errorf("ListAlerts() = %v want [%v]", alerts, got)
 			}
 		})
 	}
 }
 
-func (bt *backendTester) testNewInventoryTransactionNotFoundErrors(t *testing.T) {
-	existingLoc := Location{Id: "existing-location-id"}
-	existingItem := Item{Id: "existing-item-id"}
+func (bt *backendTester) testAlertLifecycleNotFound(t *testing.T) {
+	ctx := context.Background()
+	id := "not-found-id"
+	backend := bt.resetBackend(t)
+	want := AlertNotFound(id)
+
+	_, ackErr := backend.AcknowledgeAlert(ctx, id, "worker")
+	_, resolveErr := backend.ResolveAlert(ctx, id, "worker")
+	_, snoozeErr := backend.SnoozeAlert(ctx, id, time.Now().Add(time.Hour), "worker")
+
+	for _, err := range []error{ackErr, resolveErr, snoozeErr} {
+		if nf, ok := err.(*ResourceNotFound); !ok || nf.id != want.id || nf.collection != want.collection {
+			t.Errorf("changing alert %q returned %v, want %v", id, err, want)
+		}
+	}
+}
+
+func (bt *backendTester) testRaisedAlertsDeduplicated(t *testing.T) {
+	ctx := context.Background()
+	item := Item{Id: "item-id", LocationReorderPoints: map[string]int64{"location-id": 50}}
+	location := Location{Id: "location-id"}
+	inv := Inventory{ItemId: item.Id, LocationId: location.Id, Count: 100, LastUpdated: time.Now()}
 	backend := bt.initBackend(t, initialBackendState{
-		items: map[string]*Item{
-			existingItem.Id: &existingItem,
-		},
-		locations: map[string]*Location{
-			existingLoc.Id: &existingLoc,
-		},
+		inventories: map[string]*Inventory{"inv-id": &inv},
+		items:       map[string]*Item{item.Id: &item},
+		locations:   map[string]*Location{location.Id: &location},
 	})
+	// Each REMOVE crosses the reorder point; each ADD restocks above it
+	actions := []string{"REMOVE", "ADD", "REMOVE"}
+
+	var last *InventoryTransaction
+	for _, action := range actions {
+		txn := &InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: action, Count: 60}
+		got, err := backend.NewInventoryTransaction(ctx, txn, "")
+		if err != nil {
+			t.Fatalf("NewInventoryTransaction(%v) returned unexpected err: %v", txn, err)
+		}
+		last = got
+	}
+
+	alerts, _, err := backend.ListAlerts(ctx, AlertFilter{}, PageRequest{})
+	if err != nil {
+		t.Fatalf("ListAlerts() returned unexpected err: %v", err)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("ListAlerts() = %v want a single alert", alerts)
+	}
+	alert := alerts[0]
+	if alert.Occurrences != 2 || alert.TransactionId != last.Id || alert.State != alertOpen || alert.Kind != alertKindReorder {
+		t.Errorf("alert = %+v want an open %s alert with 2 occurrences, last raised by transaction %q", alert, alertKindReorder, last.Id)
+	}
+
+	// Once resolved, a further occurrence raises a new alert
+	if _, err := backend.ResolveAlert(ctx, alert.Id, "worker"); err != nil {
+		t.Fatalf("ResolveAlert(%q) returned unexpected err: %v", alert.Id, err)
+	}
+	for _, action := range []string{"ADD", "REMOVE"} {
+		txn := &InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: action, Count: 60}
+		if _, err := backend.NewInventoryTransaction(ctx, txn, ""); err != nil {
+			t.Fatalf("NewInventoryTransaction(%v) returned unexpected err: %v", txn, err)
+		}
+	}
+	alerts, _, err = backend.ListAlerts(ctx, AlertFilter{State: alertOpen}, PageRequest{})
+	if err != nil {
+		t.Fatalf("ListAlerts() returned unexpected err: %v", err)
+	}
+	if len(alerts) != 1 || alerts[0].Id == alert.Id || alerts[0].Occurrences != 1 {
+		t.Errorf("ListAlerts(OPEN) = %v want a single new alert with 1 occurrence", alerts)
+	}
+}
+
+func (bt *backendTester) testListPagination(t *testing.T) {
+	const n, size = 5, 2
+	item, other := "item-id", "other-item-id"
+	state := initialBackendState{
+		items:                 map[string]*Item{},
+		locations:             map[string]*Location{},
+		inventories:           map[string]*Inventory{},
+		inventoryTransactions: map[string]*InventoryTransaction{},
+		alerts:                map[string]*Alert{},
+	}
+	var itemIds, locationIds, txnIds, alertIds []string
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("id-%d", i)
+		state.items[id] = &Item{Id: id}
+		state.locations[id] = &Location{Id: id}
+		state.inventories["inv-"+id] = &Inventory{ItemId: item, LocationId: id}
+		state.inventoryTransactions[id] = &InventoryTransaction{Id: id, ItemId: item, LocationId: "location-id"}
+		state.alerts[id] = &Alert{Id: id, State: alertOpen}
+		itemIds, locationIds, txnIds, alertIds = append(itemIds, id), append(locationIds, id), append(txnIds, id), append(alertIds, id)
+	}
+	// Archived items and locations, and snoozed alerts, must not be listed, nor
+	// shorten the pages they fall in
+	state.items["id-0-archived"] = &Item{Id: "id-0-archived", Archived: true}
+	state.locations["id-0-archived"] = &Location{Id: "id-0-archived", Archived: true}
+	state.alerts["id-0-snoozed"] = &Alert{Id: "id-0-snoozed", State: alertOpen, SnoozedUntil: time.Now().Add(time.Hour)}
+	// Results for another item must not be listed
+	state.inventories["inv-other"] = &Inventory{ItemId: other, LocationId: "id-0"}
+	state.inventoryTransactions["other-txn-id"] = &InventoryTransaction{Id: "other-txn-id", ItemId: other, LocationId: "other-location-id"}
+
+	// Each case lists a page of results, identified by a string
 	cases := []struct {
 		desc string
-		txn  *InventoryTransaction
-		want *ResourceNotFound
+		list func(DatabaseBackend, PageRequest) ([]string, string, error)
+		want []string
 	}{
 		{
-			desc: "item not found",
-			txn: &InventoryTransaction{
-				ItemId:     "bad-item-id",
-				LocationId: existingLoc.Id,
+			desc: "items",
+			list: func(b DatabaseBackend, page PageRequest) ([]string, string, error) {
+				items, next, err := b.ListItems(context.Background(), false, page)
+				ids := make([]string, len(items))
+				for i, item := range items {
+					ids[i] = item.Id
+				}
+				return ids, next, err
 			},
-			want: ItemNotFound("bad-item-id"),
+			want: itemIds,
 		},
 		{
-			desc: "location not found",
-			txn: &InventoryTransaction{
-				ItemId:     existingItem.Id,
-				LocationId: "bad-loc-id",
+			desc: "locations",
+			list: func(b DatabaseBackend, page PageRequest) ([]string, string, error) {
+				locations, next, err := b.ListLocations(context.Background(), false, page)
+				ids := make([]string, len(locations))
+				for i, location := range locations {
+					ids[i] = location.Id
+				}
+				return ids, next, err
 			},
-			want: LocationNotFound("bad-loc-id"),
+			want: locationIds,
+		},
+		{
+			desc: "item inventory",
+			list: func(b DatabaseBackend, page PageRequest) ([]string, string, error) {
+				invs, next, err := b.ListItemInventory(context.Background(), item, page)
+				ids := make([]string, len(invs))
+				for i, inv := range invs {
+					ids[i] = inv.LocationId
+				}
+				return ids, next, err
+			},
+			want: locationIds,
+		},
+		{
+			desc: "inventory transactions",
+			list: func(b DatabaseBackend, page PageRequest) ([]string, string, error) {
+				txns, next, err := b.ListInventoryTransactions(context.Background(), TransactionFilter{}, page)
+				ids := make([]string, len(txns))
+				for i, txn := range txns {
+					ids[i] = txn.Id
+				}
+				return ids, next, err
+			},
+			want: append([]string{"other-txn-id"}, txnIds...),
+		},
+		{
+			desc: "item inventory transactions",
+			list: func(b DatabaseBackend, page PageRequest) ([]string, string, error) {
+				txns, next, err := b.ListItemInventoryTransactions(context.Background(), item, TransactionFilter{}, page)
+				ids := make([]string, len(txns))
+				for i, txn := range txns {
+					ids[i] = txn.Id
+				}
+				return ids, next, err
+			},
+			want: txnIds,
+		},
+		{
+			desc: "alerts",
+			list: func(b DatabaseBackend, page PageRequest) ([]string, string, error) {
+				alerts, next, err := b.ListAlerts(context.Background(), AlertFilter{State: alertOpen}, page)
+				ids := make([]string, len(alerts))
+				for i, alert := range alerts {
+					ids[i] = alert.Id
+				}
+				return ids, next, err
+			},
+			want: alertIds,
 		},
 	}
 
 	for _, tc := range cases {
-		ctx := context.Background()
 		t.Run(tc.desc, func(t *testing.T) {
-			_, err := backend.NewInventoryTransaction(ctx, tc.txn)
-			if err == nil {
-				t.Fatalf("NewInventoryTransaction(%q) succeeded, want error", tc.txn)
+			backend := bt.initBackend(t, state)
+			all, next, err := tc.list(backend, PageRequest{})
+			if err != nil {
+				t.Fatalf("listing all %s returned unexpected err: %v", tc.desc, err)
 			}
-			if nf, ok := err.(*ResourceNotFound); !ok || nf.id != tc.want.id || nf.collection != tc.want.collection {
-				t.Errorf("NewInventoryTransaction(%q) returned %v, want %v", tc.txn, err, tc.want)
+			if next != "" {
+				t.Errorf("listing all %s returned next page token %q, want none", tc.desc, next)
+			}
+
+			var got []string
+			pages := 0
+			page := PageRequest{Size: size}
+			for {
+				ids, next, err := tc.list(backend, page)
+				if err != nil {
+					t.Fatalf("listing %s with %+v returned unexpected err: %v", tc.desc, page, err)
+				}
+				if len(ids) > size || (next != "" && len(ids) < size) {
+					t.Errorf("listing %s with %+v = %v, %q, want %d results unless it is the last page", tc.desc, page, ids, next, size)
+				}
+				got = append(got, ids...)
+				pages++
+				if next == "" {
+					break
+				}
+				if pages > len(tc.want) {
+					t.Fatalf("listing %s did not end after %d pages", tc.desc, pages)
+				}
+				page.Token = next
+			}
+
+			if wantPages := (len(tc.want) + size - 1) / size; pages != wantPages {
+				t.Errorf("listing %s took %d pages, want %d", tc.desc, pages, wantPages)
+			}
+			if !cmp.Equal(got, all) {
+				t.Errorf("listing %s in pages = %v, want the same order as listing all: %v", tc.desc, got, all)
+			}
+			if !cmp.Equal(got, tc.want, cmpopts.SortSlices(func(a, b string) bool { return a < b })) {
+				t.Errorf("listing %s in pages = %v, want %v", tc.desc, got, tc.want)
 			}
 		})
 	}
 }
 
-func (bt *backendTester) testNewItem(t *testing.T) {
+func (bt *backendTester) testListInvalidPageToken(t *testing.T) {
 	ctx := context.Background()
 	backend := bt.resetBackend(t)
-	item := Item{
-		Id:          "id-to-be-replaced-by-uuid",
-		Name:        "name",
-		Description: "description",
+	page := PageRequest{Size: 1, Token: "not a page token"}
+
+	_, _, err := backend.ListItems(ctx, false, page)
+
+	if _, ok := err.(*InvalidPageToken); !ok {
+		t.Errorf("ListItems(%+v) returned %v, want *InvalidPageToken", page, err)
 	}
+}
 
-	got, err := backend.NewItem(ctx, &item)
-	if err != nil {
-		t.Fatalf("NewItem(%v) returned unexpected err: %v", item, err)
+func (bt *backendTester) testListInventoryTransactionsFilter(t *testing.T) {
+	ctx := context.Background()
+	base := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	state := initialBackendState{inventoryTransactions: map[string]*InventoryTransaction{}}
+	for i, txn := range []InventoryTransaction{
+		{Action: "ADD", CreatedBy: "alice", Warehouse: "north"},
+		{Action: "REMOVE", CreatedBy: "bob", Warehouse: "north"},
+		{Action: "ADD", CreatedBy: "bob", Warehouse: "south"},
+		{Action: "RECOUNT", CreatedBy: "alice", Warehouse: "south"},
+		{Action: "REMOVE", CreatedBy: "alice", Warehouse: "north"},
+	} {
+		// ids sort in the opposite order to timestamps, so ordering by id would be detected
+		txn := txn
+		txn.Id = fmt.Sprintf("txn-%d", 9-i)
+		txn.ItemId = "item-id"
+		txn.LocationId = "location-id"
+		txn.Timestamp = base.Add(time.Duration(i) * time.Hour)
+		state.inventoryTransactions[txn.Id] = &txn
 	}
-	if got.Id == "" {
-		t.Errorf("NewItem(%v) did not generate Item.Id", item)
+
+	cases := []struct {
+		desc   string
+		filter TransactionFilter
+		want   []string
+	}{
+		{
+			desc:   "no filter",
+			filter: TransactionFilter{},
+			want:   []string{"txn-9", "txn-8", "txn-7", "txn-6", "txn-5"},
+		},
+		{
+			desc:   "descending",
+			filter: TransactionFilter{Descending: true},
+			want:   []string{"txn-5", "txn-6", "txn-7", "txn-8", "txn-9"},
+		},
+		{
+			desc:   "start is inclusive",
+			filter: TransactionFilter{Start: base.Add(2 * time.Hour)},
+			want:   []string{"txn-7", "txn-6", "txn-5"},
+		},
+		{
+			desc:   "end is exclusive",
+			filter: TransactionFilter{End: base.Add(2 * time.Hour)},
+			want:   []string{"txn-9", "txn-8"},
+		},
+		{
+			desc:   "time range",
+			filter: TransactionFilter{Start: base.Add(time.Hour), End: base.Add(3 * time.Hour)},
+			want:   []string{"txn-8", "txn-7"},
+		},
+		{
+			desc:   "action",
+			filter: TransactionFilter{Action: "REMOVE"},
+			want:   []string{"txn-8", "txn-5"},
+		},
+		{
+			desc:   "created by",
+			filter: TransactionFilter{CreatedBy: "alice"},
+			want:   []string{"txn-9", "txn-6", "txn-5"},
+		},
+		{
+			desc:   "warehouse",
+			filter: TransactionFilter{Warehouse: "south"},
+			want:   []string{"txn-7", "txn-6"},
+		},
+		{
+			desc:   "warehouses",
+			filter: TransactionFilter{Warehouses: []string{"east", "south"}},
+			want:   []string{"txn-7", "txn-6"},
+		},
+		{
+			desc:   "many warehouses",
+			filter: TransactionFilter{Warehouses: []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "north"}, Action: "REMOVE"},
+			want:   []string{"txn-8", "txn-5"},
+		},
+		{
+			desc:   "combined, descending",
+			filter: TransactionFilter{Warehouse: "north", CreatedBy: "alice", Descending: true},
+			want:   []string{"txn-5", "txn-9"},
+		},
+		{
+			desc:   "no matches",
+			filter: TransactionFilter{Action: "RECOUNT", Warehouse: "north"},
+			want:   []string{},
+		},
+	}
+
+	lists := map[string]func(DatabaseBackend, TransactionFilter, PageRequest) ([]*InventoryTransaction, string, error){
+		"all": func(b DatabaseBackend, f TransactionFilter, p PageRequest) ([]*InventoryTransaction, string, error) {
+			return b.ListInventoryTransactions(ctx, f, p)
+		},
+		"item": func(b DatabaseBackend, f TransactionFilter, p PageRequest) ([]*InventoryTransaction, string, error) {
+			return b.ListItemInventoryTransactions(ctx, "item-id", f, p)
+		},
+		"location": func(b DatabaseBackend, f TransactionFilter, p PageRequest) ([]*InventoryTransaction, string, error) {
+			return b.ListLocationInventoryTransactions(ctx, "location-id", f, p)
+		},
+	}
+
+	backend := bt.initBackend(t, state)
+	for name, list := range lists {
+		for _, tc := range cases {
+			t.Run(name+" "+tc.desc, func(t *testing.T) {
+				// page through the results two at a time, to check that the
+				// filter and order are preserved across pages
+				got := []string{}
+				page := PageRequest{Size: 2}
+				for pages := 0; ; pages++ {
+					if pages > len(tc.want) {
+						t.Fatalf("listing %+v did not end after %d pages", tc.filter, pages)
+					}
+					txns, next, err := list(backend, tc.filter, page)
+					if err != nil {
+						t.Fatalf("listing %+v with %+v returned unexpected err: %v", tc.filter, page, err)
+					}
+					for _, txn := range txns {
+						got = append(got, txn.Id)
+					}
+					if next == "" {
+						break
+					}
+					page.Token = next
+				}
+				if !cmp.Equal(got, tc.want) {
+					t.Errorf("listing %+v = %v want %v", tc.filter, got, tc.want)
+				}
+			})
+		}
+	}
+}
+
+func (bt *backendTester) testTransactionWarehouse(t *testing.T) {
+	ctx := context.Background()
+	item := Item{Id: "item-id"}
+	north := Location{Id: "north-location", Warehouse: "north"}
+	south := Location{Id: "south-location", Warehouse: "south"}
+	backend := bt.initBackend(t, initialBackendState{
+		items:     map[string]*Item{item.Id: &item},
+		locations: map[string]*Location{north.Id: &north, south.Id: &south},
+	})
+
+	txn := &InventoryTransaction{ItemId: item.Id, LocationId: north.Id, Action: "ADD", Count: 10}
+	got, err := backend.NewInventoryTransaction(ctx, txn, "")
+	if err != nil {
+		t.Fatalf("NewInventoryTransaction(%v) returned unexpected err: %v", txn, err)
+	}
+	if got.Warehouse != north.Warehouse {
+		t.Errorf("NewInventoryTransaction(%v).Warehouse = %q want %q", txn, got.Warehouse, north.Warehouse)
+	}
+
+	transfer := &Transfer{ItemId: item.Id, SourceLocationId: north.Id, DestinationLocationId: south.Id, Count: 5}
+	tr, err := backend.NewTransfer(ctx, transfer)
+	if err != nil {
+		t.Fatalf("NewTransfer(%v) returned unexpected err: %v", transfer, err)
+	}
+	for i, want := range []string{north.Warehouse, south.Warehouse} {
+		if tr.Transactions[i].Warehouse != want {
+			t.Errorf("NewTransfer(%v).Transactions[%d].Warehouse = %q want %q", transfer, i, tr.Transactions[i].Warehouse, want)
+		}
+	}
+
+	txns, _, err := backend.ListInventoryTransactions(ctx, TransactionFilter{Warehouse: south.Warehouse}, PageRequest{})
+	if err != nil {
+		t.Fatalf("ListInventoryTransactions() returned unexpected err: %v", err)
+	}
+	if len(txns) != 1 || txns[0].LocationId != south.Id {
+		t.Errorf("ListInventoryTransactions(warehouse %q) = %v want the transfer's destination leg", south.Warehouse, txns)
+	}
+}
+
+func (bt *backendTester) testNewInventoryTransaction(t *testing.T) {
+	// properties of a
+	stockedItem := Item{Id: "stocked-item"}
+	stockedLoc := Location{Id: "stocked-location"}
+	const stockedInitCount = 100
+
+	newItem := Item{Id: "new-item"}
+	newLoc := Location{Id: "new-location"}
+	cases := []struct {
+		desc      string
+		txn       *InventoryTransaction
+		wantCount int64
+	}{
+		{
+			desc: "add to existing inventory",
+			txn: &InventoryTransaction{
+				ItemId:     stockedItem.Id,
+				LocationId: stockedLoc.Id,
+				Action:     "ADD",
+				Count:      20,
+			},
+			wantCount: stockedInitCount + 20,
+		},
+		{
+			desc: "add new inventory",
+			txn: &InventoryTransaction{
+				ItemId:     newItem.Id,
+				LocationId: newLoc.Id,
+				Action:     "ADD",
+				Count:      20,
+			},
+			wantCount: 20,
+		},
+		{
+			desc: "recount existing inventory",
+			txn: &InventoryTransaction{
+				ItemId:     stockedItem.Id,
+				LocationId: stockedLoc.Id,
+				Action:     "RECOUNT",
+				Count:      20,
+			},
+			wantCount: 20,
+		},
+		{
+			desc: "recount existing inventory to 0",
+			txn: &InventoryTransaction{
+				ItemId:     stockedItem.Id,
+				LocationId: stockedLoc.Id,
+				Action:     "RECOUNT",
+				Count:      0,
+			},
+			wantCount: 0,
+		},
+		{
+			desc: "recount new inventory",
+			txn: &InventoryTransaction{
+				ItemId:     newItem.Id,
+				LocationId: newLoc.Id,
+				Action:     "RECOUNT",
+				Count:      20,
+			},
+			wantCount: 20,
+		},
+		{
+			desc: "remove from existing inventory",
+			txn: &InventoryTransaction{
+				ItemId:     stockedItem.Id,
+				LocationId: stockedLoc.Id,
+				Action:     "REMOVE",
+				Count:      20,
+			},
+			wantCount: stockedInitCount - 20,
+		},
+		{
+			desc: "remove from new inventory",
+			txn: &InventoryTransaction{
+				ItemId:     newItem.Id,
+				LocationId: newLoc.Id,
+				Action:     "REMOVE",
+				Count:      20,
+			},
+			wantCount: -20,
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := context.Background()
+		stockedInv := Inventory{
+			LocationId:  stockedLoc.Id,
+			ItemId:      stockedItem.Id,
+			Count:       stockedInitCount,
+			LastUpdated: time.Now(),
+		}
+		backend := bt.initBackend(t, initialBackendState{
+			inventories: map[string]*Inventory{"stockedInv-id": &stockedInv},
+			items:       map[string]*Item{newItem.Id: &newItem, stockedItem.Id: &stockedItem},
+			locations:   map[string]*Location{newLoc.Id: &newLoc, stockedLoc.Id: &stockedLoc},
+		})
+		t.Run(tc.desc, func(t *testing.T) {
+
+			got, err := backend.NewInventoryTransaction(ctx, tc.txn, "")
+			if err != nil {
+				t.Fatalf("NewInventoryTransaction(%v) returned unexpected err: %v", tc.txn, err)
+			}
+			if got.Id == "" {
+				t.Errorf("NewInventoryTransaction(%v) did not generate InventoryTransaction.Id", tc.txn)
+			}
+			if !cmp.Equal(got, tc.txn, cmpopts.IgnoreFields(InventoryTransaction{}, "Id", "Timestamp")) {
+				t.Errorf("NewInventoryTransaction(%v) = %v want %v (ignoring Id field)", tc.txn, got, tc.txn)
+			}
+			if v, _ := backend.GetInventoryTransaction(ctx, got.Id); !cmp.Equal(got, v, cmpopts.EquateApproxTime(time.Microsecond)) {
+				t.Errorf("after backend.NewInventoryTransaction(%v), backend.GetInventoryTransaction(%v) = %v want %v", tc.txn, got.Id, v, got)
+			}
+
+			wantInv := &Inventory{ItemId: tc.txn.ItemId, LocationId: tc.txn.LocationId, Count: tc.wantCount}
+
+			inv, err := backend.lookupInventory(ctx, tc.txn.ItemId, tc.txn.LocationId)
+			if err != nil {
+				t.Errorf("getting inventory for item: %v, location: %v, produced error: %v", tc.txn.ItemId, tc.txn.LocationId, err)
+			}
+			if !cmp.Equal(inv, wantInv, cmpopts.IgnoreFields(Inventory{}, "LastUpdated")) {
+				t.Errorf("NewInventoryTransaction(%v) produced unexpected inventory state", tc.txn)
+				t.Errorf("[item %q, location %q] inventory = %v want %v", tc.txn.ItemId, tc.txn.LocationId, inv, wantInv)
+			}
+		})
+	}
+}
+
+func (bt *backendTester) testNewInventoryTransactionIdempotent(t *testing.T) {
+	item := Item{Id: "item-id"}
+	location := Location{Id: "location-id"}
+	cases := []struct {
+		desc      string
+		first     InventoryTransaction
+		firstKey  string
+		retry     InventoryTransaction
+		retryKey  string
+		wantSame  bool
+		wantCount int64
+	}{
+		{
+			desc:      "same key",
+			first:     InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10, CreatedBy: "alice"},
+			firstKey:  "key",
+			retry:     InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10, CreatedBy: "alice"},
+			retryKey:  "key",
+			wantSame:  true,
+			wantCount: 10,
+		},
+		{
+			desc:      "different keys",
+			first:     InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10, CreatedBy: "alice"},
+			firstKey:  "key",
+			retry:     InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10, CreatedBy: "alice"},
+			retryKey:  "other-key",
+			wantCount: 20,
+		},
+		{
+			desc:      "no key",
+			first:     InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10, CreatedBy: "alice"},
+			retry:     InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10, CreatedBy: "alice"},
+			wantCount: 20,
+		},
+		{
+			desc:      "same key from another user",
+			first:     InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10, CreatedBy: "alice"},
+			firstKey:  "key",
+			retry:     InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10, CreatedBy: "bob"},
+			retryKey:  "key",
+			wantCount: 20,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := context.Background()
+			backend := bt.initBackend(t, initialBackendState{
+				items:     map[string]*Item{item.Id: &item},
+				locations: map[string]*Location{location.Id: &location},
+			})
+
+			first, err := backend.NewInventoryTransaction(ctx, &tc.first, tc.firstKey)
+			if err != nil {
+				t.Fatalf("NewInventoryTransaction(%v, %q) returned unexpected err: %v", &tc.first, tc.firstKey, err)
+			}
+			retry, err := backend.NewInventoryTransaction(ctx, &tc.retry, tc.retryKey)
+			if err != nil {
+				t.Fatalf("NewInventoryTransaction(%v, %q) returned unexpected err: %v", &tc.retry, tc.retryKey, err)
+			}
+
+			if same := retry.Id == first.Id; same != tc.wantSame {
+				t.Errorf("retried NewInventoryTransaction(%v, %q) = %v, returned the first transaction %v: %t want %t", &tc.retry, tc.retryKey, retry, first, same, tc.wantSame)
+			}
+			if tc.wantSame && !cmp.Equal(retry, first, cmpopts.EquateApproxTime(time.Microsecond)) {
+				t.Errorf("retried NewInventoryTransaction(%v, %q) = %v want %v", &tc.retry, tc.retryKey, retry, first)
+			}
+			inv, err := backend.lookupInventory(ctx, item.Id, location.Id)
+			if err != nil {
+				t.Fatalf("getting inventory for item: %v, location: %v, produced error: %v", item.Id, location.Id, err)
+			}
+			if inv.Count != tc.wantCount {
+				t.Errorf("after retried NewInventoryTransaction(%v, %q), inventory count = %d want %d", &tc.retry, tc.retryKey, inv.Count, tc.wantCount)
+			}
+		})
+	}
+}
+
+func (bt *backendTester) testConcurrentIdempotentTransactions(t *testing.T) {
+	ctx := context.Background()
+	backend := bt.resetBackend(t)
+	item, err := backend.NewItem(ctx, &Item{Name: "item"})
+	if err != nil {
+		t.Fatalf("error creating item: %v", err)
+	}
+	location, err := backend.NewLocation(ctx, &Location{Name: "location"})
+	if err != nil {
+		t.Fatalf("error creating location: %v", err)
+	}
+
+	// Requests retried with the same key before the first one returned all
+	// get the transaction of whichever request recorded it first
+	const n = 5
+	var wg sync.WaitGroup
+	txns := make(chan *InventoryTransaction, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			txn, err := backend.NewInventoryTransaction(ctx, &InventoryTransaction{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10, CreatedBy: "alice"}, "key")
+			if err != nil {
+				errs <- err
+				return
+			}
+			txns <- txn
+		}()
+	}
+	wg.Wait()
+	close(txns)
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent NewInventoryTransaction() with the same key returned unexpected err: %v", err)
+	}
+	ids := map[string]bool{}
+	for txn := range txns {
+		ids[txn.Id] = true
+	}
+	if len(ids) != 1 {
+		t.Errorf("concurrent NewInventoryTransaction() with the same key returned transactions %v, want one", ids)
+	}
+	inv, err := backend.lookupInventory(ctx, item.Id, location.Id)
+	if err != nil {
+		t.Fatalf("error looking up inventory: %v", err)
+	}
+	if inv.Count != 10 {
+		t.Errorf("inventory count is %d after concurrent requests with the same key, want 10", inv.Count)
+	}
+}
+
+func (bt *backendTester) testConcurrentInventoryTransactions(t *testing.T) {
+	ctx := context.Background()
+	backend := bt.resetBackend(t)
+	item, err := backend.NewItem(ctx, &Item{Name: "item"})
+	if err != nil {
+		t.Fatalf("error creating item: %v", err)
+	}
+	var locations []*Location
+	for _, name := range []string{"loc1", "loc2"} {
+		location, err := backend.NewLocation(ctx, &Location{Name: name})
+		if err != nil {
+			t.Fatalf("error creating location: %v", err)
+		}
+		locations = append(locations, location)
+	}
+
+	// Single transactions, batches and reads run at the same time. Every
+	// change must apply entirely, without losing another, including the
+	// first changes to the inventory at the second location, which does not
+	// exist yet. Half of the batches list the locations in reverse.
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*n)
+	for i := 0; i < n; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_, err := backend.NewInventoryTransaction(ctx, &InventoryTransaction{ItemId: item.Id, LocationId: locations[0].Id, Action: "ADD", Count: 1}, "")
+			errs <- err
+		}()
+		first, second := locations[0], locations[1]
+		if i%2 == 1 {
+			first, second = second, first
+		}
+		go func() {
+			defer wg.Done()
+			_, err := backend.NewInventoryTransactionBatch(ctx, []*InventoryTransaction{
+				{ItemId: item.Id, LocationId: first.Id, Action: "ADD", Count: 1},
+				{ItemId: item.Id, LocationId: second.Id, Action: "ADD", Count: 1},
+			})
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, _, err := backend.ListItemInventory(ctx, item.Id, PageRequest{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent call returned unexpected err: %v", err)
+		}
+	}
+
+	for i, want := range []int64{2 * n, n} {
+		inv, err := backend.lookupInventory(ctx, item.Id, locations[i].Id)
+		if err != nil {
+			t.Fatalf("error looking up inventory: %v", err)
+		}
+		if inv.Count != want {
+			t.Errorf("inventory count at %s is %d after concurrent transactions, want %d", locations[i].Name, inv.Count, want)
+		}
+	}
+	txns, _, err := backend.ListInventoryTransactions(ctx, TransactionFilter{}, PageRequest{Size: 100})
+	if err != nil {
+		t.Fatalf("ListInventoryTransactions() returned unexpected err: %v", err)
+	}
+	if len(txns) != 3*n {
+		t.Errorf("ListInventoryTransactions() returned %d transactions, want %d", len(txns), 3*n)
+	}
+}
+
+func (bt *backendTester) testNewInventoryTransactionBatch(t *testing.T) {
+	ctx := context.Background()
+	item := Item{Id: "item-id"}
+	shelf := Location{Id: "shelf-id", Warehouse: "north"}
+	dock := Location{Id: "dock-id", Warehouse: "south"}
+	stockedInv := Inventory{ItemId: item.Id, LocationId: shelf.Id, Count: 5}
+	backend := bt.initBackend(t, initialBackendState{
+		inventories: map[string]*Inventory{"stocked-inv-id": &stockedInv},
+		items:       map[string]*Item{item.Id: &item},
+		locations:   map[string]*Location{shelf.Id: &shelf, dock.Id: &dock},
+	})
+	txns := []*InventoryTransaction{
+		{ItemId: item.Id, LocationId: shelf.Id, Action: "ADD", Count: 10},
+		{ItemId: item.Id, LocationId: dock.Id, Action: "ADD", Count: 7},
+		{ItemId: item.Id, LocationId: shelf.Id, Action: "REMOVE", Count: 3},
+	}
+
+	got, err := backend.NewInventoryTransactionBatch(ctx, txns)
+
+	if err != nil {
+		t.Fatalf("NewInventoryTransactionBatch(%v) returned unexpected err: %v", txns, err)
+	}
+	if len(got) != len(txns) {
+		t.Fatalf("NewInventoryTransactionBatch(%v) returned %d transactions, want %d", txns, len(got), len(txns))
+	}
+	ids := make(map[string]bool)
+	for i, txn := range got {
+		want := *txns[i]
+		want.Warehouse = map[string]string{shelf.Id: shelf.Warehouse, dock.Id: dock.Warehouse}[want.LocationId]
+		if !cmp.Equal(txn, &want, cmpopts.IgnoreFields(InventoryTransaction{}, "Id", "Timestamp")) {
+			t.Errorf("NewInventoryTransactionBatch(%v)[%d] = %v want %v (ignoring Id and Timestamp fields)", txns, i, txn, &want)
+		}
+		if txn.Id == "" || ids[txn.Id] {
+			t.Errorf("NewInventoryTransactionBatch(%v)[%d] has missing or duplicate Id %q", txns, i, txn.Id)
+		}
+		ids[txn.Id] = true
+		if v, _ := backend.GetInventoryTransaction(ctx, txn.Id); !cmp.Equal(v, txn, cmpopts.EquateApproxTime(time.Microsecond)) {
+			t.Errorf("after backend.NewInventoryTransactionBatch(%v), backend.GetInventoryTransaction(%v) = %v want %v", txns, txn.Id, v, txn)
+		}
+	}
+	for locId, wantCount := range map[string]int64{shelf.Id: 12, dock.Id: 7} {
+		inv, err := backend.lookupInventory(ctx, item.Id, locId)
+		if err != nil {
+			t.Fatalf("getting inventory for item: %v, location: %v, produced error: %v", item.Id, locId, err)
+		}
+		if inv.Count != wantCount {
+			t.Errorf("after NewInventoryTransactionBatch(%v), inventory count at %q = %d want %d", txns, locId, inv.Count, wantCount)
+		}
+	}
+}
+
+func (bt *backendTester) testNewInventoryTransactionBatchAllOrNone(t *testing.T) {
+	item := Item{Id: "item-id"}
+	strictItem := Item{Id: "strict-item-id", NegativeStockPolicy: negativeStockReject}
+	location := Location{Id: "location-id"}
+	cases := []struct {
+		desc      string
+		txns      []*InventoryTransaction
+		wantIndex int
+		wantErr   error
+	}{
+		{
+			desc: "item not found",
+			txns: []*InventoryTransaction{
+				{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10},
+				{ItemId: "missing-item-id", LocationId: location.Id, Action: "ADD", Count: 10},
+			},
+			wantIndex: 1,
+			wantErr:   ItemNotFound("missing-item-id"),
+		},
+		{
+			desc: "location not found",
+			txns: []*InventoryTransaction{
+				{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10},
+				{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10},
+				{ItemId: item.Id, LocationId: "missing-location-id", Action: "ADD", Count: 10},
+			},
+			wantIndex: 2,
+			wantErr:   LocationNotFound("missing-location-id"),
+		},
+		{
+			desc: "insufficient inventory after earlier entries",
+			txns: []*InventoryTransaction{
+				{ItemId: item.Id, LocationId: location.Id, Action: "ADD", Count: 10},
+				{ItemId: strictItem.Id, LocationId: location.Id, Action: "ADD", Count: 5},
+				{ItemId: strictItem.Id, LocationId: location.Id, Action: "REMOVE", Count: 3},
+				{ItemId: strictItem.Id, LocationId: location.Id, Action: "REMOVE", Count: 3},
+			},
+			wantIndex: 3,
+			wantErr:   &InsufficientInventory{itemId: strictItem.Id, locationId: location.Id, count: -1},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctx := context.Background()
+			backend := bt.initBackend(t, initialBackendState{
+				items:     map[string]*Item{item.Id: &item, strictItem.Id: &strictItem},
+				locations: map[string]*Location{location.Id: &location},
+			})
+
+			_, err := backend.NewInventoryTransactionBatch(ctx, tc.txns)
+
+			failed, ok := err.(*BatchEntryFailed)
+			if !ok {
+				t.Fatalf("NewInventoryTransactionBatch(%v) returned %v, want *BatchEntryFailed", tc.txns, err)
+			}
+			if failed.index != tc.wantIndex || failed.err.Error() != tc.wantErr.Error() {
+				t.Errorf("NewInventoryTransactionBatch(%v) failed entry %d with %v, want entry %d with %v", tc.txns, failed.index, failed.err, tc.wantIndex, tc.wantErr)
+			}
+			if txns, _, _ := backend.ListInventoryTransactions(ctx, TransactionFilter{}, PageRequest{}); len(txns) != 0 {
+				t.Errorf("after failed NewInventoryTransactionBatch(%v), ListInventoryTransactions() = %v want none", tc.txns, txns)
+			}
+			for _, id := range []string{item.Id, strictItem.Id} {
+				if inv, _ := backend.lookupInventory(ctx, id, location.Id); inv.Count != 0 {
+					t.Errorf("after failed NewInventoryTransactionBatch(%v), inventory of %q = %d want 0", tc.txns, id, inv.Count)
+				}
+			}
+		})
+	}
+}
+
+func (bt *backendTester) testNewInventoryTransactionBatchTooLarge(t *testing.T) {
+	ctx := context.Background()
+	backend := bt.resetBackend(t)
+	txns := make([]*InventoryTransaction, maxBatchSize+1)
+	for i := range txns {
+		txns[i] = &InventoryTransaction{ItemId: "item-id", LocationId: "location-id", Action: "ADD", Count: 1}
+	}
+
+	_, err := backend.NewInventoryTransactionBatch(ctx, txns)
+
+	if _, ok := err.(*BatchTooLarge); !ok {
+		t.Errorf("NewInventoryTransactionBatch() with %d transactions returned %v, want *BatchTooLarge", len(txns), err)
+	}
+}
+
+func (bt *backendTester) testNewInventoryTransactionBatchAlerts(t *testing.T) {
+	ctx := context.Background()
+	item := Item{Id: "item-id", NegativeStockPolicy: negativeStockAlert}
+	location := Location{Id: "location-id"}
+	backend := bt.initBackend(t, initialBackendState{
+		items:     map[string]*Item{item.Id: &item},
+		locations: map[string]*Location{location.Id: &location},
+	})
+	txns := []*InventoryTransaction{
+		{ItemId: item.Id, LocationId: location.Id, Action: "REMOVE", Count: 1},
+		{ItemId: item.Id, LocationId: location.Id, Action: "REMOVE", Count: 1},
+	}
+
+	got, err := backend.NewInventoryTransactionBatch(ctx, txns)
+	if err != nil {
+		t.Fatalf("NewInventoryTransactionBatch(%v) returned unexpected err: %v", txns, err)
+	}
+
+	alerts, _, err := backend.ListAlerts(ctx, AlertFilter{}, PageRequest{})
+	if err != nil {
+		t.Fatalf("ListAlerts() returned unexpected err: %v", err)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("after NewInventoryTransactionBatch(%v), ListAlerts() = %v want one alert", txns, alerts)
+	}
+	if alerts[0].Occurrences != 2 || alerts[0].TransactionId != got[1].Id {
+		t.Errorf("after NewInventoryTransactionBatch(%v), alert = %v want 2 occurrences, last raised by %q", txns, alerts[0], got[1].Id)
+	}
+}
+
+func (bt *backendTester) testNewInventoryTransactionNotFoundErrors(t *testing.T) {
+	existingLoc := Location{Id: "existing-location-id"}
+	existingItem := Item{Id: "existing-item-id"}
+	backend := bt.initBackend(t, initialBackendState{
+		items: map[string]*Item{
+			existingItem.Id: &existingItem,
+		},
+		locations: map[string]*Location{
+			existingLoc.Id: &existingLoc,
+		},
+	})
+	cases := []struct {
+		desc string
+		txn  *InventoryTransaction
+		want *ResourceNotFound
+	}{
+		{
+			desc: "item not found",
+			txn: &InventoryTransaction{
+				ItemId:     "bad-item-id",
+				LocationId: existingLoc.Id,
+			},
+			want: ItemNotFound("bad-item-id"),
+		},
+		{
+			desc: "location not found",
+			txn: &InventoryTransaction{
+				ItemId:     existingItem.Id,
+				LocationId: "bad-loc-id",
+			},
+			want: LocationNotFound("bad-loc-id"),
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := context.Background()
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := backend.NewInventoryTransaction(ctx, tc.txn, "")
+			if err == nil {
+				t.Fatalf("NewInventoryTransaction(%q) succeeded, want error", tc.txn)
+			}
+			if nf, ok := err.(*ResourceNotFound); !ok || nf.id != tc.want.id || nf.collection != tc.want.collection {
+				t.Errorf("NewInventoryTransaction(%q) returned %v, want %v", tc.txn, err, tc.want)
+			}
+		})
+	}
+}
+
+func (bt *backendTester) testNewTransfer(t *testing.T) {
+	item := Item{Id: "item-id"}
+	stockedLoc := Location{Id: "stocked-location"}
+	emptyLoc := Location{Id: "empty-location"}
+	const stockedInitCount = 100
+
+	cases := []struct {
+		desc         string
+		transfer     *Transfer
+		wantSrcCount int64
+		wantDstCount int64
+	}{
+		{
+			desc: "transfer to new inventory",
+			transfer: &Transfer{
+				ItemId:                item.Id,
+				SourceLocationId:      stockedLoc.Id,
+				DestinationLocationId: emptyLoc.Id,
+				Count:                 20,
+			},
+			wantSrcCount: stockedInitCount - 20,
+			wantDstCount: 20,
+		},
+		{
+			desc: "transfer from new inventory",
+			transfer: &Transfer{
+				ItemId:                item.Id,
+				SourceLocationId:      emptyLoc.Id,
+				DestinationLocationId: stockedLoc.Id,
+				Count:                 20,
+			},
+			wantSrcCount: -20,
+			wantDstCount: stockedInitCount + 20,
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := context.Background()
+		stockedInv := Inventory{
+			LocationId:  stockedLoc.Id,
+			ItemId:      item.Id,
+			Count:       stockedInitCount,
+			LastUpdated: time.Now(),
+		}
+		backend := bt.initBackend(t, initialBackendState{
+			inventories: map[string]*Inventory{"stockedInv-id": &stockedInv},
+			items:       map[string]*Item{item.Id: &item},
+			locations:   map[string]*Location{stockedLoc.Id: &stockedLoc, emptyLoc.Id: &emptyLoc},
+		})
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := backend.NewTransfer(ctx, tc.transfer)
+			if err != nil {
+				t.Fatalf("NewTransfer(%v) returned unexpected err: %v", tc.transfer, err)
+			}
+			if got.Id == "" {
+				t.Errorf("NewTransfer(%v) did not generate Transfer.Id", tc.transfer)
+			}
+			if len(got.Transactions) != 2 {
+				t.Fatalf("NewTransfer(%v) returned %d transactions, want 2", tc.transfer, len(got.Transactions))
+			}
+
+			wantLegs := []InventoryTransaction{
+				{ItemId: item.Id, LocationId: tc.transfer.SourceLocationId, Action: "REMOVE", Count: tc.transfer.Count, TransferId: got.Id},
+				{ItemId: item.Id, LocationId: tc.transfer.DestinationLocationId, Action: "ADD", Count: tc.transfer.Count, TransferId: got.Id},
+			}
+			if !cmp.Equal(got.Transactions, wantLegs, cmpopts.IgnoreFields(InventoryTransaction{}, "Id", "Timestamp")) {
+				t.Errorf("NewTransfer(%v).Transactions = %v want %v (ignoring Id and Timestamp fields)", tc.transfer, got.Transactions, wantLegs)
+			}
+			for _, leg := range got.Transactions {
+				if v, _ := backend.GetInventoryTransaction(ctx, leg.Id); !cmp.Equal(v, &leg, cmpopts.EquateApproxTime(time.Microsecond)) {
+					t.Errorf("after backend.NewTransfer(%v), backend.GetInventoryTransaction(%v) = %v want %v", tc.transfer, leg.Id, v, &leg)
+				}
+			}
+
+			for locId, wantCount := range map[string]int64{tc.transfer.SourceLocationId: tc.wantSrcCount, tc.transfer.DestinationLocationId: tc.wantDstCount} {
+				wantInv := &Inventory{ItemId: item.Id, LocationId: locId, Count: wantCount}
+				inv, err := backend.lookupInventory(ctx, item.Id, locId)
+				if err != nil {
+					t.Errorf("getting inventory for item: %v, location: %v, produced error: %v", item.Id, locId, err)
+				}
+				if !cmp.Equal(inv, wantInv, cmpopts.IgnoreFields(Inventory{}, "LastUpdated")) {
+					t.Errorf("NewTransfer(%v) produced unexpected inventory state", tc.transfer)
+					t.Errorf("[item %q, location %q] inventory = %v want %v", item.Id, locId, inv, wantInv)
+				}
+			}
+		})
+	}
+}
+
+func (bt *backendTester) testNewTransferNotFoundErrors(t *testing.T) {
+	existingLoc := Location{Id: "existing-location-id"}
+	existingItem := Item{Id: "existing-item-id"}
+	backend := bt.initBackend(t, initialBackendState{
+		items: map[string]*Item{
+			existingItem.Id: &existingItem,
+		},
+		locations: map[string]*Location{
+			existingLoc.Id: &existingLoc,
+		},
+	})
+	cases := []struct {
+		desc     string
+		transfer *Transfer
+		want     *ResourceNotFound
+	}{
+		{
+			desc: "item not found",
+			transfer: &Transfer{
+				ItemId:                "bad-item-id",
+				SourceLocationId:      existingLoc.Id,
+				DestinationLocationId: existingLoc.Id,
+			},
+			want: ItemNotFound("bad-item-id"),
+		},
+		{
+			desc: "source location not found",
+			transfer: &Transfer{
+				ItemId:                existingItem.Id,
+				SourceLocationId:      "bad-loc-id",
+				DestinationLocationId: existingLoc.Id,
+			},
+			want: LocationNotFound("bad-loc-id"),
+		},
+		{
+			desc: "destination location not found",
+			transfer: &Transfer{
+				ItemId:                existingItem.Id,
+				SourceLocationId:      existingLoc.Id,
+				DestinationLocationId: "bad-loc-id",
+			},
+			want: LocationNotFound("bad-loc-id"),
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := context.Background()
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := backend.NewTransfer(ctx, tc.transfer)
+			if err == nil {
+				t.Fatalf("NewTransfer(%v) succeeded, want error", tc.transfer)
+			}
+			if nf, ok := err.(*ResourceNotFound); !ok || nf.id != tc.want.id || nf.collection != tc.want.collection {
+				t.Errorf("NewTransfer(%v) returned %v, want %v", tc.transfer, err, tc.want)
+			}
+			if txns, _, _ := backend.ListInventoryTransactions(ctx, TransactionFilter{}, PageRequest{}); len(txns) != 0 {
+				t.Errorf("after failed NewTransfer(%v), ListInventoryTransactions() = %v want none", tc.transfer, txns)
+			}
+		})
+	}
+}
+
+func (bt *backendTester) testNewInventoryTransactionNegativeStockPolicy(t *testing.T) {
+	const stockedInitCount = 10
+	cases := []struct {
+		desc       string
+		itemPolicy string
+		locPolicy  string
+		txn        InventoryTransaction
+		wantErr    bool
+		wantCount  int64
+		wantAlert  bool
+	}{
+		{
+			desc:      "default policy allows negative inventory",
+			txn:       InventoryTransaction{Action: "REMOVE", Count: 20},
+			wantCount: stockedInitCount - 20,
+		},
+		{
+			desc:       "item policy rejects negative inventory",
+			itemPolicy: negativeStockReject,
+			txn:        InventoryTransaction{Action: "REMOVE", Count: 20},
+			wantErr:    true,
+			wantCount:  stockedInitCount,
+		},
+		{
+			desc:      "location policy rejects negative inventory",
+			locPolicy: negativeStockReject,
+			txn:       InventoryTransaction{Action: "REMOVE", Count: 20},
+			wantErr:   true,
+			wantCount: stockedInitCount,
+		},
+		{
+			desc:       "strictest policy applies",
+			itemPolicy: negativeStockAlert,
+			locPolicy:  negativeStockReject,
+			txn:        InventoryTransaction{Action: "REMOVE", Count: 20},
+			wantErr:    true,
+			wantCount:  stockedInitCount,
+		},
+		{
+			desc:       "reject policy allows removing all inventory",
+			itemPolicy: negativeStockReject,
+			txn:        InventoryTransaction{Action: "REMOVE", Count: stockedInitCount},
+			wantCount:  0,
+		},
+		{
+			desc:       "alert policy allows negative inventory and raises an alert",
+			itemPolicy: negativeStockAlert,
+			txn:        InventoryTransaction{Action: "REMOVE", Count: 20},
+			wantCount:  stockedInitCount - 20,
+			wantAlert:  true,
+		},
+		{
+			desc:       "alert policy does not alert on positive inventory",
+			itemPolicy: negativeStockAlert,
+			txn:        InventoryTransaction{Action: "REMOVE", Count: 5},
+			wantCount:  stockedInitCount - 5,
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := context.Background()
+		item := Item{Id: "item-id", NegativeStockPolicy: tc.itemPolicy}
+		loc := Location{Id: "location-id", NegativeStockPolicy: tc.locPolicy}
+		stockedInv := Inventory{
+			LocationId:  loc.Id,
+			ItemId:      item.Id,
+			Count:       stockedInitCount,
+			LastUpdated: time.Now(),
+		}
+		backend := bt.initBackend(t, initialBackendState{
+			inventories: map[string]*Inventory{"stockedInv-id": &stockedInv},
+			items:       map[string]*Item{item.Id: &item},
+			locations:   map[string]*Location{loc.Id: &loc},
+		})
+		txn := tc.txn
+		txn.ItemId, txn.LocationId = item.Id, loc.Id
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := backend.NewInventoryTransaction(ctx, &txn, "")
+			if tc.wantErr {
+				if _, ok := err.(*InsufficientInventory); !ok {
+					t.Errorf("NewInventoryTransaction(%v) returned %v, want *InsufficientInventory", &txn, err)
+				}
+				if txns, _, _ := backend.ListInventoryTransactions(ctx, TransactionFilter{}, PageRequest{}); len(txns) != 0 {
+					t.Errorf("after rejected NewInventoryTransaction(%v), ListInventoryTransactions() = %v want none", &txn, txns)
+				}
+			} else if err != nil {
+				t.Fatalf("NewInventoryTransaction(%v) returned unexpected err: %v", &txn, err)
+			}
+
+			inv, err := backend.lookupInventory(ctx, item.Id, loc.Id)
+			if err != nil {
+				t.Errorf("getting inventory for item: %v, location: %v, produced error: %v", item.Id, loc.Id, err)
+			} else if inv.Count != tc.wantCount {
+				t.Errorf("after NewInventoryTransaction(%v), inventory count = %d want %d", &txn, inv.Count, tc.wantCount)
+			}
+
+			alerts, _, err := backend.ListAlerts(ctx, AlertFilter{}, PageRequest{})
+			if err != nil {
+				t.Fatalf("ListAlerts() returned unexpected err: %v", err)
+			}
+			if !tc.wantAlert {
+				if len(alerts) != 0 {
+					t.Errorf("after NewInventoryTransaction(%v), ListAlerts() = %v want none", &txn, alerts)
+				}
+				return
+			}
+			if len(alerts) != 1 {
+				t.Fatalf("after NewInventoryTransaction(%v), ListAlerts() = %v want a single alert", &txn, alerts)
+			}
+			if alerts[0].ItemId != item.Id || alerts[0].TransactionId != got.Id {
+				t.Errorf("after NewInventoryTransaction(%v), alert = %v want item %q and transaction %q", &txn, alerts[0], item.Id, got.Id)
+			}
+		})
+	}
+}
+
+func (bt *backendTester) testNewTransferNegativeStockPolicy(t *testing.T) {
+	ctx := context.Background()
+	item := Item{Id: "item-id", NegativeStockPolicy: negativeStockReject}
+	srcLoc, dstLoc := Location{Id: "src-location-id"}, Location{Id: "dst-location-id"}
+	srcInv := Inventory{ItemId: item.Id, LocationId: srcLoc.Id, Count: 10, LastUpdated: time.Now()}
+	backend := bt.initBackend(t, initialBackendState{
+		inventories: map[string]*Inventory{"srcInv-id": &srcInv},
+		items:       map[string]*Item{item.Id: &item},
+		locations:   map[string]*Location{srcLoc.Id: &srcLoc, dstLoc.Id: &dstLoc},
+	})
+	transfer := &Transfer{ItemId: item.Id, SourceLocationId: srcLoc.Id, DestinationLocationId: dstLoc.Id, Count: 20}
+
+	_, err := backend.NewTransfer(ctx, transfer)
+
+	if _, ok := err.(*InsufficientInventory); !ok {
+		t.Errorf("NewTransfer(%v) returned %v, want *InsufficientInventory", transfer, err)
+	}
+	for locId, wantCount := range map[string]int64{srcLoc.Id: 10, dstLoc.Id: 0} {
+		inv, err := backend.lookupInventory(ctx, item.Id, locId)
+		if err != nil {
+			t.Errorf("getting inventory for item: %v, location: %v, produced error: %v", item.Id, locId, err)
+		} else if inv.Count != wantCount {
+			t.Errorf("after rejected NewTransfer(%v), [item %q, location %q] inventory count = %d want %d", transfer, item.Id, locId, inv.Count, wantCount)
+		}
+	}
+	if txns, _, _ := backend.ListInventoryTransactions(ctx, TransactionFilter{}, PageRequest{}); len(txns) != 0 {
+		t.Errorf("after rejected NewTransfer(%v), ListInventoryTransactions() = %v want none", transfer, txns)
+	}
+}
+
+func (bt *backendTester) testReorderAlerts(t *testing.T) {
+	stockedLoc, otherLoc := Location{Id: "stocked-location"}, Location{Id: "other-location"}
+	cases := []struct {
+		desc      string
+		item      Item
+		txn       *InventoryTransaction
+		transfer  *Transfer
+		wantTexts []string
+	}{
+		{
+			desc:      "transaction crosses location reorder point",
+			item:      Item{Id: "item-id", LocationReorderPoints: map[string]int64{stockedLoc.Id: 50}},
+			txn:       &InventoryTransaction{Action: "REMOVE", Count: 60},
+			wantTexts: []string{"below its reorder point of 50: 40"},
+		},
+		{
+			desc:      "transaction crosses total reorder point",
+			item:      Item{Id: "item-id", ReorderPoint: 120},
+			txn:       &InventoryTransaction{Action: "REMOVE", Count: 90},
+			wantTexts: []string{"Total inventory of item \"item-id\" is below its reorder point of 120: 60"},
+		},
+		{
+			desc:      "transaction crosses both reorder points",
+			item:      Item{Id: "item-id", ReorderPoint: 120, LocationReorderPoints: map[string]int64{stockedLoc.Id: 50}},
+			txn:       &InventoryTransaction{Action: "RECOUNT", Count: 0},
+			wantTexts: []string{"below its reorder point of 50: 0", "below its reorder point of 120: 50"},
+		},
+		{
+			desc: "transaction stays above reorder points",
+			item: Item{Id: "item-id", ReorderPoint: 100, LocationReorderPoints: map[string]int64{stockedLoc.Id: 50}},
+			txn:  &InventoryTransaction{Action: "REMOVE", Count: 50},
+		},
+		{
+			desc: "transaction on a location without a reorder point",
+			item: Item{Id: "item-id", LocationReorderPoints: map[string]int64{otherLoc.Id: 100}},
+			txn:  &InventoryTransaction{Action: "REMOVE", Count: 100},
+		},
+		{
+			desc:      "transfer crosses source location reorder point but not total reorder point",
+			item:      Item{Id: "item-id", ReorderPoint: 150, LocationReorderPoints: map[string]int64{stockedLoc.Id: 50}},
+			transfer:  &Transfer{SourceLocationId: stockedLoc.Id, DestinationLocationId: otherLoc.Id, Count: 60},
+			wantTexts: []string{"below its reorder point of 50: 40"},
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := context.Background()
+		item := tc.item
+		stockedInv := Inventory{ItemId: item.Id, LocationId: stockedLoc.Id, Count: 100, LastUpdated: time.Now()}
+		otherInv := Inventory{ItemId: item.Id, LocationId: otherLoc.Id, Count: 50, LastUpdated: time.Now()}
+		backend := bt.initBackend(t, initialBackendState{
+			inventories: map[string]*Inventory{"stockedInv-id": &stockedInv, "otherInv-id": &otherInv},
+			items:       map[string]*Item{item.Id: &item},
+			locations:   map[string]*Location{stockedLoc.Id: &stockedLoc, otherLoc.Id: &otherLoc},
+		})
+		t.Run(tc.desc, func(t *testing.T) {
+			var txnId string
+			if tc.txn != nil {
+				tc.txn.ItemId, tc.txn.LocationId = item.Id, stockedLoc.Id
+				got, err := backend.NewInventoryTransaction(ctx, tc.txn, "")
+				if err != nil {
+					t.Fatalf("NewInventoryTransaction(%v) returned unexpected err: %v", tc.txn, err)
+				}
+				txnId = got.Id
+			} else {
+				tc.transfer.ItemId = item.Id
+				got, err := backend.NewTransfer(ctx, tc.transfer)
+				if err != nil {
+					t.Fatalf("NewTransfer(%v) returned unexpected err: %v", tc.transfer, err)
+				}
+				txnId = got.Transactions[0].Id
+			}
+
+			alerts, _, err := backend.ListAlerts(ctx, AlertFilter{}, PageRequest{})
+			if err != nil {
+				t.Fatalf("ListAlerts() returned unexpected err: %v", err)
+			}
+			if len(alerts) != len(tc.wantTexts) {
+				t.Fatalf("ListAlerts() = %v want %d alerts", alerts, len(tc.wantTexts))
+			}
+			for _, want := range tc.wantTexts {
+				found := false
+				for _, alert := range alerts {
+					if strings.Contains(alert.Text, want) && alert.ItemId == item.Id && alert.TransactionId == txnId {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("ListAlerts() = %v want an alert for item %q and transaction %q containing %q", alerts, item.Id, txnId, want)
+				}
+			}
+		})
+	}
+}
+
+func (bt *backendTester) testNewItem(t *testing.T) {
+	ctx := context.Background()
+	backend := bt.resetBackend(t)
+	item := Item{
+		Id:          "id-to-be-replaced-by-uuid",
+		Name:        "name",
+		Description: "description",
+	}
+
+	got, err := backend.NewItem(ctx, &item)
+	if err != nil {
+		t.Fatalf("NewItem(%v) returned unexpected err: %v", item, err)
+	}
+	if got.Id == "" {
+		t.Errorf("NewItem(%v) did not generate Item.Id", item)
 	}
-	if !cmp.Equal(got, &item, cmpopts.IgnoreFields(Item{}, "Id")) {
-		t.Errorf("NewItem(%v) = %v want %v (ignoring Id field)", item, got, item)
+	if got.Version != 1 {
+		t.Errorf("NewItem(%v).Version = %d want 1", item, got.Version)
+	}
+	if !cmp.Equal(got, &item, cmpopts.IgnoreFields(Item{}, "Id", "Version")) {
+		t.Errorf("NewItem(%v) = %v want %v (ignoring Id and Version fields)", item, got, item)
 	}
 	if v, _ := backend.GetItem(ctx, got.Id); !cmp.Equal(v, got) {
 		t.Errorf("after backend.NewItem(%v), backend.GetItem(%v) = %v want %v", item, got.Id, v, got)
@@ -916,8 +2429,11 @@ func (bt *backendTester) testNewLocation(t *testing.T) {
 	if got.Id == "" {
 		t.Errorf("NewLocation(%v) did not generate Location.Id", location)
 	}
-	if !cmp.Equal(got, &location, cmpopts.IgnoreFields(Location{}, "Id")) {
-		t.Errorf("NewLocation(%v) = %v want %v (ignoring Id field)", location, got, location)
+	if got.Version != 1 {
+		t.Errorf("NewLocation(%v).Version = %d want 1", location, got.Version)
+	}
+	if !cmp.Equal(got, &location, cmpopts.IgnoreFields(Location{}, "Id", "Version")) {
+		t.Errorf("NewLocation(%v) = %v want %v (ignoring Id and Version fields)", location, got, location)
 	}
 	if v, _ := backend.GetLocation(ctx, got.Id); !cmp.Equal(v, got) {
 		t.Errorf("after backend.NewLocation(%v), backend.GetLocation(%v) = %v want %v", location, got.Id, v, got)
@@ -947,7 +2463,7 @@ func (bt *backendTester) testNewAlert(t *testing.T) {
 		t.Errorf("NewAlert(%v) = %v want %v (ignoring Id field)", alert, got, alert)
 	}
 
-	v, err := backend.ListAlerts(ctx)
+	v, _, err := backend.ListAlerts(ctx, AlertFilter{}, PageRequest{})
 	if err != nil {
 		t.Fatalf("ListAlerts() returned unexpected err: %v", err)
 	}
@@ -959,6 +2475,85 @@ func (bt *backendTester) testNewAlert(t *testing.T) {
 	}
 }
 
+func (bt *backendTester) testApiKeyLifecycle(t *testing.T) {
+	ctx := context.Background()
+	backend := bt.resetBackend(t)
+	now := time.Now()
+	record := &apiKeyRecord{
+		ApiKey: ApiKey{
+			Id:         "id-to-be-replaced-by-uuid",
+			Name:       "scanner",
+			Scope:      apiKeyTransactions,
+			Warehouses: []string{"warehouse"},
+			CreatedBy:  "admin",
+			CreatedAt:  now,
+			ExpiresAt:  now.Add(time.Hour),
+		},
+		SecretHash: hashApiKeySecret("secret"),
+	}
+	approxTime := cmpopts.EquateApproxTime(time.Millisecond)
+
+	created, err := backend.NewApiKey(ctx, record)
+	if err != nil {
+		t.Fatalf("NewApiKey(%v) returned unexpected err: %v", record, err)
+	}
+	if created.Id == "" || created.Id == record.Id {
+		t.Errorf("NewApiKey(%v) did not generate ApiKey.Id", record)
+	}
+	if !cmp.Equal(created, &record.ApiKey, cmpopts.IgnoreFields(ApiKey{}, "Id"), approxTime) {
+		t.Errorf("NewApiKey(%v) = %v want %v (ignoring Id field)", record, created, record.ApiKey)
+	}
+	if got, err := backend.GetApiKey(ctx, created.Id); err != nil || !cmp.Equal(got, created, approxTime) {
+		t.Errorf("GetApiKey(%q) = %v, %v want %v", created.Id, got, err, created)
+	}
+	list, _, err := backend.ListApiKeys(ctx, PageRequest{})
+	if err != nil || len(list) != 1 || !cmp.Equal(list[0], created, approxTime) {
+		t.Errorf("ListApiKeys() = %v, %v want [%v]", list, err, created)
+	}
+	lookedUp, err := backend.lookupApiKey(ctx, created.Id)
+	if err != nil || lookedUp.SecretHash != record.SecretHash {
+		t.Errorf("lookupApiKey(%q) = %v, %v want the hash %q", created.Id, lookedUp, err, record.SecretHash)
+	}
+
+	usedAt := now.Add(time.Minute)
+	if err := backend.recordApiKeyUse(ctx, created.Id, usedAt); err != nil {
+		t.Fatalf("recordApiKeyUse(%q) returned unexpected err: %v", created.Id, err)
+	}
+	revoked, err := backend.RevokeApiKey(ctx, created.Id)
+	if err != nil {
+		t.Fatalf("RevokeApiKey(%q) returned unexpected err: %v", created.Id, err)
+	}
+	if revoked.RevokedAt.IsZero() || !cmp.Equal(revoked.LastUsedAt, usedAt, approxTime) {
+		t.Errorf("RevokeApiKey(%q) = %v, want it revoked and last used at %v", created.Id, revoked, usedAt)
+	}
+	again, err := backend.RevokeApiKey(ctx, created.Id)
+	if err != nil || !cmp.Equal(again.RevokedAt, revoked.RevokedAt, approxTime) {
+		t.Errorf("RevokeApiKey(%q) again = %v, %v want it still revoked at %v", created.Id, again, err, revoked.RevokedAt)
+	}
+	lookedUp, err = backend.lookupApiKey(ctx, created.Id)
+	if err != nil || lookedUp.RevokedAt.IsZero() || lookedUp.SecretHash != record.SecretHash {
+		t.Errorf("lookupApiKey(%q) after revoking = %v, %v want it revoked with the hash %q", created.Id, lookedUp, err, record.SecretHash)
+	}
+}
+
+func (bt *backendTester) testApiKeyNotFound(t *testing.T) {
+	ctx := context.Background()
+	id := "not-found-id"
+	backend := bt.resetBackend(t)
+	want := ApiKeyNotFound(id)
+
+	_, getErr := backend.GetApiKey(ctx, id)
+	_, lookupErr := backend.lookupApiKey(ctx, id)
+	_, revokeErr := backend.RevokeApiKey(ctx, id)
+	useErr := backend.recordApiKeyUse(ctx, id, time.Now())
+
+	for _, err := range []error{getErr, lookupErr, revokeErr, useErr} {
+		if nf, ok := err.(*ResourceNotFound); !ok || nf.id != want.id || nf.collection != want.collection {
+			t.Errorf("API key %q returned %v, want %v", id, err, want)
+		}
+	}
+}
+
 func (bt *backendTester) testUpdateItem(t *testing.T) {
 	ctx := context.Background()
 	id := "item-id"
@@ -968,6 +2563,7 @@ func (bt *backendTester) testUpdateItem(t *testing.T) {
 				Id:          id,
 				Name:        "old-name",
 				Description: "old-description",
+				Version:     2,
 			},
 		},
 	})
@@ -977,16 +2573,98 @@ func (bt *backendTester) testUpdateItem(t *testing.T) {
 		Description: "updated-description",
 	}
 
-	got, err := backend.UpdateItem(ctx, item)
+	want := &Item{
+		Id:          id,
+		Name:        "updated-name",
+		Description: "updated-description",
+		Version:     3,
+	}
+
+	got, err := backend.UpdateItem(ctx, item, 2)
 
 	if err != nil {
 		t.Fatalf("UpdateItem(%v) returned unexpected err: %v", item, err)
 	}
-	if !cmp.Equal(got, item) {
-		t.Errorf("UpdateItem(%v) = %v want %v", item, got, item)
+	if !cmp.Equal(got, want) {
+		t.Errorf("UpdateItem(%v) = %v want %v", item, got, want)
+	}
+	if got, _ := backend.GetItem(ctx, id); !cmp.Equal(got, want) {
+		t.Errorf("after backend.UpdateItem(%v), backend.GetItem(%v) = %v want %v", item, id, got, want)
+	}
+}
+
+func (bt *backendTester) testUpdateItemVersion(t *testing.T) {
+	ctx := context.Background()
+	id := "item-id"
+	stored := Item{Id: id, Name: "old-name", Version: 2}
+	cases := []struct {
+		desc        string
+		version     int64
+		wantErr     bool
+		wantVersion int64
+	}{
+		{desc: "matching version", version: 2, wantVersion: 3},
+		{desc: "any version", version: 0, wantVersion: 3},
+		{desc: "stale version", version: 1, wantErr: true, wantVersion: 2},
+		{desc: "future version", version: 3, wantErr: true, wantVersion: 2},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			existing := stored
+			backend := bt.initBackend(t, initialBackendState{items: map[string]*Item{id: &existing}})
+			item := &Item{Id: id, Name: "updated-name"}
+
+			_, err := backend.UpdateItem(ctx, item, tc.version)
+
+			if tc.wantErr {
+				if pf, ok := err.(*PreconditionFailed); !ok || pf.id != id {
+					t.Errorf("UpdateItem(%v, %d) returned %v, want *PreconditionFailed", item, tc.version, err)
+				}
+			} else if err != nil {
+				t.Fatalf("UpdateItem(%v, %d) returned unexpected err: %v", item, tc.version, err)
+			}
+			if got, _ := backend.GetItem(ctx, id); got.Version != tc.wantVersion {
+				t.Errorf("after backend.UpdateItem(%v, %d), backend.GetItem(%v).Version = %d want %d", item, tc.version, id, got.Version, tc.wantVersion)
+			}
+		})
+	}
+}
+
+func (bt *backendTester) testUpdateLocationVersion(t *testing.T) {
+	ctx := context.Background()
+	id := "location-id"
+	stored := Location{Id: id, Name: "old-name", Warehouse: "warehouse", Version: 2}
+	cases := []struct {
+		desc        string
+		version     int64
+		wantErr     bool
+		wantVersion int64
+	}{
+		{desc: "matching version", version: 2, wantVersion: 3},
+		{desc: "any version", version: 0, wantVersion: 3},
+		{desc: "stale version", version: 1, wantErr: true, wantVersion: 2},
 	}
-	if got, _ := backend.GetItem(ctx, id); !cmp.Equal(got, item) {
-		t.Errorf("after backend.UpdateItem(%v), backend.GetItem(%v) = %v want %v", item, id, got, item)
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			existing := stored
+			backend := bt.initBackend(t, initialBackendState{locations: map[string]*Location{id: &existing}})
+			location := &Location{Id: id, Name: "updated-name", Warehouse: "warehouse"}
+
+			_, err := backend.UpdateLocation(ctx, location, tc.version)
+
+			if tc.wantErr {
+				if pf, ok := err.(*PreconditionFailed); !ok || pf.id != id {
+					t.Errorf("UpdateLocation(%v, %d) returned %v, want *PreconditionFailed", location, tc.version, err)
+				}
+			} else if err != nil {
+				t.Fatalf("UpdateLocation(%v, %d) returned unexpected err: %v", location, tc.version, err)
+			}
+			if got, _ := backend.GetLocation(ctx, id); got.Version != tc.wantVersion {
+				t.Errorf("after backend.UpdateLocation(%v, %d), backend.GetLocation(%v).Version = %d want %d", location, tc.version, id, got.Version, tc.wantVersion)
+			}
+		})
 	}
 }
 
@@ -996,13 +2674,13 @@ func (bt *backendTester) testUpdateItemNotFound(t *testing.T) {
 	backend := bt.resetBackend(t)
 	want := ItemNotFound(item.Id)
 
-	_, err := backend.UpdateItem(ctx, item)
+	_, err := backend.UpdateItem(ctx, item, 0)
 
 	if err == nil {
-		t.Fatalf("UpdateItem(%q) succeeded, want error", item)
+		t.Fatalf("UpdateItem(%v) succeeded, want error", item)
 	}
 	if nf, ok := err.(*ResourceNotFound); !ok || nf.id != want.id || nf.collection != want.collection {
-		t.Errorf("UpdateItem(%q) returned %v, want %v", item, err, want)
+		t.Errorf("UpdateItem(%v) returned %v, want %v", item, err, want)
 	}
 }
 
@@ -1015,6 +2693,7 @@ func (bt *backendTester) testUpdateLocation(t *testing.T) {
 				Id:        id,
 				Name:      "old-name",
 				Warehouse: "old-warehouse",
+				Version:   2,
 			},
 		},
 	})
@@ -1024,16 +2703,23 @@ func (bt *backendTester) testUpdateLocation(t *testing.T) {
 		Warehouse: "updated-warehouse",
 	}
 
-	got, err := backend.UpdateLocation(ctx, location)
+	want := &Location{
+		Id:        id,
+		Name:      "updated-name",
+		Warehouse: "updated-warehouse",
+		Version:   3,
+	}
+
+	got, err := backend.UpdateLocation(ctx, location, 2)
 
 	if err != nil {
 		t.Fatalf("UpdateLocation(%v) returned unexpected err: %v", location, err)
 	}
-	if !cmp.Equal(got, location) {
-		t.Errorf("UpdateLocation(%v) = %v want %v", location, got, location)
+	if !cmp.Equal(got, want) {
+		t.Errorf("UpdateLocation(%v) = %v want %v", location, got, want)
 	}
-	if got, _ = backend.GetLocation(ctx, id); !cmp.Equal(got, location) {
-		t.Errorf("after backend.UpdateLocation(%v), backend.GetLocation(%v) = %v want %v", location, id, got, location)
+	if got, _ = backend.GetLocation(ctx, id); !cmp.Equal(got, want) {
+		t.Errorf("after backend.UpdateLocation(%v), backend.GetLocation(%v) = %v want %v", location, id, got, want)
 	}
 }
 
@@ -1043,12 +2729,229 @@ func (bt *backendTester) testUpdateLocationNotFound(t *testing.T) {
 	ctx := context.Background()
 	want := LocationNotFound(location.Id)
 
-	_, err := backend.UpdateLocation(ctx, location)
+	_, err := backend.UpdateLocation(ctx, location, 0)
 
 	if err == nil {
-		t.Fatalf("UpdateLocation(%q) succeeded, want error", location)
+		t.Fatalf("UpdateLocation(%v) succeeded, want error", location)
 	}
 	if nf, ok := err.(*ResourceNotFound); !ok || nf.id != want.id || nf.collection != want.collection {
-		t.Errorf("UpdateLocation(%q) returned %v, want %v", location, err, want)
+		t.Errorf("UpdateLocation(%v) returned %v, want %v", location, err, want)
+	}
+}
+
+func (bt *backendTester) testArchiveItem(t *testing.T) {
+	ctx := context.Background()
+	id := "item-id"
+	stored := Item{Id: id, Name: "name", Version: 2}
+	backend := bt.initBackend(t, initialBackendState{items: map[string]*Item{id: &stored}})
+
+	got, err := backend.ArchiveItem(ctx, id)
+	if err != nil {
+		t.Fatalf("ArchiveItem(%q) returned unexpected err: %v", id, err)
+	}
+	if !got.Archived || got.ArchivedAt.IsZero() || got.Version != 3 {
+		t.Errorf("ArchiveItem(%q) = %+v, want archived at version 3", id, got)
+	}
+	if again, err := backend.ArchiveItem(ctx, id); err != nil || again.Version != 3 {
+		t.Errorf("ArchiveItem(%q) of an archived item = %+v, %v, want it unchanged at version 3", id, again, err)
+	}
+
+	// Updates keep the item archived
+	if _, err := backend.UpdateItem(ctx, &Item{Id: id, Name: "updated-name"}, 3); err != nil {
+		t.Fatalf("UpdateItem(%q) returned unexpected err: %v", id, err)
+	}
+	if got, _ := backend.GetItem(ctx, id); !got.Archived || got.Version != 4 {
+		t.Errorf("after UpdateItem(%q), GetItem(%q) = %+v, want archived at version 4", id, id, got)
+	}
+
+	got, err = backend.RestoreItem(ctx, id)
+	if err != nil {
+		t.Fatalf("RestoreItem(%q) returned unexpected err: %v", id, err)
+	}
+	if got.Archived || !got.ArchivedAt.IsZero() || got.Version != 5 {
+		t.Errorf("RestoreItem(%q) = %+v, want restored at version 5", id, got)
+	}
+	if got, _ := backend.GetItem(ctx, id); got.Archived || got.Name != "updated-name" {
+		t.Errorf("after RestoreItem(%q), GetItem(%q) = %+v, want the updated item restored", id, id, got)
+	}
+}
+
+func (bt *backendTester) testArchiveItemNotFound(t *testing.T) {
+	ctx := context.Background()
+	id := "not-found-id"
+	backend := bt.resetBackend(t)
+	want := ItemNotFound(id)
+
+	for name, f := range map[string]func(context.Context, string) (*Item, error){
+		"ArchiveItem": backend.ArchiveItem,
+		"RestoreItem": backend.RestoreItem,
+	} {
+		_, err := f(ctx, id)
+		if nf, ok := err.(*ResourceNotFound); !ok || *nf != *want {
+			t.Errorf("%s(%q) returned %v, want %v", name, id, err, want)
+		}
+	}
+}
+
+func (bt *backendTester) testArchiveLocation(t *testing.T) {
+	ctx := context.Background()
+	id := "location-id"
+	stored := Location{Id: id, Name: "name", Warehouse: "warehouse", Version: 2}
+	backend := bt.initBackend(t, initialBackendState{locations: map[string]*Location{id: &stored}})
+
+	got, err := backend.ArchiveLocation(ctx, id)
+	if err != nil {
+		t.Fatalf("ArchiveLocation(%q) returned unexpected err: %v", id, err)
+	}
+	if !got.Archived || got.ArchivedAt.IsZero() || got.Version != 3 {
+		t.Errorf("ArchiveLocation(%q) = %+v, want archived at version 3", id, got)
+	}
+	if again, err := backend.ArchiveLocation(ctx, id); err != nil || again.Version != 3 {
+		t.Errorf("ArchiveLocation(%q) of an archived location = %+v, %v, want it unchanged at version 3", id, again, err)
+	}
+
+	// Updates keep the location archived
+	if _, err := backend.UpdateLocation(ctx, &Location{Id: id, Name: "updated-name", Warehouse: "warehouse"}, 3); err != nil {
+		t.Fatalf("UpdateLocation(%q) returned unexpected err: %v", id, err)
+	}
+	if got, _ := backend.GetLocation(ctx, id); !got.Archived || got.Version != 4 {
+		t.Errorf("after UpdateLocation(%q), GetLocation(%q) = %+v, want archived at version 4", id, id, got)
+	}
+
+	got, err = backend.RestoreLocation(ctx, id)
+	if err != nil {
+		t.Fatalf("RestoreLocation(%q) returned unexpected err: %v", id, err)
+	}
+	if got.Archived || !got.ArchivedAt.IsZero() || got.Version != 5 {
+		t.Errorf("RestoreLocation(%q) = %+v, want restored at version 5", id, got)
+	}
+	if got, _ := backend.GetLocation(ctx, id); got.Archived || got.Name != "updated-name" {
+		t.Errorf("after RestoreLocation(%q), GetLocation(%q) = %+v, want the updated location restored", id, id, got)
+	}
+}
+
+func (bt *backendTester) testArchiveLocationNotFound(t *testing.T) {
+	ctx := context.Background()
+	id := "not-found-id"
+	backend := bt.resetBackend(t)
+	want := LocationNotFound(id)
+
+	for name, f := range map[string]func(context.Context, string) (*Location, error){
+		"ArchiveLocation": backend.ArchiveLocation,
+		"RestoreLocation": backend.RestoreLocation,
+	} {
+		_, err := f(ctx, id)
+		if nf, ok := err.(*ResourceNotFound); !ok || *nf != *want {
+			t.Errorf("%s(%q) returned %v, want %v", name, id, err, want)
+		}
+	}
+}
+
+func (bt *backendTester) testListIncludeArchived(t *testing.T) {
+	ctx := context.Background()
+	item, archivedItem := Item{Id: "item-id"}, Item{Id: "archived-item-id", Archived: true}
+	location, archivedLocation := Location{Id: "location-id"}, Location{Id: "archived-location-id", Archived: true}
+	backend := bt.initBackend(t, initialBackendState{
+		items:     map[string]*Item{item.Id: &item, archivedItem.Id: &archivedItem},
+		locations: map[string]*Location{location.Id: &location, archivedLocation.Id: &archivedLocation},
+	})
+
+	for _, tc := range []struct {
+		includeArchived bool
+		wantItems       []*Item
+		wantLocations   []*Location
+	}{
+		{includeArchived: false, wantItems: []*Item{&item}, wantLocations: []*Location{&location}},
+		{includeArchived: true, wantItems: []*Item{&item, &archivedItem}, wantLocations: []*Location{&location, &archivedLocation}},
+	} {
+		items, _, err := backend.ListItems(ctx, tc.includeArchived, PageRequest{})
+		if err != nil || !cmp.Equal(items, tc.wantItems, cmpopts.SortSlices(modelLess)) {
+			t.Errorf("ListItems(%v) = %v, %v, want %v", tc.includeArchived, items, err, tc.wantItems)
+		}
+		locations, _, err := backend.ListLocations(ctx, tc.includeArchived, PageRequest{})
+		if err != nil || !cmp.Equal(locations, tc.wantLocations, cmpopts.SortSlices(modelLess)) {
+			t.Errorf("ListLocations(%v) = %v, %v, want %v", tc.includeArchived, locations, err, tc.wantLocations)
+		}
+	}
+}
+
+func (bt *backendTester) testNewInventoryTransactionArchived(t *testing.T) {
+	item, archivedItem := Item{Id: "item-id"}, Item{Id: "archived-item-id", Archived: true}
+	location, archivedLocation := Location{Id: "location-id"}, Location{Id: "archived-location-id", Archived: true}
+	cases := []struct {
+		desc    string
+		txn     InventoryTransaction
+		wantErr *ResourceArchived
+	}{
+		{
+			desc:    "add of archived item",
+			txn:     InventoryTransaction{ItemId: archivedItem.Id, LocationId: location.Id, Action: "ADD", Count: 1},
+			wantErr: ItemArchived(archivedItem.Id),
+		},
+		{
+			desc:    "add at archived location",
+			txn:     InventoryTransaction{ItemId: item.Id, LocationId: archivedLocation.Id, Action: "ADD", Count: 1},
+			wantErr: LocationArchived(archivedLocation.Id),
+		},
+		{
+			desc:    "negative remove of archived item",
+			txn:     InventoryTransaction{ItemId: archivedItem.Id, LocationId: location.Id, Action: "REMOVE", Count: -1},
+			wantErr: ItemArchived(archivedItem.Id),
+		},
+		{
+			desc:    "recount up at archived location",
+			txn:     InventoryTransaction{ItemId: item.Id, LocationId: archivedLocation.Id, Action: "RECOUNT", Count: 5},
+			wantErr: LocationArchived(archivedLocation.Id),
+		},
+		{
+			desc: "remove of archived item",
+			txn:  InventoryTransaction{ItemId: archivedItem.Id, LocationId: location.Id, Action: "REMOVE", Count: 1},
+		},
+		{
+			desc: "recount at archived location",
+			txn:  InventoryTransaction{ItemId: item.Id, LocationId: archivedLocation.Id, Action: "RECOUNT", Count: 0},
+		},
+	}
+
+	for _, tc := range cases {
+		ctx := context.Background()
+		t.Run(tc.desc, func(t *testing.T) {
+			backend := bt.initBackend(t, initialBackendState{
+				items:     map[string]*Item{item.Id: &item, archivedItem.Id: &archivedItem},
+				locations: map[string]*Location{location.Id: &location, archivedLocation.Id: &archivedLocation},
+			})
+			txn := tc.txn
+
+			_, err := backend.NewInventoryTransaction(ctx, &txn, "")
+
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Errorf("NewInventoryTransaction(%v) returned unexpected err: %v", tc.txn, err)
+				}
+				return
+			}
+			if ra, ok := err.(*ResourceArchived); !ok || *ra != *tc.wantErr {
+				t.Errorf("NewInventoryTransaction(%v) returned %v, want %v", tc.txn, err, tc.wantErr)
+			}
+
+			// Batches and transfers reject the same transactions
+			batchTxn := tc.txn
+			_, err = backend.NewInventoryTransactionBatch(ctx, []*InventoryTransaction{&batchTxn})
+			failed, ok := err.(*BatchEntryFailed)
+			if !ok || failed.index != 0 {
+				t.Fatalf("NewInventoryTransactionBatch(%v) returned %v, want *BatchEntryFailed", tc.txn, err)
+			}
+			if ra, ok := failed.err.(*ResourceArchived); !ok || *ra != *tc.wantErr {
+				t.Errorf("NewInventoryTransactionBatch(%v) returned %v, want %v", tc.txn, failed.err, tc.wantErr)
+			}
+			transfer := &Transfer{ItemId: tc.txn.ItemId, SourceLocationId: location.Id, DestinationLocationId: tc.txn.LocationId, Count: 1}
+			if tc.txn.LocationId == location.Id {
+				transfer.SourceLocationId = archivedLocation.Id
+			}
+			_, err = backend.NewTransfer(ctx, transfer)
+			if ra, ok := err.(*ResourceArchived); !ok || *ra != *tc.wantErr {
+				t.Errorf("NewTransfer(%+v) returned %v, want %v", transfer, err, tc.wantErr)
+			}
+		})
 	}
 }
@@ -0,0 +1,365 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	backendFirestore = "firestore"
+	backendSQL       = "sql"
+	backendMemory    = "memory"
+)
+
+var supportedBackends = []string{backendFirestore, backendSQL, backendMemory}
+
+const (
+	authFirebase = "firebase"
+	authNone     = "none"
+)
+
+var supportedAuths = []string{authFirebase, authNone}
+
+const (
+	traceExporterOTLP   = "otlp"
+	traceExporterStdout = "stdout"
+	traceExporterNone   = "none"
+)
+
+var supportedTraceExporters = []string{traceExporterOTLP, traceExporterStdout, traceExporterNone}
+
+// defaultTraceOTLPEndpoint is the OTLP over HTTP endpoint of an OpenTelemetry
+// collector running next to the server
+const defaultTraceOTLPEndpoint = "http://localhost:4318"
+
+// defaultRequestTimeout bounds requests unless configured otherwise
+const defaultRequestTimeout = 30 * time.Second
+
+// Duration is a time.Duration written as a string such as "30s" in the
+// configuration file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config configures the API server and its database backend
+type Config struct {
+	// Port is the port the server listens on
+	Port int `json:"port"`
+	// RequestTimeout bounds how long a request may take, including the
+	// backend calls it makes, which are cancelled once it runs out
+	RequestTimeout Duration `json:"request_timeout"`
+	// Backend is the database backend shared by the API services: firestore,
+	// sql, or memory for local development
+	Backend string `json:"backend"`
+	// ProjectID is the Google Cloud project of the firestore backend
+	ProjectID string `json:"project_id"`
+	// SQLDriver and SQLDataSource open the database of the sql backend
+	SQLDriver     string `json:"sql_driver"`
+	SQLDataSource string `json:"sql_data_source"`
+	// MemorySnapshotFile, if set, is the file the memory backend saves its
+	// data to and reloads it from, so that demo data survives restarts
+	MemorySnapshotFile string `json:"memory_snapshot_file"`
+	// Auth is how requests are authorized: firebase verifies their Firebase
+	// ID tokens and checks the role of the caller for each route, none trusts
+	// the Istio ingress gateway to have done so
+	Auth string `json:"auth"`
+	// AuthJWKSURL serves the keys that sign the ID tokens. AuthIssuer and
+	// AuthAudience are the issuer and audience the tokens must have. They
+	// default to the ones of the Firebase project ProjectID.
+	AuthJWKSURL  string `json:"auth_jwks_url"`
+	AuthIssuer   string `json:"auth_issuer"`
+	AuthAudience string `json:"auth_audience"`
+	// TraceExporter is where spans are exported: otlp sends them to the
+	// OpenTelemetry collector at TraceOTLPEndpoint, stdout writes them to
+	// stdout, and none records no spans
+	TraceExporter     string `json:"trace_exporter"`
+	TraceOTLPEndpoint string `json:"trace_otlp_endpoint"`
+}
+
+// defaultConfig is the configuration of a server deployed next to Firestore
+func defaultConfig() *Config {
+	return &Config{Port: 8080, RequestTimeout: Duration(defaultRequestTimeout), Backend: backendFirestore, Auth: authFirebase, TraceExporter: traceExporterNone, TraceOTLPEndpoint: defaultTraceOTLPEndpoint}
+}
+
+// LoadConfig reads the configuration from a JSON file, if the -config flag or
+// the CONFIG_FILE environment variable names one, then from the environment,
+// then from the command-line arguments. Each source overrides the settings of
+// the sources before it.
+func LoadConfig(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("api-service", flag.ContinueOnError)
+	file := fs.String("config", getenv("CONFIG_FILE"), "JSON `file` to read the configuration from")
+	flags := &Config{}
+	fs.IntVar(&flags.Port, "port", 0, "`port` to listen on (env PORT, default 8080)")
+	fs.DurationVar((*time.Duration)(&flags.RequestTimeout), "request-timeout", 0, "`duration` after which requests are cancelled (env REQUEST_TIMEOUT, default 30s)")
+	fs.StringVar(&flags.Backend, "backend", "", "database `backend`: firestore, sql or memory (env BACKEND, default firestore)")
+	fs.StringVar(&flags.ProjectID, "project-id", "", "Google Cloud `project` of the firestore backend (env PROJECT_ID)")
+	fs.StringVar(&flags.SQLDriver, "sql-driver", "", "`driver` of the sql backend: postgres or sqlite (env SQL_DRIVER)")
+	fs.StringVar(&flags.SQLDataSource, "sql-data-source", "", "connection string or `file` of the sql backend (env SQL_DATA_SOURCE)")
+	fs.StringVar(&flags.MemorySnapshotFile, "memory-snapshot-file", "", "snapshot `file` the memory backend persists its data to (env MEMORY_SNAPSHOT_FILE)")
+	fs.StringVar(&flags.Auth, "auth", "", "how requests are authorized: firebase or none (env AUTH, default firebase)")
+	fs.StringVar(&flags.AuthJWKSURL, "auth-jwks-url", "", "`URL` of the keys that sign ID tokens (env AUTH_JWKS_URL, default Firebase's)")
+	fs.StringVar(&flags.AuthIssuer, "auth-issuer", "", "`issuer` of ID tokens (env AUTH_ISSUER, default the Firebase project's)")
+	fs.StringVar(&flags.AuthAudience, "auth-audience", "", "`audience` of ID tokens (env AUTH_AUDIENCE, default the project ID)")
+	fs.StringVar(&flags.TraceExporter, "trace-exporter", "", "`exporter` of spans: otlp, stdout or none (env TRACE_EXPORTER, default none)")
+	fs.StringVar(&flags.TraceOTLPEndpoint, "trace-otlp-endpoint", "", "`URL` of the OTLP over HTTP collector (env TRACE_OTLP_ENDPOINT, default http://localhost:4318)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	config := defaultConfig()
+	if *file != "" {
+		if err := config.readFile(*file); err != nil {
+			return nil, err
+		}
+	}
+	env, err := envConfig(getenv)
+	if err != nil {
+		return nil, err
+	}
+	config.override(env)
+	config.override(flags)
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readFile reads the settings in the JSON file into the configuration
+func (c *Config) readFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("error opening configuration file: %v", err)
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("error reading configuration file %s: %v", name, err)
+	}
+	return nil
+}
+
+// envConfig returns the settings of the environment
+func envConfig(getenv func(string) string) (*Config, error) {
+	env := &Config{
+		Backend:            getenv("BACKEND"),
+		ProjectID:          getenv("PROJECT_ID"),
+		SQLDriver:          getenv("SQL_DRIVER"),
+		SQLDataSource:      getenv("SQL_DATA_SOURCE"),
+		MemorySnapshotFile: getenv("MEMORY_SNAPSHOT_FILE"),
+		Auth:               getenv("AUTH"),
+		AuthJWKSURL:        getenv("AUTH_JWKS_URL"),
+		AuthIssuer:         getenv("AUTH_ISSUER"),
+		AuthAudience:       getenv("AUTH_AUDIENCE"),
+		TraceExporter:      getenv("TRACE_EXPORTER"),
+		TraceOTLPEndpoint:  getenv("TRACE_OTLP_ENDPOINT"),
+	}
+	if port := getenv("PORT"); port != "" {
+		var err error
+		if env.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid PORT %q: %v", port, err)
+		}
+	}
+	if timeout := getenv("REQUEST_TIMEOUT"); timeout != "" {
+		parsed, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REQUEST_TIMEOUT %q: %v", timeout, err)
+		}
+		env.RequestTimeout = Duration(parsed)
+	}
+	return env, nil
+}
+
+// override replaces the settings of the configuration with the ones set in
+// other
+func (c *Config) override(other *Config) {
+	if other.Port != 0 {
+		c.Port = other.Port
+	}
+	if other.RequestTimeout != 0 {
+		c.RequestTimeout = other.RequestTimeout
+	}
+	if other.Backend != "" {
+		c.Backend = other.Backend
+	}
+	if other.ProjectID != "" {
+		c.ProjectID = other.ProjectID
+	}
+	if other.SQLDriver != "" {
+		c.SQLDriver = other.SQLDriver
+	}
+	if other.SQLDataSource != "" {
+		c.SQLDataSource = other.SQLDataSource
+	}
+	if other.MemorySnapshotFile != "" {
+		c.MemorySnapshotFile = other.MemorySnapshotFile
+	}
+	if other.Auth != "" {
+		c.Auth = other.Auth
+	}
+	if other.AuthJWKSURL != "" {
+		c.AuthJWKSURL = other.AuthJWKSURL
+	}
+	if other.AuthIssuer != "" {
+		c.AuthIssuer = other.AuthIssuer
+	}
+	if other.AuthAudience != "" {
+		c.AuthAudience = other.AuthAudience
+	}
+	if other.TraceExporter != "" {
+		c.TraceExporter = other.TraceExporter
+	}
+	if other.TraceOTLPEndpoint != "" {
+		c.TraceOTLPEndpoint = other.TraceOTLPEndpoint
+	}
+}
+
+func (c *Config) validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if c.RequestTimeout <= 0 {
+		return fmt.Errorf("invalid request timeout %v, want a positive duration", time.Duration(c.RequestTimeout))
+	}
+	if !isSupported(c.Backend, supportedBackends) {
+		return fmt.Errorf("unknown backend %q, want one of %v", c.Backend, supportedBackends)
+	}
+	if c.Backend == backendSQL && c.SQLDriver == "" {
+		return fmt.Errorf("the sql backend requires a SQL driver")
+	}
+	if !isSupported(c.Auth, supportedAuths) {
+		return fmt.Errorf("unknown auth %q, want one of %v", c.Auth, supportedAuths)
+	}
+	if !isSupported(c.TraceExporter, supportedTraceExporters) {
+		return fmt.Errorf("unknown trace exporter %q, want one of %v", c.TraceExporter, supportedTraceExporters)
+	}
+	if c.TraceExporter == traceExporterOTLP {
+		if u, err := url.Parse(c.TraceOTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid OTLP endpoint %q, want an http or https URL", c.TraceOTLPEndpoint)
+		}
+	}
+	return nil
+}
+
+// NewBackend creates the configured database backend
+func (c *Config) NewBackend(ctx context.Context) (DatabaseBackend, error) {
+	switch c.Backend {
+	case backendSQL:
+		sb, err := NewSQLBackend(ctx, c.SQLDriver, c.SQLDataSource)
+		if err != nil {
+			return nil, err
+		}
+		return sb, nil
+	case backendMemory:
+		if c.MemorySnapshotFile == "" {
+			return NewInMemoryBackend(), nil
+		}
+		mb, err := NewInMemoryBackendWithSnapshot(c.MemorySnapshotFile)
+		if err != nil {
+			return nil, err
+		}
+		return mb, nil
+	default:
+		fb, err := NewFirestoreBackend(ctx, c.ProjectID)
+		if err != nil {
+			return nil, err
+		}
+		return fb, nil
+	}
+}
+
+// NewAuthorizer returns the middleware that authorizes the requests to the
+// API router. With the none auth, only requests with an API key are
+// authorized, and the Istio ingress gateway is trusted to authorize the others.
+func (c *Config) NewAuthorizer(db DatabaseBackend) (mux.MiddlewareFunc, error) {
+	if c.Auth == authNone {
+		return Authorize(nil, db), nil
+	}
+	jwksURL, issuer, audience := c.AuthJWKSURL, c.AuthIssuer, c.AuthAudience
+	if jwksURL == "" {
+		jwksURL = firebaseJWKSURL
+	}
+	if issuer == "" && c.ProjectID != "" {
+		issuer = firebaseIssuerBase + c.ProjectID
+	}
+	if audience == "" {
+		audience = c.ProjectID
+	}
+	if issuer == "" || audience == "" {
+		return nil, fmt.Errorf("the firebase auth requires a project ID, or an issuer and audience")
+	}
+	return Authorize(NewTokenVerifier(jwksURL, issuer, audience), db), nil
+}
+
+// NewTracerProvider returns the tracer provider that exports spans to the
+// configured exporter, or nil with the none exporter. Shut it down to export
+// the spans that are still queued.
+func (c *Config) NewTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch c.TraceExporter {
+	case traceExporterOTLP:
+		var endpoint *url.URL
+		if endpoint, err = url.Parse(c.TraceOTLPEndpoint); err != nil {
+			return nil, err
+		}
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(endpoint.Host),
+			otlptracehttp.WithURLPath(strings.TrimSuffix(endpoint.Path, "/") + "/v1/traces"),
+		}
+		if endpoint.Scheme == "http" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case traceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newTracerProvider(sdktrace.WithBatcher(exporter)), nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(file, []byte(`{"backend": "sql", "sql_driver": "sqlite", "sql_data_source": "file.db", "port": 9000, "request_timeout": "1m"}`), 0600); err != nil {
+		t.Fatalf("error writing config file: %v", err)
+	}
+
+	cases := []struct {
+		desc string
+		args []string
+		env  map[string]string
+		want *Config
+	}{
+		{
+			desc: "defaults",
+			want: &Config{Port: 8080, RequestTimeout: Duration(30 * time.Second), Backend: "firestore", Auth: "firebase", TraceExporter: "none", TraceOTLPEndpoint: "http://localhost:4318"},
+		},
+		{
+			desc: "environment",
+			env:  map[string]string{"PROJECT_ID": "project", "PORT": "9090"},
+			want: &Config{Port: 9090, RequestTimeout: Duration(30 * time.Second), Backend: "firestore", ProjectID: "project", Auth: "firebase", TraceExporter: "none", TraceOTLPEndpoint: "http://localhost:4318"},
+		},
+		{
+			desc: "flags override environment",
+			args: []string{"-backend", "memory", "-port", "9191", "-request-timeout", "5s"},
+			env:  map[string]string{"BACKEND": "firestore", "PORT": "9090", "REQUEST_TIMEOUT": "10s"},
+			want: &Config{Port: 9191, RequestTimeout: Duration(5 * time.Second), Backend: "memory", Auth: "firebase", TraceExporter: "none", TraceOTLPEndpoint: "http://localhost:4318"},
+		},
+		{
+			desc: "file from flag",
+			args: []string{"-config", file},
+			want: &Config{Port: 9000, RequestTimeout: Duration(time.Minute), Backend: "sql", SQLDriver: "sqlite", SQLDataSource: "file.db", Auth: "firebase", TraceExporter: "none", TraceOTLPEndpoint: "http://localhost:4318"},
+		},
+		{
+			desc: "environment overrides file",
+			env:  map[string]string{"CONFIG_FILE": file, "SQL_DATA_SOURCE": "other.db"},
+			want: &Config{Port: 9000, RequestTimeout: Duration(time.Minute), Backend: "sql", SQLDriver: "sqlite", SQLDataSource: "other.db", Auth: "firebase", TraceExporter: "none", TraceOTLPEndpoint: "http://localhost:4318"},
+		},
+		{
+			desc: "memory snapshot",
+			args: []string{"-memory-snapshot-file", "demo.json"},
+			env:  map[string]string{"BACKEND": "memory", "MEMORY_SNAPSHOT_FILE": "other.json"},
+			want: &Config{Port: 8080, RequestTimeout: Duration(30 * time.Second), Backend: "memory", MemorySnapshotFile: "demo.json", Auth: "firebase", TraceExporter: "none", TraceOTLPEndpoint: "http://localhost:4318"},
+		},
+		{
+			desc: "auth",
+			args: []string{"-auth-issuer", "https://issuer.example.com"},
+			env:  map[string]string{"AUTH": "none", "AUTH_JWKS_URL": "http://localhost/jwks", "AUTH_AUDIENCE": "audience"},
+			want: &Config{Port: 8080, RequestTimeout: Duration(30 * time.Second), Backend: "firestore", Auth: "none", AuthJWKSURL: "http://localhost/jwks", AuthIssuer: "https://issuer.example.com", AuthAudience: "audience", TraceExporter: "none", TraceOTLPEndpoint: "http://localhost:4318"},
+		},
+		{
+			desc: "tracing",
+			args: []string{"-trace-exporter", "otlp"},
+			env:  map[string]string{"TRACE_EXPORTER": "stdout", "TRACE_OTLP_ENDPOINT": "http://collector:4318"},
+			want: &Config{Port: 8080, RequestTimeout: Duration(30 * time.Second), Backend: "firestore", Auth: "firebase", TraceExporter: "otlp", TraceOTLPEndpoint: "http://collector:4318"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := LoadConfig(tc.args, func(key string) string { return tc.env[key] })
+			if err != nil {
+				t.Fatalf("LoadConfig(%v) returned unexpected err: %v", tc.args, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("LoadConfig(%v) returned diff (-want +got):\n%s", tc.args, diff)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		desc string
+		args []string
+		env  map[string]string
+	}{
+		{desc: "unknown backend", args: []string{"-backend", "mongo"}},
+		{desc: "sql backend without driver", env: map[string]string{"BACKEND": "sql"}},
+		{desc: "invalid port", env: map[string]string{"PORT": "http"}},
+		{desc: "invalid request timeout", env: map[string]string{"REQUEST_TIMEOUT": "30"}},
+		{desc: "negative request timeout", args: []string{"-request-timeout", "-1s"}},
+		{desc: "unknown auth", env: map[string]string{"AUTH": "basic"}},
+		{desc: "unknown trace exporter", env: map[string]string{"TRACE_EXPORTER": "jaeger"}},
+		{desc: "OTLP endpoint without scheme", env: map[string]string{"TRACE_EXPORTER": "otlp", "TRACE_OTLP_ENDPOINT": "collector:4318"}},
+		{desc: "missing file", args: []string{"-config", "does-not-exist.json"}},
+		{desc: "unknown flag", args: []string{"-database", "sql"}},
+		{desc: "positional argument", args: []string{"sql"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := LoadConfig(tc.args, func(key string) string { return tc.env[key] }); err == nil {
+				t.Errorf("LoadConfig(%v) with env %v returned nil err", tc.args, tc.env)
+			}
+		})
+	}
+}
+
+func TestConfigNewBackend(t *testing.T) {
+	ctx := context.Background()
+	db, err := (&Config{Backend: "memory"}).NewBackend(ctx)
+	if err != nil {
+		t.Fatalf("NewBackend() returned unexpected err: %v", err)
+	}
+	if _, ok := db.(*InMemoryBackend); !ok {
+		t.Errorf("NewBackend() = %T, want *InMemoryBackend", db)
+	}
+
+	db, err = (&Config{Backend: "sql", SQLDriver: "sqlite", SQLDataSource: ":memory:"}).NewBackend(ctx)
+	if err != nil {
+		t.Fatalf("NewBackend() returned unexpected err: %v", err)
+	}
+	sb, ok := db.(*SQLBackend)
+	if !ok {
+		t.Fatalf("NewBackend() = %T, want *SQLBackend", db)
+	}
+	sb.Close()
+}
+
+func TestConfigNewAuthorizer(t *testing.T) {
+	cases := []struct {
+		desc    string
+		config  *Config
+		wantErr bool
+	}{
+		{desc: "firebase project", config: &Config{Auth: "firebase", ProjectID: "project"}},
+		{desc: "issuer and audience", config: &Config{Auth: "firebase", AuthIssuer: "https://issuer.example.com", AuthAudience: "audience"}},
+		{desc: "firebase without project", config: &Config{Auth: "firebase"}, wantErr: true},
+		// API keys are still verified
+		{desc: "none", config: &Config{Auth: "none", ProjectID: "project"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := tc.config.NewAuthorizer(NewInMemoryBackend())
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("NewAuthorizer() returned nil err")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewAuthorizer() returned unexpected err: %v", err)
+			}
+			if got == nil {
+				t.Errorf("NewAuthorizer() returned no middleware")
+			}
+		})
+	}
+}
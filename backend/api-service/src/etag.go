@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etag returns the ETag of the given version of a resource
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// setETag sets the ETag header of the response to the given version
+func setETag(version int64, w http.ResponseWriter) {
+	w.Header().Set("ETag", etag(version))
+}
+
+// missingIfMatch explains why updates without If-Match are refused. Clients
+// that mean to overwrite whatever version is stored must say so with "*".
+const missingIfMatch = `If-Match is required: send the ETag of the version being updated, or "*" to update any version`
+
+// ifMatchMissing returns whether the If-Match header of an update is absent
+func ifMatchMissing(ifMatch string) bool {
+	return strings.TrimSpace(ifMatch) == ""
+}
+
+// checkIfMatch returns the If-Match header as an invalid parameter unless it is
+// absent, "*" or an entity tag
+func checkIfMatch(ifMatch string) invalidParams {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" || isEntityTag(strings.TrimPrefix(ifMatch, "W/")) {
+		return nil
+	}
+	return invalidParams{{Name: "If-Match", Reason: fmt.Sprintf("not an entity tag: %s", ifMatch)}}
+}
+
+// isEntityTag returns whether the tag is an opaque tag between double quotes
+func isEntityTag(tag string) bool {
+	return len(tag) >= 2 && strings.HasPrefix(tag, `"`) && strings.HasSuffix(tag, `"`) && !strings.Contains(tag[1:len(tag)-1], `"`)
+}
+
+// ifMatchVersion returns the version required by the If-Match header, which
+// is 0 if the header is "*", or a message explaining why it cannot
+// match any version. The header must have passed checkIfMatch. Weak ETags
+// never match, as If-Match uses strong comparison.
+func ifMatchVersion(ifMatch string) (int64, string) {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, ""
+	}
+	if strings.HasPrefix(ifMatch, "W/") {
+		return 0, fmt.Sprintf("If-Match is not a strong ETag: %s ", ifMatch)
+	}
+	version, err := strconv.ParseInt(strings.Trim(ifMatch, `"`), 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Sprintf("If-Match does not match any version: %s ", ifMatch)
+	}
+	return version, ""
+}
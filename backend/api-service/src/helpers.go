@@ -14,9 +14,14 @@
 
 package service
 
-import "net/http"
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
 
 // EncodeJSONStatus calls EncodeJSONResponse with the status and message wrapped in a Status message.
+// Failed requests are answered with EncodeProblem instead.
 func EncodeJSONStatus(status int, message string, w http.ResponseWriter) error {
 	response := &Status{
 		Status:  int32(status),
@@ -24,3 +29,49 @@ func EncodeJSONStatus(status int, message string, w http.ResponseWriter) error {
 	}
 	return EncodeJSONResponse(response, &status, w)
 }
+
+// errorStatus returns the HTTP status that reports an error of its kind
+func errorStatus(err error) int {
+	switch KindOf(err) {
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindConflict:
+		return http.StatusConflict
+	case KindInvalid:
+		return http.StatusBadRequest
+	case KindPreconditionFailed:
+		return http.StatusPreconditionFailed
+	case KindUnavailable:
+		return http.StatusServiceUnavailable
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindUnauthenticated:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// parseBoolParameter parses an optional boolean query parameter, which is false if absent.
+func parseBoolParameter(param string) (bool, error) {
+	if param == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(param)
+}
+
+// parseIntQueryParameter parses an optional integer query parameter, which is 0 if absent.
+func parseIntQueryParameter(param string) (int64, error) {
+	if param == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(param, 10, 64)
+}
+
+// parseTimeQueryParameter parses an optional RFC 3339 date-time query parameter, which is the zero time if absent.
+func parseTimeQueryParameter(param string) (time.Time, error) {
+	if param == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, param)
+}
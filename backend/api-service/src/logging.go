@@ -0,0 +1,264 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log entries are written as JSON lines in the structured logging format of
+// Cloud Logging, which reads the severity, message and httpRequest fields
+const (
+	severityInfo    = "INFO"
+	severityWarning = "WARNING"
+	severityError   = "ERROR"
+)
+
+// maxRequestIdLength bounds the request ids taken from request headers
+const maxRequestIdLength = 128
+
+var defaultLogOutput io.Writer = os.Stderr
+
+var (
+	logMu     sync.Mutex
+	logOutput = defaultLogOutput
+)
+
+// logFields are the fields of a log entry besides its severity, message and
+// time
+type logFields map[string]interface{}
+
+// writeLog writes a log entry with the fields, and the ids of the request and
+// span of ctx if there are any
+func writeLog(ctx context.Context, severity, message string, fields logFields) {
+	entry := logFields{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["severity"] = severity
+	entry["message"] = message
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	if l := requestLogFrom(ctx); l != nil {
+		entry["request_id"] = l.id
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		entry["trace_id"] = sc.TraceID().String()
+		entry["span_id"] = sc.SpanID().String()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(logFields{"severity": severityError, "message": fmt.Sprintf("error encoding log entry %q: %v", message, err)})
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(append(line, '\n'))
+}
+
+// LogInfof writes an informational log entry, with the id of the request of
+// ctx if there is one
+func LogInfof(ctx context.Context, format string, args ...interface{}) {
+	writeLog(ctx, severityInfo, fmt.Sprintf(format, args...), nil)
+}
+
+// LogErrorf writes an error log entry, with the id of the request of ctx if
+// there is one
+func LogErrorf(ctx context.Context, format string, args ...interface{}) {
+	writeLog(ctx, severityError, fmt.Sprintf(format, args...), nil)
+}
+
+// requestLog collects what is logged about a request while it is handled, to
+// be written in its access log entry once it is done
+type requestLog struct {
+	id string
+
+	mu           sync.Mutex
+	route        string
+	routeName    string
+	principal    string
+	err          error
+	backendCalls int
+	backendTime  time.Duration
+}
+
+type requestLogKey struct{}
+
+func requestLogFrom(ctx context.Context) *requestLog {
+	l, _ := ctx.Value(requestLogKey{}).(*requestLog)
+	return l
+}
+
+// noteRoute records the route that matched the request, and names its span
+// after it
+func noteRoute(r *http.Request) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return
+	}
+	template, _ := route.GetPathTemplate()
+	traceRoute(r, template)
+	l := requestLogFrom(r.Context())
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.route, l.routeName = template, route.GetName()
+}
+
+// notePrincipal records the caller of the request
+func notePrincipal(ctx context.Context, principal *Principal) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("enduser.id", principal.UserId))
+	if l := requestLogFrom(ctx); l != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.principal = principal.UserId
+	}
+}
+
+// noteError records the error the request failed with
+func noteError(ctx context.Context, err error) {
+	trace.SpanFromContext(ctx).RecordError(err)
+	if l := requestLogFrom(ctx); l != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.err = err
+	}
+}
+
+// noteBackendCall records a call to the backend that started at the given
+// time and just returned
+func noteBackendCall(ctx context.Context, start time.Time) {
+	if l := requestLogFrom(ctx); l != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.backendCalls++
+		l.backendTime += time.Since(start)
+	}
+}
+
+// requestId returns the id of the request: the X-Request-Id that Envoy sets,
+// or else the trace id of the B3 or W3C Trace Context headers, or else a new
+// id
+func requestId(h http.Header) string {
+	id := h.Get("X-Request-Id")
+	if id == "" {
+		id = h.Get("X-B3-TraceId")
+	}
+	if b3 := h.Get("B3"); id == "" && b3 != "" {
+		id = strings.Split(b3, "-")[0]
+	}
+	if parts := strings.Split(h.Get("Traceparent"), "-"); id == "" && len(parts) == 4 {
+		id = parts[1]
+	}
+	if id == "" || len(id) > maxRequestIdLength {
+		id = uuid.New().String()
+	}
+	return id
+}
+
+// statusWriter remembers the status of the response it writes
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// LogRequests writes an access log entry for each request handled by inner,
+// with its id, caller, route, status, latency and the time it spent in the
+// backend. The id is returned in the X-Request-Id response header, and added
+// to the other entries logged while the request is handled.
+func LogRequests(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		l := &requestLog{id: requestId(r.Header)}
+		w.Header().Set("X-Request-Id", l.id)
+		sw := &statusWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), requestLogKey{}, l))
+
+		inner.ServeHTTP(sw, r)
+
+		latency := time.Since(start)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		if l.principal == "" {
+			// Without a verified caller, the one the controllers would see
+			if principal, err := principalFromRequest(r); err == nil {
+				l.principal = principal.UserId
+			}
+		}
+		fields := logFields{
+			"httpRequest": logFields{
+				"requestMethod": r.Method,
+				"requestUrl":    r.URL.String(),
+				"status":        sw.status,
+				"latency":       formatLatency(latency),
+				"userAgent":     r.UserAgent(),
+				"remoteIp":      r.RemoteAddr,
+			},
+			"route":           l.route,
+			"route_name":      l.routeName,
+			"principal":       l.principal,
+			"backend_calls":   l.backendCalls,
+			"backend_latency": formatLatency(l.backendTime),
+		}
+		severity := severityInfo
+		switch {
+		case sw.status >= 500:
+			severity = severityError
+		case sw.status >= 400:
+			severity = severityWarning
+		}
+		message := fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, sw.status)
+		if l.err != nil {
+			fields["error"] = l.err.Error()
+			message += ": " + l.err.Error()
+		}
+		writeLog(r.Context(), severity, message, fields)
+	})
+}
+
+// formatLatency formats a duration the way Cloud Logging expects latencies
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.9fs", d.Seconds())
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// captureLogs returns a function that returns the entries logged until then
+func captureLogs(t *testing.T) func() []logFields {
+	var buf bytes.Buffer
+	logOutput = &buf
+	t.Cleanup(func() { logOutput = defaultLogOutput })
+	return func() []logFields {
+		var entries []logFields
+		d := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+		for d.More() {
+			entry := logFields{}
+			if err := d.Decode(&entry); err != nil {
+				t.Fatalf("error decoding log entry: %v", err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	cases := []struct {
+		desc    string
+		headers map[string]string
+		want    string
+	}{
+		{
+			desc:    "X-Request-Id",
+			headers: map[string]string{"X-Request-Id": "envoy-id", "X-B3-TraceId": "b3-trace"},
+			want:    "envoy-id",
+		},
+		{
+			desc:    "B3 multi header",
+			headers: map[string]string{"X-B3-TraceId": "463ac35c9f6413ad48485a3953bb6124"},
+			want:    "463ac35c9f6413ad48485a3953bb6124",
+		},
+		{
+			desc:    "B3 single header",
+			headers: map[string]string{"B3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"},
+			want:    "80f198ee56343ba864fe8b2a57d3eff7",
+		},
+		{
+			desc:    "traceparent",
+			headers: map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			want:    "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tc.headers {
+				h.Set(k, v)
+			}
+			if got := requestId(h); got != tc.want {
+				t.Errorf("requestId(%v) = %q, want %q", h, got, tc.want)
+			}
+		})
+	}
+
+	malformed := []http.Header{
+		{},
+		{"Traceparent": []string{"not-a-traceparent"}},
+		{"X-Request-Id": []string{string(bytes.Repeat([]byte("x"), maxRequestIdLength+1))}},
+	}
+	for _, h := range malformed {
+		if got := requestId(h); len(got) != 36 {
+			t.Errorf("requestId(%v) = %q, want a new UUID", h, got)
+		}
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	logs := captureLogs(t)
+	db := NewInMemoryBackend()
+	item, _ := db.NewItem(context.Background(), &Item{Name: "item"})
+	key, apiKey := testApiKey(t, db, apiKeyReadOnly, time.Now().Add(time.Hour))
+	router := apiRouter(InstrumentBackend(db))
+	router.Use(Authorize(nil, db))
+	handler := LogRequests(router)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/items/"+item.Id, nil)
+	req.Header.Set("X-Request-Id", "request-1")
+	req.Header.Set(apiKeyHeader, apiKey)
+	r := httptest.NewRecorder()
+	handler.ServeHTTP(r, req)
+
+	if got := r.Header().Get("X-Request-Id"); got != "request-1" {
+		t.Errorf("X-Request-Id response header = %q, want %q", got, "request-1")
+	}
+	entries := logs()
+	if len(entries) != 1 {
+		t.Fatalf("logged %v, want a single entry", entries)
+	}
+	entry := entries[0]
+	want := logFields{
+		"severity":      severityInfo,
+		"request_id":    "request-1",
+		"route":         "/api/items/{id}",
+		"route_name":    "GetItem",
+		"principal":     key.Id,
+		"backend_calls": 1.0,
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("entry[%q] = %v, want %v", k, entry[k], v)
+		}
+	}
+	if status := entry["httpRequest"].(map[string]interface{})["status"]; status != 200.0 {
+		t.Errorf("logged status %v, want %v", status, 200)
+	}
+}
+
+func TestLogRequestsErrors(t *testing.T) {
+	logs := captureLogs(t)
+	db := NewInMemoryBackend()
+	router := apiRouter(db)
+	router.Use(Authorize(nil, db))
+	handler := LogRequests(router)
+
+	requests := map[string]struct {
+		apiKey   string
+		severity string
+		status   float64
+	}{
+		"/api/items/missing": {severity: severityWarning, status: http.StatusNotFound},
+		"/api/items":         {apiKey: "unknown.secret", severity: severityWarning, status: http.StatusUnauthorized},
+	}
+	for path, want := range requests {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if want.apiKey != "" {
+			req.Header.Set(apiKeyHeader, want.apiKey)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries := logs()
+		entry := entries[len(entries)-1]
+		if entry["severity"] != want.severity || entry["error"] == nil {
+			t.Errorf("GET %s logged %v, want a %s entry with an error", path, entry, want.severity)
+		}
+		if status := entry["httpRequest"].(map[string]interface{})["status"]; status != want.status {
+			t.Errorf("GET %s logged status %v, want %v", path, status, want.status)
+		}
+	}
+}
+
+// failingUseBackend fails to record the use of API keys
+type failingUseBackend struct {
+	DatabaseBackend
+}
+
+func (b *failingUseBackend) recordApiKeyUse(ctx context.Context, id string, at time.Time) error {
+	return errors.New("unavailable")
+}
+
+func TestBackendErrorsLoggedWithRequestId(t *testing.T) {
+	logs := captureLogs(t)
+	db := &failingUseBackend{NewInMemoryBackend()}
+	_, apiKey := testApiKey(t, db, apiKeyReadOnly, time.Now().Add(time.Hour))
+	router := apiRouter(db)
+	router.Use(Authorize(nil, db))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+	req.Header.Set("X-Request-Id", "request-2")
+	req.Header.Set(apiKeyHeader, apiKey)
+	LogRequests(router).ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := logs()
+	if len(entries) != 2 {
+		t.Fatalf("logged %v, want an error entry and an access log entry", entries)
+	}
+	for _, entry := range entries {
+		if entry["request_id"] != "request-2" {
+			t.Errorf("entry %v has request_id %v, want %q", entry, entry["request_id"], "request-2")
+		}
+	}
+	if entries[0]["severity"] != severityError {
+		t.Errorf("first entry %v, want an %s entry", entries[0], severityError)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import "fmt"
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// pageRequest returns the backend request for the page_size and page_token
+// query parameters, or a message explaining why they are invalid.
+func pageRequest(pageSize int64, pageToken string) (PageRequest, string) {
+	switch {
+	case pageSize < 0:
+		return PageRequest{}, fmt.Sprintf("Negative page_size: %d ", pageSize)
+	case pageSize == 0:
+		pageSize = defaultPageSize
+	case pageSize > maxPageSize:
+		pageSize = maxPageSize
+	}
+	return PageRequest{Size: int(pageSize), Token: pageToken}, ""
+}
+
+func newAlertPage(alerts []*Alert, next string) *AlertPage {
+	page := &AlertPage{Alerts: make([]Alert, len(alerts)), NextPageToken: next}
+	for i, alert := range alerts {
+		page.Alerts[i] = *alert
+	}
+	return page
+}
+
+func newApiKeyPage(keys []*ApiKey, next string) *ApiKeyPage {
+	page := &ApiKeyPage{ApiKeys: make([]ApiKey, len(keys)), NextPageToken: next}
+	for i, key := range keys {
+		page.ApiKeys[i] = *key
+	}
+	return page
+}
+
+func newItemPage(items []*Item, next string) *ItemPage {
+	page := &ItemPage{Items: make([]Item, len(items)), NextPageToken: next}
+	for i, item := range items {
+		page.Items[i] = *item
+	}
+	return page
+}
+
+func newInventoryPage(invs []*Inventory, next string) *InventoryPage {
+	page := &InventoryPage{Inventory: make([]Inventory, len(invs)), NextPageToken: next}
+	for i, inv := range invs {
+		page.Inventory[i] = *inv
+	}
+	return page
+}
+
+func newInventoryTransactionPage(txns []*InventoryTransaction, next string) *InventoryTransactionPage {
+	page := &InventoryTransactionPage{InventoryTransactions: make([]InventoryTransaction, len(txns)), NextPageToken: next}
+	for i, txn := range txns {
+		page.InventoryTransactions[i] = *txn
+	}
+	return page
+}
+
+func newLocationPage(locations []*Location, next string) *LocationPage {
+	page := &LocationPage{Locations: make([]Location, len(locations)), NextPageToken: next}
+	for i, location := range locations {
+		page.Locations[i] = *location
+	}
+	return page
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Principal is the authenticated caller of an API request
+type Principal struct {
+	// UserId is the Firebase user ID of the caller
+	UserId string
+	Email  string
+	Role   string
+	// Warehouses are the warehouses the caller is assigned to, which limit
+	// the locations a caller other than an admin may access
+	Warehouses []string
+}
+
+// idTokenClaims are the Firebase ID token claims that identify a Principal
+type idTokenClaims struct {
+	Subject    string   `json:"sub"`
+	Email      string   `json:"email"`
+	Role       string   `json:"role"`
+	Warehouses []string `json:"warehouses"`
+}
+
+func (c *idTokenClaims) principal() *Principal {
+	return &Principal{UserId: c.Subject, Email: c.Email, Role: c.Role, Warehouses: c.Warehouses}
+}
+
+var errMissingIdentity = errors.New("request does not carry a verified identity")
+
+// principalKey is the context key of the Principal verified by Authorize
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx that carries the verified caller
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFromRequest returns the caller of the request.
+//
+// When the server verifies tokens itself, that is the caller Authorize
+// verified. Otherwise it is identified by the claims of the bearer token,
+// which is not verified here: the Istio ingress gateway rejects requests to
+// the API without a valid Firebase ID token, and forwards the token it
+// verified in the Authorization header.
+func principalFromRequest(r *http.Request) (*Principal, error) {
+	if principal, ok := r.Context().Value(principalKey{}).(*Principal); ok {
+		return principal, nil
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMissingIdentity
+	}
+	claims := &idTokenClaims{}
+	if err := decodeTokenSegment(parts[1], claims); err != nil || claims.Subject == "" {
+		return nil, errMissingIdentity
+	}
+	return claims.principal(), nil
+}
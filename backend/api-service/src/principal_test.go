@@ -0,0 +1,90 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var testPrincipal = Principal{UserId: "user-id", Email: "worker@example.com", Role: "worker", Warehouses: []string{"warehouse"}}
+
+// unsignedToken returns a JWT with the given payload and a dummy signature
+func unsignedToken(payload string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(`{"alg":"RS256"}`)) + "." + encode([]byte(payload)) + ".signature"
+}
+
+func TestPrincipalFromRequest(t *testing.T) {
+	cases := []struct {
+		desc          string
+		authorization string
+		want          *Principal
+	}{
+		{
+			desc:          "firebase id token",
+			authorization: "Bearer " + unsignedToken(`{"sub":"user-id","email":"worker@example.com","role":"worker","warehouses":["warehouse"]}`),
+			want:          &testPrincipal,
+		},
+		{
+			desc:          "token without role",
+			authorization: "Bearer " + unsignedToken(`{"sub":"user-id"}`),
+			want:          &Principal{UserId: "user-id"},
+		},
+		{
+			desc: "missing authorization header",
+		},
+		{
+			desc:          "token without subject",
+			authorization: "Bearer " + unsignedToken(`{"email":"worker@example.com"}`),
+		},
+		{
+			desc:          "malformed token",
+			authorization: "Bearer not-a-token",
+		},
+		{
+			desc:          "malformed payload",
+			authorization: "Bearer header.!!!.signature",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/inventoryTransactions", nil)
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+
+			got, err := principalFromRequest(r)
+
+			if tc.want == nil {
+				if err == nil {
+					t.Errorf("principalFromRequest() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("principalFromRequest() returned unexpected err: %v", err)
+			}
+			if !cmp.Equal(got, tc.want) {
+				t.Errorf("principalFromRequest() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
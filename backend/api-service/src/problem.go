@@ -0,0 +1,123 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// problemContentType is the media type of RFC 7807 problem details
+const problemContentType = "application/problem+json"
+
+// problemTypeBase is the URI the names of problem types are appended to.
+// docs/problems.md describes each type under a heading of its name.
+const problemTypeBase = "https://github.com/GoogleCloudPlatform/cloud-run-anthos-reference-web-app/blob/HEAD/docs/problems.md#"
+
+// problemType is a type of problem that an error response can describe
+type problemType struct {
+	name  string
+	title string
+}
+
+// problemTypes are the problem types by the HTTP status they are reported with
+var problemTypes = map[int]problemType{
+	http.StatusBadRequest:          {name: "invalid-request", title: "The request is invalid"},
+	http.StatusUnauthorized:        {name: "unauthenticated", title: "The request is not authenticated"},
+	http.StatusForbidden:           {name: "forbidden", title: "The caller may not make the request"},
+	http.StatusNotFound:            {name: "not-found", title: "The resource does not exist"},
+	http.StatusConflict:            {name: "conflict", title: "The request conflicts with the state of the resource"},
+	http.StatusPreconditionFailed:  {name: "precondition-failed", title: "The resource has changed since the expected version"},
+	http.StatusServiceUnavailable:  {name: "unavailable", title: "The service is unavailable, retry later"},
+	http.StatusGatewayTimeout:      {name: "timeout", title: "The request timed out"},
+	http.StatusInternalServerError: {name: "internal", title: "Internal server error"},
+}
+
+// newProblem returns the problem details of a request that failed with the
+// status, of the type reported with that status
+func newProblem(status int, detail string) *Problem {
+	t, ok := problemTypes[status]
+	if !ok {
+		t = problemTypes[http.StatusInternalServerError]
+	}
+	return &Problem{
+		Type:   problemTypeBase + t.name,
+		Title:  t.title,
+		Status: int32(status),
+		Detail: detail,
+	}
+}
+
+// EncodeProblem writes the problem details of a request that failed with the
+// status.
+func EncodeProblem(status int, detail string, w http.ResponseWriter) error {
+	return encodeProblem(newProblem(status, detail), w)
+}
+
+func encodeProblem(problem *Problem, w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(int(problem.Status))
+	return json.NewEncoder(w).Encode(problem)
+}
+
+// invalidParams collects the invalid fields and parameters of a request, so
+// that all of them are reported at once
+type invalidParams []InvalidParam
+
+func (p *invalidParams) add(name, reason string) {
+	*p = append(*p, InvalidParam{Name: name, Reason: reason})
+}
+
+// required adds the field if its value is empty
+func (p *invalidParams) required(name, value string) {
+	if value == "" {
+		p.add(name, "required field is empty")
+	}
+}
+
+// supported adds the field if its value is set and not one of the supported
+// values
+func (p *invalidParams) supported(name, value string, supported []string) {
+	if value != "" && !isSupported(value, supported) {
+		p.add(name, fmt.Sprintf("unknown value %q, want one of %s", value, strings.Join(supported, ", ")))
+	}
+}
+
+// detail returns an explanation listing the invalid fields
+func (p invalidParams) detail() string {
+	reasons := make([]string, len(p))
+	for i, param := range p {
+		reasons[i] = param.Name + ": " + param.Reason
+	}
+	return "Invalid " + strings.Join(reasons, "; ")
+}
+
+// encodeInvalidParams writes the problem details of a request with invalid
+// fields or parameters
+func encodeInvalidParams(params invalidParams, w http.ResponseWriter) error {
+	problem := newProblem(http.StatusBadRequest, params.detail())
+	problem.InvalidParams = params
+	return encodeProblem(problem, w)
+}
+
+// encodeEntryErrors writes the problem details of a batch request for the
+// errors of its individual entries.
+func encodeEntryErrors(status int, errors []EntryError, w http.ResponseWriter) error {
+	problem := newProblem(status, fmt.Sprintf("%d of the entries in the batch failed, nothing was applied", len(errors)))
+	problem.Errors = errors
+	return encodeProblem(problem, w)
+}
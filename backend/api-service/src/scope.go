@@ -0,0 +1,83 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// WarehouseForbidden is a request for a warehouse the caller is not assigned
+// to
+type WarehouseForbidden struct {
+	userId     string
+	warehouse  string
+	warehouses []string
+}
+
+func (e *WarehouseForbidden) Error() string {
+	if len(e.warehouses) == 0 {
+		return fmt.Sprintf("user %q is not assigned to any warehouse, so not to %q", e.userId, e.warehouse)
+	}
+	return fmt.Sprintf("user %q is only assigned to warehouses %s, not %q", e.userId, strings.Join(e.warehouses, ", "), e.warehouse)
+}
+
+func (e *WarehouseForbidden) Kind() ErrorKind {
+	return KindForbidden
+}
+
+// checkWarehouse returns an error unless the caller may access the warehouse.
+// Admins may access every warehouse, other callers the ones they are assigned
+// to.
+func (p *Principal) checkWarehouse(warehouse string) error {
+	if p.Role == roleAdmin {
+		return nil
+	}
+	if isSupported(warehouse, p.Warehouses) {
+		return nil
+	}
+	return &WarehouseForbidden{userId: p.UserId, warehouse: warehouse, warehouses: p.Warehouses}
+}
+
+// scopeTransactions limits the transactions the filter selects to the
+// warehouses the caller may access. Callers other than admins that do not
+// filter by a warehouse list the transactions of the warehouses they are
+// assigned to. It returns false if the caller may list none.
+func (p *Principal) scopeTransactions(filter *TransactionFilter) (bool, error) {
+	switch {
+	case p.Role == roleAdmin:
+		return true, nil
+	case filter.Warehouse != "":
+		return true, p.checkWarehouse(filter.Warehouse)
+	case len(p.Warehouses) == 0:
+		return false, nil
+	}
+	filter.Warehouses = p.Warehouses
+	return true, nil
+}
+
+// checkLocation returns an error unless the caller may access the warehouse of
+// the location
+func (p *Principal) checkLocation(ctx context.Context, db DatabaseBackend, locationId string) error {
+	if p.Role == roleAdmin {
+		return nil
+	}
+	location, err := db.GetLocation(ctx, locationId)
+	if err != nil {
+		return err
+	}
+	return p.checkWarehouse(location.Warehouse)
+}
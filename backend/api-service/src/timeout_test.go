@@ -0,0 +1,45 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowBackend is a backend whose GetItem waits until its context is done, as
+// a slow Firestore call would
+type slowBackend struct {
+	*InMemoryBackend
+}
+
+func (sb slowBackend) GetItem(ctx context.Context, id string) (*Item, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRequestTimeout(t *testing.T) {
+	db := slowBackend{NewInMemoryBackend()}
+	router := NewRouter(NewInventoryApiController(NewInventoryApiService(db)))
+	handler := WithRequestTimeout(router, 10*time.Millisecond)
+
+	r := httptest.NewRecorder()
+	handler.ServeHTTP(r, httptest.NewRequest(http.MethodGet, "/api/items/item-id", nil))
+
+	decodeProblem(t, r, http.StatusGatewayTimeout)
+}
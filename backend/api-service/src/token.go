@@ -0,0 +1,318 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// firebaseJWKSURL serves the keys that sign Firebase ID tokens
+const firebaseJWKSURL = "https://www.googleapis.com/service_accounts/v1/jwk/securetoken@system.gserviceaccount.com"
+
+// firebaseIssuerBase is the issuer of the Firebase ID tokens of a project,
+// without the project ID
+const firebaseIssuerBase = "https://securetoken.google.com/"
+
+const (
+	// tokenLeeway is the clock skew tolerated when checking the times of a
+	// token
+	tokenLeeway = time.Minute
+	// defaultKeySetMaxAge is how long keys are cached when the key set does
+	// not say
+	defaultKeySetMaxAge = time.Hour
+	// minKeySetRefresh is how long to wait after fetching the key set, or
+	// failing to, before fetching it again for a token signed by a key it
+	// lacks
+	minKeySetRefresh = 30 * time.Second
+	// keySetFetchTimeout bounds each fetch of the key set
+	keySetFetchTimeout = 10 * time.Second
+)
+
+// InvalidToken is a bearer token that does not verify
+type InvalidToken struct {
+	reason string
+}
+
+func (e *InvalidToken) Error() string {
+	return "invalid ID token: " + e.reason
+}
+
+func (e *InvalidToken) Kind() ErrorKind {
+	return KindUnauthenticated
+}
+
+// KeySetUnavailable is a key set that could not be fetched to verify tokens
+type KeySetUnavailable struct {
+	url string
+	err error
+}
+
+func (e *KeySetUnavailable) Error() string {
+	return fmt.Sprintf("error fetching the key set at %s: %v", e.url, e.err)
+}
+
+func (e *KeySetUnavailable) Unwrap() error {
+	return e.err
+}
+
+func (e *KeySetUnavailable) Kind() ErrorKind {
+	return KindUnavailable
+}
+
+// tokenHeader is the JOSE header of a token
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// verifiedClaims are the claims of an ID token that are checked before it is
+// trusted
+type verifiedClaims struct {
+	idTokenClaims
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+// jsonWebKey is an RSA key of a JSON Web Key Set
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+}
+
+// TokenVerifier verifies Firebase ID tokens, which are JWTs signed with
+// RS256 by one of the keys of a JSON Web Key Set. It caches the keys for as
+// long as the key set allows. Concurrent requests share a single fetch of the
+// key set, made without holding the lock on the cached keys.
+type TokenVerifier struct {
+	jwksURL  string
+	issuer   string
+	audience string
+	client   *http.Client
+	now      func() time.Time
+	fetches  singleflight.Group
+
+	mu       sync.Mutex
+	keys     map[string]*rsa.PublicKey
+	expires  time.Time
+	fetched  time.Time
+	fetchErr error
+}
+
+// NewTokenVerifier returns a verifier of the tokens issued by the issuer for
+// the audience, signed by the keys served at jwksURL
+func NewTokenVerifier(jwksURL, issuer, audience string) *TokenVerifier {
+	return &TokenVerifier{
+		jwksURL:  jwksURL,
+		issuer:   issuer,
+		audience: audience,
+		client:   &http.Client{Timeout: keySetFetchTimeout},
+		now:      time.Now,
+	}
+}
+
+// Verify returns the caller identified by the token, if its signature, issuer,
+// audience and lifetime are valid.
+func (v *TokenVerifier) Verify(ctx context.Context, token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, &InvalidToken{reason: "not a JWT"}
+	}
+	header := &tokenHeader{}
+	if err := decodeTokenSegment(parts[0], header); err != nil {
+		return nil, &InvalidToken{reason: "malformed header"}
+	}
+	if header.Algorithm != "RS256" {
+		return nil, &InvalidToken{reason: fmt.Sprintf("unsupported algorithm %q", header.Algorithm)}
+	}
+	key, err := v.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, &InvalidToken{reason: "malformed signature"}
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, &InvalidToken{reason: "bad signature"}
+	}
+
+	claims := &verifiedClaims{}
+	if err := decodeTokenSegment(parts[1], claims); err != nil {
+		return nil, &InvalidToken{reason: "malformed claims"}
+	}
+	now := v.now()
+	switch {
+	case claims.Issuer != v.issuer:
+		return nil, &InvalidToken{reason: fmt.Sprintf("issued by %q, want %q", claims.Issuer, v.issuer)}
+	case claims.Audience != v.audience:
+		return nil, &InvalidToken{reason: fmt.Sprintf("issued for %q, want %q", claims.Audience, v.audience)}
+	case now.Add(-tokenLeeway).After(time.Unix(claims.ExpiresAt, 0)):
+		return nil, &InvalidToken{reason: "expired"}
+	case now.Add(tokenLeeway).Before(time.Unix(claims.IssuedAt, 0)):
+		return nil, &InvalidToken{reason: "issued in the future"}
+	case claims.Subject == "":
+		return nil, &InvalidToken{reason: "no subject"}
+	}
+	return claims.principal(), nil
+}
+
+// decodeTokenSegment decodes a base64url encoded JSON segment of a token
+func decodeTokenSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// key returns the key with the ID, fetching the key set again if the cached
+// one has expired or lacks the key. Tokens signed by unknown keys fetch the
+// key set at most once every minKeySetRefresh, as does a failed fetch.
+func (v *TokenVerifier) key(ctx context.Context, id string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	now := v.now()
+	key, ok := v.keys[id]
+	fresh := now.Before(v.expires)
+	recent, fetchErr := now.Sub(v.fetched) < minKeySetRefresh, v.fetchErr
+	v.mu.Unlock()
+	switch {
+	case ok && fresh:
+		return key, nil
+	case recent && fetchErr != nil:
+		return nil, fetchErr
+	case recent && fresh:
+		return nil, &InvalidToken{reason: fmt.Sprintf("unknown key %q", id)}
+	}
+
+	// The fetch is shared with other requests, so it is not cancelled with
+	// this one
+	select {
+	case result := <-v.fetches.DoChan("", func() (interface{}, error) { return nil, v.refreshKeys() }):
+		if result.Err != nil {
+			return nil, result.Err
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok = v.keys[id]; !ok {
+		return nil, &InvalidToken{reason: fmt.Sprintf("unknown key %q", id)}
+	}
+	return key, nil
+}
+
+// refreshKeys fetches the key set and replaces the cached keys with its keys,
+// or records why it could not
+func (v *TokenVerifier) refreshKeys() error {
+	keys, maxAge, err := v.fetchKeys()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.fetched, v.fetchErr = v.now(), err
+	if err != nil {
+		return err
+	}
+	v.keys = keys
+	v.expires = v.fetched.Add(maxAge)
+	return nil
+}
+
+// fetchKeys returns the RSA keys of the key set, and how long they may be
+// cached
+func (v *TokenVerifier) fetchKeys() (map[string]*rsa.PublicKey, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), keySetFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, 0, &KeySetUnavailable{url: v.jwksURL, err: err}
+	}
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, &KeySetUnavailable{url: v.jwksURL, err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, &KeySetUnavailable{url: v.jwksURL, err: fmt.Errorf("status %s", resp.Status)}
+	}
+	keySet := &struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(keySet); err != nil {
+		return nil, 0, &KeySetUnavailable{url: v.jwksURL, err: err}
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+		key, err := jwk.rsaPublicKey()
+		if err != nil {
+			return nil, 0, &KeySetUnavailable{url: v.jwksURL, err: fmt.Errorf("key %q: %v", jwk.KeyID, err)}
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, keySetMaxAge(resp.Header.Get("Cache-Control")), nil
+}
+
+func (k jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, errors.New("malformed modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("malformed exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// keySetMaxAge returns how long a key set may be cached according to the
+// max-age of its Cache-Control header
+func keySetMaxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultKeySetMaxAge
+}
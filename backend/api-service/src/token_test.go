@@ -0,0 +1,320 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+const (
+	testIssuer   = "https://securetoken.google.com/project"
+	testAudience = "project"
+	testKeyID    = "test-key"
+)
+
+var (
+	testKeysOnce   sync.Once
+	testSigningKey *rsa.PrivateKey
+	testOtherKey   *rsa.PrivateKey
+)
+
+// testKeys returns the key that signs the tokens of tests, which the test key
+// set serves, and another key it does not serve
+func testKeys(t *testing.T) (*rsa.PrivateKey, *rsa.PrivateKey) {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		var err error
+		if testSigningKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatalf("error generating key: %v", err)
+		}
+		if testOtherKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatalf("error generating key: %v", err)
+		}
+	})
+	return testSigningKey, testOtherKey
+}
+
+// testKeySet is a local JWKS server that serves the test signing key
+type testKeySet struct {
+	*httptest.Server
+	mu      sync.Mutex
+	fetches int
+}
+
+func newTestKeySet(t *testing.T, cacheControl string) *testKeySet {
+	key, _ := testKeys(t)
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks := map[string][]jsonWebKey{"keys": {
+		{KeyType: "EC", KeyID: "ec-key"},
+		{
+			KeyType: "RSA",
+			KeyID:   testKeyID,
+			N:       encode(key.N.Bytes()),
+			E:       encode(big.NewInt(int64(key.E)).Bytes()),
+		},
+	}}
+	ks := &testKeySet{}
+	ks.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ks.mu.Lock()
+		ks.fetches++
+		ks.mu.Unlock()
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	return ks
+}
+
+func (ks *testKeySet) fetchCount() int {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.fetches
+}
+
+// signToken returns a JWT with the header and claims, signed with the key
+func signToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("error encoding token: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("error signing token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testToken returns a valid token of the test issuer for a caller with the
+// role
+func testToken(t *testing.T, role string) string {
+	key, _ := testKeys(t)
+	return signToken(t, key, testTokenHeader(), testTokenClaims(role))
+}
+
+func testTokenHeader() map[string]interface{} {
+	return map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+}
+
+func testTokenClaims(role string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":        testIssuer,
+		"aud":        testAudience,
+		"sub":        "user-id",
+		"email":      role + "@example.com",
+		"role":       role,
+		"warehouses": []string{"warehouse"},
+		"iat":        now.Add(-time.Minute).Unix(),
+		"exp":        now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestTokenVerifierVerify(t *testing.T) {
+	key, otherKey := testKeys(t)
+	ks := newTestKeySet(t, "")
+	defer ks.Close()
+
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := testTokenClaims("worker")
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	cases := []struct {
+		desc  string
+		token string
+		want  *Principal
+	}{
+		{
+			desc:  "valid",
+			token: signToken(t, key, testTokenHeader(), testTokenClaims("worker")),
+			want:  &testPrincipal,
+		},
+		{
+			desc:  "without role",
+			token: signToken(t, key, testTokenHeader(), with("role", nil)),
+			want:  &Principal{UserId: "user-id", Email: "worker@example.com", Warehouses: []string{"warehouse"}},
+		},
+		{desc: "other issuer", token: signToken(t, key, testTokenHeader(), with("iss", "https://securetoken.google.com/other"))},
+		{desc: "other audience", token: signToken(t, key, testTokenHeader(), with("aud", "other"))},
+		{desc: "expired", token: signToken(t, key, testTokenHeader(), with("exp", time.Now().Add(-time.Hour).Unix()))},
+		{desc: "issued in the future", token: signToken(t, key, testTokenHeader(), with("iat", time.Now().Add(time.Hour).Unix()))},
+		{desc: "without subject", token: signToken(t, key, testTokenHeader(), with("sub", nil))},
+		{desc: "signed by other key", token: signToken(t, otherKey, testTokenHeader(), testTokenClaims("worker"))},
+		{desc: "unknown key", token: signToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "other-key"}, testTokenClaims("worker"))},
+		{desc: "unsupported algorithm", token: signToken(t, key, map[string]interface{}{"alg": "none", "kid": testKeyID}, testTokenClaims("worker"))},
+		{desc: "unsigned", token: unsignedToken(`{"sub":"user-id","role":"admin"}`)},
+		{desc: "malformed", token: "not-a-token"},
+	}
+
+	v := NewTokenVerifier(ks.URL, testIssuer, testAudience)
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := v.Verify(context.Background(), tc.token)
+
+			if tc.want == nil {
+				if err == nil {
+					t.Errorf("Verify() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() returned unexpected err: %v", err)
+			}
+			if !cmp.Equal(got, tc.want) {
+				t.Errorf("Verify() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTokenVerifierCachesKeys(t *testing.T) {
+	ks := newTestKeySet(t, "public, max-age=600")
+	defer ks.Close()
+	now := time.Now()
+	v := NewTokenVerifier(ks.URL, testIssuer, testAudience)
+	v.now = func() time.Time { return now }
+	token := testToken(t, "worker")
+
+	verify := func(wantFetches int) {
+		t.Helper()
+		if _, err := v.Verify(context.Background(), token); err != nil {
+			t.Fatalf("Verify() returned unexpected err: %v", err)
+		}
+		if got := ks.fetchCount(); got != wantFetches {
+			t.Errorf("key set fetched %d times, want %d", got, wantFetches)
+		}
+	}
+	verify(1)
+	verify(1)
+	now = now.Add(11 * time.Minute)
+	verify(2)
+}
+
+func TestKeySetUnavailable(t *testing.T) {
+	ks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ks.Close()
+	v := NewTokenVerifier(ks.URL, testIssuer, testAudience)
+
+	_, err := v.Verify(context.Background(), testToken(t, "worker"))
+
+	if KindOf(err) != KindUnavailable {
+		t.Errorf("Verify() returned err %v of kind %v, want %v", err, KindOf(err), KindUnavailable)
+	}
+}
+
+func TestTokenVerifierLimitsFetches(t *testing.T) {
+	ks := newTestKeySet(t, "public, max-age=600")
+	defer ks.Close()
+	now := time.Now()
+	v := NewTokenVerifier(ks.URL, testIssuer, testAudience)
+	v.now = func() time.Time { return now }
+	key, _ := testKeys(t)
+	unknown := func() string {
+		header := map[string]interface{}{"alg": "RS256", "kid": uuid.New().String()}
+		return signToken(t, key, header, testTokenClaims("worker"))
+	}
+
+	// Concurrent requests share a fetch, and tokens signed by unknown keys
+	// only fetch the key set again once minKeySetRefresh has passed
+	token := testToken(t, "worker")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v.Verify(context.Background(), token)
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		if _, err := v.Verify(context.Background(), unknown()); err == nil {
+			t.Fatalf("Verify() of a token signed by an unknown key returned nil err")
+		}
+	}
+	if got := ks.fetchCount(); got != 1 {
+		t.Errorf("key set fetched %d times, want 1", got)
+	}
+	now = now.Add(minKeySetRefresh)
+	v.Verify(context.Background(), unknown())
+	v.Verify(context.Background(), unknown())
+	if got := ks.fetchCount(); got != 2 {
+		t.Errorf("key set fetched %d times after %v, want 2", got, minKeySetRefresh)
+	}
+}
+
+func TestKeySetUnavailableNotRefetched(t *testing.T) {
+	var fetches int32
+	ks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ks.Close()
+	now := time.Now()
+	v := NewTokenVerifier(ks.URL, testIssuer, testAudience)
+	v.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := v.Verify(context.Background(), testToken(t, "worker")); KindOf(err) != KindUnavailable {
+			t.Errorf("Verify() returned err %v, want the key set unavailable", err)
+		}
+	}
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("key set fetched %d times, want 1", got)
+	}
+}
+
+func TestKeySetMaxAge(t *testing.T) {
+	cases := map[string]time.Duration{
+		"public, max-age=19700, must-revalidate": 19700 * time.Second,
+		"max-age=60":                             time.Minute,
+		"no-cache":                               defaultKeySetMaxAge,
+		"max-age=soon":                           defaultKeySetMaxAge,
+		"":                                       defaultKeySetMaxAge,
+	}
+	for cacheControl, want := range cases {
+		if got := keySetMaxAge(cacheControl); got != want {
+			t.Errorf("keySetMaxAge(%q) = %v, want %v", cacheControl, got, want)
+		}
+	}
+}
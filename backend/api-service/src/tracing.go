@@ -0,0 +1,119 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans
+const tracerName = "github.com/GoogleCloudPlatform/cloud-run-anthos-reference-web-app/api-service"
+
+// traceServiceName is the service.name resource attribute of the spans
+const traceServiceName = "api-service"
+
+// propagator reads the trace that the Istio sidecar, or another client of the
+// request, propagated in its B3 or W3C Trace Context headers. The Trace
+// Context headers win when a request has both.
+var propagator = propagation.NewCompositeTextMapPropagator(b3.New(), propagation.TraceContext{})
+
+// newTracerProvider returns a tracer provider that records the spans of the
+// API service, sampling the traces that have no sampled parent
+func newTracerProvider(opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	opts = append([]sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", traceServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	}, opts...)
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+type tracerProviderKey struct{}
+
+// WithTracerProvider returns a context whose root spans are recorded by the
+// tracer provider
+func WithTracerProvider(ctx context.Context, tp *sdktrace.TracerProvider) context.Context {
+	if tp == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerProviderKey{}, tp)
+}
+
+// startSpan starts a span that is a child of the span of ctx, or the root of a
+// new trace if ctx has none, and returns a context with the new span. The span
+// records nothing unless ctx has a span or a tracer provider.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	tp := trace.SpanFromContext(ctx).TracerProvider()
+	if p, ok := ctx.Value(tracerProviderKey{}).(*sdktrace.TracerProvider); ok && !trace.SpanContextFromContext(ctx).IsValid() {
+		tp = p
+	}
+	return tp.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(kind))
+}
+
+// endSpan ends the span, failed with err if it is not nil
+func endSpan(s trace.Span, err error) {
+	if err != nil {
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+	s.End()
+}
+
+// TraceRequests records a server span for each request handled by inner, which
+// continues the trace propagated by the Istio sidecar, if any. The span is
+// named after the route that matched the request.
+func TraceRequests(tp *sdktrace.TracerProvider, inner http.Handler) http.Handler {
+	if tp == nil {
+		return inner
+	}
+	tracer := tp.Tracer(tracerName)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, s := tracer.Start(ctx, "HTTP "+r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.RequestURI()),
+			attribute.String("http.user_agent", r.UserAgent()),
+		))
+		defer s.End()
+		sw := &statusWriter{ResponseWriter: w}
+
+		inner.ServeHTTP(sw, r.WithContext(ctx))
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		s.SetAttributes(attribute.Int("http.status_code", sw.status))
+		// The status code tells why the request failed, and noteError records
+		// the error it failed with
+		if sw.status >= 500 {
+			s.SetStatus(codes.Error, "")
+		}
+	})
+}
+
+// traceRoute names the span of the request after the route that matched it
+func traceRoute(r *http.Request, template string) {
+	s := trace.SpanFromContext(r.Context())
+	s.SetName(r.Method + " " + template)
+	s.SetAttributes(attribute.String("http.route", template))
+}
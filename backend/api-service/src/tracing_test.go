@@ -0,0 +1,281 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// recordingTracerProvider returns a tracer provider that samples like the one
+// of the server, and the recorder of the spans it ends
+func recordingTracerProvider() (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	return newTracerProvider(sdktrace.WithSpanProcessor(recorder)), recorder
+}
+
+// endedSpans returns the spans the recorder got, by name
+func endedSpans(recorder *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	return spans
+}
+
+// spanAttribute returns the value of the span attribute as a string
+func spanAttribute(s sdktrace.ReadOnlySpan, key string) string {
+	for _, a := range s.Attributes() {
+		if string(a.Key) == key {
+			return a.Value.Emit()
+		}
+	}
+	return ""
+}
+
+// spanIds returns the trace and span ids of the span context, or "" if it is
+// not valid
+func spanIds(c trace.SpanContext) string {
+	if !c.IsValid() {
+		return ""
+	}
+	return c.TraceID().String() + "-" + c.SpanID().String()
+}
+
+func TestTraceRequestsPropagation(t *testing.T) {
+	cases := []struct {
+		desc    string
+		headers map[string]string
+		parent  string
+		sampled bool
+	}{
+		{
+			desc:    "traceparent",
+			headers: map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "X-B3-TraceId": "463ac35c9f6413ad48485a3953bb6124", "X-B3-SpanId": "a2fb4a1d1a96d312", "X-B3-Sampled": "1"},
+			parent:  "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+			sampled: true,
+		},
+		{
+			desc:    "unsampled traceparent",
+			headers: map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		},
+		{
+			desc:    "B3 multi header",
+			headers: map[string]string{"X-B3-TraceId": "463ac35c9f6413ad48485a3953bb6124", "X-B3-SpanId": "a2fb4a1d1a96d312", "X-B3-Sampled": "1"},
+			parent:  "463ac35c9f6413ad48485a3953bb6124-a2fb4a1d1a96d312",
+			sampled: true,
+		},
+		{
+			desc:    "B3 64-bit trace id",
+			headers: map[string]string{"X-B3-TraceId": "48485a3953bb6124", "X-B3-SpanId": "a2fb4a1d1a96d312", "X-B3-Sampled": "1"},
+			parent:  "000000000000000048485a3953bb6124-a2fb4a1d1a96d312",
+			sampled: true,
+		},
+		{
+			desc:    "unsampled B3",
+			headers: map[string]string{"X-B3-TraceId": "463ac35c9f6413ad48485a3953bb6124", "X-B3-SpanId": "a2fb4a1d1a96d312", "X-B3-Sampled": "0"},
+		},
+		{
+			desc:    "B3 single header",
+			headers: map[string]string{"B3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"},
+			parent:  "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1",
+			sampled: true,
+		},
+		{
+			desc:    "malformed",
+			headers: map[string]string{"Traceparent": "00-not-a-trace-id", "X-B3-TraceId": "trace", "X-B3-SpanId": "span"},
+			sampled: true,
+		},
+		{
+			desc:    "zero ids",
+			headers: map[string]string{"Traceparent": "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+			sampled: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tp, recorder := recordingTracerProvider()
+			handler := TraceRequests(tp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := recorder.Ended()
+			if !tc.sampled {
+				if len(spans) != 0 {
+					t.Errorf("recorded spans %v of an unsampled trace, want none", spans)
+				}
+				return
+			}
+			if len(spans) != 1 {
+				t.Fatalf("recorded spans %v, want the server span", spans)
+			}
+			if got := spanIds(spans[0].Parent()); got != tc.parent {
+				t.Errorf("server span has parent %q, want %q", got, tc.parent)
+			}
+		})
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	logs := captureLogs(t)
+	tp, recorder := recordingTracerProvider()
+	db := NewInMemoryBackend()
+	item, _ := db.NewItem(context.Background(), &Item{Name: "item"})
+	key, apiKey := testApiKey(t, db, apiKeyReadOnly, time.Now().Add(time.Hour))
+	router := apiRouter(InstrumentBackend(db))
+	router.Use(Authorize(nil, db))
+	handler := TraceRequests(tp, LogRequests(router))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/items/"+item.Id, nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(apiKeyHeader, apiKey)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := endedSpans(recorder)
+	server, ok := spans["GET /api/items/{id}"]
+	if !ok {
+		t.Fatalf("recorded spans %v, want a span named after the route", spans)
+	}
+	if server.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.Parent().SpanID().String() != "00f067aa0ba902b7" || server.SpanKind() != trace.SpanKindServer {
+		t.Errorf("server span %v does not continue the propagated trace", server)
+	}
+	want := map[string]string{"http.route": "/api/items/{id}", "http.status_code": "200", "enduser.id": key.Id}
+	for k, v := range want {
+		if got := spanAttribute(server, k); got != v {
+			t.Errorf("server span attribute %s = %q, want %q", k, got, v)
+		}
+	}
+	backend, ok := spans["DatabaseBackend.GetItem"]
+	if !ok || backend.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("recorded spans %v, want a DatabaseBackend.GetItem child of the server span", spans)
+	}
+	if entries := logs(); len(entries) != 1 || entries[0]["trace_id"] != server.SpanContext().TraceID().String() || entries[0]["span_id"] != server.SpanContext().SpanID().String() {
+		t.Errorf("logged %v, want an entry with the trace and span ids of the request", entries)
+	}
+}
+
+func TestTraceRequestsServerError(t *testing.T) {
+	tp, recorder := recordingTracerProvider()
+	handler := TraceRequests(tp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		noteError(r.Context(), ItemNotFound("id"))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+	handler = TraceRequests(tp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		noteError(r.Context(), &ResourceNotFound{collection: "items", id: "id"})
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/failing", nil))
+
+	spans := endedSpans(recorder)
+	if s := spans["HTTP GET"]; s.Status().Code != codes.Unset || len(s.Events()) != 1 {
+		t.Errorf("span of a 404 response has status %+v and events %v, want the status unset and the error recorded", s.Status(), s.Events())
+	}
+	if s := spans["HTTP POST"]; s.Status().Code != codes.Error || len(s.Events()) != 1 || s.Events()[0].Name != "exception" {
+		t.Errorf("span of a 500 response has status %+v and events %v, want an error status and the error recorded", s.Status(), s.Events())
+	}
+}
+
+func TestBackendSpanErrors(t *testing.T) {
+	tp, recorder := recordingTracerProvider()
+	db := InstrumentBackend(NewInMemoryBackend())
+
+	db.GetItem(WithTracerProvider(context.Background(), tp), "missing")
+
+	s, ok := endedSpans(recorder)["DatabaseBackend.GetItem"]
+	if !ok || s.Parent().IsValid() || s.Status().Code != codes.Error || s.Status().Description != ItemNotFound("missing").Error() {
+		t.Errorf("recorded span %v, want a root span with the error of the call", s)
+	}
+}
+
+func TestStartSpanWithoutTracerProvider(t *testing.T) {
+	_, s := startSpan(context.Background(), "span", trace.SpanKindInternal)
+	if s.IsRecording() || s.SpanContext().IsValid() {
+		t.Errorf("startSpan() without a tracer provider started span %v, want a span that records nothing", s)
+	}
+}
+
+func TestConfigNewTracerProvider(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []*collectortrace.ExportTraceServiceRequest
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("collector got %s request with Content-Type %q, want /v1/traces with application/x-protobuf", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		req := &collectortrace.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Errorf("error decoding export request: %v", err)
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+		// Collectors may accept the spans with any 2xx status
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer collector.Close()
+
+	if tp, err := (&Config{TraceExporter: "none"}).NewTracerProvider(context.Background()); tp != nil || err != nil {
+		t.Errorf("NewTracerProvider() with the none exporter = %v, %v, want nil", tp, err)
+	}
+	tp, err := (&Config{TraceExporter: "otlp", TraceOTLPEndpoint: collector.URL + "/"}).NewTracerProvider(context.Background())
+	if err != nil {
+		t.Fatalf("NewTracerProvider() returned unexpected error: %v", err)
+	}
+	ctx, s := startSpan(WithTracerProvider(context.Background(), tp), "parent", trace.SpanKindInternal)
+	_, child := startSpan(ctx, "child", trace.SpanKindClient)
+	child.End()
+	s.End()
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() returned unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 || len(requests[0].ResourceSpans) != 1 {
+		t.Fatalf("collector got %v, want one export request", requests)
+	}
+	resourceSpans := requests[0].ResourceSpans[0]
+	name := ""
+	for _, a := range resourceSpans.Resource.Attributes {
+		if a.Key == "service.name" {
+			name = a.Value.GetStringValue()
+		}
+	}
+	if name != traceServiceName {
+		t.Errorf("exported spans of service %q, want %q", name, traceServiceName)
+	}
+	if spans := resourceSpans.ScopeSpans[0].Spans; len(spans) != 2 || spans[0].Name != "child" || string(spans[0].ParentSpanId) != string(spans[1].SpanId) {
+		t.Errorf("exported spans %v, want the child and its parent", spans)
+	}
+}
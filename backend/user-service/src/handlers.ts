@@ -56,7 +56,33 @@ export const updateUser = async (
   const role = request.query.role;
   if (uid && typeof uid === 'string') {
     try {
-      await admin.auth().setCustomUserClaims(uid, {role});
+      // Keep the other claims, such as the warehouses of a worker
+      const user = await admin.auth().getUser(uid);
+      await admin.auth().setCustomUserClaims(uid, {...user.customClaims, role});
+      return response.status(200).send();
+    } catch (e) {
+      if (e.code === 'auth/user-not-found') {
+        return response.status(404).send(e);
+      }
+      return response.status(500).send(e);
+    }
+  }
+  return response.status(400).send();
+};
+
+export const updateUserWarehouses = async (
+  request: express.Request,
+  response: express.Response
+) => {
+  const uid = request.params.uid;
+  const warehouses: string[] = request.body;
+  if (uid && typeof uid === 'string' && Array.isArray(warehouses)) {
+    try {
+      // Keep the other claims, such as the role of the user
+      const user = await admin.auth().getUser(uid);
+      await admin
+        .auth()
+        .setCustomUserClaims(uid, {...user.customClaims, warehouses});
       return response.status(200).send();
     } catch (e) {
       if (e.code === 'auth/user-not-found') {
@@ -23,6 +23,7 @@ import path = require('path');
 
 const app = express();
 app.use(morgan('dev'));
+app.use(express.json());
 const apiSpec = path.join(__dirname, '../user-api.yaml');
 app.use('/spec', express.static(apiSpec));
 app.use('/api-doc', swaggerUI.serve, swaggerUI.setup(yaml.load(apiSpec)));
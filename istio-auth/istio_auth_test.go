@@ -44,6 +44,13 @@ var paths = []string{
 	"/api",
 	"/api/alerts",
 	"/api/alerts/id",
+	"/api/alerts/id/acknowledge",
+	"/api/alerts/id/resolve",
+	"/api/alerts/id/snooze",
+	"/api/apiKeys",
+	"/api/apiKeys/id",
+	"/api/apiKeys/id/revoke",
+	"/api/inventoryTransactionBatches",
 	"/api/inventoryTransactions",
 	"/api/inventoryTransactions/id",
 	"/api/items",
@@ -54,20 +61,51 @@ var paths = []string{
 	"/api/locations/id",
 	"/api/locations/id/inventory",
 	"/api/locations/id/inventoryTransactions",
+	"/api/transfers",
 	"/api/users",
 	"/api/users/id",
+	"/api/users/id/warehouses",
+}
+
+// paths that workers may POST to
+var workerPaths = map[string]bool{
+	"/api/inventoryTransactions":       true,
+	"/api/inventoryTransactionBatches": true,
+	"/api/transfers":                   true,
+	"/api/alerts/id/acknowledge":       true,
+	"/api/alerts/id/resolve":           true,
+	"/api/alerts/id/snooze":            true,
+}
+
+// paths of the user-service, which API keys may not reach
+var userServicePaths = map[string]bool{
+	"/api/users":               true,
+	"/api/users/id":            true,
+	"/api/users/id/warehouses": true,
+}
+
+// paths that only admins may GET
+var adminPaths = map[string]bool{
+	"/api/apiKeys":    true,
+	"/api/apiKeys/id": true,
 }
 
 func checkResponse(t *testing.T, method, path, token string, want int) {
+	header := http.Header{}
+	if token != "" {
+		header.Add("Authorization", "Bearer "+token)
+	}
+	checkResponseWithHeader(t, method, path, header, want)
+}
+
+func checkResponseWithHeader(t *testing.T, method, path string, header http.Header, want int) {
 	client := http.DefaultClient
 	req, err := http.NewRequest(method, host+path, nil)
 	if err != nil {
 		t.Errorf("error creating request: %v", err)
 		return
 	}
-	if token != "" {
-		req.Header.Add("Authorization", "Bearer "+token)
-	}
+	req.Header = header
 	resp, err := client.Do(req)
 	if err != nil {
 		t.Errorf("%v %v returned unexpected err: %v", method, path, err)
@@ -104,17 +142,35 @@ func TestDenyUnauthenticatedUsers(t *testing.T) {
 // Tests api-allow-get policy
 func TestAllowGetPolicy(t *testing.T) {
 	m := http.MethodGet
-	want := http.StatusNotFound
 	for _, u := range []string{"admin", "worker", "other"} {
 		t.Run(u, func(t *testing.T) {
 			token := tokens[u]
 			for _, p := range paths {
+				want := http.StatusNotFound
+				if adminPaths[p] && u != "admin" {
+					want = http.StatusForbidden
+				}
 				checkResponse(t, m, p, token, want)
 			}
 		})
 	}
 }
 
+// Tests api-allow-api-keys policy. The api-service verifies the keys.
+func TestAllowApiKeys(t *testing.T) {
+	header := http.Header{}
+	header.Add("X-API-Key", "id.secret")
+	for _, m := range methods {
+		for _, p := range paths {
+			want := http.StatusNotFound
+			if userServicePaths[p] {
+				want = http.StatusForbidden
+			}
+			checkResponseWithHeader(t, m, p, header, want)
+		}
+	}
+}
+
 // Tests api-allow-admin and api-allow-workers policy
 func TestRoleBasedPolicies(t *testing.T) {
 	for _, u := range []string{"admin", "worker", "other"} {
@@ -127,7 +183,7 @@ func TestRoleBasedPolicies(t *testing.T) {
 			for _, m := range []string{http.MethodDelete, http.MethodPost, http.MethodPut} {
 				for _, p := range paths {
 					want := defaultWant
-					if p == "/api/inventoryTransactions" && u == "worker" && m == "POST" {
+					if workerPaths[p] && u == "worker" && m == "POST" {
 						want = http.StatusNotFound
 					}
 					checkResponse(t, m, p, token, want)
@@ -16,7 +16,7 @@
 
 import { ComponentFixture, TestBed, waitForAsync } from '@angular/core/testing';
 
-import { InventoryTransactionDialogComponent } from './inventory-transaction-dialog.component';
+import { InventoryTransactionDialogComponent, newIdempotencyKey } from './inventory-transaction-dialog.component';
 
 import { ReactiveFormsModule } from '@angular/forms';
 import { NoopAnimationsModule } from '@angular/platform-browser/animations';
@@ -75,4 +75,14 @@ describe('InventoryTransactionDialogComponent', () => {
   it('should create', () => {
     expect(component).toBeTruthy();
   });
+
+  it('should have an idempotency key', () => {
+    expect(component.idempotencyKey).toMatch(/^[0-9a-f]{32}$/);
+  });
+});
+
+describe('newIdempotencyKey', () => {
+  it('should return a different key every time', () => {
+    expect(newIdempotencyKey()).not.toEqual(newIdempotencyKey());
+  });
 });
@@ -40,6 +40,9 @@ export class InventoryTransactionDialogComponent {
   items: Item[];
   locations: Location[];
   submitting = false;
+  // sent with every submission from this dialog, so that the transaction is
+  // only applied once if a submission is retried
+  idempotencyKey = newIdempotencyKey();
 
   constructor(
     private dialogRef: MatDialogRef<InventoryTransactionDialogComponent>,
@@ -58,7 +61,7 @@ export class InventoryTransactionDialogComponent {
   onSubmit(): void {
     const data = this.inventoryTransactionForm.value;
     this.submitting = true;
-    this.inventoryService.newInventoryTransaction(data).subscribe(() => {
+    this.inventoryService.newInventoryTransaction(this.idempotencyKey, data).subscribe(() => {
       this.dialogRef.close({event: 'submit'});
       this.submitting = false;
     }, () => {
@@ -66,3 +69,11 @@ export class InventoryTransactionDialogComponent {
     });
   }
 }
+
+/**
+ * Returns a random key that identifies a request when it is retried.
+ */
+export function newIdempotencyKey(): string {
+  const bytes = crypto.getRandomValues(new Uint8Array(16));
+  return Array.from(bytes, b => b.toString(16).padStart(2, '0')).join('');
+}
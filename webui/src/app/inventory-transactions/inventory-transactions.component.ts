@@ -17,6 +17,7 @@
 import { Component, OnInit, Input } from '@angular/core';
 import { InventoryTransaction, InventoryService, Item, Location } from 'api-client';
 import { MatTableDataSource } from '@angular/material/table';
+import { listAll } from '../list-all';
 import * as moment from 'moment';
 import { MatDialog } from '@angular/material/dialog';
 import { InventoryTransactionDialogComponent } from '../inventory-transaction-dialog/inventory-transaction-dialog.component';
@@ -52,10 +53,11 @@ export class InventoryTransactionsComponent implements OnInit {
       this.loadTransactionByLocationId(this.locationId);
     }
 
-    this.inventoryService.listItems().subscribe(items => {
+    // Include archived items and locations, which the history may still refer to
+    listAll(token => this.inventoryService.listItems(undefined, token, true), page => page.items).subscribe(items => {
       this.items = items;
     });
-    this.inventoryService.listLocations().subscribe(locations => {
+    listAll(token => this.inventoryService.listLocations(undefined, token, true), page => page.locations).subscribe(locations => {
       this.locations = locations;
     });
   }
@@ -66,7 +68,12 @@ export class InventoryTransactionsComponent implements OnInit {
 
   loadTransactionByItemId(itemId: string): void {
     this.loading = true;
-    this.inventoryService.listItemInventoryTransactions(itemId).subscribe(transactions => {
+    listAll(
+      // start_time, end_time, action, created_by, warehouse, order_by and page_size are left unset
+      token => this.inventoryService.listItemInventoryTransactions(
+        itemId, undefined, undefined, undefined, undefined, undefined, undefined, undefined, token),
+      page => page.inventory_transactions,
+    ).subscribe(transactions => {
       if (transactions) {
         this.dataSource.data = transactions.sort(this.sortByTime);
       } else {
@@ -81,7 +88,12 @@ export class InventoryTransactionsComponent implements OnInit {
 
   loadTransactionByLocationId(locationId: string): void {
     this.loading = true;
-    this.inventoryService.listLocationInventoryTransactions(locationId).subscribe(transactions => {
+    listAll(
+      // start_time, end_time, action, created_by, warehouse, order_by and page_size are left unset
+      token => this.inventoryService.listLocationInventoryTransactions(
+        locationId, undefined, undefined, undefined, undefined, undefined, undefined, undefined, token),
+      page => page.inventory_transactions,
+    ).subscribe(transactions => {
       if (transactions) {
         this.dataSource.data = transactions.sort(this.sortByTime);
       } else {
@@ -50,7 +50,7 @@ describe('ItemEditorComponent', () => {
       => Observable<Item>
   >;
   let updateItemSpy: jasmine.Spy<
-    (id: string, item?: Item, observe?: 'body', reportProgress?: boolean, options?: {})
+    (id: string, ifMatch?: string, item?: Item, observe?: 'body', reportProgress?: boolean, options?: {})
       => Observable<Item>
   >;
 
@@ -140,7 +140,7 @@ describe('ItemEditorComponent', () => {
     const value = {id: '123', name: 'test', description: 'desc'};
     const expectValue = {id: '123', name: 'test', description: 'desc'};
     const spy = updateItemSpy;
-    spy.withArgs(value.id, value).and.returnValue(of(expectValue));
+    spy.withArgs(value.id, undefined, value).and.returnValue(of(expectValue));
     component.isNew = false;
     fixture.detectChanges();
     expect(component).toBeTruthy();
@@ -154,6 +154,18 @@ describe('ItemEditorComponent', () => {
     });
   });
 
+  it('should update item only if unchanged since loaded', () => {
+    const loaded = {id: '123', name: 'test', description: 'desc', version: 3};
+    const value = {id: '123', name: 'updated', description: 'desc'};
+    getItemSpy.withArgs(loaded.id).and.returnValue(of(loaded));
+    updateItemSpy.withArgs(value.id, '"3"', value).and.returnValue(of({...value, version: 4}));
+    activatedRouteSub.setParamMap({ id: loaded.id });
+    fixture.detectChanges();
+    SetFormValue(fixture, '[formControlName="name"]', value.name);
+    fixture.debugElement.nativeElement.querySelector('button[type="submit"]').click();
+    expect(updateItemSpy).toHaveBeenCalledWith(value.id, '"3"', value);
+  });
+
   it('should go back on create', () => {
     fixture.detectChanges();
     fixture.debugElement.nativeElement.querySelector('[data-testid="cancelBtn"]').click();
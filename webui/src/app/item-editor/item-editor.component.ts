@@ -18,6 +18,7 @@ import { Component, OnInit } from '@angular/core';
 import { FormControl, FormGroup } from '@angular/forms';
 import { ActivatedRoute, Router } from '@angular/router';
 import { InventoryService } from 'api-client';
+import { etag } from '../etag';
 
 @Component({
   selector: 'app-item-editor',
@@ -29,6 +30,8 @@ export class ItemEditorComponent implements OnInit {
   loading = false;
   submitting = false;
   itemId: string | null = null;
+  // version being edited, sent as If-Match so that concurrent edits are not overwritten
+  version?: number;
 
   itemForm = new FormGroup({
     name: new FormControl(''),
@@ -49,11 +52,13 @@ export class ItemEditorComponent implements OnInit {
         this.isNew = false;
         this.loading = true;
         this.inventoryService.getItem(this.itemId).subscribe(item => {
+          const { version, ...value } = item;
+          this.version = version;
           this.itemForm.setValue(
             Object.assign({
               name: '',
               description: '',
-            }, item)
+            }, value)
           );
           this.loading = false;
         }, () => {
@@ -74,7 +79,7 @@ export class ItemEditorComponent implements OnInit {
         this.submitting = false;
       });
     } else {
-      this.inventoryService.updateItem(item.id, item).subscribe((newItem) => {
+      this.inventoryService.updateItem(item.id, etag(this.version), item).subscribe((newItem) => {
         this.router.navigate(['/items', newItem.id]);
         this.submitting = false;
       }, () => {
@@ -102,7 +102,7 @@ describe('ItemsComponent', () => {
   testListParams.forEach(param => {
     it(param.description, () => {
       listItemSpy = spyOn(inventoryService, 'listItems');
-      listItemSpy.and.returnValue(of(param.items));
+      listItemSpy.and.returnValue(of({ items: param.items }));
       initComponent();
       expect(component).toBeTruthy();
       expect(listItemSpy).toHaveBeenCalledTimes(1);
@@ -125,7 +125,7 @@ describe('ItemsComponent', () => {
 
   it('should navigate to item page', waitForAsync(() => {
     listItemSpy = spyOn(inventoryService, 'listItems');
-    listItemSpy.and.returnValue(of([{ name: 'test0', id: 'id-0', description: 'desc-0' }]));
+    listItemSpy.and.returnValue(of({ items: [{ name: 'test0', id: 'id-0', description: 'desc-0' }] }));
     initComponent();
 
     const button = fixture.debugElement.nativeElement.querySelector('a.item-link:first-child');
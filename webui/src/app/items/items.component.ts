@@ -18,6 +18,7 @@ import { Component, OnInit } from '@angular/core';
 import { FormControl } from '@angular/forms';
 import { InventoryService, Item } from 'api-client';
 import { MatTableDataSource } from '@angular/material/table';
+import { listAll } from '../list-all';
 
 @Component({
   selector: 'app-items',
@@ -41,7 +42,7 @@ export class ItemsComponent implements OnInit {
 
   getItems(): void {
     this.loading = true;
-    this.inventoryService.listItems().subscribe(items => {
+    listAll(token => this.inventoryService.listItems(undefined, token), page => page.items).subscribe(items => {
       this.dataSource.data = items;
       this.loading = false;
     }, () => {
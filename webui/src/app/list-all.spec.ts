@@ -0,0 +1,40 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { of } from 'rxjs';
+import { listAll } from './list-all';
+
+describe('listAll', () => {
+  const pages: {[token: string]: {items: string[], next_page_token?: string}} = {
+    '': { items: ['a', 'b'], next_page_token: 'page-2' },
+    'page-2': { items: ['c', 'd'], next_page_token: 'page-3' },
+    'page-3': { items: ['e'] },
+  };
+
+  it('should emit the results of every page', () => {
+    const listPage = jasmine.createSpy('listPage').and.callFake((token?: string) => of(pages[token || '']));
+    let got: string[] = [];
+    listAll(listPage, page => page.items).subscribe(all => got = all);
+    expect(got).toEqual(['a', 'b', 'c', 'd', 'e']);
+    expect(listPage).toHaveBeenCalledTimes(3);
+  });
+
+  it('should emit an empty list for an empty page', () => {
+    let got: string[] | undefined;
+    listAll(() => of({}), (page: {items?: string[]}) => page.items).subscribe(all => got = all);
+    expect(got).toEqual([]);
+  });
+});
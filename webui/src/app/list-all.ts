@@ -0,0 +1,38 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { EMPTY, Observable } from 'rxjs';
+import { expand, map, reduce } from 'rxjs/operators';
+
+interface Page {
+  next_page_token?: string;
+}
+
+/**
+ * Lists every page of a paginated API list, and emits all of their results.
+ * @param listPage lists the page with the given token, or the first page
+ * @param results returns the results of a page
+ */
+export function listAll<P extends Page, T>(
+  listPage: (pageToken?: string) => Observable<P>,
+  results: (page: P) => T[] | undefined,
+): Observable<T[]> {
+  return listPage().pipe(
+    expand(page => page.next_page_token ? listPage(page.next_page_token) : EMPTY),
+    map(page => results(page) || []),
+    reduce((all: T[], some: T[]) => all.concat(some), []),
+  );
+}
@@ -50,7 +50,7 @@ describe('LocationEditorComponent', () => {
       => Observable<Location>
   >;
   let updateLocationSpy: jasmine.Spy<
-    (id: string, location?: Location, observe?: 'body', reportProgress?: boolean, options?: {})
+    (id: string, ifMatch?: string, location?: Location, observe?: 'body', reportProgress?: boolean, options?: {})
       => Observable<Location>
   >;
 
@@ -130,7 +130,7 @@ describe('LocationEditorComponent', () => {
     const value = {id: '123', name: 'test', warehouse: 'wh'};
     const expectValue = {id: '123', name: 'test', warehouse: 'wh'};
     const spy = updateLocationSpy;
-    spy.withArgs(value.id, value).and.returnValue(of(expectValue));
+    spy.withArgs(value.id, undefined, value).and.returnValue(of(expectValue));
     component.isNew = false;
     fixture.detectChanges();
     expect(component).toBeTruthy();
@@ -144,6 +144,18 @@ describe('LocationEditorComponent', () => {
     });
   });
 
+  it('should update location only if unchanged since loaded', () => {
+    const loaded = {id: '123', name: 'test', warehouse: 'wh', version: 3};
+    const value = {id: '123', name: 'updated', warehouse: 'wh'};
+    getLocationSpy.withArgs(loaded.id).and.returnValue(of(loaded));
+    updateLocationSpy.withArgs(value.id, '"3"', value).and.returnValue(of({...value, version: 4}));
+    activatedRouteSub.setParamMap({ id: loaded.id });
+    fixture.detectChanges();
+    SetFormValue(fixture, '[formControlName="name"]', value.name);
+    fixture.debugElement.nativeElement.querySelector('button[type="submit"]').click();
+    expect(updateLocationSpy).toHaveBeenCalledWith(value.id, '"3"', value);
+  });
+
   it('should go back on create', () => {
     fixture.detectChanges();
     fixture.debugElement.nativeElement.querySelector('[data-testid="cancelBtn"]').click();
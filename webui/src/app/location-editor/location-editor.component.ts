@@ -16,6 +16,7 @@
 
 import { Component, OnInit } from '@angular/core';
 import { InventoryService } from 'api-client';
+import { etag } from '../etag';
 import { Router, ActivatedRoute } from '@angular/router';
 import { FormGroup, FormControl } from '@angular/forms';
 
@@ -29,6 +30,8 @@ export class LocationEditorComponent implements OnInit {
   loading = false;
   submitting = false;
   locationId: string | null = null;
+  // version being edited, sent as If-Match so that concurrent edits are not overwritten
+  version?: number;
 
   locationForm = new FormGroup({
     name: new FormControl(''),
@@ -49,11 +52,13 @@ export class LocationEditorComponent implements OnInit {
         this.isNew = false;
         this.loading = true;
         this.inventoryService.getLocation(this.locationId).subscribe(location => {
+          const { version, ...value } = location;
+          this.version = version;
           this.locationForm.setValue(
             Object.assign({
               name: '',
               warehouse: '',
-            }, location)
+            }, value)
           );
           this.loading = false;
         }, () => {
@@ -74,7 +79,7 @@ export class LocationEditorComponent implements OnInit {
         this.submitting = false;
       });
     } else {
-      this.inventoryService.updateLocation(location.id, location).subscribe((newLocation) => {
+      this.inventoryService.updateLocation(location.id, etag(this.version), location).subscribe((newLocation) => {
         this.router.navigate(['/locations', newLocation.id]);
         this.submitting = false;
       }, () => {
@@ -17,6 +17,7 @@
 import { Component, OnInit } from '@angular/core';
 import { InventoryService, Location } from 'api-client';
 import { MatTableDataSource } from '@angular/material/table';
+import { listAll } from '../list-all';
 
 @Component({
   selector: 'app-locations',
@@ -38,7 +39,7 @@ export class LocationsComponent implements OnInit {
 
   loadLocations(): void {
     this.loading = true;
-    this.inventoryService.listLocations().subscribe( res => {
+    listAll(token => this.inventoryService.listLocations(undefined, token), page => page.locations).subscribe( res => {
       this.dataSource.data = res;
       this.loading = false;
     }, () => {
@@ -24,10 +24,11 @@ import { UserService, User } from 'user-svc-client';
   styleUrls: ['./users.component.scss']
 })
 export class UsersComponent implements OnInit {
-  displayedColumns: string[] = ['name', 'email', 'role'];
+  displayedColumns: string[] = ['name', 'email', 'role', 'warehouses'];
   roleList: string[] = ['', 'worker', 'admin'];
   dataSource = new MatTableDataSource<any>();
   userRoles: {[name: string]: string} = {};
+  userWarehouses: {[name: string]: string} = {};
   loading = false;
 
   constructor(private userService: UserService) {
@@ -60,6 +61,11 @@ export class UsersComponent implements OnInit {
       } else {
         this.userRoles[user.uid] = '';
       }
+      if (user.customClaims && user.customClaims.warehouses) {
+        this.userWarehouses[user.uid] = user.customClaims.warehouses.join(', ');
+      } else {
+        this.userWarehouses[user.uid] = '';
+      }
     });
   }
 
@@ -77,4 +83,16 @@ export class UsersComponent implements OnInit {
     // reset userRoles on failure to wipe temporary values.
     this.initUserRoles();
   }
+
+  // Assigns the user to the comma-separated warehouses, which limit the
+  // inventory transactions workers may record and list.
+  onWarehousesChange(user: User, value: string) {
+    if (user.uid) {
+      const warehouses = value.split(',').map(w => w.trim()).filter(w => w !== '');
+      this.userService.updateUserWarehouses(user.uid, warehouses).subscribe(
+        () => this.loadData(),
+        () => this.initUserRoles(),
+      );
+    }
+  }
 }